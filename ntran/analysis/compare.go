@@ -0,0 +1,137 @@
+package analysis
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"ntran/stats"
+)
+
+// Verdicts of comparing a configuration across two runs
+const (
+	VerdictUnchanged   = "unchanged"
+	VerdictRegression  = "regression"
+	VerdictImprovement = "improvement"
+	// VerdictMissing - in the baseline but not the candidate, which fails
+	// the comparison as a configuration that no longer runs
+	VerdictMissing = "missing"
+	// VerdictNew - in the candidate but not the baseline
+	VerdictNew = "new"
+)
+
+type Comparison struct {
+	Key
+	Baseline  *Group
+	Candidate *Group
+	// Change - relative change of the candidate median versus the baseline median
+	Change float64
+	// P - p-value of the Mann-Whitney U test on the repetitions, NaN when
+	// either side has fewer than two repetitions
+	P float64
+	// ThresholdOnly - significance could not be tested, as there were too
+	// few repetitions for any p-value to fall below alpha, so the threshold
+	// alone decided the verdict
+	ThresholdOnly bool
+	Verdict       string
+}
+
+/*
+ * Compare - matches the configurations of a baseline and a candidate and
+ * decides for each whether it regressed: its median got slower by more
+ * than threshold (a fraction, e.g. 0.05) and the difference is significant
+ * at alpha. When significance cannot be tested, with fewer than two
+ * repetitions on either side or too few for the smallest possible p-value
+ * to fall below alpha (e.g. 0.1 with 3 against 3), the threshold alone
+ * decides. Configurations missing from the candidate are VerdictMissing.
+ */
+func Compare(baseline []Group, candidate []Group, threshold float64, alpha float64) []Comparison {
+	baseByKey := index(baseline)
+	candByKey := index(candidate)
+
+	var keys []Key
+	seen := make(map[Key]bool)
+	for _, g := range append(append([]Group{}, baseline...), candidate...) {
+		if !seen[g.Key] {
+			seen[g.Key] = true
+			keys = append(keys, g.Key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return lessKey(keys[i], keys[j]) })
+
+	comparisons := make([]Comparison, 0, len(keys))
+	for _, key := range keys {
+		c := Comparison{Key: key, P: math.NaN(), Verdict: VerdictMissing}
+		if g, ok := baseByKey[key]; ok {
+			c.Baseline = &g
+		}
+		if g, ok := candByKey[key]; ok {
+			c.Candidate = &g
+		}
+		if c.Baseline == nil {
+			c.Verdict = VerdictNew
+		}
+		if c.Baseline == nil || c.Candidate == nil {
+			comparisons = append(comparisons, c)
+			continue
+		}
+		if c.Baseline.Summary.Median == 0 {
+			c.Verdict = VerdictUnchanged
+			comparisons = append(comparisons, c)
+			continue
+		}
+
+		c.Change = (c.Candidate.Summary.Median - c.Baseline.Summary.Median) / c.Baseline.Summary.Median
+		significant := true
+		n1, n2 := len(c.Baseline.Samples), len(c.Candidate.Samples)
+		if n1 >= 2 && n2 >= 2 {
+			_, c.P = stats.MannWhitneyU(c.Baseline.Samples, c.Candidate.Samples)
+		}
+		if n1 >= 2 && n2 >= 2 && stats.MinMannWhitneyP(n1, n2) < alpha {
+			significant = c.P < alpha
+		} else {
+			c.ThresholdOnly = true
+		}
+
+		switch {
+		case significant && c.Change > threshold:
+			c.Verdict = VerdictRegression
+		case significant && c.Change < -threshold:
+			c.Verdict = VerdictImprovement
+		default:
+			c.Verdict = VerdictUnchanged
+		}
+		comparisons = append(comparisons, c)
+	}
+	return comparisons
+}
+
+func ComparisonTable(comparisons []Comparison) *Table {
+	t := &Table{
+		Title:   "Candidate versus baseline",
+		Headers: []string{"Policy", "TestCase", "InFlight", "BaselineN", "BaselineMedian", "CandidateN", "CandidateMedian", "Change%", "P", "ThresholdOnly", "Verdict"},
+	}
+	for _, c := range comparisons {
+		row := []any{c.Policy, c.TestCase, c.InFlight}
+		for _, g := range []*Group{c.Baseline, c.Candidate} {
+			if g == nil {
+				row = append(row, nil, nil)
+			} else {
+				row = append(row, g.Summary.N, time.Duration(g.Summary.Median))
+			}
+		}
+		if c.Baseline != nil && c.Candidate != nil {
+			row = append(row, 100*c.Change)
+		} else {
+			row = append(row, nil)
+		}
+		if math.IsNaN(c.P) {
+			row = append(row, nil)
+		} else {
+			row = append(row, c.P)
+		}
+		row = append(row, c.ThresholdOnly, c.Verdict)
+		t.Append(row...)
+	}
+	return t
+}
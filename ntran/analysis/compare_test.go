@@ -0,0 +1,100 @@
+package analysis
+
+import (
+	"math"
+	"testing"
+
+	"ntran/stats"
+)
+
+// group - a configuration of testCase with samples as its repetitions
+func group(testCase string, samples ...float64) Group {
+	return Group{
+		Key:     Key{Policy: "duckdb-parallel", TestCase: testCase, InFlight: 10},
+		Samples: samples,
+		Summary: stats.Summarize(samples),
+	}
+}
+
+func TestCompare(t *testing.T) {
+	baseline := []Group{
+		group("regressed", 100, 101, 102, 103, 104),
+		group("improved", 100, 101, 102, 103, 104),
+		group("within threshold", 100, 101, 102, 103, 104),
+		group("not significant", 100, 150, 102, 160, 104),
+		group("few repetitions", 100, 101, 102),
+		group("single", 100),
+		group("zero", 0, 0, 0),
+		group("missing", 100, 101, 102),
+	}
+	candidate := []Group{
+		group("regressed", 120, 121, 122, 123, 124),
+		group("improved", 80, 81, 82, 83, 84),
+		group("within threshold", 103, 104, 105, 106, 107),
+		group("not significant", 101, 103, 140, 155, 158),
+		group("few repetitions", 120, 121, 122),
+		group("single", 120),
+		group("zero", 10, 10, 10),
+		group("new", 100, 101, 102),
+	}
+
+	tests := map[string]struct {
+		verdict       string
+		thresholdOnly bool
+		hasP          bool
+	}{
+		"regressed":        {VerdictRegression, false, true},
+		"improved":         {VerdictImprovement, false, true},
+		"within threshold": {VerdictUnchanged, false, true},
+		// the medians differ by 36% but the repetitions overlap
+		"not significant": {VerdictUnchanged, false, true},
+		// no p-value of 3 against 3 falls below 0.05, so the threshold decides
+		"few repetitions": {VerdictRegression, true, true},
+		"single":          {VerdictRegression, true, false},
+		"zero":            {VerdictUnchanged, false, false},
+		"missing":         {VerdictMissing, false, false},
+		"new":             {VerdictNew, false, false},
+	}
+
+	comparisons := Compare(baseline, candidate, 0.05, 0.05)
+	if len(comparisons) != len(tests) {
+		t.Fatalf("%d comparisons, want %d", len(comparisons), len(tests))
+	}
+	for _, c := range comparisons {
+		want, ok := tests[c.TestCase]
+		if !ok {
+			t.Errorf("unexpected comparison of %s", c.TestCase)
+			continue
+		}
+		if c.Verdict != want.verdict {
+			t.Errorf("%s: verdict %s, want %s", c.TestCase, c.Verdict, want.verdict)
+		}
+		if c.ThresholdOnly != want.thresholdOnly {
+			t.Errorf("%s: ThresholdOnly %v, want %v", c.TestCase, c.ThresholdOnly, want.thresholdOnly)
+		}
+		if hasP := !math.IsNaN(c.P); hasP != want.hasP {
+			t.Errorf("%s: P = %v, want a p-value %v", c.TestCase, c.P, want.hasP)
+		}
+	}
+}
+
+func TestCompareChange(t *testing.T) {
+	comparisons := Compare([]Group{group("a", 100, 200, 300)}, []Group{group("a", 150, 250, 350)}, 0.05, 0.05)
+	if len(comparisons) != 1 {
+		t.Fatalf("%d comparisons, want 1", len(comparisons))
+	}
+	if got := comparisons[0].Change; math.Abs(got-0.25) > 1e-12 {
+		t.Errorf("Change = %v, want 0.25 (medians 200 and 250)", got)
+	}
+}
+
+func TestCompareOrder(t *testing.T) {
+	comparisons := Compare([]Group{group("b", 1), group("a", 1)}, []Group{group("c", 1), group("a", 1)}, 0.05, 0.05)
+	var got []string
+	for _, c := range comparisons {
+		got = append(got, c.TestCase)
+	}
+	if len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != "c" {
+		t.Errorf("comparisons in order %v, want [a b c]", got)
+	}
+}
@@ -0,0 +1,141 @@
+package analysis
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"ntran/policy"
+)
+
+// runTimestampLayout - the timestamp in run ids and legacy results filenames
+const runTimestampLayout = "2006-01-02_15-04-05"
+
+// ParseRunID - splits a run id (or legacy results filename without its
+// extension) of the form <policy>_<timestamp> into its parts
+func ParseRunID(runID string) (string, time.Time, bool) {
+	if len(runID) <= len(runTimestampLayout)+1 {
+		return "", time.Time{}, false
+	}
+	split := len(runID) - len(runTimestampLayout)
+	if runID[split-1] != '_' {
+		return "", time.Time{}, false
+	}
+	t, err := time.ParseInLocation(runTimestampLayout, runID[split:], time.Local)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return runID[:split-1], t, true
+}
+
+/*
+ * Import - converts a legacy results file into a run directory under
+ * runsDir in the current results schema. Durations are normalized to
+ * nanoseconds and repeated
+ * configurations within the file are numbered as repetitions. Metadata
+ * missing from the file (policy, start time) is inferred from its name.
+ * Returns the run directory, or "" if it was already imported.
+ */
+func Import(path string, runsDir string, format string) (string, error) {
+	name := runIDFromFilename(path)
+	filePolicy, startTime, ok := ParseRunID(name)
+	if !ok {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		startTime = info.ModTime()
+	}
+
+	records, err := LoadFile(path, name)
+	if err != nil {
+		return "", err
+	}
+	if len(records) == 0 {
+		return "", fmt.Errorf("%s has no records", path)
+	}
+
+	repetitions := make(map[Key]int)
+	for i := range records {
+		if records[i].Policy == "" {
+			records[i].Policy = filePolicy
+		}
+		if records[i].Policy == "" {
+			return "", fmt.Errorf("%s: unable to infer the policy of its records", path)
+		}
+		key := Key{Policy: records[i].Policy, TestCase: records[i].TestCase, InFlight: records[i].TransactionCount}
+		records[i].Repetition = repetitions[key]
+		repetitions[key]++
+	}
+
+	runPolicy := records[0].Policy
+	runID := fmt.Sprintf("%s_%s", runPolicy, startTime.Format(runTimestampLayout))
+	runDir := filepath.Join(runsDir, runID)
+	if _, err := os.Stat(runDir); err == nil {
+		return "", nil
+	}
+	if err := os.MkdirAll(runDir, os.ModePerm); err != nil {
+		return "", err
+	}
+
+	writer, err := policy.NewRecordWriter(format, filepath.Join(runDir, policy.ResultsFile(format)))
+	if err != nil {
+		return "", err
+	}
+	for _, record := range records {
+		if err := writer.Write(record.Record); err != nil {
+			writer.Close()
+			return "", err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	source, err := filepath.Abs(path)
+	if err != nil {
+		source = path
+	}
+	manifest := policy.Manifest{
+		RunID:        runID,
+		Policy:       runPolicy,
+		Format:       format,
+		ResultsFile:  policy.ResultsFile(format),
+		StartTime:    startTime,
+		ImportedFrom: source,
+		GitRevision:  "unknown",
+	}
+	if err := manifest.Write(runDir); err != nil {
+		return "", err
+	}
+	return runDir, nil
+}
+
+// LegacyResultsFiles - every loose results csv under paths, skipping run
+// directories, which are already in the current schema
+func LegacyResultsFiles(paths ...string) ([]string, error) {
+	var files []string
+	for _, root := range paths {
+		err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if entry.IsDir() {
+				if _, err := os.Stat(filepath.Join(path, policy.ManifestFile)); err == nil {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if filepath.Ext(path) == ".csv" && isResultsFile(entry.Name()) {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
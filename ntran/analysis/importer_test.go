@@ -0,0 +1,131 @@
+package analysis
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ntran/policy"
+)
+
+func TestImport(t *testing.T) {
+	runsDir := t.TempDir()
+	source := filepath.Join("testdata", "cold-neondb_2024-11-30_09-14-13.csv")
+	runDir, err := Import(source, runsDir, policy.FormatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(runsDir, "cold-neondb_2024-11-30_09-14-13"); runDir != want {
+		t.Fatalf("imported into %s, want %s", runDir, want)
+	}
+
+	manifest, err := policy.ReadManifest(runDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantStart := time.Date(2024, 11, 30, 9, 14, 13, 0, time.Local)
+	if manifest.RunID != "cold-neondb_2024-11-30_09-14-13" || manifest.Policy != "cold-neondb" || !manifest.StartTime.Equal(wantStart) {
+		t.Errorf("manifest run %s, policy %s, start %v", manifest.RunID, manifest.Policy, manifest.StartTime)
+	}
+	if abs, _ := filepath.Abs(source); manifest.ImportedFrom != abs {
+		t.Errorf("manifest imported from %s, want %s", manifest.ImportedFrom, abs)
+	}
+
+	records, err := Load(runDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		testCase   string
+		inFlight   int
+		duration   time.Duration
+		repetition int
+	}{
+		{"Long Update", 2, 2732125738, 0},
+		{"Select Join", 9, time.Minute + 44647476887, 0},
+		{"Long Update", 2, 3100 * time.Millisecond, 1},
+		{"Select Scan", 2, 838417, 0},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("%d records, want %d", len(records), len(want))
+	}
+	for i, w := range want {
+		r := records[i]
+		if r.Policy != "cold-neondb" || r.TestCase != w.testCase || r.TransactionCount != w.inFlight {
+			t.Errorf("record %d is %s %s %d, want cold-neondb %s %d", i, r.Policy, r.TestCase, r.TransactionCount, w.testCase, w.inFlight)
+		}
+		if r.Duration != w.duration || r.Total != w.duration {
+			t.Errorf("record %d has duration %v and total %v, want %v", i, r.Duration, r.Total, w.duration)
+		}
+		if r.Repetition != w.repetition {
+			t.Errorf("record %d is repetition %d, want %d", i, r.Repetition, w.repetition)
+		}
+		if r.RunID != manifest.RunID {
+			t.Errorf("record %d has run id %s, want %s", i, r.RunID, manifest.RunID)
+		}
+	}
+
+	// a run that was already imported is left alone
+	again, err := Import(source, runsDir, policy.FormatCSV)
+	if err != nil || again != "" {
+		t.Errorf("importing again = %q, %v, want it skipped", again, err)
+	}
+}
+
+func TestImportPolicyFromFilename(t *testing.T) {
+	runsDir := t.TempDir()
+	runDir, err := Import(filepath.Join("testdata", "duckdb-serial_2024-12-05_15-55-00.csv"), runsDir, policy.FormatJSONL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(runDir, policy.ResultsFile(policy.FormatJSONL))); err != nil {
+		t.Errorf("no JSON Lines results: %v", err)
+	}
+	records, err := Load(runDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("%d records, want 2", len(records))
+	}
+	for _, r := range records {
+		if r.Policy != "duckdb-serial" {
+			t.Errorf("%s has policy %q, want duckdb-serial from the filename", r.TestCase, r.Policy)
+		}
+	}
+	if records[1].Duration != 746*time.Microsecond {
+		t.Errorf("Select Scan has duration %v, want 746µs", records[1].Duration)
+	}
+}
+
+// TestImportHistoricalResults - every results file ntran has kept imports
+// under the name of a policy ntran still has
+func TestImportHistoricalResults(t *testing.T) {
+	policies := map[string]bool{"serial-snapshot": true, "duckdb-parallel": true, "duckdb-serial": true, "cold-neondb": true, "prewarm-neondb": true, "postgres-template": true}
+	files, err := LegacyResultsFiles(filepath.Join("..", "results"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Skip("no historical results")
+	}
+	runsDir := t.TempDir()
+	for _, file := range files {
+		runDir, err := Import(file, runsDir, policy.FormatCSV)
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		records, err := Load(runDir)
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		for _, r := range records {
+			if !policies[r.Policy] {
+				t.Errorf("%s: unknown policy %q", file, r.Policy)
+			}
+		}
+	}
+}
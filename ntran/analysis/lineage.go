@@ -0,0 +1,242 @@
+package analysis
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"ntran/policy"
+)
+
+// Lineage export formats
+const (
+	LineageText = "text"
+	LineageDOT  = "dot"
+	LineageJSON = "json"
+)
+
+var LineageFormats = []string{LineageText, LineageDOT, LineageJSON}
+
+// lineageSQLWidth - SQL longer than this is truncated in the text and DOT views
+const lineageSQLWidth = 60
+
+/*
+ * LoadLineage - reads the lineage of a run from a lineage.json file or a
+ * run directory. Runs recorded before lineage.json existed have theirs
+ * rebuilt from their results, which lack the candidates' SQL unless they
+ * are jsonl
+ */
+func LoadLineage(path string) (*policy.Lineage, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return policy.ReadLineage(path)
+	}
+	if lineage, err := policy.ReadLineage(filepath.Join(path, policy.LineageFile)); err == nil {
+		return lineage, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	manifest, err := policy.ReadManifest(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a run directory: %v", path, err)
+	}
+	records, err := LoadFile(filepath.Join(path, manifest.ResultsFile), manifest.RunID)
+	if err != nil {
+		return nil, err
+	}
+	lineage := &policy.Lineage{RunID: manifest.RunID, Policy: manifest.Policy}
+	for _, record := range records {
+		lineage.Add(record.Record)
+	}
+	return lineage, nil
+}
+
+// FilterLineage - the trees of lineage whose test case is testCase
+func FilterLineage(lineage *policy.Lineage, testCase string) *policy.Lineage {
+	filtered := &policy.Lineage{RunID: lineage.RunID, Policy: lineage.Policy}
+	kept := make(map[string]bool)
+	for _, node := range lineage.Nodes {
+		if node.TestCase == testCase {
+			filtered.Nodes = append(filtered.Nodes, node)
+			kept[node.ID] = true
+		}
+	}
+	for _, edge := range lineage.Edges {
+		if kept[edge.From] && kept[edge.To] {
+			filtered.Edges = append(filtered.Edges, edge)
+		}
+	}
+	return filtered
+}
+
+func WriteLineage(w io.Writer, lineage *policy.Lineage, format string) error {
+	switch format {
+	case LineageText:
+		return writeLineageText(w, lineage)
+	case LineageDOT:
+		return writeLineageDOT(w, lineage)
+	case LineageJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(lineage)
+	}
+	return fmt.Errorf("unsupported lineage format %s, must be one of %v", format, LineageFormats)
+}
+
+// lineageTree - the nodes of one tree and the children of each
+type lineageTree struct {
+	base     policy.LineageNode
+	nodes    map[string]policy.LineageNode
+	children map[string][]string
+	promoted string // the fork promoted, if any
+}
+
+// lineageTrees - the trees of lineage in the order they ran
+func lineageTrees(lineage *policy.Lineage) []*lineageTree {
+	var trees []*lineageTree
+	byTree := make(map[int]*lineageTree)
+	treeOf := make(map[string]*lineageTree)
+	for _, node := range lineage.Nodes {
+		tree, ok := byTree[node.Tree]
+		if !ok {
+			tree = &lineageTree{nodes: make(map[string]policy.LineageNode), children: make(map[string][]string)}
+			byTree[node.Tree] = tree
+			trees = append(trees, tree)
+		}
+		if node.Kind == policy.LineageBase {
+			tree.base = node
+		}
+		tree.nodes[node.ID] = node
+		treeOf[node.ID] = tree
+	}
+	for _, edge := range lineage.Edges {
+		tree, ok := treeOf[edge.From]
+		if !ok {
+			continue
+		}
+		switch edge.Kind {
+		case policy.EdgeFork:
+			tree.children[edge.From] = append(tree.children[edge.From], edge.To)
+		case policy.EdgePromote:
+			tree.promoted = edge.From
+		}
+	}
+	return trees
+}
+
+func treeTitle(node policy.LineageNode) string {
+	return fmt.Sprintf("%s, inFlight %d, repetition %d", node.TestCase, node.TransactionCount, node.Repetition)
+}
+
+func truncateSQL(sql string) string {
+	sql = strings.Join(strings.Fields(sql), " ")
+	if len(sql) > lineageSQLWidth {
+		return sql[:lineageSQLWidth-3] + "..."
+	}
+	return sql
+}
+
+/*
+ * writeLineageText - draws every tree with box-drawing characters. Winners
+ * are starred, failed candidates crossed, and the fork promoted to main is
+ * marked as such
+ */
+func writeLineageText(w io.Writer, lineage *policy.Lineage) error {
+	fmt.Fprintf(w, "%s (%s)\n", lineage.RunID, lineage.Policy)
+	for _, tree := range lineageTrees(lineage) {
+		fmt.Fprintf(w, "\n%s\n", treeTitle(tree.base))
+		fmt.Fprintln(w, "main")
+		writeLineageChildren(w, tree, tree.base.ID, "")
+	}
+	return nil
+}
+
+func writeLineageChildren(w io.Writer, tree *lineageTree, id string, indent string) {
+	children := tree.children[id]
+	for i, child := range children {
+		branch, next := "├── ", "│   "
+		if i == len(children)-1 {
+			branch, next = "└── ", "    "
+		}
+		node := tree.nodes[child]
+		label := fmt.Sprintf("#%d", node.Candidate)
+		if node.Branch != "" {
+			label += " " + node.Branch
+		}
+		if node.SQL != "" {
+			label += ": " + truncateSQL(node.SQL)
+		}
+		switch {
+		case node.Error != "":
+			label += " ✗ " + node.Error
+		case node.Winner:
+			label += " ★"
+		}
+		if child == tree.promoted {
+			label += " → promoted to main"
+		}
+		fmt.Fprintf(w, "%s%s%s\n", indent, branch, label)
+		writeLineageChildren(w, tree, child, indent+next)
+	}
+}
+
+/*
+ * writeLineageDOT - a Graphviz digraph with a cluster per tree. Winners are
+ * filled, failed candidates red, and promote edges bold
+ */
+func writeLineageDOT(w io.Writer, lineage *policy.Lineage) error {
+	fmt.Fprintf(w, "digraph %q {\n", lineage.RunID)
+	fmt.Fprintln(w, "\trankdir=LR;")
+	fmt.Fprintln(w, "\tnode [shape=box, fontname=\"monospace\"];")
+	for i, tree := range lineageTrees(lineage) {
+		fmt.Fprintf(w, "\tsubgraph cluster_%d {\n", i)
+		fmt.Fprintf(w, "\t\tlabel=%q;\n", treeTitle(tree.base))
+		for _, node := range lineage.Nodes {
+			if _, ok := tree.nodes[node.ID]; !ok {
+				continue
+			}
+			fmt.Fprintf(w, "\t\t%q [%s];\n", node.ID, dotAttributes(node))
+		}
+		fmt.Fprintln(w, "\t}")
+	}
+	for _, edge := range lineage.Edges {
+		style := ""
+		if edge.Kind == policy.EdgePromote {
+			style = " [style=bold, label=\"promote\"]"
+		}
+		fmt.Fprintf(w, "\t%q -> %q%s;\n", edge.From, edge.To, style)
+	}
+	fmt.Fprintln(w, "}")
+	return nil
+}
+
+func dotAttributes(node policy.LineageNode) string {
+	switch node.Kind {
+	case policy.LineageBase:
+		return `label="main", shape=ellipse`
+	case policy.LineagePromoted:
+		return `label="main (promoted)", shape=ellipse, style=bold`
+	}
+	label := fmt.Sprintf("#%d", node.Candidate)
+	if node.Branch != "" {
+		label += " " + node.Branch
+	}
+	if node.SQL != "" {
+		label += "\n" + truncateSQL(node.SQL)
+	}
+	attributes := fmt.Sprintf("label=%q", label)
+	switch {
+	case node.Error != "":
+		attributes += fmt.Sprintf(", color=red, tooltip=%q", node.Error)
+	case node.Winner:
+		attributes += ", style=filled, fillcolor=gold"
+	}
+	return attributes
+}
@@ -0,0 +1,437 @@
+// Loading, summarizing and rendering experiment results
+package analysis
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow/go/v17/arrow/array"
+	"github.com/apache/arrow/go/v17/arrow/memory"
+	"github.com/apache/arrow/go/v17/parquet"
+	"github.com/apache/arrow/go/v17/parquet/pqarrow"
+
+	"ntran/policy"
+)
+
+// Record - one experiment record along with the run it came from
+type Record struct {
+	policy.Record
+	RunID string
+}
+
+// ArchiveDir - directories of superseded results (e.g. ntran/results/archive),
+// which are only loaded when named as a path themselves
+const ArchiveDir = "archive"
+
+/*
+ * Load - reads the records of every given path. A path can be
+ *  - a results file (.csv, .jsonl or .parquet)
+ *  - a run directory containing a manifest.json
+ *  - any other directory, which is searched for run directories and
+ *    loose results files (e.g. ntran/results from before run directories),
+ *    skipping ArchiveDir directories so that superseded results are not
+ *    mixed in with current ones
+ */
+func Load(paths ...string) ([]Record, error) {
+	var records []Record
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var loaded []Record
+		if info.IsDir() {
+			loaded, err = loadDir(path)
+		} else {
+			loaded, err = LoadFile(path, runIDFromFilename(path))
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, loaded...)
+	}
+	return records, nil
+}
+
+func loadDir(dir string) ([]Record, error) {
+	if manifest, err := policy.ReadManifest(dir); err == nil {
+		return LoadFile(filepath.Join(dir, manifest.ResultsFile), manifest.RunID)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []Record
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		var loaded []Record
+		if entry.IsDir() && entry.Name() == ArchiveDir {
+			continue
+		}
+		if entry.IsDir() {
+			loaded, err = loadDir(path)
+		} else if isResultsFile(entry.Name()) {
+			loaded, err = LoadFile(path, runIDFromFilename(path))
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, loaded...)
+	}
+	return records, nil
+}
+
+func isResultsFile(name string) bool {
+	if strings.HasSuffix(name, "summary.csv") {
+		return false
+	}
+	switch filepath.Ext(name) {
+	case ".csv", ".jsonl", ".parquet":
+		return true
+	}
+	return false
+}
+
+// runIDFromFilename - loose results files are named <policy>_<timestamp>.<ext>,
+// which is exactly what a run id is
+func runIDFromFilename(path string) string {
+	base := filepath.Base(path)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// LoadFile - reads a single results file in any of the formats ntran writes
+func LoadFile(path string, runID string) ([]Record, error) {
+	var records []Record
+	var err error
+	switch filepath.Ext(path) {
+	case ".csv":
+		records, err = loadCSV(path)
+	case ".jsonl":
+		records, err = loadJSONL(path)
+	case ".parquet":
+		records, err = loadParquet(path)
+	default:
+		return nil, fmt.Errorf("unsupported results file %s", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", path, err)
+	}
+
+	filePolicy, _, _ := ParseRunID(runIDFromFilename(path))
+	for i := range records {
+		records[i].RunID = runID
+		if records[i].Policy == "" {
+			records[i].Policy = filePolicy
+		}
+		if records[i].Total == 0 {
+			// results from before phases were recorded only have the duration
+			records[i].Total = records[i].Duration
+		}
+	}
+	return records, nil
+}
+
+/*
+ * loadCSV - reads every csv layout the experiment has written: the original
+ * four columns with Go duration strings, and later layouts with phase and
+ * integer nanosecond columns, which are preferred when present
+ */
+func loadCSV(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	headers, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int, len(headers))
+	for i, header := range headers {
+		columns[header] = i
+	}
+	// the policy can be inferred from the filename, everything else is required
+	for _, required := range []string{"TestCase", "TransactionCount", "Duration"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("missing column %s", required)
+		}
+	}
+
+	var records []Record
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		get := func(column string) string {
+			if i, ok := columns[column]; ok && i < len(row) {
+				return row[i]
+			}
+			return ""
+		}
+
+		record := Record{Record: policy.Record{
+			Policy:   get("Policy"),
+			TestCase: get("TestCase"),
+			Phases:   map[string]time.Duration{},
+		}}
+		if record.TransactionCount, err = strconv.Atoi(get("TransactionCount")); err != nil {
+			return nil, fmt.Errorf("invalid TransactionCount %q", get("TransactionCount"))
+		}
+		if record.Duration, err = durationColumn(get("DurationNs"), get("Duration")); err != nil {
+			return nil, err
+		}
+		if record.Total, err = durationColumn(get("TotalNs"), get("Total")); err != nil {
+			return nil, err
+		}
+		for _, phase := range policy.Phases {
+			column := policy.PhaseColumn(phase)
+			d, err := durationColumn(get(column+"Ns"), get(column))
+			if err != nil {
+				return nil, err
+			}
+			if d != 0 {
+				record.Phases[phase] = d
+			}
+		}
+		if failures := get("Failures"); failures != "" {
+			if record.Failures, err = strconv.Atoi(failures); err != nil {
+				return nil, fmt.Errorf("invalid Failures %q", failures)
+			}
+		}
+		if repetition := get("Repetition"); repetition != "" {
+			if record.Repetition, err = strconv.Atoi(repetition); err != nil {
+				return nil, fmt.Errorf("invalid Repetition %q", repetition)
+			}
+		}
+		var cpuTime int64
+		for column, v := range map[string]*int64{
+			"CPUTimeNs":    &cpuTime,
+			"PeakRSSBytes": &record.Resources.PeakRSS,
+			"AllocBytes":   &record.Resources.AllocBytes,
+			"Allocs":       &record.Resources.Allocs,
+			"ForkBytes":    &record.Resources.ForkBytes,
+			"BaseBytes":    &record.Resources.BaseBytes,
+		} {
+			if s := get(column); s != "" {
+				if *v, err = strconv.ParseInt(s, 10, 64); err != nil {
+					return nil, fmt.Errorf("invalid %s %q", column, s)
+				}
+			}
+		}
+		record.Resources.CPUTime = time.Duration(cpuTime)
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// durationColumn - parses integer nanoseconds if present, falling back
+// to a Go duration string ("1m2.5s", "746µs"); empty means zero
+func durationColumn(ns string, s string) (time.Duration, error) {
+	if ns != "" {
+		v, err := strconv.ParseInt(ns, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", ns)
+		}
+		return time.Duration(v), nil
+	}
+	if s == "" {
+		return 0, nil
+	}
+	return ParseDuration(s)
+}
+
+// ParseDuration - parses a Go duration string (e.g. 1.5ms, 300µs or 300us),
+// ignoring surrounding whitespace
+func ParseDuration(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+func loadJSONL(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []Record
+	decoder := json.NewDecoder(f)
+	for {
+		var r policy.JSONRecord
+		err := decoder.Decode(&r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		phases := make(map[string]time.Duration, len(r.PhasesNs))
+		for phase, ns := range r.PhasesNs {
+			if ns != 0 {
+				phases[phase] = time.Duration(ns)
+			}
+		}
+		var candidates []policy.CandidateRecord
+		for _, c := range r.Candidates {
+			candidate := policy.CandidateRecord{Index: c.Index, Branch: c.Branch, Duration: time.Duration(c.DurationNs), Error: c.Error, Winner: c.Winner, Bytes: c.Bytes, Depth: c.Depth, Parent: -1, SQL: c.SQL}
+			if c.Parent != nil {
+				candidate.Parent = *c.Parent
+			}
+			candidates = append(candidates, candidate)
+		}
+		var depths []policy.DepthRecord
+		for _, d := range r.Depths {
+			depthPhases := make(map[string]time.Duration, len(d.PhasesNs))
+			for phase, ns := range d.PhasesNs {
+				depthPhases[phase] = time.Duration(ns)
+			}
+			depths = append(depths, policy.DepthRecord{Depth: d.Depth, Forks: d.Forks, Survivors: d.Survivors, Failures: d.Failures, Duration: time.Duration(d.DurationNs), Phases: depthPhases})
+		}
+		records = append(records, Record{Record: policy.Record{
+			Policy:           r.Policy,
+			TestCase:         r.TestCase,
+			TransactionCount: r.TransactionCount,
+			Repetition:       r.Repetition,
+			Duration:         time.Duration(r.DurationNs),
+			Total:            time.Duration(r.TotalNs),
+			Phases:           phases,
+			Failures:         r.Failures,
+			Candidates:       candidates,
+			Depths:           depths,
+			Resources: policy.Resources{
+				CPUTime:    time.Duration(r.CPUTimeNs),
+				PeakRSS:    r.PeakRSSBytes,
+				AllocBytes: r.AllocBytes,
+				Allocs:     r.Allocs,
+				ForkBytes:  r.ForkBytes,
+				BaseBytes:  r.BaseBytes,
+			},
+		}})
+	}
+	return records, nil
+}
+
+func loadParquet(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	table, err := pqarrow.ReadTable(context.Background(), f, parquet.NewReaderProperties(memory.DefaultAllocator), pqarrow.ArrowReadProperties{}, memory.DefaultAllocator)
+	if err != nil {
+		return nil, err
+	}
+	defer table.Release()
+
+	columns := make(map[string]int)
+	for i, field := range table.Schema().Fields() {
+		columns[field.Name] = i
+	}
+
+	var records []Record
+	reader := array.NewTableReader(table, 1024)
+	defer reader.Release()
+	for reader.Next() {
+		rec := reader.Record()
+		str := func(name string, row int) string {
+			if i, ok := columns[name]; ok {
+				return rec.Column(i).(*array.String).Value(row)
+			}
+			return ""
+		}
+		num := func(name string, row int) int64 {
+			if i, ok := columns[name]; ok {
+				return rec.Column(i).(*array.Int64).Value(row)
+			}
+			return 0
+		}
+		for row := 0; row < int(rec.NumRows()); row++ {
+			phases := make(map[string]time.Duration)
+			for _, phase := range policy.Phases {
+				if ns := num(phase+"_ns", row); ns != 0 {
+					phases[phase] = time.Duration(ns)
+				}
+			}
+			records = append(records, Record{Record: policy.Record{
+				Policy:           str("policy", row),
+				TestCase:         str("test_case", row),
+				TransactionCount: int(num("transaction_count", row)),
+				Repetition:       int(num("repetition", row)),
+				Duration:         time.Duration(num("duration_ns", row)),
+				Total:            time.Duration(num("total_ns", row)),
+				Phases:           phases,
+				Failures:         int(num("failures", row)),
+				Resources: policy.Resources{
+					CPUTime:    time.Duration(num("cpu_time_ns", row)),
+					PeakRSS:    num("peak_rss_bytes", row),
+					AllocBytes: num("alloc_bytes", row),
+					Allocs:     num("allocs", row),
+					ForkBytes:  num("fork_bytes", row),
+					BaseBytes:  num("base_bytes", row),
+				},
+			}})
+		}
+	}
+	return records, reader.Err()
+}
+
+// Policies - the distinct policies in records, sorted
+func Policies(records []Record) []string {
+	return distinct(records, func(r Record) string { return r.Policy })
+}
+
+// TestCases - the distinct test cases in records, sorted
+func TestCases(records []Record) []string {
+	return distinct(records, func(r Record) string { return r.TestCase })
+}
+
+// InFlights - the distinct numbers of transactions in flight in records, sorted
+func InFlights(records []Record) []int {
+	seen := make(map[int]bool)
+	var values []int
+	for _, r := range records {
+		if !seen[r.TransactionCount] {
+			seen[r.TransactionCount] = true
+			values = append(values, r.TransactionCount)
+		}
+	}
+	sort.Ints(values)
+	return values
+}
+
+func distinct(records []Record, key func(Record) string) []string {
+	seen := make(map[string]bool)
+	var values []string
+	for _, r := range records {
+		k := key(r)
+		if !seen[k] {
+			seen[k] = true
+			values = append(values, k)
+		}
+	}
+	sort.Strings(values)
+	return values
+}
@@ -0,0 +1,277 @@
+package analysis
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"ntran/policy"
+)
+
+type reportSection struct {
+	Title       string
+	Description string
+	Charts      []template.HTML
+	Tables      []template.HTML
+}
+
+type reportData struct {
+	Title     string
+	Generated string
+	Runs      []string
+	Sections  []reportSection
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+section { margin-bottom: 3em; }
+svg { display: block; margin: 1em 0; }
+table { border-collapse: collapse; font-size: 12px; margin: 1em 0; }
+th, td { border: 1px solid #ccc; padding: 3px 8px; text-align: right; }
+th { background: #f4f4f4; }
+td:first-child, td:nth-child(2) { text-align: left; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>Generated {{.Generated}} from {{len .Runs}} run(s): {{range $i, $run := .Runs}}{{if $i}}, {{end}}<code>{{$run}}</code>{{end}}</p>
+{{range .Sections}}
+<section>
+<h2>{{.Title}}</h2>
+<p>{{.Description}}</p>
+{{range .Charts}}{{.}}
+{{end}}{{range .Tables}}{{.}}
+{{end}}
+</section>
+{{end}}
+</body>
+</html>
+`))
+
+/*
+ * WriteReport - renders a single self-contained html file with inline svg
+ * charts of the records: latency versus inFlight, per test case breakdowns,
+ * phase stacks, candidate failure rates and fork storage
+ */
+func WriteReport(w io.Writer, records []Record, metric string) error {
+	groups, err := Summarize(records, metric)
+	if err != nil {
+		return err
+	}
+
+	data := reportData{
+		Title:     "ntran experiment report",
+		Generated: time.Now().Format(time.RFC1123),
+		Runs:      distinct(records, func(r Record) string { return r.RunID }),
+	}
+	data.Sections = append(data.Sections,
+		latencySection(groups, metric),
+		testCaseSection(groups, metric),
+		phaseSection(records),
+		failureSection(records),
+		storageSection(records, groups, metric),
+	)
+	return reportTemplate.Execute(w, data)
+}
+
+func formatNanos(v float64) string {
+	return FormatDuration(time.Duration(v))
+}
+
+func latencySection(groups []Group, metric string) reportSection {
+	section := reportSection{
+		Title:       "Latency vs inFlight",
+		Description: fmt.Sprintf("Median %s of every policy by the number of transactions in flight, one chart per test case. Both axes are logarithmic.", metric),
+	}
+	for _, testCase := range distinctGroups(groups, func(g Group) string { return g.TestCase }) {
+		chart := LineChart{Title: testCase, XLabel: "inFlight", YLabel: "median " + metric, LogX: true, LogY: true, FormatY: formatNanos}
+		for _, p := range distinctGroups(groups, func(g Group) string { return g.Policy }) {
+			series := Series{Name: p}
+			for _, g := range groups {
+				if g.Policy == p && g.TestCase == testCase {
+					series.Points = append(series.Points, Point{X: float64(g.InFlight), Y: g.Summary.Median})
+				}
+			}
+			if len(series.Points) > 0 {
+				chart.Series = append(chart.Series, series)
+			}
+		}
+		section.Charts = append(section.Charts, chart.SVG())
+	}
+	section.Tables = append(section.Tables, ScalingTable(groups).HTML())
+	return section
+}
+
+func testCaseSection(groups []Group, metric string) reportSection {
+	section := reportSection{
+		Title:       "Test case breakdown",
+		Description: fmt.Sprintf("Median %s of every test case by the number of transactions in flight, one chart per policy.", metric),
+	}
+	for _, p := range distinctGroups(groups, func(g Group) string { return g.Policy }) {
+		chart := LineChart{Title: p, XLabel: "inFlight", YLabel: "median " + metric, LogX: true, LogY: true, FormatY: formatNanos}
+		for _, testCase := range distinctGroups(groups, func(g Group) string { return g.TestCase }) {
+			series := Series{Name: testCase}
+			for _, g := range groups {
+				if g.Policy == p && g.TestCase == testCase {
+					series.Points = append(series.Points, Point{X: float64(g.InFlight), Y: g.Summary.Median})
+				}
+			}
+			if len(series.Points) > 0 {
+				chart.Series = append(chart.Series, series)
+			}
+		}
+		section.Charts = append(section.Charts, chart.SVG())
+	}
+	section.Tables = append(section.Tables, SummaryTable(groups, metric).HTML())
+	return section
+}
+
+// phaseSection - the mean duration of every phase by inFlight, one stacked
+// chart per policy. Results from before phases were recorded are skipped.
+func phaseSection(records []Record) reportSection {
+	section := reportSection{
+		Title:       "Phases",
+		Description: "Mean duration of each phase by the number of transactions in flight, across all test cases, one chart per policy.",
+	}
+	for _, p := range Policies(records) {
+		type key struct {
+			inFlight int
+			phase    string
+		}
+		sums := make(map[key]float64)
+		counts := make(map[int]int)
+		for _, r := range records {
+			if r.Policy != p || len(r.Phases) == 0 {
+				continue
+			}
+			counts[r.TransactionCount]++
+			for phase, d := range r.Phases {
+				sums[key{r.TransactionCount, phase}] += float64(d)
+			}
+		}
+		if len(counts) == 0 {
+			continue
+		}
+
+		chart := StackedBarChart{Title: p, XLabel: "inFlight", YLabel: "mean duration", FormatY: formatNanos}
+		var inFlights []int
+		for _, inFlight := range InFlights(records) {
+			if counts[inFlight] > 0 {
+				inFlights = append(inFlights, inFlight)
+				chart.Categories = append(chart.Categories, strconv.Itoa(inFlight))
+			}
+		}
+		for _, phase := range policy.Phases {
+			stack := Series{Name: phase}
+			for _, inFlight := range inFlights {
+				stack.Points = append(stack.Points, Point{X: float64(inFlight), Y: sums[key{inFlight, phase}] / float64(counts[inFlight])})
+			}
+			chart.Stacks = append(chart.Stacks, stack)
+		}
+		section.Charts = append(section.Charts, chart.SVG())
+	}
+	if len(section.Charts) == 0 {
+		section.Description = "None of the results include phase timings."
+	}
+	return section
+}
+
+// failureSection - the percentage of candidates that failed to execute
+func failureSection(records []Record) reportSection {
+	section := reportSection{
+		Title:       "Candidate failure rates",
+		Description: "Percentage of candidate transactions that failed to execute by the number of transactions in flight, across all test cases.",
+	}
+	chart := LineChart{Title: "Candidate failure rate", XLabel: "inFlight", YLabel: "% failed", LogX: true, FormatY: func(v float64) string { return fmt.Sprintf("%.1f%%", v) }}
+	table := &Table{Title: "Candidate failures", Headers: []string{"Policy", "InFlight", "Candidates", "Failures", "FailureRate"}}
+	for _, p := range Policies(records) {
+		series := Series{Name: p}
+		for _, inFlight := range InFlights(records) {
+			var candidates, failures int
+			for _, r := range records {
+				if r.Policy == p && r.TransactionCount == inFlight {
+					candidates += r.TransactionCount
+					failures += r.Failures
+				}
+			}
+			if candidates == 0 {
+				continue
+			}
+			rate := 100 * float64(failures) / float64(candidates)
+			series.Points = append(series.Points, Point{X: float64(inFlight), Y: rate})
+			table.Append(p, inFlight, candidates, failures, rate)
+		}
+		chart.Series = append(chart.Series, series)
+	}
+	section.Charts = append(section.Charts, chart.SVG())
+	section.Tables = append(section.Tables, table.HTML())
+	return section
+}
+
+// storageSection - the extra storage of one candidate's fork and the storage
+// amplification by inFlight, across all test cases
+func storageSection(records []Record, groups []Group, metric string) reportSection {
+	section := reportSection{
+		Title:       "Fork storage",
+		Description: "Extra storage of one candidate's fork and storage amplification ((base + forks) / base) at the peak of a test case by the number of transactions in flight, averaged across test cases.",
+	}
+	sums, keys := storageByKey(records)
+	if len(keys) == 0 {
+		section.Description = "None of the results include fork storage."
+		return section
+	}
+
+	perCandidate := LineChart{Title: "Storage per candidate", XLabel: "inFlight", YLabel: "bytes per candidate", LogX: true, FormatY: func(v float64) string { return FormatBytes(int64(v)) }}
+	amplification := LineChart{Title: "Storage amplification", XLabel: "inFlight", YLabel: "amplification", LogX: true, FormatY: func(v float64) string { return fmt.Sprintf("%.1fx", v) }}
+	for _, p := range Policies(records) {
+		bytes, amp := Series{Name: p}, Series{Name: p}
+		for _, inFlight := range InFlights(records) {
+			var n int
+			var b, a float64
+			for _, key := range keys {
+				if key.Policy == p && key.InFlight == inFlight {
+					n++
+					b += float64(sums[key].perCandidate)
+					a += sums[key].amplification()
+				}
+			}
+			if n == 0 {
+				continue
+			}
+			bytes.Points = append(bytes.Points, Point{X: float64(inFlight), Y: b / float64(n)})
+			if a > 0 {
+				amp.Points = append(amp.Points, Point{X: float64(inFlight), Y: a / float64(n)})
+			}
+		}
+		if len(bytes.Points) > 0 {
+			perCandidate.Series = append(perCandidate.Series, bytes)
+		}
+		if len(amp.Points) > 0 {
+			amplification.Series = append(amplification.Series, amp)
+		}
+	}
+	section.Charts = append(section.Charts, perCandidate.SVG(), amplification.SVG())
+	section.Tables = append(section.Tables, StorageTable(records, groups, metric).HTML())
+	return section
+}
+
+func distinctGroups(groups []Group, key func(Group) string) []string {
+	seen := make(map[string]bool)
+	var values []string
+	for _, g := range groups {
+		if k := key(g); !seen[k] {
+			seen[k] = true
+			values = append(values, k)
+		}
+	}
+	sort.Strings(values)
+	return values
+}
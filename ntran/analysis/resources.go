@@ -0,0 +1,126 @@
+package analysis
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+ * ResourceTable - the mean resources each configuration used per
+ * repetition: CPU time, peak RSS and Go allocations of the ntran process,
+ * and the storage of the forks. Empty when the records predate resource
+ * accounting
+ */
+func ResourceTable(records []Record) *Table {
+	t := &Table{
+		Title:   "Mean resources per configuration",
+		Headers: []string{"Policy", "TestCase", "InFlight", "N", "CPUTime", "PeakRSS", "Alloc", "Allocs", "Forks"},
+	}
+
+	type sums struct {
+		n                                      int64
+		cpuTime                                time.Duration
+		peakRSS, allocBytes, allocs, forkBytes int64
+	}
+	byKey := make(map[Key]*sums)
+	var keys []Key
+	for _, r := range records {
+		res := r.Resources
+		if res.CPUTime == 0 && res.PeakRSS == 0 && res.AllocBytes == 0 && res.ForkBytes == 0 {
+			continue
+		}
+		key := Key{Policy: r.Policy, TestCase: r.TestCase, InFlight: r.TransactionCount}
+		s, ok := byKey[key]
+		if !ok {
+			s = &sums{}
+			byKey[key] = s
+			keys = append(keys, key)
+		}
+		s.n++
+		s.cpuTime += res.CPUTime
+		s.peakRSS += res.PeakRSS
+		s.allocBytes += res.AllocBytes
+		s.allocs += res.Allocs
+		s.forkBytes += res.ForkBytes
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return lessKey(keys[i], keys[j])
+	})
+
+	for _, key := range keys {
+		s := byKey[key]
+		t.Append(key.Policy, key.TestCase, key.InFlight, int(s.n),
+			s.cpuTime/time.Duration(s.n), Bytes(s.peakRSS/s.n), Bytes(s.allocBytes/s.n), s.allocs/s.n, Bytes(s.forkBytes/s.n))
+	}
+	return t
+}
+
+// storage - the mean storage of a configuration's repetitions
+type storage struct {
+	n            int
+	base, forks  int64
+	perCandidate int64
+}
+
+func (s storage) amplification() float64 {
+	if s.base <= 0 {
+		return 0
+	}
+	return float64(s.base+s.forks) / float64(s.base)
+}
+
+// storageByKey - the mean storage of every configuration whose forks were measured
+func storageByKey(records []Record) (map[Key]storage, []Key) {
+	sums := make(map[Key]storage)
+	var keys []Key
+	for _, r := range records {
+		res := r.Resources
+		if res.BaseBytes == 0 && res.ForkBytes == 0 {
+			continue
+		}
+		key := Key{Policy: r.Policy, TestCase: r.TestCase, InFlight: r.TransactionCount}
+		s, ok := sums[key]
+		if !ok {
+			keys = append(keys, key)
+		}
+		s.n++
+		s.base += res.BaseBytes
+		s.forks += res.ForkBytes
+		sums[key] = s
+	}
+	for key, s := range sums {
+		s.base /= int64(s.n)
+		s.forks /= int64(s.n)
+		s.perCandidate = s.forks / int64(key.InFlight)
+		sums[key] = s
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return lessKey(keys[i], keys[j])
+	})
+	return sums, keys
+}
+
+/*
+ * StorageTable - the storage each configuration's forks took at the peak
+ * of a test case next to its median latency: the base state, the extra
+ * storage of all forks and of one candidate, and the amplification
+ * (base + forks) / base
+ */
+func StorageTable(records []Record, groups []Group, metric string) *Table {
+	t := &Table{
+		Title:   "Fork storage per configuration",
+		Headers: []string{"Policy", "TestCase", "InFlight", "Median" + strings.ToUpper(metric[:1]) + metric[1:], "Base", "Forks", "PerCandidate", "Amplification"},
+	}
+	sums, keys := storageByKey(records)
+	byKey := index(groups)
+	for _, key := range keys {
+		s := sums[key]
+		var median any
+		if g, ok := byKey[key]; ok {
+			median = g.Median()
+		}
+		t.Append(key.Policy, key.TestCase, key.InFlight, median, Bytes(s.base), Bytes(s.forks), Bytes(s.perCandidate), s.amplification())
+	}
+	return t
+}
@@ -0,0 +1,205 @@
+package analysis
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"ntran/policy"
+	"ntran/stats"
+)
+
+// Metrics that can be summarized: the overall duration, the sum of all
+// phases, or any single phase
+const (
+	MetricDuration = "duration"
+	MetricTotal    = "total"
+)
+
+func Metrics() []string {
+	return append([]string{MetricDuration, MetricTotal}, policy.Phases...)
+}
+
+// Value - the value of a metric for a record
+func Value(record Record, metric string) (time.Duration, error) {
+	switch metric {
+	case MetricDuration:
+		return record.Duration, nil
+	case MetricTotal:
+		return record.Total, nil
+	}
+	for _, phase := range policy.Phases {
+		if phase == metric {
+			return record.Phases[phase], nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported metric %s, must be one of %v", metric, Metrics())
+}
+
+// Key - identifies one configuration of one policy
+type Key struct {
+	Policy   string
+	TestCase string
+	InFlight int
+}
+
+type Group struct {
+	Key
+	// Samples - the metric of every repetition, in nanoseconds
+	Samples []float64
+	Summary stats.Summary
+}
+
+func (g Group) Median() time.Duration {
+	return time.Duration(g.Summary.Median)
+}
+
+// Summarize - groups records by (policy, test case, inFlight) and computes
+// summary statistics of the metric for each group
+func Summarize(records []Record, metric string) ([]Group, error) {
+	samples := make(map[Key][]float64)
+	for _, record := range records {
+		v, err := Value(record, metric)
+		if err != nil {
+			return nil, err
+		}
+		key := Key{Policy: record.Policy, TestCase: record.TestCase, InFlight: record.TransactionCount}
+		samples[key] = append(samples[key], float64(v))
+	}
+
+	groups := make([]Group, 0, len(samples))
+	for key, s := range samples {
+		groups = append(groups, Group{Key: key, Samples: s, Summary: stats.Summarize(s)})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return lessKey(groups[i].Key, groups[j].Key)
+	})
+	return groups, nil
+}
+
+func lessKey(a Key, b Key) bool {
+	if a.Policy != b.Policy {
+		return a.Policy < b.Policy
+	}
+	if a.TestCase != b.TestCase {
+		return a.TestCase < b.TestCase
+	}
+	return a.InFlight < b.InFlight
+}
+
+func index(groups []Group) map[Key]Group {
+	m := make(map[Key]Group, len(groups))
+	for _, g := range groups {
+		m[g.Key] = g
+	}
+	return m
+}
+
+func SummaryTable(groups []Group, metric string) *Table {
+	t := &Table{
+		Title:   fmt.Sprintf("Summary of %s per configuration", metric),
+		Headers: []string{"Policy", "TestCase", "InFlight", "N", "Mean", "Median", "P95", "P99", "StdDev", "CILow", "CIHigh"},
+	}
+	for _, g := range groups {
+		s := g.Summary
+		t.Append(g.Policy, g.TestCase, g.InFlight, s.N,
+			time.Duration(s.Mean), time.Duration(s.Median), time.Duration(s.P95), time.Duration(s.P99),
+			time.Duration(s.StdDev), time.Duration(s.CILow), time.Duration(s.CIHigh))
+	}
+	return t
+}
+
+// SpeedupTable - the median of the baseline policy divided by the median of
+// every other policy for the configurations they share; above 1 is faster
+func SpeedupTable(groups []Group, baseline string) *Table {
+	t := &Table{
+		Title:   fmt.Sprintf("Speedup versus %s (baseline median / policy median)", baseline),
+		Headers: []string{"Policy", "TestCase", "InFlight", "BaselineMedian", "Median", "Speedup"},
+	}
+	byKey := index(groups)
+	for _, g := range groups {
+		if g.Policy == baseline {
+			continue
+		}
+		base, ok := byKey[Key{Policy: baseline, TestCase: g.TestCase, InFlight: g.InFlight}]
+		if !ok || g.Summary.Median == 0 {
+			continue
+		}
+		t.Append(g.Policy, g.TestCase, g.InFlight, base.Median(), g.Median(), base.Summary.Median/g.Summary.Median)
+	}
+	return t
+}
+
+/*
+ * ScalingTable - the median of every policy and test case at each inFlight,
+ * one column per inFlight, along with the scaling exponent k of the fit
+ * median ~ inFlight^k (k = 1 is linear, k = 0 is flat)
+ */
+func ScalingTable(groups []Group) *Table {
+	var inFlights []int
+	seen := make(map[int]bool)
+	type curve struct{ policy, testCase string }
+	var curves []curve
+	seenCurve := make(map[curve]bool)
+	for _, g := range groups {
+		if !seen[g.InFlight] {
+			seen[g.InFlight] = true
+			inFlights = append(inFlights, g.InFlight)
+		}
+		c := curve{g.Policy, g.TestCase}
+		if !seenCurve[c] {
+			seenCurve[c] = true
+			curves = append(curves, c)
+		}
+	}
+	sort.Ints(inFlights)
+
+	t := &Table{Title: "Scaling of the median with inFlight", Headers: []string{"Policy", "TestCase"}}
+	for _, inFlight := range inFlights {
+		t.Headers = append(t.Headers, fmt.Sprintf("%d", inFlight))
+	}
+	t.Headers = append(t.Headers, "Exponent")
+
+	byKey := index(groups)
+	for _, c := range curves {
+		row := []any{c.policy, c.testCase}
+		var xs, ys []float64
+		for _, inFlight := range inFlights {
+			g, ok := byKey[Key{Policy: c.policy, TestCase: c.testCase, InFlight: inFlight}]
+			if !ok {
+				row = append(row, nil)
+				continue
+			}
+			row = append(row, g.Median())
+			if g.Summary.Median > 0 {
+				xs = append(xs, math.Log(float64(inFlight)))
+				ys = append(ys, math.Log(g.Summary.Median))
+			}
+		}
+		if len(xs) >= 2 {
+			row = append(row, slope(xs, ys))
+		} else {
+			row = append(row, nil)
+		}
+		t.Append(row...)
+	}
+	return t
+}
+
+// slope - least squares slope of ys over xs
+func slope(xs []float64, ys []float64) float64 {
+	n := float64(len(xs))
+	var sx, sy, sxy, sxx float64
+	for i := range xs {
+		sx += xs[i]
+		sy += ys[i]
+		sxy += xs[i] * ys[i]
+		sxx += xs[i] * xs[i]
+	}
+	denominator := n*sxx - sx*sx
+	if denominator == 0 {
+		return 0
+	}
+	return (n*sxy - sx*sy) / denominator
+}
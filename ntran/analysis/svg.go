@@ -0,0 +1,269 @@
+package analysis
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"sort"
+	"strings"
+)
+
+// palette - colors for series, in order
+var palette = []string{"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd", "#8c564b", "#e377c2", "#7f7f7f", "#bcbd22", "#17becf"}
+
+const (
+	chartWidth   = 720
+	chartHeight  = 320
+	marginLeft   = 80
+	marginRight  = 170
+	marginTop    = 30
+	marginBottom = 45
+)
+
+type Point struct {
+	X float64
+	Y float64
+}
+
+type Series struct {
+	Name   string
+	Points []Point
+}
+
+/*
+ * LineChart - an inline SVG line chart. Either axis can be logarithmic,
+ * which is how latencies spanning milliseconds to minutes stay readable.
+ * X ticks are placed at the x values that occur in the data.
+ */
+type LineChart struct {
+	Title   string
+	XLabel  string
+	YLabel  string
+	LogX    bool
+	LogY    bool
+	Series  []Series
+	FormatY func(float64) string
+}
+
+type scale struct {
+	min, max float64
+	from, to float64
+	log      bool
+}
+
+func (s scale) at(v float64) float64 {
+	lo, hi := s.min, s.max
+	if s.log {
+		v, lo, hi = math.Log10(v), math.Log10(lo), math.Log10(hi)
+	}
+	if hi == lo {
+		return (s.from + s.to) / 2
+	}
+	return s.from + (v-lo)/(hi-lo)*(s.to-s.from)
+}
+
+func newScale(values []float64, log bool, from float64, to float64, zero bool) scale {
+	s := scale{min: math.Inf(1), max: math.Inf(-1), from: from, to: to, log: log}
+	for _, v := range values {
+		if log && v <= 0 {
+			continue
+		}
+		s.min = math.Min(s.min, v)
+		s.max = math.Max(s.max, v)
+	}
+	if math.IsInf(s.min, 1) {
+		s.min, s.max = 1, 10
+	}
+	if zero && !log {
+		s.min = math.Min(0, s.min)
+	}
+	if s.min == s.max {
+		if log {
+			s.min, s.max = s.min/2, s.max*2
+		} else {
+			s.max = s.min + 1
+		}
+	}
+	return s
+}
+
+// ticks - powers of 1, 2 and 5 times ten for log scales, five evenly
+// spaced values otherwise
+func (s scale) ticks() []float64 {
+	var ticks []float64
+	if s.log {
+		for e := math.Floor(math.Log10(s.min)); e <= math.Ceil(math.Log10(s.max)); e++ {
+			for _, m := range []float64{1, 2, 5} {
+				v := m * math.Pow(10, e)
+				if v >= s.min && v <= s.max {
+					ticks = append(ticks, v)
+				}
+			}
+		}
+		if len(ticks) > 8 {
+			var decades []float64
+			for _, v := range ticks {
+				if m := v / math.Pow(10, math.Floor(math.Log10(v))); math.Abs(m-1) < 1e-9 {
+					decades = append(decades, v)
+				}
+			}
+			ticks = decades
+		}
+		return ticks
+	}
+	for i := 0; i <= 4; i++ {
+		ticks = append(ticks, s.min+(s.max-s.min)*float64(i)/4)
+	}
+	return ticks
+}
+
+func (c LineChart) SVG() template.HTML {
+	format := c.FormatY
+	if format == nil {
+		format = func(v float64) string { return fmt.Sprintf("%.3g", v) }
+	}
+
+	var xs, ys []float64
+	xSet := make(map[float64]bool)
+	for _, series := range c.Series {
+		for _, p := range series.Points {
+			xs = append(xs, p.X)
+			ys = append(ys, p.Y)
+			xSet[p.X] = true
+		}
+	}
+	x := newScale(xs, c.LogX, marginLeft, chartWidth-marginRight, false)
+	y := newScale(ys, c.LogY, chartHeight-marginBottom, marginTop, true)
+
+	var b strings.Builder
+	openSVG(&b, c.Title)
+	axes(&b, c.XLabel, c.YLabel)
+
+	for _, tick := range y.ticks() {
+		py := y.at(tick)
+		fmt.Fprintf(&b, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#eee"/>`, marginLeft, py, chartWidth-marginRight, py)
+		fmt.Fprintf(&b, `<text x="%d" y="%.1f" text-anchor="end" font-size="11">%s</text>`, marginLeft-6, py+4, template.HTMLEscapeString(format(tick)))
+	}
+	xTicks := make([]float64, 0, len(xSet))
+	for v := range xSet {
+		xTicks = append(xTicks, v)
+	}
+	sort.Float64s(xTicks)
+	for _, tick := range xTicks {
+		px := x.at(tick)
+		fmt.Fprintf(&b, `<text x="%.1f" y="%d" text-anchor="middle" font-size="11">%g</text>`, px, chartHeight-marginBottom+15, tick)
+	}
+
+	for i, series := range c.Series {
+		color := palette[i%len(palette)]
+		points := make([]Point, len(series.Points))
+		copy(points, series.Points)
+		sort.Slice(points, func(i, j int) bool { return points[i].X < points[j].X })
+
+		var path []string
+		for _, p := range points {
+			if c.LogY && p.Y <= 0 {
+				continue
+			}
+			path = append(path, fmt.Sprintf("%.1f,%.1f", x.at(p.X), y.at(p.Y)))
+		}
+		fmt.Fprintf(&b, `<polyline fill="none" stroke="%s" stroke-width="2" points="%s"/>`, color, strings.Join(path, " "))
+		for _, p := range points {
+			if c.LogY && p.Y <= 0 {
+				continue
+			}
+			fmt.Fprintf(&b, `<circle cx="%.1f" cy="%.1f" r="3" fill="%s"><title>%s: %g, %s</title></circle>`,
+				x.at(p.X), y.at(p.Y), color, template.HTMLEscapeString(series.Name), p.X, template.HTMLEscapeString(format(p.Y)))
+		}
+		legend(&b, i, series.Name, color)
+	}
+
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+/*
+ * StackedBarChart - an inline SVG bar chart with one bar per category,
+ * each stacked from the values of every series at that category
+ */
+type StackedBarChart struct {
+	Title      string
+	XLabel     string
+	YLabel     string
+	Categories []string
+	// Stacks - one series per stack segment; Points[i].Y is the value at Categories[i]
+	Stacks  []Series
+	FormatY func(float64) string
+}
+
+func (c StackedBarChart) SVG() template.HTML {
+	format := c.FormatY
+	if format == nil {
+		format = func(v float64) string { return fmt.Sprintf("%.3g", v) }
+	}
+
+	totals := make([]float64, len(c.Categories))
+	for _, stack := range c.Stacks {
+		for i, p := range stack.Points {
+			if i < len(totals) {
+				totals[i] += p.Y
+			}
+		}
+	}
+	y := newScale(append(totals, 0), false, chartHeight-marginBottom, marginTop, true)
+
+	var b strings.Builder
+	openSVG(&b, c.Title)
+	axes(&b, c.XLabel, c.YLabel)
+	for _, tick := range y.ticks() {
+		py := y.at(tick)
+		fmt.Fprintf(&b, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#eee"/>`, marginLeft, py, chartWidth-marginRight, py)
+		fmt.Fprintf(&b, `<text x="%d" y="%.1f" text-anchor="end" font-size="11">%s</text>`, marginLeft-6, py+4, template.HTMLEscapeString(format(tick)))
+	}
+
+	if len(c.Categories) > 0 {
+		slot := float64(chartWidth-marginLeft-marginRight) / float64(len(c.Categories))
+		width := slot * 0.7
+		for i, category := range c.Categories {
+			left := float64(marginLeft) + slot*float64(i) + (slot-width)/2
+			fmt.Fprintf(&b, `<text x="%.1f" y="%d" text-anchor="middle" font-size="11">%s</text>`, left+width/2, chartHeight-marginBottom+15, template.HTMLEscapeString(category))
+			base := 0.0
+			for j, stack := range c.Stacks {
+				if i >= len(stack.Points) || stack.Points[i].Y <= 0 {
+					continue
+				}
+				v := stack.Points[i].Y
+				top, bottom := y.at(base+v), y.at(base)
+				fmt.Fprintf(&b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"><title>%s %s: %s</title></rect>`,
+					left, top, width, bottom-top, palette[j%len(palette)],
+					template.HTMLEscapeString(category), template.HTMLEscapeString(stack.Name), template.HTMLEscapeString(format(v)))
+				base += v
+			}
+		}
+	}
+	for j, stack := range c.Stacks {
+		legend(&b, j, stack.Name, palette[j%len(palette)])
+	}
+
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+func openSVG(b *strings.Builder, title string) {
+	fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif">`, chartWidth, chartHeight, chartWidth, chartHeight)
+	fmt.Fprintf(b, `<text x="%d" y="18" font-size="14" font-weight="bold">%s</text>`, marginLeft, template.HTMLEscapeString(title))
+}
+
+func axes(b *strings.Builder, xLabel string, yLabel string) {
+	fmt.Fprintf(b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#333"/>`, marginLeft, chartHeight-marginBottom, chartWidth-marginRight, chartHeight-marginBottom)
+	fmt.Fprintf(b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#333"/>`, marginLeft, marginTop, marginLeft, chartHeight-marginBottom)
+	fmt.Fprintf(b, `<text x="%d" y="%d" text-anchor="middle" font-size="12">%s</text>`, (marginLeft+chartWidth-marginRight)/2, chartHeight-8, template.HTMLEscapeString(xLabel))
+	fmt.Fprintf(b, `<text x="14" y="%d" text-anchor="middle" font-size="12" transform="rotate(-90 14 %d)">%s</text>`, (marginTop+chartHeight-marginBottom)/2, (marginTop+chartHeight-marginBottom)/2, template.HTMLEscapeString(yLabel))
+}
+
+func legend(b *strings.Builder, i int, name string, color string) {
+	lx := chartWidth - marginRight + 15
+	ly := marginTop + 18*i
+	fmt.Fprintf(b, `<rect x="%d" y="%d" width="12" height="12" fill="%s"/>`, lx, ly, color)
+	fmt.Fprintf(b, `<text x="%d" y="%d" font-size="12">%s</text>`, lx+18, ly+10, template.HTMLEscapeString(name))
+}
@@ -0,0 +1,196 @@
+package analysis
+
+import (
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Output formats for tables
+const (
+	FormatText     = "text"
+	FormatMarkdown = "markdown"
+	FormatCSV      = "csv"
+)
+
+var Formats = []string{FormatText, FormatMarkdown, FormatCSV}
+
+/*
+ * Table - a titled table of cells. Cells are kept typed (time.Duration,
+ * Bytes, float64, int, string) so each format can render them
+ * appropriately: durations and sizes are rounded for people and written
+ * as integer nanoseconds and bytes in csv
+ */
+type Table struct {
+	Title   string
+	Headers []string
+	Rows    [][]any
+}
+
+// Bytes - a size cell
+type Bytes int64
+
+func (t *Table) Append(row ...any) {
+	t.Rows = append(t.Rows, row)
+}
+
+func (t *Table) Render(w io.Writer, format string) error {
+	switch format {
+	case FormatText:
+		return t.renderText(w)
+	case FormatMarkdown:
+		return t.renderMarkdown(w)
+	case FormatCSV:
+		return t.renderCSV(w)
+	}
+	return fmt.Errorf("unsupported output format %s, must be one of %v", format, Formats)
+}
+
+func (t *Table) renderText(w io.Writer) error {
+	if t.Title != "" {
+		fmt.Fprintf(w, "%s\n\n", t.Title)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(t.Headers, "\t"))
+	for _, row := range t.Rows {
+		fmt.Fprintln(tw, strings.Join(t.humanCells(row), "\t"))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+func (t *Table) renderMarkdown(w io.Writer) error {
+	if t.Title != "" {
+		fmt.Fprintf(w, "### %s\n\n", t.Title)
+	}
+	fmt.Fprintf(w, "| %s |\n", strings.Join(t.Headers, " | "))
+	separators := make([]string, len(t.Headers))
+	for i := range separators {
+		separators[i] = "---"
+	}
+	fmt.Fprintf(w, "| %s |\n", strings.Join(separators, " | "))
+	for _, row := range t.Rows {
+		fmt.Fprintf(w, "| %s |\n", strings.Join(t.humanCells(row), " | "))
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+func (t *Table) renderCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	headers := make([]string, len(t.Headers))
+	for i, header := range t.Headers {
+		headers[i] = header
+		if len(t.Rows) > 0 && i < len(t.Rows[0]) {
+			switch t.Rows[0][i].(type) {
+			case time.Duration:
+				headers[i] = header + "Ns"
+			case Bytes:
+				headers[i] = header + "Bytes"
+			}
+		}
+	}
+	if err := writer.Write(headers); err != nil {
+		return err
+	}
+	for _, row := range t.Rows {
+		cells := make([]string, len(row))
+		for i, cell := range row {
+			switch v := cell.(type) {
+			case time.Duration:
+				cells[i] = fmt.Sprintf("%d", v.Nanoseconds())
+			case float64:
+				cells[i] = fmt.Sprintf("%g", v)
+			case nil:
+				cells[i] = ""
+			default:
+				cells[i] = fmt.Sprint(v)
+			}
+		}
+		if err := writer.Write(cells); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func (t *Table) humanCells(row []any) []string {
+	cells := make([]string, len(row))
+	for i, cell := range row {
+		switch v := cell.(type) {
+		case time.Duration:
+			cells[i] = FormatDuration(v)
+		case Bytes:
+			cells[i] = FormatBytes(int64(v))
+		case float64:
+			cells[i] = fmt.Sprintf("%.2f", v)
+		case nil:
+			cells[i] = "-"
+		default:
+			cells[i] = fmt.Sprint(v)
+		}
+	}
+	return cells
+}
+
+// FormatDuration - a duration rounded to a precision people can read
+func FormatDuration(d time.Duration) string {
+	abs := d
+	if abs < 0 {
+		abs = -abs
+	}
+	switch {
+	case abs >= time.Second:
+		return d.Round(time.Millisecond).String()
+	case abs >= time.Millisecond:
+		return d.Round(time.Microsecond).String()
+	case abs >= time.Microsecond:
+		return d.Round(10 * time.Nanosecond).String()
+	}
+	return d.String()
+}
+
+// FormatBytes - a size in binary units, e.g. 1536 -> "1.5KiB"
+func FormatBytes(b int64) string {
+	const unit = 1024
+	abs := b
+	if abs < 0 {
+		abs = -abs
+	}
+	if abs < unit {
+		return fmt.Sprintf("%dB", b)
+	}
+	div, exp := int64(unit), 0
+	for n := abs / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+// HTML - the table as an html table, for reports
+func (t *Table) HTML() template.HTML {
+	var b strings.Builder
+	b.WriteString("<table><thead><tr>")
+	for _, header := range t.Headers {
+		fmt.Fprintf(&b, "<th>%s</th>", template.HTMLEscapeString(header))
+	}
+	b.WriteString("</tr></thead><tbody>")
+	for _, row := range t.Rows {
+		b.WriteString("<tr>")
+		for _, cell := range t.humanCells(row) {
+			fmt.Fprintf(&b, "<td>%s</td>", template.HTMLEscapeString(cell))
+		}
+		b.WriteString("</tr>")
+	}
+	b.WriteString("</tbody></table>")
+	return template.HTML(b.String())
+}
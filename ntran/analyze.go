@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"ntran/analysis"
+)
+
+func analyzeCommand(args []string) error {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	metricArg := fs.String("metric", analysis.MetricTotal, fmt.Sprintf("the duration to analyze %v", analysis.Metrics()))
+	baselineArg := fs.String("baseline", "serial-snapshot", "the policy speedups are computed against")
+	formatArg := fs.String("format", analysis.FormatText, fmt.Sprintf("the output format %v", analysis.Formats))
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: ntran analyze [flags] [results files or run directories...]\n\n")
+		fmt.Fprintf(fs.Output(), "Summarizes results per policy, test case and inFlight. Defaults to ./runs and ./results.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	records, err := analysis.Load(resultPaths(fs.Args())...)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("no results found")
+	}
+
+	groups, err := analysis.Summarize(records, *metricArg)
+	if err != nil {
+		return err
+	}
+
+	tables := []*analysis.Table{analysis.SummaryTable(groups, *metricArg)}
+	speedups := analysis.SpeedupTable(groups, *baselineArg)
+	if len(speedups.Rows) > 0 {
+		tables = append(tables, speedups)
+	}
+	tables = append(tables, analysis.ScalingTable(groups))
+	if resources := analysis.ResourceTable(records); len(resources.Rows) > 0 {
+		tables = append(tables, resources)
+	}
+	if storage := analysis.StorageTable(records, groups, *metricArg); len(storage.Rows) > 0 {
+		tables = append(tables, storage)
+	}
+
+	for _, table := range tables {
+		if *formatArg == analysis.FormatCSV {
+			// separate the tables so each can be split out and parsed on its own
+			fmt.Printf("# %s\n", table.Title)
+		}
+		if err := table.Render(os.Stdout, *formatArg); err != nil {
+			return err
+		}
+		if *formatArg == analysis.FormatCSV {
+			fmt.Println()
+		}
+	}
+	return nil
+}
+
+// resultPaths - the paths given on the command line, or the default
+// locations of results when there are none
+func resultPaths(args []string) []string {
+	if len(args) > 0 {
+		return args
+	}
+	var paths []string
+	for _, path := range []string{"./runs", "./results"} {
+		if _, err := os.Stat(path); err == nil {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
@@ -9,7 +9,8 @@ from plotly.subplots import make_subplots
 
 def get_latest_csv(policy: str, directory: str):
     g = os.path.join(directory, f"{policy}*.csv")
-    csv_files = glob.glob(g)
+    # run directories written by ntran, e.g. runs/<policy>_<timestamp>/results.csv
+    csv_files = glob.glob(g) + glob.glob(os.path.join(directory, f"{policy}_*", "results.csv"))
     if not csv_files:
         logging.log(logging.WARNING, f"no CSV files found that match {g}")
         return None
@@ -47,6 +48,17 @@ def convert_duration_to_milliseconds(value):
         print(f"Error converting value: {value}")
         raise e
 
+def duration_seconds(df):
+    # newer results carry integer nanoseconds, older ones only Go duration strings
+    if "DurationNs" in df.columns:
+        return df["DurationNs"] / 1e9
+    return df["Duration"].apply(convert_duration_to_seconds)
+
+def duration_milliseconds(df):
+    if "DurationNs" in df.columns:
+        return df["DurationNs"] / 1e6
+    return df["Duration"].apply(convert_duration_to_milliseconds)
+
 def create_neondb_figures(results: str, figures: str):
     policies = [
         "cold-neondb",
@@ -63,7 +75,7 @@ def create_neondb_figures(results: str, figures: str):
         return
 
     df = pd.concat(policy_dfs)
-    df["Duration (secs)"] = df["Duration"].apply(convert_duration_to_seconds)
+    df["Duration (secs)"] = duration_seconds(df)
     max_duration = df["Duration (secs)"].max()
     del df["Duration"]
 
@@ -104,7 +116,7 @@ def create_postgres_figures(results: str, figures: str):
         return
     
     df = pd.concat(policy_dfs)
-    df["Duration (ms)"] = df["Duration"].apply(convert_duration_to_milliseconds)
+    df["Duration (ms)"] = duration_milliseconds(df)
 
     fig = make_subplots(rows=4, cols=1)
 
@@ -148,7 +160,7 @@ def create_duckdb_figures(results: str, figures: str):
         return
     
     df = pd.concat(policy_dfs)
-    df["Duration (ms)"] = df["Duration"].apply(convert_duration_to_milliseconds)
+    df["Duration (ms)"] = duration_milliseconds(df)
 
     test_cases = ["Long Update", "Short Insert", "Select Scan", "Select Join"]
     fig = make_subplots(rows=4, cols=1, subplot_titles=test_cases)
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"ntran/analysis"
+)
+
+func compareCommand(args []string) error {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	metricArg := fs.String("metric", analysis.MetricTotal, fmt.Sprintf("the duration to compare %v", analysis.Metrics()))
+	thresholdArg := fs.Float64("threshold", 0.05, "the relative slowdown of a configuration's median (e.g. 0.05 = 5%) above which it regresses")
+	alphaArg := fs.Float64("alpha", 0.05, "the significance level of the Mann-Whitney U test on repetitions")
+	formatArg := fs.String("format", analysis.FormatText, fmt.Sprintf("the output format %v", analysis.Formats))
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: ntran compare [flags] <baseline> <candidate>\n\n")
+		fmt.Fprintf(fs.Output(), "Compares every configuration of two runs (results files or directories) and exits\nnon-zero when any configuration regresses or is missing from the candidate.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	baseline, err := loadGroups(fs.Arg(0), *metricArg)
+	if err != nil {
+		return err
+	}
+	candidate, err := loadGroups(fs.Arg(1), *metricArg)
+	if err != nil {
+		return err
+	}
+
+	comparisons := analysis.Compare(baseline, candidate, *thresholdArg, *alphaArg)
+	if err := analysis.ComparisonTable(comparisons).Render(os.Stdout, *formatArg); err != nil {
+		return err
+	}
+
+	regressions, missing, thresholdOnly := 0, 0, 0
+	for _, c := range comparisons {
+		switch c.Verdict {
+		case analysis.VerdictRegression:
+			regressions++
+		case analysis.VerdictMissing:
+			missing++
+		}
+		if c.ThresholdOnly {
+			thresholdOnly++
+		}
+	}
+	if thresholdOnly > 0 {
+		slog.Warn("too few repetitions to test significance, the threshold alone decided", "configurations", thresholdOnly, "alpha", *alphaArg)
+	}
+	var errs []error
+	if regressions > 0 {
+		errs = append(errs, fmt.Errorf("%d of %d configurations regressed by more than %.1f%%", regressions, len(comparisons), 100**thresholdArg))
+	}
+	if missing > 0 {
+		errs = append(errs, fmt.Errorf("%d configurations of the baseline are missing from the candidate", missing))
+	}
+	return errors.Join(errs...)
+}
+
+func loadGroups(path string, metric string) ([]analysis.Group, error) {
+	records, err := analysis.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no results found in %s", path)
+	}
+	return analysis.Summarize(records, metric)
+}
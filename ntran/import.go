@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"ntran/analysis"
+	"ntran/policy"
+)
+
+func importCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	runsDirArg := fs.String("runs-dir", "./runs", "the directory to create the imported run directories in")
+	formatArg := fs.String("format", policy.FormatCSV, "the format to write imported results in [csv, jsonl, parquet]")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: ntran import [flags] [legacy results files or directories...]\n\n")
+		fmt.Fprintf(fs.Output(), "Converts results csv files from before run directories (e.g. ./results and\n./results/archive) into run directories in the current results schema. Defaults to ./results.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	paths := fs.Args()
+	if len(paths) == 0 {
+		paths = []string{"./results"}
+	}
+	files, err := analysis.LegacyResultsFiles(paths...)
+	if err != nil {
+		return err
+	}
+
+	imported := 0
+	for _, file := range files {
+		runDir, err := analysis.Import(file, *runsDirArg, *formatArg)
+		if err != nil {
+			return err
+		}
+		if runDir == "" {
+			fmt.Printf("skipped '%s', already imported\n", file)
+			continue
+		}
+		imported++
+		fmt.Printf("imported '%s' to '%s'\n", file, runDir)
+	}
+	fmt.Printf("imported %d of %d results files\n", imported, len(files))
+	return nil
+}
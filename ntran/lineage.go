@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"ntran/analysis"
+)
+
+func lineageCommand(args []string) error {
+	fs := flag.NewFlagSet("lineage", flag.ExitOnError)
+	formatArg := fs.String("format", analysis.LineageText, fmt.Sprintf("the output format %v", analysis.LineageFormats))
+	testCaseArg := fs.String("test-case", "", "only show the trees of this test case")
+	outArg := fs.String("o", "", "the file to write to, defaults to stdout")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: ntran lineage [flags] <run directory or lineage.json>\n\n")
+		fmt.Fprintf(fs.Output(), "Shows the lineage of a run: the base states, forks, candidate SQL and winners of every test case.\n")
+		fmt.Fprintf(fs.Output(), "Render dot output with e.g. `ntran lineage -format dot runs/<run> | dot -Tsvg > lineage.svg`.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	lineage, err := analysis.LoadLineage(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *testCaseArg != "" {
+		lineage = analysis.FilterLineage(lineage, *testCaseArg)
+		if len(lineage.Nodes) == 0 {
+			return fmt.Errorf("no lineage of test case %s", *testCaseArg)
+		}
+	}
+
+	out := os.Stdout
+	if *outArg != "" {
+		f, err := os.Create(*outArg)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	return analysis.WriteLineage(out, lineage, *formatArg)
+}
@@ -1,36 +1,76 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"ntran/analysis"
 	policy "ntran/policy"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
-	// "strings"
 	"os"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
-func setupLog(logDir string) (*os.File, error) {
-	err := os.RemoveAll(logDir)
+// setupLog - logs to the run's log file in format at level and above
+func setupLog(runDir string, format string, level string) (*os.File, error) {
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %s: %v", level, err)
+	}
+	logFile, err := os.OpenFile(filepath.Join(runDir, policy.LogFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 	if err != nil {
-		return nil, fmt.Errorf("failed to remove directory: %v", err)
+		return nil, fmt.Errorf("failed to open log file: %v", err)
 	}
 
-	err = os.MkdirAll(logDir, os.ModePerm)
+	logger, err := policy.NewLogger(logFile, format, logLevel)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create directory: %v", err)
+		logFile.Close()
+		return nil, err
 	}
+	slog.SetDefault(logger)
 
-	logFile, err := os.OpenFile(logDir+"/out.log", os.O_CREATE|os.O_WRONLY, 0666)
+	return logFile, nil
+}
 
-	log.SetOutput(logFile)
+// setupStderrLog - logs to stderr, for commands that serve rather than
+// write a run directory
+func setupStderrLog(format string, level string) error {
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %s: %v", level, err)
+	}
+	logger, err := policy.NewLogger(os.Stderr, format, logLevel)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	return nil
+}
 
-	return logFile, err
+// fatal - logs an error the experiment cannot recover from and exits,
+// ending the experiment first when one has started
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	policy.Exit(1)
 }
 
 func generateSQL(inFlight int) ([]policy.TestCase, error) {
+	// iterate in a stable order so that a seeded run is reproducible
+	names := make([]string, 0, len(policy.TestCaseTemplatesLite))
+	for key := range policy.TestCaseTemplatesLite {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+
 	var testCases []policy.TestCase
-	for key, val := range policy.TestCaseTemplatesLite {
+	for _, key := range names {
+		val := policy.TestCaseTemplatesLite[key]
 		var statements []policy.Statement
 		for i := 0; i < inFlight; i++ {
 			statement := policy.Statement{}
@@ -51,68 +91,253 @@ func generateSQL(inFlight int) ([]policy.TestCase, error) {
 	return testCases, nil
 }
 
+// Experiment modes
+const (
+	modeSingle = "single" // each test case is one step, whose winner is promoted
+	modeBeam   = "beam"   // each test case is a beam search over several steps
+)
+
+var modes = []string{modeSingle, modeBeam}
+
+// plannedCandidates - the candidates a test case of inFlight statements
+// runs: inFlight for a single step, and for a beam search inFlight at the
+// first depth then inFlight per kept branch at every later one, fewer if
+// the search ends early
+func plannedCandidates(inFlight int, beam *policy.BeamOptions) int {
+	if beam == nil {
+		return inFlight
+	}
+	return inFlight + (beam.Depth-1)*beam.Width*inFlight
+}
+
+// commands - the subcommands of ntran. Without one, ntran runs an experiment
+var commands = map[string]func(args []string) error{
+	"analyze": analyzeCommand,
+	"compare": compareCommand,
+	"import":  importCommand,
+	"lineage": lineageCommand,
+	"mcp":     mcpCommand,
+	"proxy":   proxyCommand,
+	"query":   queryCommand,
+	"report":  reportCommand,
+	"serve":   serveCommand,
+}
+
+func commandNames() []string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func main() {
-	policyArg := flag.String("policy", "serial-snapshot", "the policy to run [serial-snapshot, duckdb-parallel, duckdb-serial, cold-neondb, prewarm-neondb]")
-	logDirArg := flag.String("log-dir", "./logs", "the directory to write logs to")
-	csvDirArg := flag.String("csv-dir", "./results", "the directory to write csv output for analysis input")
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "error: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
 
-	flag.Parse()
+	policyArg := flag.String("policy", "serial-snapshot", "the policy to run [serial-snapshot, duckdb-parallel, duckdb-serial, cold-neondb, prewarm-neondb, postgres-template]")
+	runsDirArg := flag.String("runs-dir", "./runs", "the directory to create this run's directory (results, logs and manifest) in")
+	resultsDBArg := flag.String("results-db", "", "the DuckDB results database to also append this run to, queryable with `ntran query` (disabled when empty)")
+	seedArg := flag.Int64("seed", time.Now().UnixNano(), "the seed for winner selection, recorded in the manifest to reproduce a run")
+	formatArg := flag.String("format", policy.FormatCSV, "the format to write results in [csv, jsonl, parquet]")
+	repeatArg := flag.Int("repeat", 1, "the number of measured repetitions of each (inFlight, test case) configuration")
+	warmupArg := flag.Int("warmup", 0, "the number of unmeasured warmup repetitions to run before each configuration")
+	ciTargetArg := flag.Float64("ci-target", 0, "adaptive mode: keep repeating each configuration until the width of its 95% confidence interval is below this fraction of the mean (0 disables)")
+	maxRepeatArg := flag.Int("max-repeat", 30, "adaptive mode: the maximum number of measured repetitions of each configuration")
+	otlpEndpointArg := flag.String("otlp-endpoint", "", "the OTLP/HTTP endpoint to export traces to, e.g. http://localhost:4318 (disabled when empty)")
+	traceFileArg := flag.String("trace-file", "", "the file to write traces to as JSON, one span per line (disabled when empty)")
+	logFormatArg := flag.String("log-format", policy.LogFormatText, fmt.Sprintf("the format of the run's log file %v", policy.LogFormats))
+	logLevelArg := flag.String("log-level", "info", "the minimum level of the run's log file [debug, info, warn, error]")
+	modeArg := flag.String("mode", modeSingle, fmt.Sprintf("the experiment mode %v: a single step per test case, or a beam search over -depth steps keeping -beam-width branches", modes))
+	depthArg := flag.Int("depth", 3, "beam mode: the number of sequential steps searched")
+	beamWidthArg := flag.Int("beam-width", 2, "beam mode: the number of branches kept after every step")
+	metricsAddrArg := flag.String("metrics-addr", "", "the address to serve Prometheus/OpenMetrics metrics on at /metrics while the experiment runs, e.g. :9090 (disabled when empty)")
 
-	logFile, err := setupLog(*logDirArg)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: ntran [flags]\n       ntran <command> [flags] (commands: %s)\n\n", strings.Join(commandNames(), ", "))
+		flag.PrintDefaults()
+	}
+	flag.Parse()
 
+	dbClient, err := policy.CreateClient(*policyArg)
 	if err != nil {
-		fmt.Printf("error: %v", err)
-	} else {
-		fmt.Printf("will print logs to '%s'\n", *logDirArg)
+		fatal("error creating the database client", "error", err)
 	}
 
-	defer logFile.Close()
+	var beam *policy.BeamOptions
+	switch *modeArg {
+	case modeSingle:
+	case modeBeam:
+		if _, ok := dbClient.(policy.TreeForker); !ok {
+			fatal("the policy does not support beam mode", policy.LogPolicy, *policyArg)
+		}
+		if *depthArg < 1 || *beamWidthArg < 1 {
+			fatal("-depth and -beam-width must be at least 1", "depth", *depthArg, "beam_width", *beamWidthArg)
+		}
+		beam = &policy.BeamOptions{Depth: *depthArg, Width: *beamWidthArg}
+	default:
+		fatal("unknown mode", "mode", *modeArg, "modes", modes)
+	}
 
-	dbClient, err := policy.CreateClient(*policyArg)
+	scaffold_schema, err := os.ReadFile("../schemas/schema.sql")
 	if err != nil {
-		log.Fatalf("error creating the database client: %v", err)
+		fatal("error reading the schema", "error", err)
 	}
 
-	experiment := policy.Experiment{Policy: *policyArg}
-	err = experiment.Start(*csvDirArg)
-	defer experiment.End()
+	rollback_schema, err := os.ReadFile("../schemas/rollback.sql")
+	if err != nil {
+		fatal("error reading the rollback schema", "error", err)
+	}
+
+	policy.Seed(*seedArg)
+	manifest := newManifest(dbClient, *seedArg, string(scaffold_schema), string(rollback_schema))
 
+	experiment := policy.Experiment{Policy: *policyArg, Format: *formatArg, Manifest: manifest, ResultsDB: *resultsDBArg}
+	err = experiment.Start(*runsDirArg)
 	if err != nil {
-		log.Fatalf("error: %v", err)
+		fatal("error starting the experiment", "error", err)
 	}
+	defer experiment.End()
+	policy.AtExit(experiment.End)
 
-	scaffold_schema, err := os.ReadFile("../schemas/schema.sql")
+	logFile, err := setupLog(experiment.RunDir, *logFormatArg, *logLevelArg)
 	if err != nil {
-		log.Fatalf("error: %v", err)
+		fatal("error setting up the log", "error", err)
 	}
+	defer logFile.Close()
+	fmt.Printf("writing run '%s' to '%s'\n", experiment.RunID, experiment.RunDir)
 
-	rollback_schema, err := os.ReadFile("../schemas/rollback.sql")
+	if *metricsAddrArg != "" {
+		go func() {
+			if err := policy.ServeMetrics(*metricsAddrArg); err != nil {
+				slog.Error("error serving metrics", "error", err)
+			}
+		}()
+		fmt.Printf("serving metrics on '%s/metrics'\n", *metricsAddrArg)
+	}
+
+	shutdownTracing, err := policy.SetupTracing(context.Background(), *otlpEndpointArg, *traceFileArg)
 	if err != nil {
-		log.Fatalf("error: %v", err)
+		fatal("error setting up tracing", "error", err)
 	}
+	defer shutdownTracing(context.Background())
+	policy.AtExit(func() { shutdownTracing(context.Background()) })
+	ctx, span := policy.StartSpan(context.Background(), "experiment",
+		policy.AttrPolicy.String(*policyArg),
+		attribute.String("ntran.run_id", experiment.RunID),
+	)
+	defer span.End()
+
+	inFlights := dbClient.GetNumTransactionsInFlight()
+	progress := newProgress(os.Stdout, inFlights, len(policy.TestCaseTemplatesLite), *warmupArg+*repeatArg, func(inFlight int) int {
+		return plannedCandidates(inFlight, beam)
+	})
+	experiment.Observer = progress
+	var configs []analysis.Key
 
-	for _, inFlight := range dbClient.GetNumTransactionsInFlight() {
+	for _, inFlight := range inFlights {
 		testCases, err := generateSQL(inFlight)
 		if err != nil {
-			log.Fatalf("error generating the SQL: %v", err)
+			fatal("error generating the SQL", policy.LogInFlight, inFlight, "error", err)
 		}
 
 		for _, testCase := range testCases {
-			err = dbClient.Scaffold(string(scaffold_schema), inFlight)
-			if err != nil {
-				log.Fatalf("error scaffolding the database: %v", err)
+			configs = append(configs, analysis.Key{Policy: *policyArg, TestCase: testCase.Name, InFlight: inFlight})
+			experiment.Warmup = true
+			for i := 0; i < *warmupArg; i++ {
+				progress.TestCase(inFlight, testCase.Name, fmt.Sprintf("warmup %d/%d", i+1, *warmupArg))
+				runTestCase(ctx, dbClient, testCase, inFlight, string(scaffold_schema), string(rollback_schema), beam, &experiment)
+				progress.TestCaseFinished()
 			}
 
-			err = dbClient.Execute(testCase, &experiment)
-			if err != nil {
-				log.Fatalf("error executing: %v", err)
-			}
-
-			err = dbClient.Cleanup(string(rollback_schema))
-			if err != nil {
-				log.Fatalf("error cleaning up: %v", err)
+			experiment.Warmup = false
+			for rep := 0; ; rep++ {
+				if rep >= *repeatArg {
+					if *ciTargetArg <= 0 || rep >= *maxRepeatArg {
+						break
+					}
+					summary := experiment.Summary(testCase.Name, inFlight)
+					if summary.RelativeCIWidth() < *ciTargetArg {
+						break
+					}
+				}
+				experiment.Repetition = rep
+				progress.TestCase(inFlight, testCase.Name, fmt.Sprintf("repetition %d/%d", rep+1, max(*repeatArg, rep+1)))
+				runTestCase(ctx, dbClient, testCase, inFlight, string(scaffold_schema), string(rollback_schema), beam, &experiment)
+				progress.TestCaseFinished()
 			}
 		}
 
 	}
+	progress.Finish(&experiment, configs)
+}
+
+// newManifest - captures the provenance of a run before it starts
+func newManifest(dbClient policy.Policy, seed int64, scaffoldSchema string, rollbackSchema string) *policy.Manifest {
+	flags := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+
+	engineVersions := map[string]string{}
+	if versioner, ok := dbClient.(policy.EngineVersioner); ok {
+		engineVersions = versioner.EngineVersions()
+	}
+
+	return &policy.Manifest{
+		Flags:          flags,
+		Seed:           seed,
+		WorkloadHash:   policy.WorkloadHash(policy.TestCaseTemplatesLite),
+		SchemaHash:     policy.HashFiles(scaffoldSchema, rollbackSchema),
+		GitRevision:    policy.GitRevision(),
+		GoVersion:      policy.GoVersion(),
+		EngineVersions: engineVersions,
+		Host:           policy.Host(),
+	}
+}
+
+// runTestCase - scaffolds, executes and cleans up a single repetition of a
+// test case, executing it as a beam search when beam is set
+func runTestCase(ctx context.Context, dbClient policy.Policy, testCase policy.TestCase, inFlight int, scaffoldSchema string, rollbackSchema string, beam *policy.BeamOptions, experiment *policy.Experiment) {
+	ctx, span := policy.StartSpan(ctx, "test case",
+		policy.AttrPolicy.String(dbClient.GetName()),
+		policy.AttrTestCase.String(testCase.Name),
+		policy.AttrInFlight.Int(inFlight),
+		attribute.Int("ntran.repetition", experiment.Repetition),
+		attribute.Bool("ntran.warmup", experiment.Warmup),
+	)
+	defer span.End()
+
+	scaffoldCtx, scaffoldSpan := policy.StartSpan(ctx, "Scaffold")
+	err := dbClient.Scaffold(scaffoldCtx, scaffoldSchema, inFlight)
+	policy.EndSpan(scaffoldSpan, err)
+	if err != nil {
+		fatal("error scaffolding the database", policy.LogTestCase, testCase.Name, policy.LogInFlight, inFlight, "error", err)
+	}
+
+	executeCtx, executeSpan := policy.StartSpan(ctx, "Execute")
+	if beam != nil {
+		err = policy.BeamSearch(executeCtx, dbClient, testCase, *beam, experiment)
+	} else {
+		err = dbClient.Execute(executeCtx, testCase, experiment)
+	}
+	policy.EndSpan(executeSpan, err)
+	if err != nil {
+		fatal("error executing", policy.LogTestCase, testCase.Name, policy.LogInFlight, inFlight, "error", err)
+	}
+
+	cleanupCtx, cleanupSpan := policy.StartSpan(ctx, "Cleanup")
+	err = dbClient.Cleanup(cleanupCtx, rollbackSchema)
+	policy.EndSpan(cleanupSpan, err)
+	if err != nil {
+		fatal("error cleaning up", policy.LogTestCase, testCase.Name, policy.LogInFlight, inFlight, "error", err)
+	}
 }
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"ntran/analysis"
+	"ntran/policy"
+	"ntran/speculate"
+)
+
+// mcpProtocolVersions - the Model Context Protocol versions ntran speaks,
+// newest first
+var mcpProtocolVersions = []string{"2025-06-18", "2025-03-26", "2024-11-05"}
+
+// JSON-RPC error codes
+const (
+	rpcParseError     = -32700
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+)
+
+func mcpCommand(args []string) error {
+	fs := flag.NewFlagSet("mcp", flag.ExitOnError)
+	policyArg := fs.String("policy", "postgres-template", "the policy to fork with [serial-snapshot, duckdb-parallel, duckdb-serial, cold-neondb, prewarm-neondb, postgres-template]")
+	schemaArg := fs.String("schema", "", "a SQL file to execute on the main database at startup (none when empty)")
+	cleanupArg := fs.String("cleanup", "", "a SQL file to execute on the main database at shutdown (none when empty)")
+	branchesArg := fs.Int("branches", 8, "the most branches an agent may fork at once")
+	ttlArg := fs.Duration("ttl", 10*time.Minute, "how long branches may be idle before they are discarded (0 to never expire)")
+	historyArg := fs.Int("history", 0, "the most earlier committed states kept for the revert tool (0 to keep none, without the tool)")
+	logFormatArg := fs.String("log-format", policy.LogFormatText, fmt.Sprintf("the format of the log written to stderr %v", policy.LogFormats))
+	logLevelArg := fs.String("log-level", "info", "the minimum level of the log [debug, info, warn, error]")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: ntran mcp [flags]\n\n")
+		fmt.Fprintf(fs.Output(), "Serves the Model Context Protocol over stdin and stdout, offering agents tools\nto fork the database, run SQL on branches, compare them and commit one.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if err := setupStderrLog(*logFormatArg, *logLevelArg); err != nil {
+		return err
+	}
+	var err error
+	options := speculate.Options{Policy: *policyArg, Branches: *branchesArg, History: *historyArg}
+	if options.Schema, err = readSQLFile(*schemaArg); err != nil {
+		return err
+	}
+	if options.Cleanup, err = readSQLFile(*cleanupArg); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	engine, err := speculate.Open(ctx, options)
+	if err != nil {
+		return err
+	}
+	defer engine.Close(context.Background())
+
+	slog.Info("serving MCP on stdio", policy.LogPolicy, *policyArg)
+	return (&mcpServer{engine: engine, ttl: *ttlArg, history: *historyArg}).serve(ctx, os.Stdin, os.Stdout)
+}
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+// mcpTool - a tool as tools/list describes it
+type mcpTool struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	InputSchema map[string]any `json:"inputSchema"`
+}
+
+type mcpContent struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type mcpToolResult struct {
+	Content []mcpContent `json:"content"`
+	IsError bool         `json:"isError,omitempty"`
+}
+
+// mcpServer - the tools of one engine, called one at a time. The branches
+// fork_branches opens are a session, discarded once idle for ttl. The
+// revert tool is offered when history earlier states are kept
+type mcpServer struct {
+	engine  *speculate.Engine
+	ttl     time.Duration
+	history int
+	session *speculate.Session
+}
+
+var (
+	branchProperty = map[string]any{"type": "integer", "description": "the index of the branch, as fork_branches listed it"}
+	sqlProperty    = map[string]any{"type": "string", "description": "a single SQL statement"}
+	argsProperty   = map[string]any{"type": "array", "description": "values of the statement's placeholders ($1 for Postgres, ? for DuckDB)", "items": map[string]any{}}
+)
+
+func (s *mcpServer) tools() []mcpTool {
+	tools := []mcpTool{
+		{
+			Name: "fork_branches",
+			Description: fmt.Sprintf("Forks the database into n branches, each a copy of the committed state (policy %s). "+
+				"Statements on a branch do not affect the database or the other branches until the branch is committed. "+
+				"Only one set of branches is open at a time; commit or discard it before forking again. "+
+				"Branches stay open between calls, but are discarded once no SQL has run on them for %v.", s.engine.Policy(), s.ttl),
+			InputSchema: map[string]any{
+				"type":       "object",
+				"properties": map[string]any{"n": map[string]any{"type": "integer", "minimum": 1, "description": "the number of branches"}},
+				"required":   []string{"n"},
+			},
+		},
+		{
+			Name: "run_sql_on_branch",
+			Description: "Runs one SQL statement on one open branch. Set query to true for statements that return rows, " +
+				"which are returned as a table; other statements change the branch's state and are the ones a commit keeps.",
+			InputSchema: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"branch": branchProperty,
+					"sql":    sqlProperty,
+					"args":   argsProperty,
+					"query":  map[string]any{"type": "boolean", "description": "the statement returns rows"},
+				},
+				"required": []string{"branch", "sql"},
+			},
+		},
+		{
+			Name:        "compare_branches",
+			Description: "Runs the same read-only query on several open branches (all of them by default) and shows each branch's rows and which branches agree. The query is not recorded as one of the branches' statements and an error does not rule a branch out.",
+			InputSchema: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"sql":      sqlProperty,
+					"args":     argsProperty,
+					"branches": map[string]any{"type": "array", "items": branchProperty, "description": "the branches to compare, all when omitted"},
+				},
+				"required": []string{"sql"},
+			},
+		},
+		{
+			Name:        "commit_branch",
+			Description: "Makes one open branch's state the committed state of the database and closes every branch.",
+			InputSchema: map[string]any{
+				"type":       "object",
+				"properties": map[string]any{"branch": branchProperty},
+				"required":   []string{"branch"},
+			},
+		},
+		{
+			Name:        "discard_branches",
+			Description: "Closes every open branch without committing any, leaving the database as it was.",
+			InputSchema: map[string]any{"type": "object", "properties": map[string]any{}},
+		},
+	}
+	if s.history > 0 {
+		tools = append(tools, mcpTool{
+			Name: "revert",
+			Description: fmt.Sprintf("Undoes the most recent commits, restoring the committed state from before them. "+
+				"Up to %d earlier states are kept; no branches may be open.", s.history),
+			InputSchema: map[string]any{
+				"type":       "object",
+				"properties": map[string]any{"steps": map[string]any{"type": "integer", "minimum": 1, "description": "the number of commits to undo, 1 when omitted"}},
+			},
+		})
+	}
+	return tools
+}
+
+// serve - answers newline-delimited JSON-RPC requests from r on w until r
+// is closed or ctx is done
+func (s *mcpServer) serve(ctx context.Context, r io.Reader, w io.Writer) error {
+	lines := make(chan []byte)
+	scanErr := make(chan error, 1)
+	go func() {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			lines <- append([]byte(nil), scanner.Bytes()...)
+		}
+		scanErr <- scanner.Err()
+		close(lines)
+	}()
+
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case line, ok := <-lines:
+			if !ok {
+				return <-scanErr
+			}
+			if len(strings.TrimSpace(string(line))) == 0 {
+				continue
+			}
+			if response := s.handle(ctx, line); response != nil {
+				if err := encoder.Encode(response); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// handle - the response to one message, nil for notifications
+func (s *mcpServer) handle(ctx context.Context, line []byte) *rpcResponse {
+	var request rpcRequest
+	if err := json.Unmarshal(line, &request); err != nil {
+		return &rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{Code: rpcParseError, Message: err.Error()}}
+	}
+	if request.ID == nil {
+		return nil
+	}
+
+	response := &rpcResponse{JSONRPC: "2.0", ID: request.ID}
+	switch request.Method {
+	case "initialize":
+		var params struct {
+			ProtocolVersion string `json:"protocolVersion"`
+		}
+		json.Unmarshal(request.Params, &params)
+		version := mcpProtocolVersions[0]
+		if slices.Contains(mcpProtocolVersions, params.ProtocolVersion) {
+			version = params.ProtocolVersion
+		}
+		response.Result = map[string]any{
+			"protocolVersion": version,
+			"capabilities":    map[string]any{"tools": map[string]any{}},
+			"serverInfo":      map[string]any{"name": "ntran", "version": policy.GitRevision()},
+			"instructions": "Explore alternatives on forks of the database: fork_branches, try statements on each branch with " +
+				"run_sql_on_branch, compare_branches to see how they differ, then commit_branch the one to keep or discard_branches.",
+		}
+	case "ping":
+		response.Result = map[string]any{}
+	case "tools/list":
+		response.Result = map[string]any{"tools": s.tools()}
+	case "tools/call":
+		var params struct {
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		if err := json.Unmarshal(request.Params, &params); err != nil {
+			response.Error = &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+			break
+		}
+		result, err := s.call(ctx, params.Name, params.Arguments)
+		if errors.Is(err, errUnknownTool) {
+			response.Error = &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+			break
+		}
+		if err != nil {
+			// tool errors are results, so the agent can see and recover from them
+			slog.Warn("tool failed", "tool", params.Name, "error", err)
+			result = &mcpToolResult{Content: []mcpContent{{Type: "text", Text: policy.Redact(err.Error())}}, IsError: true}
+		}
+		response.Result = result
+	default:
+		response.Error = &rpcError{Code: rpcMethodNotFound, Message: fmt.Sprintf("method %s not found", request.Method)}
+	}
+	return response
+}
+
+var errUnknownTool = errors.New("unknown tool")
+
+type toolArguments struct {
+	N        int    `json:"n"`
+	Branch   *int   `json:"branch"`
+	SQL      string `json:"sql"`
+	Args     []any  `json:"args"`
+	Query    bool   `json:"query"`
+	Branches []int  `json:"branches"`
+	Steps    *int   `json:"steps"`
+}
+
+func (s *mcpServer) call(ctx context.Context, name string, raw json.RawMessage) (*mcpToolResult, error) {
+	var arguments toolArguments
+	if len(raw) > 0 {
+		decoder := json.NewDecoder(strings.NewReader(string(raw)))
+		decoder.UseNumber()
+		if err := decoder.Decode(&arguments); err != nil {
+			return nil, fmt.Errorf("invalid arguments: %v", err)
+		}
+		for i, arg := range arguments.Args {
+			arguments.Args[i] = jsonArg(arg)
+		}
+	}
+
+	var text strings.Builder
+	switch name {
+	case "fork_branches":
+		session, err := s.engine.OpenSession(ctx, arguments.N, s.ttl)
+		if err != nil {
+			return nil, err
+		}
+		s.session = session
+		fmt.Fprintf(&text, "Forked %d branches:\n", len(session.Branches()))
+		for _, branch := range session.Branches() {
+			fmt.Fprintf(&text, "- branch %d (%s)\n", branch.Index, branch.Name())
+		}
+		if s.ttl > 0 {
+			fmt.Fprintf(&text, "They are discarded if no SQL runs on them for %v.\n", s.ttl)
+		}
+	case "run_sql_on_branch":
+		session, branch, err := s.branch(arguments.Branch)
+		if err != nil {
+			return nil, err
+		}
+		if !arguments.Query {
+			if err := session.Exec(ctx, branch.Index, arguments.SQL, arguments.Args...); err != nil {
+				return nil, fmt.Errorf("branch %d: %v", branch.Index, err)
+			}
+			fmt.Fprintf(&text, "Executed on branch %d.\n", branch.Index)
+			break
+		}
+		rows, err := session.Query(ctx, branch.Index, arguments.SQL, arguments.Args...)
+		if err != nil {
+			return nil, fmt.Errorf("branch %d: %v", branch.Index, err)
+		}
+		writeRows(&text, rows)
+	case "compare_branches":
+		if err := s.compare(ctx, &text, arguments); err != nil {
+			return nil, err
+		}
+	case "commit_branch":
+		session, branch, err := s.branch(arguments.Branch)
+		if err != nil {
+			return nil, err
+		}
+		if err := session.Commit(ctx, branch.Index); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&text, "Committed branch %d; every branch is now closed.\n", branch.Index)
+	case "discard_branches":
+		session, err := s.openSession()
+		if err != nil {
+			return nil, err
+		}
+		if err := session.Discard(ctx); err != nil {
+			return nil, err
+		}
+		text.WriteString("Discarded every branch; the database is unchanged.\n")
+	case "revert":
+		if s.history == 0 {
+			return nil, fmt.Errorf("%w %s", errUnknownTool, name)
+		}
+		steps := 1
+		if arguments.Steps != nil {
+			steps = *arguments.Steps
+		}
+		if steps < 1 {
+			return nil, fmt.Errorf("steps must be at least 1, got %d", steps)
+		}
+		if err := s.engine.Revert(ctx, steps); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&text, "Reverted %d commits; %d earlier states remain to revert to.\n", steps, s.engine.History())
+	default:
+		return nil, fmt.Errorf("%w %s", errUnknownTool, name)
+	}
+	return &mcpToolResult{Content: []mcpContent{{Type: "text", Text: text.String()}}}, nil
+}
+
+// openSession - the session of the open branches
+func (s *mcpServer) openSession() (*speculate.Session, error) {
+	if s.session == nil {
+		return nil, errors.New("no branches are open, call fork_branches first")
+	}
+	switch s.session.State() {
+	case speculate.SessionOpen:
+		return s.session, nil
+	case speculate.SessionExpired:
+		return nil, fmt.Errorf("the branches were discarded after being idle for %v, call fork_branches again", s.ttl)
+	default:
+		return nil, errors.New("no branches are open, call fork_branches first")
+	}
+}
+
+// branch - the open branch at index, and its session
+func (s *mcpServer) branch(index *int) (*speculate.Session, *speculate.Branch, error) {
+	if index == nil {
+		return nil, nil, errors.New("branch is required")
+	}
+	session, err := s.openSession()
+	if err != nil {
+		return nil, nil, err
+	}
+	branches := session.Branches()
+	if *index < 0 || *index >= len(branches) {
+		return nil, nil, fmt.Errorf("branch %d does not exist, branches 0 to %d are open", *index, len(branches)-1)
+	}
+	return session, branches[*index], nil
+}
+
+// compare - runs the query on each branch, then groups the branches whose
+// rows are the same
+func (s *mcpServer) compare(ctx context.Context, text *strings.Builder, arguments toolArguments) error {
+	session, err := s.openSession()
+	if err != nil {
+		return err
+	}
+	branches := session.Branches()
+	if len(arguments.Branches) > 0 {
+		var selected []*speculate.Branch
+		for _, index := range arguments.Branches {
+			_, branch, err := s.branch(&index)
+			if err != nil {
+				return err
+			}
+			selected = append(selected, branch)
+		}
+		branches = selected
+	}
+
+	var groups [][]int
+	keys := make(map[string]int)
+	for _, branch := range branches {
+		fmt.Fprintf(text, "## Branch %d (%s)\n", branch.Index, branch.Name())
+		if err := branch.Err(); err != nil {
+			fmt.Fprintf(text, "Failed earlier: %v\n\n", err)
+			continue
+		}
+		rows, err := session.Peek(ctx, branch.Index, arguments.SQL, arguments.Args...)
+		if err != nil {
+			fmt.Fprintf(text, "Error: %v\n\n", err)
+			continue
+		}
+		writeRows(text, rows)
+		text.WriteString("\n")
+
+		key := fmt.Sprint(rows.Values)
+		group, ok := keys[key]
+		if !ok {
+			group = len(groups)
+			keys[key] = group
+			groups = append(groups, nil)
+		}
+		groups[group] = append(groups[group], branch.Index)
+	}
+
+	switch len(groups) {
+	case 0:
+		text.WriteString("No branch returned rows to compare.\n")
+	case 1:
+		text.WriteString("Every branch that succeeded returned the same rows.\n")
+	default:
+		fmt.Fprintf(text, "%d different results:\n", len(groups))
+		for i, group := range groups {
+			fmt.Fprintf(text, "- result %d: branches %s\n", i+1, strings.Trim(fmt.Sprint(group), "[]"))
+		}
+	}
+	return nil
+}
+
+// writeRows - rows as a markdown table
+func writeRows(text *strings.Builder, rows speculate.Rows) {
+	if len(rows.Values) == 0 {
+		text.WriteString("(no rows)\n")
+		return
+	}
+	table := &analysis.Table{Headers: rows.Columns}
+	for _, values := range rows.Values {
+		table.Append(values...)
+	}
+	table.Render(text, analysis.FormatMarkdown)
+}
@@ -0,0 +1,172 @@
+package policy
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// BeamOptions - the shape of a beam search
+type BeamOptions struct {
+	// Depth - the number of sequential steps searched
+	Depth int
+	// Width - the number of branches kept after every step
+	Width int
+}
+
+// beamNode - a branch of the search tree, and the path of candidates that
+// led to it from main
+type beamNode struct {
+	fork      Fork
+	statement Statement
+	index     int
+	score     float64
+	path      []int
+}
+
+/*
+ * BeamSearch - a multi-step tree search over a test case, modelling an
+ * agent that takes sequential steps with alternatives at each one. At every
+ * depth each surviving branch forks a child per statement of the test case,
+ * the children are scored, and the Width best are kept for the next depth.
+ * A branch's score is the sum of its path's scores, each drawn at random as
+ * the single-step policies choose their winner. Once every depth has run,
+ * the best path is promoted. A depth whose candidates all fail ends the
+ * search early with the branches of the depth before
+ */
+func BeamSearch(ctx context.Context, client Policy, testCase TestCase, options BeamOptions, experiment *Experiment) error {
+	forker, ok := client.(TreeForker)
+	if !ok {
+		return fmt.Errorf("policy %s does not support tree search", client.GetName())
+	}
+	if options.Depth < 1 || options.Width < 1 {
+		return fmt.Errorf("beam depth and width must be at least 1, got %d and %d", options.Depth, options.Width)
+	}
+
+	benchmark := Benchmark{
+		Experiment:       experiment,
+		Policy:           client.GetName(),
+		TestCase:         testCase.Name,
+		TransactionCount: len(testCase.Statements),
+	}
+	if sizer, ok := client.(ForkSizer); ok {
+		benchmark.Forks = sizer
+	}
+	benchmark.Start(ctx)
+
+	survivors := []beamNode{{}}
+	index := 0
+	for depth := 1; depth <= options.Depth; depth++ {
+		benchmark.StartDepth(depth)
+
+		benchmark.Phase(PhaseFork)
+		var children []beamNode
+		for _, parent := range survivors {
+			forks, err := forker.ForkFrom(ctx, parent.fork, len(testCase.Statements))
+			if err != nil {
+				return errors.Join(fmt.Errorf("error forking at depth %d: %v", depth, err), forker.Discard(ctx))
+			}
+			for i, fork := range forks {
+				path := append(slices.Clone(parent.path), index)
+				children = append(children, beamNode{fork: fork, statement: testCase.Statements[i], index: index, score: parent.score, path: path})
+				if parent.fork != nil {
+					benchmark.ForkedFrom(index, parent.index)
+				}
+				index++
+			}
+		}
+
+		benchmark.Phase(PhaseExecute)
+		results := make([]ExecutionResult, len(children))
+		var wg sync.WaitGroup
+		for i, child := range children {
+			wg.Add(1)
+			candidateCtx, span := benchmark.StartCandidate(child.index)
+			go func() {
+				defer wg.Done()
+				results[i] = executeFork(candidateCtx, child)
+				EndCandidate(span, results[i])
+			}()
+		}
+		wg.Wait()
+
+		var succeeded []beamNode
+		for i, result := range results {
+			benchmark.Candidate(result)
+			if result.Error == nil {
+				succeeded = append(succeeded, children[i])
+			}
+		}
+
+		benchmark.Phase(PhaseConsensus)
+		for i := range succeeded {
+			succeeded[i].score += rng.Float64()
+		}
+		slices.SortStableFunc(succeeded, func(a, b beamNode) int {
+			return cmp.Compare(b.score, a.score)
+		})
+		kept := succeeded[:min(options.Width, len(succeeded))]
+
+		benchmark.Phase(PhaseTeardown)
+		var released []Fork
+		for _, child := range children {
+			if !slices.ContainsFunc(kept, func(k beamNode) bool { return k.fork == child.fork }) {
+				released = append(released, child.fork)
+			}
+		}
+		if len(kept) > 0 {
+			for _, parent := range survivors {
+				if parent.fork != nil {
+					released = append(released, parent.fork)
+				}
+			}
+		}
+		if err := forker.Release(ctx, released...); err != nil {
+			return errors.Join(err, forker.Discard(ctx))
+		}
+		benchmark.EndDepth(len(children), len(kept))
+		if len(kept) == 0 {
+			if depth == 1 {
+				return errors.Join(errors.New("every candidate failed"), forker.Discard(ctx))
+			}
+			benchmark.Logger().Warn("every candidate failed, ending the search early", "depth", depth)
+			break
+		}
+		survivors = kept
+	}
+
+	benchmark.Phase(PhasePromote)
+	best := survivors[0]
+	benchmark.Logger().Debug("best path", "path", best.path, "score", best.score)
+	benchmark.Winner(best.path...)
+	if err := forker.PromoteFork(ctx, best.fork); err != nil {
+		return errors.Join(fmt.Errorf("error promoting the best path: %v", err), forker.Discard(ctx))
+	}
+
+	benchmark.End()
+	benchmark.Log()
+	return nil
+}
+
+// executeFork - executes a node's statement on its fork, the command and
+// then the query, whose first row is the candidate's values
+func executeFork(ctx context.Context, node beamNode) ExecutionResult {
+	start := time.Now()
+	result := ExecutionResult{Index: node.index, BranchName: node.fork.Name(), Statement: node.statement}
+	if node.statement.Command != "" {
+		result.Error = node.fork.Exec(ctx, node.statement.Command)
+	}
+	if result.Error == nil && node.statement.Query != "" {
+		rows, err := node.fork.Query(ctx, node.statement.Query)
+		result.Error = err
+		if err == nil && len(rows.Values) > 0 {
+			result.Values = rows.Values[0]
+		}
+	}
+	result.Duration = time.Since(start)
+	return result
+}
@@ -1,39 +1,352 @@
 package policy
 
 import (
-	"fmt"
-	"log"
+	"context"
+	"log/slog"
+	"slices"
 	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Phases of a speculative execution, in the order they occur
+const (
+	PhaseFork      = "fork"      // creating the branches/instances/savepoints candidates run on
+	PhaseExecute   = "execute"   // running every candidate statement
+	PhaseConsensus = "consensus" // choosing the winning candidate
+	PhasePromote   = "promote"   // making the winner's state the new main state
+	PhaseTeardown  = "teardown"  // discarding the losing forks
 )
 
+var Phases = []string{PhaseFork, PhaseExecute, PhaseConsensus, PhasePromote, PhaseTeardown}
+
 type Benchmark struct {
 	Experiment       *Experiment
 	Policy           string
 	TestCase         string
 	TransactionCount int
-	startTime        time.Time
-	endTime          time.Time
+	// Failures - the number of candidates that failed to execute
+	Failures int
+	// Forks - when set, the storage of the forks is measured at the end
+	// of the execute phase
+	Forks        ForkSizer
+	resources    Resources
+	snapshot     resourceSnapshot
+	untimed      time.Duration
+	ctx          context.Context
+	logger       *slog.Logger
+	phaseSpan    trace.Span
+	startTime    time.Time
+	endTime      time.Time
+	phases       map[string]time.Duration
+	currentPhase string
+	phaseStart   time.Time
+	candidates   []CandidateRecord
+	// depth, depths and the depth* fields - the search depths of a tree
+	// search, see StartDepth
+	depth         int
+	depths        []DepthRecord
+	depthStart    time.Time
+	depthPhases   map[string]time.Duration
+	depthFailures int
+	// parents - the parent candidates of candidates forked from forks
+	parents map[int]int
+}
+
+// DepthRecord - one depth of a tree search: how many forks it created,
+// how many of them survived to the next depth, and how long it took
+type DepthRecord struct {
+	Depth     int
+	Forks     int
+	Survivors int
+	Failures  int
+	Duration  time.Duration
+	Phases    map[string]time.Duration
+}
+
+// CandidateRecord - how one candidate transaction of a test case fared
+type CandidateRecord struct {
+	Index    int
+	Branch   string
+	Duration time.Duration
+	Error    string
+	Winner   bool
+	// Bytes - the extra storage of the candidate's fork, when the fork
+	// is the candidate's alone
+	Bytes int64
+	// Depth - the search depth the candidate ran at, 0 outside of tree
+	// search
+	Depth int
+	// Parent - the index of the candidate whose fork the candidate's fork
+	// was copied from, -1 when it was copied from the base state
+	Parent int
+	// SQL - the candidate's statement, its command if it has one
+	SQL string
+}
+
+// StartCandidate - counts a candidate that started executing and starts
+// its span, which the candidate ends with EndCandidate
+func (b *Benchmark) StartCandidate(index int) (context.Context, trace.Span) {
+	candidatesStarted.WithLabelValues(b.Policy).Inc()
+	return StartSpan(b.phaseContext(), "candidate", AttrCandidate.Int(index))
+}
+
+// EndCandidate - ends the span of a candidate with its outcome
+func EndCandidate(span trace.Span, result ExecutionResult) {
+	if result.BranchName != "" {
+		span.SetAttributes(AttrBranch.String(result.BranchName))
+	}
+	EndSpan(span, result.Error)
+}
+
+// Candidate - records the outcome of one candidate, counting it as a
+// failure if it errored
+func (b *Benchmark) Candidate(result ExecutionResult) {
+	candidate := CandidateRecord{Index: result.Index, Branch: result.BranchName, Duration: result.Duration, Depth: b.depth, Parent: -1, SQL: result.Statement.Command}
+	if candidate.SQL == "" {
+		candidate.SQL = result.Statement.Query
+	}
+	if parent, ok := b.parents[result.Index]; ok {
+		candidate.Parent = parent
+	}
+	candidatesFinished.WithLabelValues(b.Policy).Inc()
+	executionLatency.WithLabelValues(b.Policy).Observe(result.Duration.Seconds())
+	logger := b.Logger().With(candidateAttrs(result.Index, result.BranchName)...)
+	if result.Error != nil {
+		candidate.Error = result.Error.Error()
+		candidatesFailed.WithLabelValues(b.Policy).Inc()
+		b.Failures++
+		logger.Warn("candidate failed", "duration", result.Duration, "error", result.Error)
+	} else {
+		logger.Debug("candidate finished", "duration", result.Duration, "values", result.Values)
+	}
+	b.candidates = append(b.candidates, candidate)
+	if b.Experiment != nil && b.Experiment.Observer != nil {
+		b.Experiment.Observer.CandidateFinished(result)
+	}
+}
+
+// Logger - logs with the run, policy, test case and inFlight of the benchmark
+func (b *Benchmark) Logger() *slog.Logger {
+	if b.logger == nil {
+		var runID string
+		if b.Experiment != nil {
+			runID = b.Experiment.RunID
+		}
+		b.logger = slog.Default().With(LogRunID, runID, LogPolicy, b.Policy, LogTestCase, b.TestCase, LogInFlight, b.TransactionCount)
+	}
+	return b.logger
+}
+
+// Winner - marks the candidates at indexes as the ones that were
+// committed, one per depth of a tree search's best path
+func (b *Benchmark) Winner(indexes ...int) {
+	for i := range b.candidates {
+		b.candidates[i].Winner = slices.Contains(indexes, b.candidates[i].Index)
+		if b.candidates[i].Winner {
+			b.Logger().Info("winner selected", candidateAttrs(b.candidates[i].Index, b.candidates[i].Branch)...)
+		}
+	}
+	if len(indexes) > 0 {
+		trace.SpanFromContext(b.phaseContext()).SetAttributes(AttrWinner.Int(indexes[len(indexes)-1]))
+	}
 }
 
-func (b *Benchmark) Start() {
+// ForkedFrom - records that the fork of the candidate at index was copied
+// from the fork of the candidate at parent, rather than from the base state
+func (b *Benchmark) ForkedFrom(index int, parent int) {
+	if b.parents == nil {
+		b.parents = make(map[int]int)
+	}
+	b.parents[index] = parent
+}
+
+// StartDepth - starts timing a depth of a tree search; the candidates
+// recorded until EndDepth ran at depth
+func (b *Benchmark) StartDepth(depth int) {
+	b.depth = depth
+	b.depthStart = time.Now()
+	b.depthFailures = b.Failures
+	b.depthPhases = make(map[string]time.Duration, len(b.phases))
+	for name, d := range b.phases {
+		b.depthPhases[name] = d
+	}
+}
+
+// EndDepth - ends the current phase and records the depth started by
+// StartDepth, which created forks and kept survivors of them
+func (b *Benchmark) EndDepth(forks int, survivors int) {
+	now := time.Now()
+	b.endPhase(now)
+	phases := make(map[string]time.Duration)
+	for name, d := range b.phases {
+		if delta := d - b.depthPhases[name]; delta > 0 {
+			phases[name] = delta
+		}
+	}
+	record := DepthRecord{
+		Depth:     b.depth,
+		Forks:     forks,
+		Survivors: survivors,
+		Failures:  b.Failures - b.depthFailures,
+		Duration:  now.Sub(b.depthStart),
+		Phases:    phases,
+	}
+	b.depths = append(b.depths, record)
+	b.Logger().Debug("depth finished", "depth", record.Depth, "forks", forks, "survivors", survivors, "failures", record.Failures, "duration", record.Duration)
+}
+
+// Start - starts timing the test case; phase spans are children of ctx
+func (b *Benchmark) Start(ctx context.Context) {
+	b.ctx = ctx
+	b.Logger().Debug("test case started")
+	resetPeakRSS()
+	b.snapshot = takeResourceSnapshot()
 	b.startTime = time.Now()
 }
 
+// phaseContext - the context of the current phase's span
+func (b *Benchmark) phaseContext() context.Context {
+	if b.ctx == nil {
+		b.ctx = context.Background()
+	}
+	if b.phaseSpan == nil {
+		return b.ctx
+	}
+	return trace.ContextWithSpan(b.ctx, b.phaseSpan)
+}
+
+// Phase - ends the current phase (if any) and starts timing the named phase
+func (b *Benchmark) Phase(name string) {
+	now := time.Now()
+	ended := b.currentPhase
+	b.endPhase(now)
+	if ended == PhaseExecute && b.Forks != nil {
+		// forks are at their largest once every candidate has run
+		b.measureForks()
+		b.untimed += time.Since(now)
+		now = time.Now()
+	}
+	b.currentPhase = name
+	b.phaseStart = now
+	_, b.phaseSpan = StartSpan(b.phaseContext(), name)
+}
+
+// AddPhase - records a phase that was timed outside of the benchmark,
+// e.g. forks that a policy creates up front in Scaffold
+func (b *Benchmark) AddPhase(name string, duration time.Duration) {
+	if b.phases == nil {
+		b.phases = make(map[string]time.Duration)
+	}
+	b.phases[name] += duration
+	observePhase(b.Policy, name, duration)
+}
+
+func (b *Benchmark) endPhase(now time.Time) {
+	if b.currentPhase == "" {
+		return
+	}
+	b.AddPhase(b.currentPhase, now.Sub(b.phaseStart))
+	b.phaseSpan.End(trace.WithTimestamp(now))
+	b.phaseSpan = nil
+	b.currentPhase = ""
+}
+
+// measureForks - measures the storage of the base state and of every
+// fork, outside of any phase
+func (b *Benchmark) measureForks() {
+	base, sizes, err := b.Forks.ForkSizes(b.phaseContext())
+	if err != nil {
+		b.Logger().Error("error measuring fork storage", "error", err)
+		return
+	}
+	b.resources.BaseBytes = base
+	b.resources.ForkBytes = 0
+	for _, size := range sizes {
+		b.resources.ForkBytes += size
+	}
+
+	// forks shared by several candidates (savepoints) are not attributed
+	shared := make(map[string]int)
+	for _, c := range b.candidates {
+		shared[c.Branch]++
+	}
+	for i, c := range b.candidates {
+		if size, ok := sizes[c.Branch]; ok && shared[c.Branch] == 1 {
+			b.candidates[i].Bytes = size
+		}
+	}
+}
+
 func (b *Benchmark) End() {
 	b.endTime = time.Now()
+	b.endPhase(b.endTime)
+	forkBytes, baseBytes := b.resources.ForkBytes, b.resources.BaseBytes
+	b.resources = b.snapshot.since()
+	b.resources.ForkBytes, b.resources.BaseBytes = forkBytes, baseBytes
+}
+
+// Total - the sum of all phase durations, comparable across policies
+// regardless of where each one creates and tears down its forks
+func (b *Benchmark) Total() time.Duration {
+	var total time.Duration
+	for _, d := range b.phases {
+		total += d
+	}
+	return total
 }
 
 func (b *Benchmark) Log() {
-	duration := b.endTime.Sub(b.startTime)
-	logger := log.Default()
-	logger.Printf("Policy: %v | Test Case: %v | Transaction Count: %v | Duration: %v\n", b.Policy, b.TestCase, b.TransactionCount, duration)
+	duration := b.endTime.Sub(b.startTime) - b.untimed
+	b.Logger().Info("test case finished",
+		"duration", duration,
+		slog.Group("phases", phaseAttrs(b.phases)...),
+		"failures", b.Failures,
+		slog.Group("resources",
+			"cpu_time", b.resources.CPUTime,
+			"peak_rss_bytes", b.resources.PeakRSS,
+			"alloc_bytes", b.resources.AllocBytes,
+			"allocs", b.resources.Allocs,
+			"fork_bytes", b.resources.ForkBytes,
+			"base_bytes", b.resources.BaseBytes,
+		),
+	)
+	phases := make(map[string]time.Duration, len(b.phases))
+	for name, d := range b.phases {
+		phases[name] = d
+	}
 	err := b.Experiment.Log(Record{
 		Policy:           b.Policy,
 		TestCase:         b.TestCase,
-		TransactionCount: fmt.Sprintf("%d", b.TransactionCount),
-		Duration:         duration.String(),
+		TransactionCount: b.TransactionCount,
+		Duration:         duration,
+		Total:            b.Total(),
+		Phases:           phases,
+		Failures:         b.Failures,
+		Candidates:       b.candidates,
+		Resources:        b.resources,
+		Depths:           b.depths,
 	})
 	if err != nil {
-		logger.Fatalf("error writing experiment result: %v", err)
+		fatal("error writing experiment result", "error", err)
+	}
+	b.Experiment.sample(b.TestCase, b.TransactionCount, b.Total(), b.resources)
+}
+
+// candidateAttrs - the log attributes of a candidate, without a branch for
+// policies whose candidates run on the main state
+func candidateAttrs(index int, branch string) []any {
+	if branch == "" {
+		return []any{LogCandidate, index}
+	}
+	return []any{LogCandidate, index, LogBranch, branch}
+}
+
+// phaseAttrs - the duration of every phase, in order
+func phaseAttrs(phases map[string]time.Duration) []any {
+	attrs := make([]any, 0, len(Phases))
+	for _, phase := range Phases {
+		attrs = append(attrs, slog.Duration(phase, phases[phase]))
 	}
+	return attrs
 }
@@ -5,19 +5,27 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"math"
 	"os/exec"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/jackc/pgx/v5"
-	"golang.org/x/exp/rand"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ColdNeonDBClient struct {
 	mainConnStr string
+	// forks - the branches open for Fork
+	forks []*directFork
+	// created - every branch created for Fork or ForkFrom, in order, as
+	// released branches are only deleted once their children are
+	created []string
+	// mainHistory - the points in main's history before each promotion
+	mainHistory
 }
 
 type BranchInfo struct {
@@ -26,10 +34,14 @@ type BranchInfo struct {
 }
 
 type ExecutionResult struct {
+	// Index - the candidate's position in the test case
+	Index      int
 	BranchName string
 	Statement  Statement
 	Values     []any
 	Error      error
+	// Duration - how long the candidate took to execute
+	Duration time.Duration
 }
 
 func (c *ColdNeonDBClient) GetName() string {
@@ -40,90 +52,168 @@ func (c *ColdNeonDBClient) GetNumTransactionsInFlight() []int {
 	return []int{2, 4, 6, 8, 9}
 }
 
-func (c *ColdNeonDBClient) Scaffold(sql string, inFlight int) error {
-	c.mainConnStr = c.getConnectionString("main")
-	conn, err := pgx.Connect(context.Background(), c.mainConnStr)
+func (c *ColdNeonDBClient) EngineVersions() map[string]string {
+	versions := make(map[string]string)
+	if connStr, err := c.getConnectionString("main"); err != nil {
+		versions["postgres"] = fmt.Sprintf("unknown: %v", err)
+	} else {
+		versions["postgres"] = postgresVersion(connStr)
+	}
+	out, err := exec.Command("neon", "--version").Output()
+	if err != nil {
+		versions["neon-cli"] = fmt.Sprintf("unknown: %v", err)
+	} else {
+		versions["neon-cli"] = strings.TrimSpace(string(out))
+	}
+	return versions
+}
+
+func (c *ColdNeonDBClient) Scaffold(ctx context.Context, sql string, inFlight int) error {
+	var err error
+	if c.mainConnStr, err = c.getConnectionString("main"); err != nil {
+		return err
+	}
+	conn, err := pgx.Connect(ctx, c.mainConnStr)
 	if err != nil {
 		return err
 	}
-	defer conn.Close(context.Background())
+	defer conn.Close(ctx)
 
-	_, err = conn.Exec(context.Background(), sql)
+	_, err = conn.Exec(ctx, sql)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (c *ColdNeonDBClient) runNeonCmd(idempotentError string, args ...string) string {
-	exponents := []float64{1, 2, 3, 4, 5}
+// neonCommand - runs the neon CLI with args, returning its stdout and
+// stderr. Tests replace it with a fake project
+var neonCommand = func(args ...string) (string, string, error) {
+	var stdout, stderr strings.Builder
+	cmd := exec.Command("neon", args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	return stdout.String(), stderr.String(), err
+}
+
+// neonAttempts - how many times a neon command is run before its error is
+// returned, backing off exponentially in between (about 30s in all)
+const neonAttempts = 5
+
+/*
+ * runNeonCmd - runs the neon CLI, retrying failures with exponential
+ * backoff, and returns its stdout. A failure whose output contains
+ * idempotentError means an earlier attempt already succeeded. The last
+ * attempt's error is returned, so that a bad invocation fails the request
+ * or experiment rather than hanging it
+ */
+func (c *ColdNeonDBClient) runNeonCmd(idempotentError string, args ...string) (string, error) {
 	var err error
-	var stdout strings.Builder
-	var stderr strings.Builder
-	shouldBreak := false
-	for {
-		for _, exponent := range exponents {
-			cmd := exec.Command("neon", args...)
-			cmd.Stdout = &stdout
-			cmd.Stderr = &stderr
-			err = cmd.Run()
-			if err == nil || (idempotentError != "" && strings.Contains(err.Error(), idempotentError)) {
-				shouldBreak = true
-				break
-			} else {
-				log.Printf("error running command \"%v\" %v", args, err)
-				log.Print(stderr.String())
-				time.Sleep(time.Duration(math.Pow(2, exponent)) * time.Second)
-			}
+	for attempt := 1; ; attempt++ {
+		var stdout, stderr string
+		stdout, stderr, err = neonCommand(args...)
+		if err == nil || (idempotentError != "" && strings.Contains(err.Error()+stderr, idempotentError)) {
+			return stdout, nil
 		}
-		if shouldBreak {
-			break
+		err = fmt.Errorf("error running neon %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr))
+		if attempt == neonAttempts {
+			return "", err
 		}
+		backoff := time.Duration(math.Pow(2, float64(attempt))) * time.Second
+		slog.Warn("error running neon command, retrying", "args", args, "error", err, "backoff", backoff)
+		time.Sleep(backoff)
 	}
-
-	return stdout.String()
 }
 
-func (c *ColdNeonDBClient) deleteBranch(name string) {
-	c.runNeonCmd(fmt.Sprintf("branch %s not found", name), "branch", "delete", name)
+func (c *ColdNeonDBClient) deleteBranch(name string) error {
+	if _, err := c.runNeonCmd(fmt.Sprintf("branch %s not found", name), "branch", "delete", name); err != nil {
+		return err
+	}
+	openForks.WithLabelValues(forkBranch).Dec()
+	return nil
 }
 
-func (c *ColdNeonDBClient) getConnectionString(branchName string) string {
-	stdout := c.runNeonCmd("", "connection-string", branchName)
-	return strings.TrimSpace(stdout)
+func (c *ColdNeonDBClient) getConnectionString(branchName string) (string, error) {
+	stdout, err := c.runNeonCmd("", "connection-string", branchName)
+	return strings.TrimSpace(stdout), err
 }
 
-func (c *ColdNeonDBClient) createBranch(name string) string {
-	stdout := c.runNeonCmd("branch already exists", "branch", "create", "--name", name, "--output", "json")
+// createBranch - creates a branch of parent, or of the default branch when
+// parent is empty, returning its connection string
+func (c *ColdNeonDBClient) createBranch(name string, parent string) (string, error) {
+	args := []string{"branch", "create", "--name", name, "--output", "json"}
+	if parent != "" {
+		args = append(args, "--parent", parent)
+	}
+	stdout, err := c.runNeonCmd("branch already exists", args...)
+	if err != nil {
+		return "", err
+	}
 
 	var result map[string]interface{}
 	if err := json.Unmarshal([]byte(stdout), &result); err != nil {
-		log.Fatal(err)
+		return "", fmt.Errorf("error parsing created branch %s: %v", name, err)
 	}
 
 	if uris, ok := result["connection_uris"].([]interface{}); ok {
 		if len(uris) > 0 {
 			if uri, ok := uris[0].(map[string]interface{})["connection_uri"]; ok {
-				return uri.(string)
+				openForks.WithLabelValues(forkBranch).Inc()
+				return uri.(string), nil
 			}
 		}
 	}
 
-	log.Fatal("unable to completely create a branch; might have left dangling branches")
-	return ""
+	return "", fmt.Errorf("unable to completely create branch %s; might have left dangling branches", name)
 }
 
-func (c *ColdNeonDBClient) commit(statement Statement) error {
-	conn, err := pgx.Connect(context.Background(), c.mainConnStr)
+/*
+ * ForkSizes - the logical size of main and how much larger than it each
+ * other branch is, as reported by the Neon API. Branches are copy-on-write,
+ * so a branch only adds the data its candidate wrote; the API updates
+ * logical sizes lazily, so small writes may not show up yet
+ */
+func (c *ColdNeonDBClient) ForkSizes(ctx context.Context) (int64, map[string]int64, error) {
+	stdout, err := c.runNeonCmd("", "branch", "list", "--output", "json")
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var branches []struct {
+		Name        string `json:"name"`
+		LogicalSize int64  `json:"logical_size"`
+	}
+	if err := json.Unmarshal([]byte(stdout), &branches); err != nil {
+		return 0, nil, fmt.Errorf("error parsing branches: %v", err)
+	}
+
+	var base int64
+	for _, branch := range branches {
+		if branch.Name == "main" {
+			base = branch.LogicalSize
+		}
+	}
+	forks := make(map[string]int64)
+	for _, branch := range branches {
+		if branch.Name != "main" {
+			forks[branch.Name] = max(branch.LogicalSize-base, 0)
+		}
+	}
+	return base, forks, nil
+}
+
+func (c *ColdNeonDBClient) commit(ctx context.Context, statement Statement) error {
+	conn, err := pgx.Connect(ctx, c.mainConnStr)
 	if err != nil {
 		return err
 	}
-	defer conn.Close(context.Background())
+	defer conn.Close(ctx)
 
 	if statement.Command != "" {
-		_, err = conn.Exec(context.Background(), statement.Command)
+		_, err = conn.Exec(ctx, statement.Command)
 	} else {
-		_, err = conn.Query(context.Background(), statement.Query)
+		_, err = conn.Query(ctx, statement.Query)
 	}
 
 	if err != nil {
@@ -132,8 +222,16 @@ func (c *ColdNeonDBClient) commit(statement Statement) error {
 	return nil
 }
 
-func execute(statement Statement, branchInfoMap map[string]BranchInfo, wg *sync.WaitGroup, ch chan ExecutionResult) {
+func execute(ctx context.Context, index int, statement Statement, branchInfoMap map[string]BranchInfo, wg *sync.WaitGroup, ch chan ExecutionResult) {
 	defer wg.Done()
+	start := time.Now()
+	send := func(result ExecutionResult) {
+		result.Index = index
+		result.Statement = statement
+		result.Duration = time.Since(start)
+		EndCandidate(trace.SpanFromContext(ctx), result)
+		ch <- result
+	}
 
 	var rows pgx.Rows
 	var branchName string
@@ -148,51 +246,52 @@ func execute(statement Statement, branchInfoMap map[string]BranchInfo, wg *sync.
 
 	if branchInfo, ok := branchInfoMap[sql]; ok {
 		branchName = branchInfo.Name
-		conn, err := pgx.Connect(context.Background(), branchInfo.ConnStr)
+		conn, err := pgx.Connect(ctx, branchInfo.ConnStr)
 		if err != nil {
-			ch <- ExecutionResult{Error: err}
+			send(ExecutionResult{BranchName: branchName, Error: err})
 			return
 		}
-		defer conn.Close(context.Background())
+		defer conn.Close(ctx)
 
 		if statement.Command != "" {
-			_, err = conn.Exec(context.Background(), statement.Command)
+			_, err = conn.Exec(ctx, statement.Command)
 			if err != nil {
-				ch <- ExecutionResult{Error: err}
+				send(ExecutionResult{BranchName: branchName, Error: err})
 				return
 			}
 		} else {
-			rows, err = conn.Query(context.Background(), statement.Query)
+			rows, err = conn.Query(ctx, statement.Query)
 			if err != nil {
-				ch <- ExecutionResult{Error: err}
+				send(ExecutionResult{BranchName: branchName, Error: err})
 				return
 			}
 
 			if rows.Next() {
 				v, err := rows.Values()
 				if err != nil {
-					ch <- ExecutionResult{Error: err}
+					send(ExecutionResult{BranchName: branchName, Error: err})
 					return
 				}
 				values = v
 			}
 		}
-		ch <- ExecutionResult{BranchName: branchName, Statement: statement, Values: values}
+		send(ExecutionResult{BranchName: branchName, Values: values})
 	} else {
-		ch <- ExecutionResult{Error: errors.New("could not find sql statement in branchInfoMap")}
+		send(ExecutionResult{Error: errors.New("could not find sql statement in branchInfoMap")})
 	}
 }
 
-func (c *ColdNeonDBClient) Execute(testCase TestCase, experiment *Experiment) error {
-	rand.Seed(uint64(time.Now().UnixNano()))
+func (c *ColdNeonDBClient) Execute(ctx context.Context, testCase TestCase, experiment *Experiment) error {
 	benchmark := Benchmark{
 		Experiment:       experiment,
 		Policy:           c.GetName(),
 		TestCase:         testCase.Name,
 		TransactionCount: len(testCase.Statements),
+		Forks:            c,
 	}
-	benchmark.Start()
+	benchmark.Start(ctx)
 
+	benchmark.Phase(PhaseFork)
 	branchInfoMap := make(map[string]BranchInfo)
 
 	// assume all the sql statements are different across
@@ -208,17 +307,23 @@ func (c *ColdNeonDBClient) Execute(testCase TestCase, experiment *Experiment) er
 		}
 		if _, ok := branchInfoMap[sql]; !ok {
 			db := fmt.Sprintf("db_%v", i)
-			branchInfoMap[sql] = BranchInfo{Name: db, ConnStr: c.createBranch(db)}
+			connStr, err := c.createBranch(db, "")
+			if err != nil {
+				return err
+			}
+			branchInfoMap[sql] = BranchInfo{Name: db, ConnStr: connStr}
 		}
 	}
 
+	benchmark.Phase(PhaseExecute)
 	var results []ExecutionResult
 	ch := make(chan ExecutionResult)
 	var wg sync.WaitGroup
 
-	for _, statement := range testCase.Statements {
+	for i, statement := range testCase.Statements {
 		wg.Add(1)
-		go execute(statement, branchInfoMap, &wg, ch)
+		candidateCtx, _ := benchmark.StartCandidate(i)
+		go execute(candidateCtx, i, statement, branchInfoMap, &wg, ch)
 	}
 
 	go func() {
@@ -227,39 +332,252 @@ func (c *ColdNeonDBClient) Execute(testCase TestCase, experiment *Experiment) er
 	}()
 
 	for result := range ch {
+		benchmark.Candidate(result)
 		if result.Error == nil {
 			results = append(results, result)
-		} else {
-			log.Printf("error encountered while executing statement: %v", result.Error)
 		}
 	}
+	deleteBranches := func() {
+		for _, branchInfo := range branchInfoMap {
+			if err := c.deleteBranch(branchInfo.Name); err != nil {
+				benchmark.Logger().Error("error deleting branch", LogBranch, branchInfo.Name, "error", err)
+			}
+		}
+	}
+	if len(results) == 0 {
+		deleteBranches()
+		return fmt.Errorf("every candidate failed")
+	}
 
 	// dummy "consensus" step here -- take a random one.
 	// should _not_ close db that wins consensus.
 	// instead, make that the new mainConnStr (I think).
-	idx := rand.Intn(len(results))
-	err := c.commit(results[idx].Statement)
+	benchmark.Phase(PhaseConsensus)
+	idx := rng.Intn(len(results))
+	benchmark.Winner(results[idx].Index)
+
+	benchmark.Phase(PhasePromote)
+	err := c.commit(ctx, results[idx].Statement)
 	if err != nil {
-		log.Println(err)
+		benchmark.Logger().Error("error committing winner", LogCandidate, results[idx].Index, "error", err)
 	}
 
+	// Duration has always ended once the winner was promoted, so the
+	// branches are deleted after it and only reported as the teardown phase
 	benchmark.End()
+	_, span := StartSpan(benchmark.phaseContext(), PhaseTeardown)
+	teardownStart := time.Now()
+	deleteBranches()
+	benchmark.AddPhase(PhaseTeardown, time.Since(teardownStart))
+	span.End()
 	benchmark.Log()
+	return nil
+}
+
+// Fork - creates a branch of main per fork, as Execute does
+func (c *ColdNeonDBClient) Fork(ctx context.Context, n int) ([]Fork, error) {
+	if len(c.forks) > 0 {
+		return nil, ErrForksOpen
+	}
+	return c.ForkFrom(ctx, nil, n)
+}
+
+// ForkFrom - creates a branch of parent's branch, or of main, per fork
+func (c *ColdNeonDBClient) ForkFrom(ctx context.Context, parent Fork, n int) ([]Fork, error) {
+	parentName := ""
+	if parent != nil {
+		if forkIndex(c.forks, parent) < 0 {
+			return nil, fmt.Errorf("fork %s is not open", parent.Name())
+		}
+		parentName = parent.Name()
+	}
+	return c.forkBranches(ctx, "db", parentName, parentLog(parent), n)
+}
+
+// forkBranches - creates n branches of parent named after prefix, each
+// starting from log
+func (c *ColdNeonDBClient) forkBranches(ctx context.Context, prefix string, parent string, log []loggedStatement, n int) ([]Fork, error) {
+	forks := make([]Fork, 0, n)
+	for range n {
+		name := fmt.Sprintf("%s_%v", prefix, len(c.created))
+		connStr, err := c.createBranch(name, parent)
+		if err != nil {
+			c.Release(ctx, forks...)
+			return nil, err
+		}
+		c.created = append(c.created, name)
+		fork, err := connectFork(ctx, BranchInfo{Name: name, ConnStr: connStr})
+		if err != nil {
+			c.Release(ctx, forks...)
+			return nil, err
+		}
+		fork.log = slices.Clone(log)
+		c.forks = append(c.forks, fork)
+		forks = append(forks, fork)
+	}
+	return forks, nil
+}
+
+// Release - closes the connections to forks; Neon cannot delete a branch
+// that has children, so their branches are deleted by Discard
+func (c *ColdNeonDBClient) Release(ctx context.Context, forks ...Fork) error {
+	var errs []error
+	for _, fork := range forks {
+		if i := forkIndex(c.forks, fork); i >= 0 {
+			errs = append(errs, closeForks(c.forks[i:i+1]))
+			c.forks = slices.Delete(c.forks, i, i+1)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Promote - re-executes the winner's statements on main in a transaction,
+// as Execute commits the winning statement, then deletes the branches
+func (c *ColdNeonDBClient) Promote(ctx context.Context, winner int) error {
+	if err := checkWinner(winner, len(c.forks)); err != nil {
+		return err
+	}
+	return c.PromoteFork(ctx, c.forks[winner])
+}
+
+// PromoteFork - re-executes the statements of fork's whole path on main in
+// a transaction, then deletes the branches
+func (c *ColdNeonDBClient) PromoteFork(ctx context.Context, fork Fork) error {
+	i := forkIndex(c.forks, fork)
+	if i < 0 {
+		return fmt.Errorf("fork %s is not open", fork.Name())
+	}
+	state, err := c.branchState(ctx, "main", c.mainConnStr)
+	if err != nil {
+		return err
+	}
+	if err := promoteLog(ctx, c.mainConnStr, c.forks[i].log); err != nil {
+		return err
+	}
+	c.keep(state)
+	return c.Discard(ctx)
+}
+
+/*
+ * branchState - the current state of branch, as a source Neon can restore
+ * from: the branch at its current LSN. Empty when history is not kept.
+ * Neon keeps a branch's history for the project's retention period, so
+ * keeping a state creates nothing. connStr is looked up when empty
+ */
+func (c *ColdNeonDBClient) branchState(ctx context.Context, branch string, connStr string) (string, error) {
+	if !c.keeping() {
+		return "", nil
+	}
+	if connStr == "" {
+		var err error
+		if connStr, err = c.getConnectionString(branch); err != nil {
+			return "", err
+		}
+	}
+	conn, err := pgx.Connect(ctx, connStr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close(ctx)
+
+	var lsn string
+	if err := conn.QueryRow(ctx, "SELECT pg_current_wal_lsn()::text").Scan(&lsn); err != nil {
+		return "", fmt.Errorf("error reading the LSN of %s: %v", branch, err)
+	}
+	return fmt.Sprintf("%s@%s", branch, lsn), nil
+}
 
-	for _, branchInfo := range branchInfoMap {
-		c.deleteBranch(branchInfo.Name)
+// keep - keeps a state from branchState once its promotion succeeded.
+// States are LSNs, so those past the history's depth need no dropping
+func (c *ColdNeonDBClient) keep(state string) {
+	if state != "" {
+		c.push(state)
 	}
+}
+
+// preserved - branch's timeline was preserved under name, so the states
+// kept on it are now found there
+func (c *ColdNeonDBClient) preserved(branch string, name string) {
+	for i, state := range c.states {
+		source, lsn, ok := strings.Cut(state, "@")
+		if source != branch {
+			continue
+		}
+		c.states[i] = name
+		if ok {
+			c.states[i] += "@" + lsn
+		}
+	}
+}
+
+/*
+ * restoreBranch - restores branch to state, a branch at an LSN or at its
+ * head. Restoring replaces the branch's timeline, which the states kept on
+ * it still need, so it is preserved under another name. The restored
+ * branch descends from it, so it is left in the project
+ */
+func (c *ColdNeonDBClient) restoreBranch(branch string, state string) error {
+	source := state
+	if name, lsn, ok := strings.Cut(state, "@"); ok && name == branch {
+		source = "^self@" + lsn
+	}
+	name := c.next(branch + "_reverted_")
+	if _, err := c.runNeonCmd("", "branch", "restore", branch, source, "--preserve-under-name", name); err != nil {
+		return err
+	}
+	c.preserved(branch, name)
 	return nil
 }
 
-func (c *ColdNeonDBClient) Cleanup(sql string) error {
-	conn, err := pgx.Connect(context.Background(), c.mainConnStr)
+// Revert - restores main to its LSN n promotions ago
+func (c *ColdNeonDBClient) Revert(ctx context.Context, n int) error {
+	if len(c.forks) > 0 || len(c.created) > 0 {
+		return ErrForksOpen
+	}
+	state, _, err := c.revert(n)
+	if err != nil {
+		return err
+	}
+	return c.restoreBranch("main", state)
+}
+
+// promoteLog - re-executes statements on the branch at connStr in a
+// transaction
+func promoteLog(ctx context.Context, connStr string, log []loggedStatement) error {
+	conn, err := pgx.Connect(ctx, connStr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+
+	return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		return replay(ctx, pgxQuerier{tx}, log)
+	})
+}
+
+// Discard - deletes every fork's branch, children before their parents
+func (c *ColdNeonDBClient) Discard(ctx context.Context) error {
+	errs := []error{closeForks(c.forks)}
+	for _, name := range slices.Backward(c.created) {
+		errs = append(errs, c.deleteBranch(name))
+	}
+	c.forks = nil
+	c.created = nil
+	return errors.Join(errs...)
+}
+
+func (c *ColdNeonDBClient) Cleanup(ctx context.Context, sql string) error {
+	if err := c.Discard(ctx); err != nil {
+		return err
+	}
+	c.clear()
+	conn, err := pgx.Connect(ctx, c.mainConnStr)
 	if err != nil {
 		return err
 	}
-	defer conn.Close(context.Background())
+	defer conn.Close(ctx)
 
-	_, err = conn.Exec(context.Background(), sql)
+	_, err = conn.Exec(ctx, sql)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,284 @@
+package policy
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+// duckDBConn - the interfaces a DuckDB connection implements, which
+// duckDBMainConn forwards
+type duckDBConn interface {
+	driver.Conn
+	driver.ConnBeginTx
+	driver.ExecerContext
+	driver.QueryerContext
+	driver.NamedValueChecker
+}
+
+/*
+ * duckDBMain - a connector to a DuckDB main database whose file can be
+ * replaced, as reverting to a snapshot does. DuckDB holds its file open
+ * until every connection is closed, so replacing it closes the connections
+ * first; they then report themselves bad, and database/sql opens new ones
+ * on the replaced file
+ */
+type duckDBMain struct {
+	path string
+
+	mu        sync.Mutex
+	connector *duckdb.Connector
+	conns     map[*duckDBMainConn]struct{}
+}
+
+func newDuckDBMain(path string) (*duckDBMain, error) {
+	connector, err := duckdb.NewConnector(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &duckDBMain{path: path, connector: connector, conns: make(map[*duckDBMainConn]struct{})}, nil
+}
+
+func (m *duckDBMain) Connect(ctx context.Context) (driver.Conn, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.connector == nil {
+		return nil, errors.New("the main database is closed")
+	}
+	underlying, err := m.connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, ok := underlying.(duckDBConn)
+	if !ok {
+		underlying.Close()
+		return nil, errors.New("unexpected DuckDB connection type")
+	}
+	c := &duckDBMainConn{conn: conn, main: m}
+	m.conns[c] = struct{}{}
+	return c, nil
+}
+
+func (m *duckDBMain) Driver() driver.Driver {
+	return duckdb.Driver{}
+}
+
+// Close - closes every connection and the database
+func (m *duckDBMain) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closeConns()
+	if m.connector == nil {
+		return nil
+	}
+	err := m.connector.Close()
+	m.connector = nil
+	return err
+}
+
+// closeConns - the caller holds mu
+func (m *duckDBMain) closeConns() {
+	for c := range m.conns {
+		c.mu.Lock()
+		if !c.bad {
+			c.conn.Close()
+			c.bad = true
+		}
+		c.mu.Unlock()
+	}
+	clear(m.conns)
+}
+
+// snapshot - checkpoints db, a database over m, so that its file holds the
+// whole state, and copies the file to path. DuckDB may write its file while
+// it is open, so the database is closed while it is copied and reopened
+// after, as restoring it does
+func (m *duckDBMain) snapshot(ctx context.Context, db *sql.DB, path string) error {
+	if _, err := db.ExecContext(ctx, "CHECKPOINT"); err != nil {
+		return fmt.Errorf("error checkpointing the main database: %v", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closeConns()
+	if m.connector != nil {
+		m.connector.Close()
+		m.connector = nil
+	}
+
+	copyErr := copyFile(m.path, path)
+	if copyErr != nil {
+		os.Remove(path)
+	}
+	connector, err := duckdb.NewConnector(m.path, nil)
+	if err != nil {
+		return fmt.Errorf("failed to reopen the main database: %v", err)
+	}
+	m.connector = connector
+	if copyErr != nil {
+		return fmt.Errorf("error snapshotting the main database: %v", copyErr)
+	}
+	return nil
+}
+
+// restore - replaces the main database's file with the snapshot at path,
+// which is removed. Statements running on the main database finish first
+func (m *duckDBMain) restore(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closeConns()
+	if m.connector != nil {
+		m.connector.Close()
+		m.connector = nil
+	}
+
+	os.Remove(m.path + ".wal")
+	if err := os.Rename(path, m.path); err != nil {
+		return fmt.Errorf("error restoring the main database: %v", err)
+	}
+	connector, err := duckdb.NewConnector(m.path, nil)
+	if err != nil {
+		return fmt.Errorf("failed to reopen the main database: %v", err)
+	}
+	m.connector = connector
+	return nil
+}
+
+// duckDBMainConn - a connection to a duckDBMain, bad once its database has
+// been restored
+type duckDBMainConn struct {
+	main *duckDBMain
+
+	mu   sync.Mutex
+	conn duckDBConn
+	bad  bool
+}
+
+// use - the connection for one call, holding it until done is called so
+// that restoring waits for the call
+func (c *duckDBMainConn) use() (duckDBConn, func(), error) {
+	c.mu.Lock()
+	if c.bad {
+		c.mu.Unlock()
+		return nil, nil, driver.ErrBadConn
+	}
+	return c.conn, c.mu.Unlock, nil
+}
+
+func (c *duckDBMainConn) Prepare(query string) (driver.Stmt, error) {
+	conn, done, err := c.use()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return conn.Prepare(query)
+}
+
+func (c *duckDBMainConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *duckDBMainConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	conn, done, err := c.use()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return conn.BeginTx(ctx, opts)
+}
+
+func (c *duckDBMainConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	conn, done, err := c.use()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return conn.ExecContext(ctx, query, args)
+}
+
+func (c *duckDBMainConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	conn, done, err := c.use()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return conn.QueryContext(ctx, query, args)
+}
+
+func (c *duckDBMainConn) CheckNamedValue(value *driver.NamedValue) error {
+	return c.conn.CheckNamedValue(value)
+}
+
+func (c *duckDBMainConn) ResetSession(ctx context.Context) error {
+	if !c.IsValid() {
+		return driver.ErrBadConn
+	}
+	return nil
+}
+
+func (c *duckDBMainConn) IsValid() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.bad
+}
+
+func (c *duckDBMainConn) Close() error {
+	c.main.mu.Lock()
+	delete(c.main.conns, c)
+	c.main.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.bad {
+		return nil
+	}
+	c.bad = true
+	return c.conn.Close()
+}
+
+// promoteKeeping - runs promote on db, a database over m, first
+// snapshotting m into history when it keeps states. The snapshot is kept
+// once promote succeeds, dropping the oldest beyond the history's depth
+func (m *duckDBMain) promoteKeeping(ctx context.Context, db *sql.DB, history *mainHistory, promote func() error) error {
+	if !history.keeping() {
+		return promote()
+	}
+	path := fmt.Sprintf("%s.%s", m.path, history.next("history_"))
+	if err := m.snapshot(ctx, db, path); err != nil {
+		return err
+	}
+	if err := promote(); err != nil {
+		os.Remove(path)
+		return err
+	}
+	for _, evicted := range history.push(path) {
+		os.Remove(evicted)
+	}
+	return nil
+}
+
+// revert - restores m from the snapshot n promotions ago in history,
+// removing the snapshots taken since
+func (m *duckDBMain) revert(history *mainHistory, n int) error {
+	path, newer, err := history.revert(n)
+	if err != nil {
+		return err
+	}
+	for _, snapshot := range newer {
+		os.Remove(snapshot)
+	}
+	return m.restore(path)
+}
+
+// dropHistory - removes every snapshot in history
+func dropHistory(history *mainHistory) {
+	for _, snapshot := range history.clear() {
+		os.Remove(snapshot)
+	}
+}
@@ -1,16 +1,18 @@
 package policy
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"slices"
 	"sync"
-
-	// "time"
-
-	_ "github.com/marcboeker/go-duckdb"
+	"time"
 )
 
 /*
@@ -24,9 +26,21 @@ import (
 
 type DuckDBParallelClient struct {
 	mainDB        *sql.DB
+	mainConnector *duckDBMain
 	mainDBPath    string
 	instances     []*sql.DB
 	instancePaths []string
+	forkDuration  time.Duration
+	// forks - the instances open for Fork, copied from the main database
+	// or, for ForkFrom, from another fork
+	forks []*directFork
+	// forkPaths - the files of forks, apart from the instances scaffolded
+	// for Execute
+	forkPaths []string
+	// forkSeq - numbers fork files uniquely until the client is cleaned up
+	forkSeq int
+	// mainHistory - snapshots of the main database that promotions replaced
+	mainHistory
 }
 
 func (c *DuckDBParallelClient) GetName() string {
@@ -37,7 +51,11 @@ func (c *DuckDBParallelClient) GetNumTransactionsInFlight() []int {
 	return []int{10, 25, 50, 100, 200, 500}
 }
 
-func (c *DuckDBParallelClient) Scaffold(schema string, inFlight int) error {
+func (c *DuckDBParallelClient) EngineVersions() map[string]string {
+	return map[string]string{"duckdb": duckDBVersion()}
+}
+
+func (c *DuckDBParallelClient) Scaffold(ctx context.Context, schema string, inFlight int) error {
 	// temp dir for test run
 	tmpDir := filepath.Join(os.TempDir(), fmt.Sprintf("duckdb_test_%d", rand.Intn(10000)))
 	err := os.MkdirAll(tmpDir, 0755)
@@ -47,22 +65,27 @@ func (c *DuckDBParallelClient) Scaffold(schema string, inFlight int) error {
 
 	// initialize main db
 	c.mainDBPath = filepath.Join(tmpDir, "main.db")
-	mainDB, err := sql.Open("duckdb", c.mainDBPath)
+	connector, err := newDuckDBMain(c.mainDBPath)
 	if err != nil {
 		return fmt.Errorf("failed to open main database: %v", err)
 	}
+	mainDB := sql.OpenDB(connector)
+	c.mainConnector = connector
 	c.mainDB = mainDB
 
-	// exec schema on main db
-	_, err = mainDB.Exec(schema)
-	if err != nil {
-		return fmt.Errorf("error executing schema on main database: %v", err)
+	// exec schema on main db, which may be empty when forking an existing state
+	if schema != "" {
+		_, err = mainDB.Exec(schema)
+		if err != nil {
+			return fmt.Errorf("error executing schema on main database: %v", err)
+		}
 	}
 
 	// instances for parallel execution
 	c.instances = make([]*sql.DB, inFlight)
 	c.instancePaths = make([]string, inFlight)
 
+	forkStart := time.Now()
 	for i := 0; i < inFlight; i++ {
 		// new db per instance
 		instancePath := filepath.Join(tmpDir, fmt.Sprintf("instance_%d.db", i))
@@ -74,32 +97,38 @@ func (c *DuckDBParallelClient) Scaffold(schema string, inFlight int) error {
 		}
 
 		// apply schema
-		_, err = instance.Exec(schema)
-		if err != nil {
-			return fmt.Errorf("error executing schema on instance %d: %v", i, err)
+		if schema != "" {
+			_, err = instance.Exec(schema)
+			if err != nil {
+				return fmt.Errorf("error executing schema on instance %d: %v", i, err)
+			}
 		}
 
 		c.instances[i] = instance
+		openForks.WithLabelValues(forkInstance).Inc()
 	}
+	c.forkDuration = time.Since(forkStart)
 
 	return nil
 }
 
-func (c *DuckDBParallelClient) Execute(testCase TestCase, experiment *Experiment) error {
+func (c *DuckDBParallelClient) Execute(ctx context.Context, testCase TestCase, experiment *Experiment) error {
 	if len(c.instances) == 0 {
 		return fmt.Errorf("no database instances available")
 	}
 
-	// rand.Seed(time.Now().UnixNano())
-
 	benchmark := Benchmark{
 		Experiment:       experiment,
 		Policy:           c.GetName(),
 		TestCase:         testCase.Name,
 		TransactionCount: len(testCase.Statements),
+		Forks:            c,
 	}
-	benchmark.Start()
+	benchmark.Start(ctx)
+	// instances are forked up front in Scaffold
+	benchmark.AddPhase(PhaseFork, c.forkDuration)
 
+	benchmark.Phase(PhaseExecute)
 	results := make(chan ExecutionResult, len(testCase.Statements))
 	var wg sync.WaitGroup
 
@@ -110,10 +139,19 @@ func (c *DuckDBParallelClient) Execute(testCase TestCase, experiment *Experiment
 
 			db := c.instances[idx]
 			stmt := testCase.Statements[idx]
+			_, span := benchmark.StartCandidate(idx)
+			start := time.Now()
+			send := func(result ExecutionResult) {
+				result.Index = idx
+				result.BranchName = filepath.Base(c.instancePaths[idx])
+				result.Duration = time.Since(start)
+				EndCandidate(span, result)
+				results <- result
+			}
 
 			tx, err := db.Begin()
 			if err != nil {
-				results <- ExecutionResult{Statement: stmt, Error: err}
+				send(ExecutionResult{Statement: stmt, Error: err})
 				return
 			}
 			defer tx.Rollback()
@@ -122,14 +160,14 @@ func (c *DuckDBParallelClient) Execute(testCase TestCase, experiment *Experiment
 			if stmt.Command != "" {
 				_, err = tx.Exec(stmt.Command)
 				if err != nil {
-					results <- ExecutionResult{Statement: stmt, Error: err}
+					send(ExecutionResult{Statement: stmt, Error: err})
 					return
 				}
 			}
 			if stmt.Query != "" {
 				rows, err := tx.Query(stmt.Query)
 				if err != nil {
-					results <- ExecutionResult{Statement: stmt, Error: err}
+					send(ExecutionResult{Statement: stmt, Error: err})
 					return
 				}
 				defer rows.Close()
@@ -138,7 +176,7 @@ func (c *DuckDBParallelClient) Execute(testCase TestCase, experiment *Experiment
 					values = make([]any, 0)
 					cols, err := rows.Columns()
 					if err != nil {
-						results <- ExecutionResult{Statement: stmt, Error: err}
+						send(ExecutionResult{Statement: stmt, Error: err})
 						return
 					}
 					scanVals := make([]any, len(cols))
@@ -146,7 +184,7 @@ func (c *DuckDBParallelClient) Execute(testCase TestCase, experiment *Experiment
 						scanVals[i] = new(any)
 					}
 					if err := rows.Scan(scanVals...); err != nil {
-						results <- ExecutionResult{Statement: stmt, Error: err}
+						send(ExecutionResult{Statement: stmt, Error: err})
 						return
 					}
 					for _, v := range scanVals {
@@ -156,11 +194,11 @@ func (c *DuckDBParallelClient) Execute(testCase TestCase, experiment *Experiment
 			}
 
 			if err := tx.Commit(); err != nil {
-				results <- ExecutionResult{Statement: stmt, Error: err}
+				send(ExecutionResult{Statement: stmt, Error: err})
 				return
 			}
 
-			results <- ExecutionResult{Statement: stmt, Values: values}
+			send(ExecutionResult{Statement: stmt, Values: values})
 		}(i)
 	}
 
@@ -169,6 +207,7 @@ func (c *DuckDBParallelClient) Execute(testCase TestCase, experiment *Experiment
 
 	var validResults []ExecutionResult
 	for result := range results {
+		benchmark.Candidate(result)
 		if result.Error != nil {
 			return fmt.Errorf("execution error: %v", result.Error)
 		}
@@ -176,9 +215,12 @@ func (c *DuckDBParallelClient) Execute(testCase TestCase, experiment *Experiment
 	}
 
 	// select winner randomly (stop using checksum / majority consensus)
-	winnerIdx := rand.Intn(len(validResults))
+	benchmark.Phase(PhaseConsensus)
+	winnerIdx := rng.Intn(len(validResults))
+	benchmark.Winner(validResults[winnerIdx].Index)
 
 	// apply winning txn to main DB
+	benchmark.Phase(PhasePromote)
 	winnerStmt := validResults[winnerIdx].Statement
 	if winnerStmt.Command != "" {
 		_, err := c.mainDB.Exec(winnerStmt.Command)
@@ -187,21 +229,266 @@ func (c *DuckDBParallelClient) Execute(testCase TestCase, experiment *Experiment
 		}
 	}
 
+	// instances are single use, the main DB now holds the winning state
+	benchmark.Phase(PhaseTeardown)
+	c.closeInstances()
+
 	benchmark.End()
 	benchmark.Log()
 
 	return nil
 }
 
-func (c *DuckDBParallelClient) Cleanup(cleanupSQL string) error {
+// ForkSizes - instances and forks are full copies, so each adds its whole
+// file
+func (c *DuckDBParallelClient) ForkSizes(ctx context.Context) (int64, map[string]int64, error) {
+	paths := make(map[string]string, len(c.instancePaths)+len(c.forkPaths))
+	if len(c.instances) > 0 {
+		for _, path := range c.instancePaths {
+			paths[filepath.Base(path)] = path
+		}
+	}
+	for _, path := range c.forkPaths {
+		paths[filepath.Base(path)] = path
+	}
+	base := fileSizes(map[string]string{"main": c.mainDBPath})["main"]
+	return base, fileSizes(paths), nil
+}
+
+// MainConnector - connects to the main database, whose instance the forks
+// are copied from and the winner is promoted to
+func (c *DuckDBParallelClient) MainConnector() (driver.Connector, error) {
+	if c.mainConnector == nil {
+		return nil, fmt.Errorf("the main database has not been scaffolded")
+	}
+	return c.mainConnector, nil
+}
+
+// Fork - copies the main database into a new instance per fork
+func (c *DuckDBParallelClient) Fork(ctx context.Context, n int) ([]Fork, error) {
+	if len(c.forks) > 0 {
+		return nil, ErrForksOpen
+	}
+	return c.ForkFrom(ctx, nil, n)
+}
+
+// ForkFrom - copies parent's instance, or the main database, into a new
+// instance per fork
+func (c *DuckDBParallelClient) ForkFrom(ctx context.Context, parent Fork, n int) ([]Fork, error) {
+	if c.mainDB == nil {
+		return nil, fmt.Errorf("the main database has not been scaffolded")
+	}
+	// instances scaffolded for Execute hold the schema, not the main state
+	c.closeInstances()
+
+	var fork *directFork
+	var source string
+	if parent != nil {
+		i := forkIndex(c.forks, parent)
+		if i < 0 {
+			return nil, fmt.Errorf("fork %s is not open", parent.Name())
+		}
+		fork, source = c.forks[i], c.forkPaths[i]
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+
+	paths := make([]string, n)
+	for i := range paths {
+		paths[i] = filepath.Join(filepath.Dir(c.mainDBPath), fmt.Sprintf("fork_%d.db", c.forkSeq))
+		c.forkSeq++
+		os.Remove(paths[i] + ".wal")
+	}
+	removeAll := func() {
+		for _, path := range paths {
+			os.Remove(path)
+		}
+	}
+
+	// the source is copied closed, once, and the other forks from the
+	// first copy, so that DuckDB is not writing what is copied
+	var err error
+	if fork == nil {
+		err = c.mainConnector.snapshot(ctx, c.mainDB, paths[0])
+	} else {
+		err = copyForkFile(ctx, fork, source, paths[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths[1:] {
+		if err := copyFile(paths[0], path); err != nil {
+			removeAll()
+			return nil, fmt.Errorf("error forking %s: %v", filepath.Base(path), err)
+		}
+	}
+
+	log := parentLog(parent)
+	forks := make([]Fork, 0, n)
+	for i, path := range paths {
+		instance, err := sql.Open("duckdb", path)
+		if err != nil {
+			c.Release(ctx, forks...)
+			for _, path := range paths[i:] {
+				os.Remove(path)
+			}
+			return nil, fmt.Errorf("failed to open instance database %s: %v", filepath.Base(path), err)
+		}
+		openForks.WithLabelValues(forkInstance).Inc()
+		fork := &directFork{name: filepath.Base(path), db: sqlQuerier{instance}, log: slices.Clone(log), close: instance.Close}
+		c.forks = append(c.forks, fork)
+		c.forkPaths = append(c.forkPaths, path)
+		forks = append(forks, fork)
+	}
+	return forks, nil
+}
+
+// copyForkFile - checkpoints fork so that its file at source holds its
+// whole state, then copies the file to path with fork's instance closed,
+// reopening it after. Statements on fork wait until it is reopened
+func copyForkFile(ctx context.Context, fork *directFork, source string, path string) error {
+	fork.mu.Lock()
+	defer fork.mu.Unlock()
+	if _, err := fork.db.exec(ctx, "CHECKPOINT"); err != nil {
+		return fmt.Errorf("error checkpointing %s: %v", fork.name, err)
+	}
+	if err := fork.close(); err != nil {
+		return fmt.Errorf("error closing %s: %v", fork.name, err)
+	}
+
+	copyErr := copyFile(source, path)
+	if copyErr != nil {
+		os.Remove(path)
+	}
+	instance, err := sql.Open("duckdb", source)
+	if err != nil {
+		return fmt.Errorf("failed to reopen instance database %s: %v", fork.name, err)
+	}
+	fork.db, fork.close = sqlQuerier{instance}, instance.Close
+	if copyErr != nil {
+		return fmt.Errorf("error forking %s: %v", filepath.Base(path), copyErr)
+	}
+	return nil
+}
+
+// Release - closes and deletes the instances of forks
+func (c *DuckDBParallelClient) Release(ctx context.Context, forks ...Fork) error {
+	var errs []error
+	for _, fork := range forks {
+		i := forkIndex(c.forks, fork)
+		if i < 0 {
+			continue
+		}
+		errs = append(errs, closeForks(c.forks[i:i+1]))
+		openForks.WithLabelValues(forkInstance).Dec()
+		os.Remove(c.forkPaths[i])
+		os.Remove(c.forkPaths[i] + ".wal")
+		c.forks = slices.Delete(c.forks, i, i+1)
+		c.forkPaths = slices.Delete(c.forkPaths, i, i+1)
+	}
+	return errors.Join(errs...)
+}
+
+// Promote - re-executes the winner's statements on the main database, as
+// Execute does with the winning command
+func (c *DuckDBParallelClient) Promote(ctx context.Context, winner int) error {
+	if err := checkWinner(winner, len(c.forks)); err != nil {
+		return err
+	}
+	return c.PromoteFork(ctx, c.forks[winner])
+}
+
+// PromoteFork - re-executes the statements of fork's whole path on the
+// main database
+func (c *DuckDBParallelClient) PromoteFork(ctx context.Context, fork Fork) error {
+	i := forkIndex(c.forks, fork)
+	if i < 0 {
+		return fmt.Errorf("fork %s is not open", fork.Name())
+	}
+	err := c.mainConnector.promoteKeeping(ctx, c.mainDB, &c.mainHistory, func() error {
+		tx, err := c.mainDB.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("error beginning promote transaction: %v", err)
+		}
+		if err := replay(ctx, sqlQuerier{tx}, c.forks[i].log); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("error committing winner: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return c.Discard(ctx)
+}
+
+// Revert - restores the main database from its snapshot n promotions ago
+func (c *DuckDBParallelClient) Revert(ctx context.Context, n int) error {
+	if len(c.forks) > 0 {
+		return ErrForksOpen
+	}
+	if c.mainConnector == nil {
+		return fmt.Errorf("the main database has not been scaffolded")
+	}
+	return c.mainConnector.revert(&c.mainHistory, n)
+}
+
+// Discard - closes and deletes the fork instances
+func (c *DuckDBParallelClient) Discard(ctx context.Context) error {
+	if len(c.forks) == 0 {
+		return nil
+	}
+	err := closeForks(c.forks)
+	for range c.forks {
+		openForks.WithLabelValues(forkInstance).Dec()
+	}
+	for _, path := range c.forkPaths {
+		os.Remove(path)
+		os.Remove(path + ".wal")
+	}
+	c.forks = nil
+	c.forkPaths = nil
+	return err
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func (c *DuckDBParallelClient) closeInstances() {
 	for _, db := range c.instances {
 		if db != nil {
 			db.Close()
+			openForks.WithLabelValues(forkInstance).Dec()
 		}
 	}
+	c.instances = nil
+}
+
+func (c *DuckDBParallelClient) Cleanup(ctx context.Context, cleanupSQL string) error {
+	c.Discard(ctx)
+	c.closeInstances()
 	if c.mainDB != nil {
 		c.mainDB.Close()
 	}
+	dropHistory(&c.mainHistory)
 
 	if c.mainDBPath != "" {
 		tmpDir := filepath.Dir(c.mainDBPath)
@@ -210,9 +497,10 @@ func (c *DuckDBParallelClient) Cleanup(cleanupSQL string) error {
 
 	// reset client state
 	c.mainDB = nil
+	c.mainConnector = nil
 	c.mainDBPath = ""
-	c.instances = nil
 	c.instancePaths = nil
+	c.forkSeq = 0
 
 	return nil
 }
@@ -1,15 +1,16 @@
 package policy
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
-	"log"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"slices"
+	"sync"
 	"time"
-
-	_ "github.com/marcboeker/go-duckdb"
 )
 
 /*
@@ -22,7 +23,15 @@ and avoiding lock contention
 
 type DuckDBSerialClient struct {
 	currentDB    *sql.DB
+	connector    *duckDBMain
 	databasePath string
+	// forks - the forks open for Fork, which take turns on currentDB
+	forks []*rollbackFork
+	// forkSeq - numbers forks uniquely while forks are open
+	forkSeq int
+	mu      sync.Mutex
+	// mainHistory - snapshots of the database that promotions replaced
+	mainHistory
 }
 
 func (c *DuckDBSerialClient) GetName() string {
@@ -33,44 +42,57 @@ func (c *DuckDBSerialClient) GetNumTransactionsInFlight() []int {
 	return []int{10, 25, 50, 100, 200, 500}
 }
 
-func (c *DuckDBSerialClient) Scaffold(schema string, inFlight int) error {
+func (c *DuckDBSerialClient) EngineVersions() map[string]string {
+	return map[string]string{"duckdb": duckDBVersion()}
+}
+
+func (c *DuckDBSerialClient) Scaffold(ctx context.Context, schema string, inFlight int) error {
 	tmpDir := os.TempDir()
 	databasePath := filepath.Join(tmpDir, fmt.Sprintf("duckdb_serial_%d.db", rand.Intn(10000)))
 	c.databasePath = databasePath
 
-	db, err := sql.Open("duckdb", databasePath)
+	connector, err := newDuckDBMain(databasePath)
 	if err != nil {
 		return fmt.Errorf("failed to open database: %v", err)
 	}
+	db := sql.OpenDB(connector)
+	c.connector = connector
 	c.currentDB = db
 
-	_, err = db.Exec(schema)
-	if err != nil {
-		return fmt.Errorf("error executing schema: %v", err)
+	// the schema may be empty when forking an existing state
+	if schema != "" {
+		_, err = db.Exec(schema)
+		if err != nil {
+			return fmt.Errorf("error executing schema: %v", err)
+		}
 	}
 
 	return nil
 }
 
-func (c *DuckDBSerialClient) Execute(testCase TestCase, experiment *Experiment) error {
-	rand.Seed(time.Now().UnixNano())
-
+func (c *DuckDBSerialClient) Execute(ctx context.Context, testCase TestCase, experiment *Experiment) error {
 	benchmark := Benchmark{
 		Experiment:       experiment,
 		Policy:           c.GetName(),
 		TestCase:         testCase.Name,
 		TransactionCount: len(testCase.Statements),
 	}
-	benchmark.Start()
+	benchmark.Start(ctx)
 
+	// Each statement runs in its own transaction that is rolled back, so
+	// forking and tearing down happen inline with execution
+	benchmark.Phase(PhaseExecute)
 	var states []ExecutionResult
 
 	// Try each statement and collect states
-	for _, statement := range testCase.Statements {
+	for i, statement := range testCase.Statements {
+		_, span := benchmark.StartCandidate(i)
+		candidateStart := time.Now()
 		tx, err := c.currentDB.Begin()
 		if err != nil {
 			return fmt.Errorf("error beginning transaction: %v", err)
 		}
+		openForks.WithLabelValues(forkTransaction).Inc()
 
 		var values []any
 		if statement.Command != "" {
@@ -79,7 +101,7 @@ func (c *DuckDBSerialClient) Execute(testCase TestCase, experiment *Experiment)
 				tx.Rollback()
 				return fmt.Errorf("error executing command: %v", err)
 			}
-			states = append(states, ExecutionResult{Statement: statement})
+			states = append(states, ExecutionResult{Index: i, Statement: statement})
 		}
 		if statement.Query != "" {
 			rows, err := tx.Query(statement.Query)
@@ -105,17 +127,24 @@ func (c *DuckDBSerialClient) Execute(testCase TestCase, experiment *Experiment)
 				}
 			}
 			rows.Close()
-			states = append(states, ExecutionResult{Statement: statement, Values: values})
+			states = append(states, ExecutionResult{Index: i, Statement: statement, Values: values})
 		}
 
 		tx.Rollback() // Roll back each transaction
+		openForks.WithLabelValues(forkTransaction).Dec()
+		result := ExecutionResult{Index: i, Statement: statement, Values: values, Duration: time.Since(candidateStart)}
+		benchmark.Candidate(result)
+		EndCandidate(span, result)
 	}
 
 	// Pick random winner and execute it
-	idx := rand.Intn(len(states))
+	benchmark.Phase(PhaseConsensus)
+	idx := rng.Intn(len(states))
 	winner := states[idx]
-	log.Printf("idx: %v; state: %v\n", idx, winner)
+	benchmark.Logger().Debug("winner state", LogCandidate, winner.Index, "values", winner.Values)
+	benchmark.Winner(winner.Index)
 
+	benchmark.Phase(PhasePromote)
 	tx, err := c.currentDB.Begin()
 	if err != nil {
 		return fmt.Errorf("error beginning winner transaction: %v", err)
@@ -139,16 +168,134 @@ func (c *DuckDBSerialClient) Execute(testCase TestCase, experiment *Experiment)
 	return nil
 }
 
-func (c *DuckDBSerialClient) Cleanup(cleanupSQL string) error {
+// MainConnector - connects to the database the forks' transactions run on
+func (c *DuckDBSerialClient) MainConnector() (driver.Connector, error) {
+	if c.connector == nil {
+		return nil, fmt.Errorf("the database has not been scaffolded")
+	}
+	return c.connector, nil
+}
+
+// Fork - forks that each run in a transaction which is rolled back
+func (c *DuckDBSerialClient) Fork(ctx context.Context, n int) ([]Fork, error) {
+	if len(c.forks) > 0 {
+		return nil, ErrForksOpen
+	}
+	return c.ForkFrom(ctx, nil, n)
+}
+
+// ForkFrom - forks that start from parent's statements, replayed in each
+// of their transactions
+func (c *DuckDBSerialClient) ForkFrom(ctx context.Context, parent Fork, n int) ([]Fork, error) {
+	if c.currentDB == nil {
+		return nil, fmt.Errorf("the database has not been scaffolded")
+	}
+	if parent != nil && forkIndex(c.forks, parent) < 0 {
+		return nil, fmt.Errorf("fork %s is not open", parent.Name())
+	}
+	log := parentLog(parent)
+	forks := make([]Fork, n)
+	for i := range n {
+		fork := &rollbackFork{name: fmt.Sprintf("txn_%d", c.forkSeq), sandbox: c.sandbox, log: slices.Clone(log)}
+		c.forkSeq++
+		c.forks = append(c.forks, fork)
+		forks[i] = fork
+	}
+	return forks, nil
+}
+
+// Release - the forks' transactions are already rolled back
+func (c *DuckDBSerialClient) Release(ctx context.Context, forks ...Fork) error {
+	c.forks = withoutForks(c.forks, forks)
+	return nil
+}
+
+// sandbox - runs fn in a transaction that is rolled back
+func (c *DuckDBSerialClient) sandbox(ctx context.Context, fn func(q querier) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tx, err := c.currentDB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %v", err)
+	}
+	openForks.WithLabelValues(forkTransaction).Inc()
+	defer openForks.WithLabelValues(forkTransaction).Dec()
+	defer tx.Rollback()
+	return fn(sqlQuerier{tx})
+}
+
+// Promote - re-executes the winner's statements and commits them, as
+// Execute does with the winning command
+func (c *DuckDBSerialClient) Promote(ctx context.Context, winner int) error {
+	if err := checkWinner(winner, len(c.forks)); err != nil {
+		return err
+	}
+	return c.PromoteFork(ctx, c.forks[winner])
+}
+
+// PromoteFork - re-executes the statements of fork's whole path and
+// commits them
+func (c *DuckDBSerialClient) PromoteFork(ctx context.Context, fork Fork) error {
+	i := forkIndex(c.forks, fork)
+	if i < 0 {
+		return fmt.Errorf("fork %s is not open", fork.Name())
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.connector.promoteKeeping(ctx, c.currentDB, &c.mainHistory, func() error {
+		tx, err := c.currentDB.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("error beginning winner transaction: %v", err)
+		}
+		if err := replay(ctx, sqlQuerier{tx}, c.forks[i].log); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("error committing winner: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.forks = nil
+	c.forkSeq = 0
+	return nil
+}
+
+// Discard - the forks' transactions are already rolled back
+func (c *DuckDBSerialClient) Discard(ctx context.Context) error {
+	c.forks = nil
+	c.forkSeq = 0
+	return nil
+}
+
+// Revert - restores the database from its snapshot n promotions ago
+func (c *DuckDBSerialClient) Revert(ctx context.Context, n int) error {
+	if len(c.forks) > 0 {
+		return ErrForksOpen
+	}
+	if c.connector == nil {
+		return fmt.Errorf("the database has not been scaffolded")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connector.revert(&c.mainHistory, n)
+}
+
+func (c *DuckDBSerialClient) Cleanup(ctx context.Context, cleanupSQL string) error {
 	if c.currentDB != nil {
 		c.currentDB.Close()
 	}
+	dropHistory(&c.mainHistory)
 
 	if c.databasePath != "" {
 		os.Remove(c.databasePath)
 	}
 
 	c.currentDB = nil
+	c.connector = nil
 	c.databasePath = ""
 
 	return nil
@@ -0,0 +1,57 @@
+package policy
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// postgresVersion - the server version of the Postgres database at connStr
+func postgresVersion(connStr string) string {
+	conn, err := pgx.Connect(context.Background(), connStr)
+	if err != nil {
+		return fmt.Sprintf("unknown: %v", err)
+	}
+	defer conn.Close(context.Background())
+
+	var version string
+	if err := conn.QueryRow(context.Background(), "SHOW server_version").Scan(&version); err != nil {
+		return fmt.Sprintf("unknown: %v", err)
+	}
+	return version
+}
+
+// duckDBVersion - the version of the DuckDB library linked into ntran
+func duckDBVersion() string {
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		return fmt.Sprintf("unknown: %v", err)
+	}
+	defer db.Close()
+
+	var version string
+	if err := db.QueryRow("SELECT version()").Scan(&version); err != nil {
+		return fmt.Sprintf("unknown: %v", err)
+	}
+	return version
+}
+
+// postgresDatabaseSize - the on-disk size in bytes of the Postgres database
+// at connStr, or of the database named name on the same server when set
+func postgresDatabaseSize(ctx context.Context, connStr string, name string) (int64, error) {
+	conn, err := pgx.Connect(ctx, connStr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close(ctx)
+
+	var size int64
+	if name == "" {
+		err = conn.QueryRow(ctx, "SELECT pg_database_size(current_database())").Scan(&size)
+	} else {
+		err = conn.QueryRow(ctx, "SELECT pg_database_size($1)", name).Scan(&size)
+	}
+	return size, err
+}
@@ -2,57 +2,277 @@ package policy
 
 import (
 	"encoding/csv"
+	"errors"
 	"fmt"
+	"io/fs"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
+
+	"ntran/stats"
 )
 
 type Experiment struct {
-	Policy    string
-	csvWriter *csv.Writer
-	csvFile   *os.File
+	Policy string
+	// Format - the format results are written in [csv, jsonl, parquet]
+	Format string
+	// Warmup - when set, results are neither written nor summarized
+	Warmup bool
+	// Repetition - the repetition of the current configuration being run
+	Repetition int
+	// Manifest - provenance of the run, written to the run directory
+	Manifest *Manifest
+	// RunID - uniquely names the run, assigned by Start
+	RunID string
+	// RunDir - the directory holding everything the run produces, assigned by Start
+	RunDir string
+	// ResultsDB - when set, the path of a DuckDB results database the run is also appended to
+	ResultsDB string
+	// Observer - when set, notified as candidates finish, e.g. to display progress
+	Observer  Observer
+	resultsDB *ResultsDB
+	writer    RecordWriter
+	lineage   *Lineage
+	samples   map[configuration][]float64
+	resources map[configuration][]Resources
+	configs   []configuration
+	endOnce   sync.Once
+}
+
+// Observer - follows an experiment as it runs, including warmup repetitions
+type Observer interface {
+	CandidateFinished(result ExecutionResult)
+}
+
+// configuration - one (test case, inFlight) pair that is repeated
+type configuration struct {
+	TestCase         string
+	TransactionCount int
 }
 
 type Record struct {
 	Policy           string
 	TestCase         string
-	TransactionCount string
-	Duration         string
+	TransactionCount int
+	Duration         time.Duration
+	Total            time.Duration
+	Phases           map[string]time.Duration
+	Repetition       int
+	Failures         int
+	Candidates       []CandidateRecord
+	Resources        Resources
+	// Depths - the depths of a tree search, empty for a single step
+	Depths []DepthRecord
 }
 
-func (e *Experiment) Start(csvDirArg string) error {
-	timestamp := time.Now().Format("2006-01-02_15-04-05")
-	filepath := fmt.Sprintf("%s/%s_%s.csv", csvDirArg, e.Policy, timestamp)
-	var err error
-	e.csvFile, err = os.Create(filepath)
-	if err != nil {
-		return err
+// Forks - the forks created across every depth of a tree search
+func (r Record) Forks() int {
+	forks := 0
+	for _, depth := range r.Depths {
+		forks += depth.Forks
 	}
-	e.csvWriter = csv.NewWriter(e.csvFile)
-	headers := []string{"Policy", "TestCase", "TransactionCount", "Duration"}
-	if err := e.csvWriter.Write(headers); err != nil {
-		e.csvFile.Close()
-		return err
+	return forks
+}
+
+const (
+	SummaryFile = "summary.csv"
+	LogFile     = "out.log"
+)
+
+// ResultsFile - the name of the results file for a format, e.g. results.csv
+func ResultsFile(format string) string {
+	return "results." + format
+}
+
+/*
+ * Start - creates a new run directory <runsDir>/<policy>_<timestamp>
+ * holding the results, summary, logs and manifest of the run. A run
+ * started in the same second as another gets a -2, -3, ... suffix rather
+ * than sharing its directory
+ */
+func (e *Experiment) Start(runsDir string) error {
+	if e.Format == "" {
+		e.Format = FormatCSV
+	}
+	if e.Manifest == nil {
+		e.Manifest = &Manifest{}
+	}
+	startTime := time.Now()
+	if err := os.MkdirAll(runsDir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create runs directory: %v", err)
+	}
+	runID := fmt.Sprintf("%s_%s", e.Policy, startTime.Format("2006-01-02_15-04-05"))
+	e.RunID = runID
+	for i := 2; ; i++ {
+		e.RunDir = filepath.Join(runsDir, e.RunID)
+		err := os.Mkdir(e.RunDir, os.ModePerm)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return fmt.Errorf("failed to create run directory: %v", err)
+		}
+		e.RunID = fmt.Sprintf("%s-%d", runID, i)
 	}
-	e.csvWriter.Flush()
-	return nil
+	e.samples = make(map[configuration][]float64)
+	e.resources = make(map[configuration][]Resources)
+	e.lineage = &Lineage{RunID: e.RunID, Policy: e.Policy}
+
+	e.Manifest.RunID = e.RunID
+	e.Manifest.Policy = e.Policy
+	e.Manifest.Format = e.Format
+	e.Manifest.ResultsFile = ResultsFile(e.Format)
+	e.Manifest.SummaryFile = SummaryFile
+	e.Manifest.LogFile = LogFile
+	e.Manifest.LineageFile = LineageFile
+	e.Manifest.StartTime = startTime
+	if err := e.Manifest.Write(e.RunDir); err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+
+	if e.ResultsDB != "" {
+		db, err := OpenResultsDB(e.ResultsDB)
+		if err != nil {
+			return err
+		}
+		e.resultsDB = db
+		if err := e.resultsDB.WriteRun(e.Manifest); err != nil {
+			return fmt.Errorf("failed to write run to results database: %v", err)
+		}
+	}
+
+	var err error
+	e.writer, err = NewRecordWriter(e.Format, filepath.Join(e.RunDir, ResultsFile(e.Format)))
+	return err
 }
 
 func (e *Experiment) Log(record Record) error {
-	err := e.csvWriter.Write([]string{
-		record.Policy,
-		record.TestCase,
-		record.TransactionCount,
-		record.Duration,
-	})
+	if e.Warmup {
+		return nil
+	}
+	record.Repetition = e.Repetition
+	e.lineage.Add(record)
+	if e.resultsDB != nil {
+		if err := e.resultsDB.WriteRecord(e.RunID, record); err != nil {
+			return fmt.Errorf("failed to write record to results database: %v", err)
+		}
+	}
+	return e.writer.Write(record)
+}
+
+// sample - records the total duration and resources of one repetition of
+// a configuration
+func (e *Experiment) sample(testCase string, transactionCount int, total time.Duration, resources Resources) {
+	if e.Warmup {
+		return
+	}
+	config := configuration{TestCase: testCase, TransactionCount: transactionCount}
+	if _, ok := e.samples[config]; !ok {
+		e.configs = append(e.configs, config)
+	}
+	e.samples[config] = append(e.samples[config], float64(total))
+	e.resources[config] = append(e.resources[config], resources)
+}
+
+// MeanResources - the mean resources used by the repetitions of a configuration
+func (e *Experiment) MeanResources(testCase string, transactionCount int) Resources {
+	return meanResources(e.resources[configuration{TestCase: testCase, TransactionCount: transactionCount}])
+}
+
+// Summary - summary statistics (in nanoseconds) of the total durations
+// recorded so far for a configuration
+func (e *Experiment) Summary(testCase string, transactionCount int) stats.Summary {
+	return stats.Summarize(e.samples[configuration{TestCase: testCase, TransactionCount: transactionCount}])
+}
+
+// writeSummary - writes one row of summary statistics per configuration
+// next to the raw results
+func (e *Experiment) writeSummary() error {
+	f, err := os.Create(filepath.Join(e.RunDir, SummaryFile))
 	if err != nil {
-		e.csvFile.Close()
 		return err
 	}
-	e.csvWriter.Flush()
-	return nil
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	headers := []string{"Policy", "TestCase", "TransactionCount", "N", "Mean", "Median", "P95", "P99", "StdDev", "CILow", "CIHigh",
+		"MeanCPUTime", "MeanPeakRSS", "MeanAllocBytes", "MeanAllocs", "MeanForkBytes", "MeanBaseBytes"}
+	if err := w.Write(headers); err != nil {
+		return err
+	}
+	for _, config := range e.configs {
+		summary := e.Summary(config.TestCase, config.TransactionCount)
+		resources := e.MeanResources(config.TestCase, config.TransactionCount)
+		slog.Info("configuration summary",
+			LogRunID, e.RunID, LogPolicy, e.Policy, LogTestCase, config.TestCase, LogInFlight, config.TransactionCount,
+			"n", summary.N, "mean", nanos(summary.Mean), "median", nanos(summary.Median), "p95", nanos(summary.P95), "p99", nanos(summary.P99),
+			"stddev", nanos(summary.StdDev), "ci_low", nanos(summary.CILow), "ci_high", nanos(summary.CIHigh))
+		err := w.Write([]string{
+			e.Policy,
+			config.TestCase,
+			fmt.Sprintf("%d", config.TransactionCount),
+			fmt.Sprintf("%d", summary.N),
+			nanos(summary.Mean).String(),
+			nanos(summary.Median).String(),
+			nanos(summary.P95).String(),
+			nanos(summary.P99).String(),
+			nanos(summary.StdDev).String(),
+			nanos(summary.CILow).String(),
+			nanos(summary.CIHigh).String(),
+			resources.CPUTime.String(),
+			fmt.Sprintf("%d", resources.PeakRSS),
+			fmt.Sprintf("%d", resources.AllocBytes),
+			fmt.Sprintf("%d", resources.Allocs),
+			fmt.Sprintf("%d", resources.ForkBytes),
+			fmt.Sprintf("%d", resources.BaseBytes),
+		})
+		if err != nil {
+			return err
+		}
+		if e.resultsDB != nil {
+			if err := e.resultsDB.WriteConfiguration(e.RunID, e.Policy, config.TestCase, config.TransactionCount, summary, resources); err != nil {
+				return err
+			}
+		}
+	}
+	w.Flush()
+	return w.Error()
 }
 
+func nanos(v float64) time.Duration {
+	return time.Duration(v)
+}
+
+// End - writes out the results, summary, lineage and manifest of the run.
+// Only the first call has any effect, so End can both be deferred and
+// registered with AtExit
 func (e *Experiment) End() {
-	e.csvFile.Close()
+	e.endOnce.Do(e.end)
+}
+
+func (e *Experiment) end() {
+	if err := e.writer.Close(); err != nil {
+		slog.Error("error closing experiment results", LogRunID, e.RunID, "error", err)
+	}
+	if len(e.configs) > 0 {
+		if err := e.writeSummary(); err != nil {
+			slog.Error("error writing experiment summary", LogRunID, e.RunID, "error", err)
+		}
+	}
+	if err := e.lineage.Write(e.RunDir); err != nil {
+		slog.Error("error writing lineage", LogRunID, e.RunID, "error", err)
+	}
+	endTime := time.Now()
+	e.Manifest.EndTime = &endTime
+	if err := e.Manifest.Write(e.RunDir); err != nil {
+		slog.Error("error writing manifest", LogRunID, e.RunID, "error", err)
+	}
+	if e.resultsDB != nil {
+		if err := e.resultsDB.WriteRun(e.Manifest); err != nil {
+			slog.Error("error writing run to results database", LogRunID, e.RunID, "error", err)
+		}
+		e.resultsDB.Close()
+	}
 }
@@ -0,0 +1,378 @@
+package policy
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ErrForksOpen - Fork was called while the forks of an earlier call are
+// still open
+var ErrForksOpen = errors.New("forks are already open, promote or discard them first")
+
+// Rows - the result of a query on a fork
+type Rows struct {
+	Columns []string
+	Values  [][]any
+}
+
+// Fork - one candidate's copy of the main state, which statements can be
+// executed on without affecting main or the other forks
+type Fork interface {
+	// Name - the name of the fork, e.g. its branch or database
+	Name() string
+	// Exec - executes a statement on the fork
+	Exec(ctx context.Context, sql string, args ...any) error
+	// Query - executes a query on the fork, returning every row
+	Query(ctx context.Context, sql string, args ...any) (Rows, error)
+}
+
+// RowCounter - implemented by forks that count the rows their last Exec
+// affected, -1 when the driver cannot tell
+type RowCounter interface {
+	RowsAffected() int64
+}
+
+/*
+ * Forker - implemented by policies whose forks can be driven a statement at
+ * a time instead of a test case at a time, which the speculate package
+ * builds on. One set of forks is open at a time: Promote makes the winner's
+ * state the new main state and drops the other forks, Discard drops them all
+ */
+type Forker interface {
+	Fork(ctx context.Context, n int) ([]Fork, error)
+	Promote(ctx context.Context, winner int) error
+	Discard(ctx context.Context) error
+}
+
+/*
+ * TreeForker - implemented by forkers whose forks can themselves be forked,
+ * which tree search builds on. ForkFrom adds forks alongside those already
+ * open, Release drops forks that are no longer needed, and PromoteFork
+ * makes any open fork's state the new main state, dropping every fork as
+ * Promote does. Discard drops every fork
+ */
+type TreeForker interface {
+	Forker
+	// ForkFrom - n forks, each a copy of parent's state, or of the main
+	// state when parent is nil
+	ForkFrom(ctx context.Context, parent Fork, n int) ([]Fork, error)
+	Release(ctx context.Context, forks ...Fork) error
+	PromoteFork(ctx context.Context, fork Fork) error
+}
+
+/*
+ * Reverter - implemented by forkers that can keep the main states their
+ * promotions replace, so that a winner found to be wrong later can be
+ * rolled back without scaffolding again. Promotions keep nothing until
+ * SetHistory is called. Revert needs every fork to be closed
+ */
+type Reverter interface {
+	// SetHistory - keeps up to depth earlier main states, dropping the
+	// oldest beyond it; 0 keeps none
+	SetHistory(depth int)
+	// History - the number of earlier main states kept
+	History() int
+	// Revert - restores the main state from n promotions ago, dropping the
+	// states kept since
+	Revert(ctx context.Context, n int) error
+}
+
+/*
+ * MainConnector - implemented by forkers whose main database can be used
+ * directly between forks, e.g. by the database/sql driver for statements
+ * outside of a speculation. It connects to the database once it has been
+ * scaffolded, and writes through it are what the next Fork copies
+ */
+type MainConnector interface {
+	MainConnector() (driver.Connector, error)
+}
+
+// loggedStatement - a statement a fork executed, which policies that
+// promote by re-executing the winner's statements replay on main
+type loggedStatement struct {
+	sql  string
+	args []any
+}
+
+// querier - executes statements over either pgx or database/sql. exec
+// returns the number of rows the statement affected
+type querier interface {
+	exec(ctx context.Context, sql string, args ...any) (int64, error)
+	query(ctx context.Context, sql string, args ...any) (Rows, error)
+}
+
+// pgxQuerier - a querier over a pgx connection or transaction
+type pgxQuerier struct {
+	db interface {
+		Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+		Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	}
+}
+
+func (q pgxQuerier) exec(ctx context.Context, sql string, args ...any) (int64, error) {
+	tag, err := q.db.Exec(ctx, sql, args...)
+	return tag.RowsAffected(), err
+}
+
+func (q pgxQuerier) query(ctx context.Context, sql string, args ...any) (Rows, error) {
+	rows, err := q.db.Query(ctx, sql, args...)
+	if err != nil {
+		return Rows{}, err
+	}
+	defer rows.Close()
+
+	var result Rows
+	for _, field := range rows.FieldDescriptions() {
+		result.Columns = append(result.Columns, field.Name)
+	}
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			return Rows{}, err
+		}
+		result.Values = append(result.Values, values)
+	}
+	return result, rows.Err()
+}
+
+// sqlQuerier - a querier over a database/sql database or transaction
+type sqlQuerier struct {
+	db interface {
+		ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+		QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	}
+}
+
+func (q sqlQuerier) exec(ctx context.Context, sql string, args ...any) (int64, error) {
+	result, err := q.db.ExecContext(ctx, sql, args...)
+	if err != nil {
+		return 0, err
+	}
+	// drivers that cannot count report an error, counted as unknown
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return -1, nil
+	}
+	return affected, nil
+}
+
+func (q sqlQuerier) query(ctx context.Context, sql string, args ...any) (Rows, error) {
+	rows, err := q.db.QueryContext(ctx, sql, args...)
+	if err != nil {
+		return Rows{}, err
+	}
+	defer rows.Close()
+
+	var result Rows
+	result.Columns, err = rows.Columns()
+	if err != nil {
+		return Rows{}, err
+	}
+	for rows.Next() {
+		scanVals := make([]any, len(result.Columns))
+		for i := range scanVals {
+			scanVals[i] = new(any)
+		}
+		if err := rows.Scan(scanVals...); err != nil {
+			return Rows{}, err
+		}
+		values := make([]any, len(scanVals))
+		for i, v := range scanVals {
+			values[i] = *(v.(*any))
+		}
+		result.Values = append(result.Values, values)
+	}
+	return result, rows.Err()
+}
+
+// replay - executes statements in order, stopping at the first error
+func replay(ctx context.Context, q querier, statements []loggedStatement) error {
+	for _, statement := range statements {
+		if _, err := q.exec(ctx, statement.sql, statement.args...); err != nil {
+			return fmt.Errorf("error replaying %q: %v", statement.sql, err)
+		}
+	}
+	return nil
+}
+
+/*
+ * directFork - a fork with its own copy of the state (a branch, database or
+ * instance), so statements execute on it directly. Its connection is not
+ * safe for concurrent use, so statements on one fork run one at a time
+ */
+type directFork struct {
+	name     string
+	mu       sync.Mutex
+	db       querier
+	log      []loggedStatement
+	affected int64
+	close    func() error
+}
+
+func (f *directFork) Name() string {
+	return f.name
+}
+
+func (f *directFork) Exec(ctx context.Context, sql string, args ...any) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	affected, err := f.db.exec(ctx, sql, args...)
+	if err != nil {
+		return err
+	}
+	f.log = append(f.log, loggedStatement{sql: sql, args: args})
+	f.affected = affected
+	return nil
+}
+
+func (f *directFork) RowsAffected() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.affected
+}
+
+func (f *directFork) Query(ctx context.Context, sql string, args ...any) (Rows, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.db.query(ctx, sql, args...)
+}
+
+// closeForks - closes the connections of forks
+func closeForks(forks []*directFork) error {
+	var errs []error
+	for _, fork := range forks {
+		if fork.close != nil {
+			errs = append(errs, fork.close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// connectFork - a directFork over a new connection to a Postgres branch
+func connectFork(ctx context.Context, branch BranchInfo) (*directFork, error) {
+	conn, err := pgx.Connect(ctx, branch.ConnStr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to fork %s: %v", branch.Name, err)
+	}
+	return &directFork{
+		name:  branch.Name,
+		db:    pgxQuerier{conn},
+		close: func() error { return conn.Close(context.Background()) },
+	}, nil
+}
+
+/*
+ * rollbackFork - a fork of a policy that shares one database between its
+ * candidates and rolls each back, as the serial policies do. Every call
+ * replays the fork's earlier statements inside a sandbox (a savepoint or
+ * transaction) that is rolled back afterwards, so forks take turns
+ */
+type rollbackFork struct {
+	name     string
+	mu       sync.Mutex
+	sandbox  func(ctx context.Context, fn func(q querier) error) error
+	log      []loggedStatement
+	affected int64
+}
+
+func (f *rollbackFork) Name() string {
+	return f.name
+}
+
+func (f *rollbackFork) Exec(ctx context.Context, sql string, args ...any) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var affected int64
+	err := f.sandbox(ctx, func(q querier) error {
+		if err := replay(ctx, q, f.log); err != nil {
+			return err
+		}
+		var err error
+		affected, err = q.exec(ctx, sql, args...)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	f.log = append(f.log, loggedStatement{sql: sql, args: args})
+	f.affected = affected
+	return nil
+}
+
+func (f *rollbackFork) RowsAffected() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.affected
+}
+
+func (f *rollbackFork) Query(ctx context.Context, sql string, args ...any) (Rows, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var rows Rows
+	err := f.sandbox(ctx, func(q querier) error {
+		if err := replay(ctx, q, f.log); err != nil {
+			return err
+		}
+		var err error
+		rows, err = q.query(ctx, sql, args...)
+		return err
+	})
+	return rows, err
+}
+
+// forkIndex - the position of fork among forks, -1 when it is not one of
+// them, e.g. because it was released
+func forkIndex[F Fork](forks []F, fork Fork) int {
+	for i, f := range forks {
+		if Fork(f) == fork {
+			return i
+		}
+	}
+	return -1
+}
+
+// withoutForks - forks without the released ones, in order
+func withoutForks[F Fork](forks []F, released []Fork) []F {
+	kept := forks[:0:0]
+	for _, f := range forks {
+		if !slices.Contains(released, Fork(f)) {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// parentLog - the statements a fork of parent starts from, so that
+// promoting by replay re-executes the whole path from main
+func parentLog(parent Fork) []loggedStatement {
+	switch p := parent.(type) {
+	case *directFork:
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return slices.Clone(p.log)
+	case *rollbackFork:
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return slices.Clone(p.log)
+	}
+	return nil
+}
+
+// checkWinner - an error unless winner indexes one of n open forks
+func checkWinner(winner int, n int) error {
+	if n == 0 {
+		return errors.New("no forks are open")
+	}
+	if winner < 0 || winner >= n {
+		return fmt.Errorf("winner %d out of range, %d forks are open", winner, n)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNoHistory - Revert was called without enough earlier main states kept
+var ErrNoHistory = errors.New("not enough earlier main states are kept")
+
+/*
+ * mainHistory - the main states that promotions replaced, oldest first, of
+ * a policy that keeps up to depth of them. A state is named by the policy,
+ * e.g. a snapshot file, database or branch; the policy creates and drops
+ * them, mainHistory only decides which
+ */
+type mainHistory struct {
+	depth  int
+	states []string
+	// seq - numbers states uniquely, as reverting frees names that the
+	// policy may still be dropping
+	seq int
+}
+
+// SetHistory - implements Reverter
+func (h *mainHistory) SetHistory(depth int) {
+	h.depth = max(depth, 0)
+}
+
+// History - implements Reverter
+func (h *mainHistory) History() int {
+	return len(h.states)
+}
+
+// keeping - whether promotions keep the main state they replace
+func (h *mainHistory) keeping() bool {
+	return h.depth > 0
+}
+
+// next - a name for the next state kept, from prefix
+func (h *mainHistory) next(prefix string) string {
+	name := fmt.Sprintf("%s%d", prefix, h.seq)
+	h.seq++
+	return name
+}
+
+// push - keeps state as the most recent, returning the oldest states past
+// depth, which the policy drops
+func (h *mainHistory) push(state string) []string {
+	h.states = append(h.states, state)
+	if len(h.states) <= h.depth {
+		return nil
+	}
+	evicted := h.states[:len(h.states)-h.depth]
+	h.states = h.states[len(h.states)-h.depth:]
+	return evicted
+}
+
+// revert - the state n promotions ago, which the policy restores, and the
+// states kept since, which it drops. Neither is kept any longer
+func (h *mainHistory) revert(n int) (string, []string, error) {
+	if n < 1 {
+		return "", nil, fmt.Errorf("can only revert at least 1 promotion, got %d", n)
+	}
+	if n > len(h.states) {
+		return "", nil, fmt.Errorf("%w: cannot revert %d promotions, %d are kept", ErrNoHistory, n, len(h.states))
+	}
+	i := len(h.states) - n
+	state, newer := h.states[i], append([]string(nil), h.states[i+1:]...)
+	h.states = h.states[:i]
+	return state, newer, nil
+}
+
+// clear - every state kept, which the policy drops on cleanup
+func (h *mainHistory) clear() []string {
+	states := h.states
+	h.states = nil
+	h.seq = 0
+	return states
+}
@@ -0,0 +1,179 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestMainHistory(t *testing.T) {
+	var h mainHistory
+	h.SetHistory(2)
+	if !h.keeping() {
+		t.Fatal("keeping() = false with depth 2")
+	}
+	var names []string
+	for range 3 {
+		names = append(names, h.next("history_"))
+	}
+	if want := []string{"history_0", "history_1", "history_2"}; !slices.Equal(names, want) {
+		t.Fatalf("next() = %v, want %v", names, want)
+	}
+
+	if evicted := h.push("s0"); evicted != nil {
+		t.Errorf("push(s0) evicted %v", evicted)
+	}
+	h.push("s1")
+	if evicted := h.push("s2"); !slices.Equal(evicted, []string{"s0"}) {
+		t.Errorf("push(s2) evicted %v, want [s0]", evicted)
+	}
+	if got := h.History(); got != 2 {
+		t.Fatalf("History() = %d beyond depth 2", got)
+	}
+
+	if _, _, err := h.revert(0); err == nil || errors.Is(err, ErrNoHistory) {
+		t.Errorf("revert(0) = %v, want an invalid count", err)
+	}
+	if _, _, err := h.revert(3); !errors.Is(err, ErrNoHistory) {
+		t.Errorf("revert(3) = %v, want ErrNoHistory", err)
+	}
+	state, newer, err := h.revert(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != "s1" || !slices.Equal(newer, []string{"s2"}) {
+		t.Errorf("revert(2) = %s, %v, want s1, [s2]", state, newer)
+	}
+	if got := h.History(); got != 0 {
+		t.Errorf("History() = %d after reverting every state", got)
+	}
+
+	h.push("s3")
+	h.push("s4")
+	if states := h.clear(); !slices.Equal(states, []string{"s3", "s4"}) {
+		t.Errorf("clear() = %v, want [s3 s4]", states)
+	}
+	if got := h.next("history_"); got != "history_0" {
+		t.Errorf("next() after clear = %s, want history_0", got)
+	}
+}
+
+func TestMainHistoryNotKeeping(t *testing.T) {
+	var h mainHistory
+	h.SetHistory(-1)
+	if h.keeping() {
+		t.Error("keeping() = true with a negative depth")
+	}
+	if _, _, err := h.revert(1); !errors.Is(err, ErrNoHistory) {
+		t.Errorf("revert(1) = %v, want ErrNoHistory", err)
+	}
+}
+
+// historyForker - a DuckDB policy promoting and reverting its main database
+type historyForker interface {
+	Policy
+	Forker
+	Reverter
+}
+
+// countUsers - the rows in main's users table, read through a fork
+func countUsers(t *testing.T, ctx context.Context, c historyForker) int {
+	t.Helper()
+	forks, err := c.Fork(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Discard(ctx)
+	rows, err := forks[0].Query(ctx, "SELECT count(*) FROM users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := strconv.Atoi(fmt.Sprint(rows.Values[0][0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// promoteInsert - promotes a fork that inserted user id
+func promoteInsert(t *testing.T, ctx context.Context, c historyForker, id int) {
+	t.Helper()
+	forks, err := c.Fork(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := forks[1].Exec(ctx, "INSERT INTO users VALUES ($1)", id); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Promote(ctx, 1); err != nil {
+		t.Fatalf("promoting user %d: %v", id, err)
+	}
+}
+
+func TestDuckDBRevert(t *testing.T) {
+	tests := []struct {
+		client historyForker
+		// path - the main database's file, once scaffolded
+		path func(c historyForker) string
+	}{
+		{&DuckDBParallelClient{}, func(c historyForker) string { return c.(*DuckDBParallelClient).mainDBPath }},
+		{&DuckDBSerialClient{}, func(c historyForker) string { return c.(*DuckDBSerialClient).databasePath }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.client.GetName(), func(t *testing.T) {
+			ctx := context.Background()
+			c := tt.client
+			if err := c.Scaffold(ctx, "CREATE TABLE users (id INTEGER)", 1); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { c.Cleanup(ctx, "") })
+			c.SetHistory(2)
+			snapshots := func() []string {
+				paths, err := filepath.Glob(tt.path(c) + ".history_*")
+				if err != nil {
+					t.Fatal(err)
+				}
+				return paths
+			}
+
+			for id := 1; id <= 3; id++ {
+				promoteInsert(t, ctx, c, id)
+			}
+			if got := c.History(); got != 2 {
+				t.Fatalf("History() = %d beyond depth 2", got)
+			}
+			if got := len(snapshots()); got != 2 {
+				t.Fatalf("%d snapshots kept, want the evicted one removed", got)
+			}
+			if got := countUsers(t, ctx, c); got != 3 {
+				t.Fatalf("main has %d users after 3 promotions", got)
+			}
+
+			if err := c.Revert(ctx, 1); err != nil {
+				t.Fatalf("Revert(1): %v", err)
+			}
+			if got := countUsers(t, ctx, c); got != 2 {
+				t.Errorf("main has %d users after Revert(1), want 2", got)
+			}
+
+			promoteInsert(t, ctx, c, 4)
+			if err := c.Revert(ctx, 2); err != nil {
+				t.Fatalf("Revert(2): %v", err)
+			}
+			if got := countUsers(t, ctx, c); got != 1 {
+				t.Errorf("main has %d users after Revert(2), want 1", got)
+			}
+			if got := len(snapshots()); got != 0 {
+				t.Errorf("%d snapshots left after reverting every state", got)
+			}
+			if err := c.Revert(ctx, 1); !errors.Is(err, ErrNoHistory) {
+				t.Errorf("Revert(1) with no states kept = %v, want ErrNoHistory", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const LineageFile = "lineage.json"
+
+// Kinds of lineage nodes
+const (
+	LineageBase     = "base"     // the main state a test case forked from
+	LineageFork     = "fork"     // the fork a candidate ran on
+	LineagePromoted = "promoted" // the main state once the winner was promoted
+)
+
+// Kinds of lineage edges
+const (
+	EdgeFork    = "fork"    // a fork was copied from a base state or another fork
+	EdgePromote = "promote" // a fork's state became the new main state
+)
+
+/*
+ * Lineage - the DAG of states a run went through: for every measured
+ * repetition of a test case, the base state, the forks its candidates ran
+ * on (forks of forks in beam mode) with their SQL, and the state the
+ * winner was promoted to. It is written to lineage.json in the run
+ * directory when the run finishes
+ */
+type Lineage struct {
+	RunID  string        `json:"run_id"`
+	Policy string        `json:"policy"`
+	Nodes  []LineageNode `json:"nodes"`
+	Edges  []LineageEdge `json:"edges"`
+	trees  int
+}
+
+// LineageNode - a state of the lineage
+type LineageNode struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	// Tree - the repetition of a test case the node belongs to, numbered
+	// from 0 in the order they ran
+	Tree             int    `json:"tree"`
+	TestCase         string `json:"test_case"`
+	TransactionCount int    `json:"transaction_count"`
+	Repetition       int    `json:"repetition"`
+	// Candidate, Branch, Depth, SQL, Winner and Error - of fork nodes
+	Candidate int    `json:"candidate"`
+	Branch    string `json:"branch,omitempty"`
+	Depth     int    `json:"depth,omitempty"`
+	SQL       string `json:"sql,omitempty"`
+	Winner    bool   `json:"winner,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// LineageEdge - a state derived from another
+type LineageEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Kind string `json:"kind"`
+}
+
+// BuildLineage - the lineage of records, e.g. loaded from a run's results
+func BuildLineage(runID string, policy string, records []Record) *Lineage {
+	lineage := &Lineage{RunID: runID, Policy: policy}
+	for _, record := range records {
+		lineage.Add(record)
+	}
+	return lineage
+}
+
+/*
+ * Add - adds the tree of one record. Candidates without a parent forked
+ * from the base state; the deepest winner is the one promoted, as every
+ * winner of a beam search lies on the best path
+ */
+func (l *Lineage) Add(record Record) {
+	tree := l.trees
+	l.trees++
+	node := func(kind string) LineageNode {
+		return LineageNode{Kind: kind, Tree: tree, TestCase: record.TestCase, TransactionCount: record.TransactionCount, Repetition: record.Repetition}
+	}
+
+	base := node(LineageBase)
+	base.ID = fmt.Sprintf("t%d_base", tree)
+	l.Nodes = append(l.Nodes, base)
+
+	var promoted *CandidateRecord
+	for i, c := range record.Candidates {
+		fork := node(LineageFork)
+		fork.ID = lineageForkID(tree, c.Index)
+		fork.Candidate, fork.Branch, fork.Depth, fork.SQL, fork.Winner, fork.Error = c.Index, c.Branch, c.Depth, c.SQL, c.Winner, c.Error
+		l.Nodes = append(l.Nodes, fork)
+
+		from := base.ID
+		if c.Parent >= 0 {
+			from = lineageForkID(tree, c.Parent)
+		}
+		l.Edges = append(l.Edges, LineageEdge{From: from, To: fork.ID, Kind: EdgeFork})
+		if c.Winner && (promoted == nil || c.Depth >= promoted.Depth) {
+			promoted = &record.Candidates[i]
+		}
+	}
+
+	if promoted != nil {
+		main := node(LineagePromoted)
+		main.ID = fmt.Sprintf("t%d_promoted", tree)
+		l.Nodes = append(l.Nodes, main)
+		l.Edges = append(l.Edges, LineageEdge{From: lineageForkID(tree, promoted.Index), To: main.ID, Kind: EdgePromote})
+	}
+}
+
+func lineageForkID(tree int, candidate int) string {
+	return fmt.Sprintf("t%d_c%d", tree, candidate)
+}
+
+// Write - writes the lineage to lineage.json in dir
+func (l *Lineage) Write(dir string) error {
+	b, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, LineageFile), b, 0644)
+}
+
+// ReadLineage - reads a lineage written by Write
+func ReadLineage(path string) (*Lineage, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lineage Lineage
+	if err := json.Unmarshal(b, &lineage); err != nil {
+		return nil, fmt.Errorf("error parsing lineage %s: %v", path, err)
+	}
+	return &lineage, nil
+}
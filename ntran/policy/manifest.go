@@ -0,0 +1,183 @@
+package policy
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Manifest - describes everything needed to interpret and reproduce a run.
+// It is written to manifest.json in the run directory when the run starts
+// and rewritten with the end time when it finishes.
+type Manifest struct {
+	RunID          string            `json:"run_id"`
+	Policy         string            `json:"policy"`
+	Flags          map[string]string `json:"flags"`
+	Seed           int64             `json:"seed"`
+	WorkloadHash   string            `json:"workload_hash"`
+	SchemaHash     string            `json:"schema_hash"`
+	GitRevision    string            `json:"git_revision"`
+	GoVersion      string            `json:"go_version"`
+	EngineVersions map[string]string `json:"engine_versions"`
+	Host           HostInfo          `json:"host"`
+	Format         string            `json:"format"`
+	ResultsFile    string            `json:"results_file"`
+	SummaryFile    string            `json:"summary_file"`
+	LogFile        string            `json:"log_file"`
+	LineageFile    string            `json:"lineage_file,omitempty"`
+	StartTime      time.Time         `json:"start_time"`
+	EndTime        *time.Time        `json:"end_time,omitempty"`
+	// ImportedFrom - the legacy results file this run was imported from, if any
+	ImportedFrom string `json:"imported_from,omitempty"`
+}
+
+type HostInfo struct {
+	Hostname      string `json:"hostname"`
+	OS            string `json:"os"`
+	Arch          string `json:"arch"`
+	NumCPU        int    `json:"num_cpu"`
+	CPUModel      string `json:"cpu_model"`
+	MemTotalBytes int64  `json:"mem_total_bytes"`
+}
+
+// EngineVersioner - implemented by policies that can report the version
+// of the database engine(s) they run against
+type EngineVersioner interface {
+	EngineVersions() map[string]string
+}
+
+const ManifestFile = "manifest.json"
+
+func (m *Manifest) Write(runDir string) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(runDir, ManifestFile), append(b, '\n'), 0666)
+}
+
+func ReadManifest(runDir string) (*Manifest, error) {
+	b, err := os.ReadFile(filepath.Join(runDir, ManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", ManifestFile, err)
+	}
+	return &m, nil
+}
+
+// WorkloadHash - a stable hash of the test case templates a run executes
+func WorkloadHash(templates map[string]Statement) string {
+	names := make([]string, 0, len(templates))
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s\x00%s\x00%s\x00", name, templates[name].Command, templates[name].Query)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// HashFiles - a stable hash over the contents of the given files
+func HashFiles(contents ...string) string {
+	h := sha256.New()
+	for _, c := range contents {
+		fmt.Fprintf(h, "%d\x00%s", len(c), c)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// GitRevision - the revision ntran was built from, preferring the
+// information stamped by `go build` and falling back to asking git
+// (e.g. under `go run`). Marked "-dirty" when there are local changes.
+func GitRevision() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		var revision string
+		var modified bool
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				revision = setting.Value
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+		if revision != "" {
+			if modified {
+				revision += "-dirty"
+			}
+			return revision
+		}
+	}
+
+	out, err := exec.Command("git", "rev-parse", "HEAD").Output()
+	if err != nil {
+		return "unknown"
+	}
+	revision := strings.TrimSpace(string(out))
+	status, err := exec.Command("git", "status", "--porcelain", "--untracked-files=no").Output()
+	if err == nil && len(strings.TrimSpace(string(status))) > 0 {
+		revision += "-dirty"
+	}
+	return revision
+}
+
+func GoVersion() string {
+	return runtime.Version()
+}
+
+// Host - describes the machine the run executes on. CPU model and memory
+// are read from /proc and left empty where it is unavailable
+func Host() HostInfo {
+	hostname, _ := os.Hostname()
+	info := HostInfo{
+		Hostname: hostname,
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		NumCPU:   runtime.NumCPU(),
+	}
+
+	if f, err := os.Open("/proc/cpuinfo"); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			key, value, ok := strings.Cut(scanner.Text(), ":")
+			if ok && strings.TrimSpace(key) == "model name" {
+				info.CPUModel = strings.TrimSpace(value)
+				break
+			}
+		}
+		f.Close()
+	}
+
+	if f, err := os.Open("/proc/meminfo"); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "MemTotal:" {
+				if kb, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+					info.MemTotalBytes = kb * 1024
+				}
+				break
+			}
+		}
+		f.Close()
+	}
+
+	return info
+}
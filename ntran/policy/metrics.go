@@ -0,0 +1,90 @@
+package policy
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Kinds of forks counted by the open forks gauge
+const (
+	forkSavepoint   = "savepoint"
+	forkTransaction = "duckdb-transaction"
+	forkInstance    = "duckdb-instance"
+	forkBranch      = "neon-branch"
+	forkDatabase    = "postgres-database"
+)
+
+// latencyBuckets - from 100µs to ~100s, covering DuckDB through Neon
+var latencyBuckets = prometheus.ExponentialBuckets(0.0001, 4, 11)
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	candidatesStarted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ntran_candidates_started_total",
+		Help: "Candidate transactions started.",
+	}, []string{"policy"})
+	candidatesFinished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ntran_candidates_finished_total",
+		Help: "Candidate transactions finished, successfully or not.",
+	}, []string{"policy"})
+	candidatesFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ntran_candidates_failed_total",
+		Help: "Candidate transactions that failed to execute.",
+	}, []string{"policy"})
+	forkLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ntran_fork_duration_seconds",
+		Help:    "Time to create the forks of a test case.",
+		Buckets: latencyBuckets,
+	}, []string{"policy"})
+	executionLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ntran_candidate_duration_seconds",
+		Help:    "Time to execute a single candidate transaction.",
+		Buckets: latencyBuckets,
+	}, []string{"policy"})
+	consensusLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ntran_consensus_duration_seconds",
+		Help:    "Time to choose the winning candidate of a test case.",
+		Buckets: latencyBuckets,
+	}, []string{"policy"})
+	openForks = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ntran_open_forks",
+		Help: "Savepoints, DuckDB transactions and instances, Neon branches and Postgres databases currently open.",
+	}, []string{"kind"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		candidatesStarted,
+		candidatesFinished,
+		candidatesFailed,
+		forkLatency,
+		executionLatency,
+		consensusLatency,
+		openForks,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+}
+
+// ServeMetrics - serves the metrics of the running experiment in the
+// Prometheus/OpenMetrics exposition format on addr at /metrics
+func ServeMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{EnableOpenMetrics: true}))
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	return server.ListenAndServe()
+}
+
+// observePhase - feeds the phase histograms from a benchmark's phases
+func observePhase(policy string, phase string, d time.Duration) {
+	switch phase {
+	case PhaseFork:
+		forkLatency.WithLabelValues(policy).Observe(d.Seconds())
+	case PhaseConsensus:
+		consensusLatency.WithLabelValues(policy).Observe(d.Seconds())
+	}
+}
@@ -1,6 +1,7 @@
 package policy
 
 import (
+	"context"
 	"fmt"
 )
 
@@ -10,11 +11,11 @@ type Policy interface {
 	// GetNumTransactionsInFlight - gets the slices of numbers of concurrent transactions to test
 	GetNumTransactionsInFlight() []int
 	// Scaffold - creates the database schema
-	Scaffold(sql string, inFlight int) error
+	Scaffold(ctx context.Context, sql string, inFlight int) error
 	// Execute - executes each SQL command and query
-	Execute(testCase TestCase, experiment *Experiment) error
+	Execute(ctx context.Context, testCase TestCase, experiment *Experiment) error
 	// Cleanup - resets the DBMS state back to pre-scaffolding state
-	Cleanup(sql string) error
+	Cleanup(ctx context.Context, sql string) error
 }
 
 func CreateClient(policy string) (Policy, error) {
@@ -24,6 +25,7 @@ func CreateClient(policy string) (Policy, error) {
 		&DuckDBSerialClient{},
 		&ColdNeonDBClient{},
 		&PreWarmNeonDBClient{},
+		&PostgresTemplateClient{},
 	}
 
 	for _, client := range clientRegistry {
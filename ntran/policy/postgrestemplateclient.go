@@ -0,0 +1,431 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/joho/godotenv"
+)
+
+// templateMainDB - the database holding the main state, which forks are copied from
+const templateMainDB = "ntran_main"
+
+/*
+ * PostgresTemplateClient - forks the main database once per candidate with
+ * CREATE DATABASE ... TEMPLATE, executes the candidates in parallel on
+ * their own database, then renames the winner's database to become the
+ * new main database and drops the rest
+ */
+type PostgresTemplateClient struct {
+	serverConnStr string
+	forks         []BranchInfo
+	// conns - connections to the forks open for Fork, in the order of forks
+	conns []*directFork
+	// forkSeq - numbers fork databases uniquely while forks are open
+	forkSeq int
+	// mainHistory - databases that were main before a promotion
+	mainHistory
+}
+
+func (c *PostgresTemplateClient) GetName() string {
+	return "postgres-template"
+}
+
+func (c *PostgresTemplateClient) GetNumTransactionsInFlight() []int {
+	return []int{2, 4, 8, 16, 32}
+}
+
+func (c *PostgresTemplateClient) loadConnStr() error {
+	err := godotenv.Load()
+	if err != nil {
+		return fmt.Errorf("error loading .env file")
+	}
+	c.serverConnStr = os.Getenv("TEMPLATE_DATABASE_URL")
+	return nil
+}
+
+func (c *PostgresTemplateClient) EngineVersions() map[string]string {
+	if err := c.loadConnStr(); err != nil {
+		return map[string]string{"postgres": fmt.Sprintf("unknown: %v", err)}
+	}
+	return map[string]string{"postgres": postgresVersion(c.serverConnStr)}
+}
+
+// databaseConnStr - the connection string of another database on the server
+func (c *PostgresTemplateClient) databaseConnStr(name string) (string, error) {
+	u, err := url.Parse(c.serverConnStr)
+	if err != nil {
+		return "", fmt.Errorf("TEMPLATE_DATABASE_URL must be a postgres:// URL: %v", err)
+	}
+	u.Path = "/" + name
+	return u.String(), nil
+}
+
+// exec - runs statements that cannot run inside the databases they change
+// (CREATE, ALTER and DROP DATABASE) on the server's own database
+func (c *PostgresTemplateClient) exec(ctx context.Context, statements ...string) error {
+	conn, err := pgx.Connect(ctx, c.serverConnStr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+
+	for _, statement := range statements {
+		if _, err := conn.Exec(ctx, statement); err != nil {
+			return fmt.Errorf("error executing %q: %v", statement, err)
+		}
+	}
+	return nil
+}
+
+func (c *PostgresTemplateClient) Scaffold(ctx context.Context, sql string, inFlight int) error {
+	err := c.loadConnStr()
+	if err != nil {
+		return err
+	}
+	err = c.exec(ctx,
+		"DROP DATABASE IF EXISTS "+templateMainDB,
+		"CREATE DATABASE "+templateMainDB,
+	)
+	if err != nil {
+		return err
+	}
+
+	mainConnStr, err := c.databaseConnStr(templateMainDB)
+	if err != nil {
+		return err
+	}
+	conn, err := pgx.Connect(ctx, mainConnStr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+
+	_, err = conn.Exec(ctx, sql)
+	return err
+}
+
+// fork - copies the template database, main or another fork's, into a new
+// database for a candidate
+func (c *PostgresTemplateClient) fork(ctx context.Context, name string, template string) (BranchInfo, error) {
+	if err := c.exec(ctx, fmt.Sprintf("CREATE DATABASE %s TEMPLATE %s", name, template)); err != nil {
+		return BranchInfo{}, err
+	}
+	openForks.WithLabelValues(forkDatabase).Inc()
+	connStr, err := c.databaseConnStr(name)
+	return BranchInfo{Name: name, ConnStr: connStr}, err
+}
+
+func (c *PostgresTemplateClient) dropForks(ctx context.Context) error {
+	for _, fork := range c.forks {
+		if err := c.exec(ctx, "DROP DATABASE IF EXISTS "+fork.Name); err != nil {
+			return err
+		}
+		openForks.WithLabelValues(forkDatabase).Dec()
+	}
+	c.forks = nil
+	return nil
+}
+
+func (c *PostgresTemplateClient) Execute(ctx context.Context, testCase TestCase, experiment *Experiment) error {
+	benchmark := Benchmark{
+		Experiment:       experiment,
+		Policy:           c.GetName(),
+		TestCase:         testCase.Name,
+		TransactionCount: len(testCase.Statements),
+		Forks:            c,
+	}
+	benchmark.Start(ctx)
+
+	// a database may only be copied while nothing is connected to it, so
+	// forks are created one at a time
+	benchmark.Phase(PhaseFork)
+	for i := range testCase.Statements {
+		fork, err := c.fork(ctx, fmt.Sprintf("ntran_fork_%d", i), templateMainDB)
+		if err != nil {
+			return errors.Join(err, c.dropForks(ctx))
+		}
+		c.forks = append(c.forks, fork)
+	}
+
+	benchmark.Phase(PhaseExecute)
+	var results []ExecutionResult
+	ch := make(chan ExecutionResult)
+	var wg sync.WaitGroup
+
+	for i, statement := range testCase.Statements {
+		wg.Add(1)
+		candidateCtx, _ := benchmark.StartCandidate(i)
+		go executeBranchInfo(candidateCtx, i, statement, c.forks[i], &wg, ch)
+	}
+
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+
+	for result := range ch {
+		benchmark.Candidate(result)
+		if result.Error == nil {
+			results = append(results, result)
+		}
+	}
+	if len(results) == 0 {
+		return fmt.Errorf("every candidate failed")
+	}
+
+	benchmark.Phase(PhaseConsensus)
+	idx := rng.Intn(len(results))
+	benchmark.Winner(results[idx].Index)
+	winner := c.forks[results[idx].Index]
+
+	benchmark.Phase(PhasePromote)
+	if err := c.promote(ctx, winner); err != nil {
+		return err
+	}
+
+	benchmark.Phase(PhaseTeardown)
+	if err := c.dropForks(ctx); err != nil {
+		return err
+	}
+
+	benchmark.End()
+	benchmark.Log()
+	return nil
+}
+
+// promote - the winner's database already holds its state, so it replaces
+// main; the other forks are left for dropForks. Main is renamed out of the
+// way first, and renamed back if the winner cannot take its name, then
+// dropped unless history is kept
+func (c *PostgresTemplateClient) promote(ctx context.Context, winner BranchInfo) error {
+	replaced := templateMainDB + "_replaced"
+	if c.keeping() {
+		replaced = c.next(templateMainDB + "_history_")
+	} else if err := c.exec(ctx, "DROP DATABASE IF EXISTS "+replaced); err != nil {
+		return err
+	}
+	if err := c.exec(ctx, fmt.Sprintf("ALTER DATABASE %s RENAME TO %s", templateMainDB, replaced)); err != nil {
+		return err
+	}
+	if err := c.exec(ctx, fmt.Sprintf("ALTER DATABASE %s RENAME TO %s", winner.Name, templateMainDB)); err != nil {
+		return errors.Join(err, c.exec(ctx, fmt.Sprintf("ALTER DATABASE %s RENAME TO %s", replaced, templateMainDB)))
+	}
+	openForks.WithLabelValues(forkDatabase).Dec()
+	losers := c.forks[:0]
+	for _, fork := range c.forks {
+		if fork.Name != winner.Name {
+			losers = append(losers, fork)
+		}
+	}
+	c.forks = losers
+
+	if !c.keeping() {
+		return c.exec(ctx, "DROP DATABASE "+replaced)
+	}
+	return c.dropHistory(ctx, c.push(replaced))
+}
+
+// Fork - copies the main database once per fork, as Execute does
+func (c *PostgresTemplateClient) Fork(ctx context.Context, n int) ([]Fork, error) {
+	if len(c.forks) > 0 {
+		return nil, ErrForksOpen
+	}
+	return c.ForkFrom(ctx, nil, n)
+}
+
+// ForkFrom - copies parent's database, or the main database, once per fork.
+// The parent's connection is closed while it is copied and then reopened
+func (c *PostgresTemplateClient) ForkFrom(ctx context.Context, parent Fork, n int) ([]Fork, error) {
+	template := templateMainDB
+	var source *directFork
+	if parent != nil {
+		i := forkIndex(c.conns, parent)
+		if i < 0 {
+			return nil, fmt.Errorf("fork %s is not open", parent.Name())
+		}
+		source, template = c.conns[i], c.forks[i].Name
+		source.mu.Lock()
+		defer source.mu.Unlock()
+		source.close()
+	}
+
+	branches := make([]BranchInfo, 0, n)
+	for range n {
+		branch, err := c.fork(ctx, fmt.Sprintf("ntran_fork_%d", c.forkSeq), template)
+		c.forkSeq++
+		if err != nil {
+			c.dropDatabases(ctx, branches)
+			return nil, errors.Join(err, c.reconnect(ctx, source, template))
+		}
+		branches = append(branches, branch)
+	}
+	// connections are only opened once every copy is made, since a
+	// database cannot be copied while anything is connected to it
+	if err := c.reconnect(ctx, source, template); err != nil {
+		c.dropDatabases(ctx, branches)
+		return nil, err
+	}
+
+	var log []loggedStatement
+	if source != nil {
+		log = source.log
+	}
+	forks := make([]Fork, 0, n)
+	for i, branch := range branches {
+		fork, err := connectFork(ctx, branch)
+		if err != nil {
+			c.Release(ctx, forks...)
+			c.dropDatabases(ctx, branches[i:])
+			return nil, err
+		}
+		fork.log = slices.Clone(log)
+		c.forks = append(c.forks, branch)
+		c.conns = append(c.conns, fork)
+		forks = append(forks, fork)
+	}
+	return forks, nil
+}
+
+// reconnect - reopens the connection of a fork that was copied, keeping the
+// fork its callers hold; the caller holds its mu
+func (c *PostgresTemplateClient) reconnect(ctx context.Context, fork *directFork, name string) error {
+	if fork == nil {
+		return nil
+	}
+	connStr, err := c.databaseConnStr(name)
+	if err != nil {
+		return err
+	}
+	conn, err := pgx.Connect(ctx, connStr)
+	if err != nil {
+		return fmt.Errorf("error reconnecting to fork %s: %v", name, err)
+	}
+	fork.db = pgxQuerier{conn}
+	fork.close = func() error { return conn.Close(context.Background()) }
+	return nil
+}
+
+// dropDatabases - drops the databases of forks that were never opened
+func (c *PostgresTemplateClient) dropDatabases(ctx context.Context, branches []BranchInfo) error {
+	for _, branch := range branches {
+		if err := c.exec(ctx, "DROP DATABASE IF EXISTS "+branch.Name); err != nil {
+			return err
+		}
+		openForks.WithLabelValues(forkDatabase).Dec()
+	}
+	return nil
+}
+
+// Release - closes the connections to forks and drops their databases
+func (c *PostgresTemplateClient) Release(ctx context.Context, forks ...Fork) error {
+	for _, fork := range forks {
+		i := forkIndex(c.conns, fork)
+		if i < 0 {
+			continue
+		}
+		closeForks(c.conns[i : i+1])
+		if err := c.dropDatabases(ctx, c.forks[i:i+1]); err != nil {
+			return err
+		}
+		c.forks = slices.Delete(c.forks, i, i+1)
+		c.conns = slices.Delete(c.conns, i, i+1)
+	}
+	return nil
+}
+
+// Promote - renames the winner's database to main and drops the rest
+func (c *PostgresTemplateClient) Promote(ctx context.Context, winner int) error {
+	if err := checkWinner(winner, len(c.forks)); err != nil {
+		return err
+	}
+	return c.PromoteFork(ctx, c.conns[winner])
+}
+
+// PromoteFork - renames fork's database to main and drops the rest; it
+// already holds the state of its whole path
+func (c *PostgresTemplateClient) PromoteFork(ctx context.Context, fork Fork) error {
+	i := forkIndex(c.conns, fork)
+	if i < 0 {
+		return fmt.Errorf("fork %s is not open", fork.Name())
+	}
+	// databases cannot be renamed or dropped while connected to
+	closeForks(c.conns)
+	c.conns = nil
+	if err := c.promote(ctx, c.forks[i]); err != nil {
+		return err
+	}
+	return c.dropForks(ctx)
+}
+
+// Discard - drops every fork's database
+func (c *PostgresTemplateClient) Discard(ctx context.Context) error {
+	closeForks(c.conns)
+	c.conns = nil
+	c.forkSeq = 0
+	return c.dropForks(ctx)
+}
+
+// Revert - makes the database that was main n promotions ago main again,
+// dropping main and the databases kept since
+func (c *PostgresTemplateClient) Revert(ctx context.Context, n int) error {
+	if len(c.forks) > 0 {
+		return ErrForksOpen
+	}
+	kept, newer, err := c.revert(n)
+	if err != nil {
+		return err
+	}
+	err = c.exec(ctx,
+		"DROP DATABASE "+templateMainDB,
+		fmt.Sprintf("ALTER DATABASE %s RENAME TO %s", kept, templateMainDB),
+	)
+	if err != nil {
+		return err
+	}
+	return c.dropHistory(ctx, newer)
+}
+
+// dropHistory - drops databases that were main
+func (c *PostgresTemplateClient) dropHistory(ctx context.Context, databases []string) error {
+	for _, database := range databases {
+		if err := c.exec(ctx, "DROP DATABASE IF EXISTS "+database); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ForkSizes - every fork is a full physical copy of main
+func (c *PostgresTemplateClient) ForkSizes(ctx context.Context) (int64, map[string]int64, error) {
+	base, err := postgresDatabaseSize(ctx, c.serverConnStr, templateMainDB)
+	if err != nil {
+		return 0, nil, err
+	}
+	forks := make(map[string]int64, len(c.forks))
+	for _, fork := range c.forks {
+		size, err := postgresDatabaseSize(ctx, c.serverConnStr, fork.Name)
+		if err != nil {
+			return 0, nil, err
+		}
+		forks[fork.Name] = size
+	}
+	return base, forks, nil
+}
+
+// Cleanup - dropping the main database undoes everything the schema created
+func (c *PostgresTemplateClient) Cleanup(ctx context.Context, sql string) error {
+	if err := c.Discard(ctx); err != nil {
+		return err
+	}
+	if err := c.dropHistory(ctx, c.clear()); err != nil {
+		return err
+	}
+	return c.exec(ctx, "DROP DATABASE IF EXISTS "+templateMainDB)
+}
@@ -2,46 +2,88 @@ package policy
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/jackc/pgx/v5"
-	"golang.org/x/exp/rand"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type PreWarmNeonDBClient struct {
 	ColdNeonDBClient
 	branches          []BranchInfo
 	defaultBranchName string
+	forkDuration      time.Duration
+	// conns - connections to the branches open for Fork
+	conns []*directFork
 }
 
-func (c *PreWarmNeonDBClient) addCompute(branchName string) {
-	c.runNeonCmd("read_write endpoint already exists", "branch", "add-compute", branchName, "--type", "read_write")
+func (c *PreWarmNeonDBClient) addCompute(branchName string) error {
+	_, err := c.runNeonCmd("read_write endpoint already exists", "branch", "add-compute", branchName, "--type", "read_write")
+	return err
 }
 
-func (c *PreWarmNeonDBClient) moveBranchesToTargetHead(targetBranchName string) {
+/*
+ * moveBranchesToTargetHead - restores every branch but the target to the
+ * target's head. When history is kept, previous (the default branch the
+ * target replaced) has its timeline preserved under another branch, whose
+ * head is kept as the state before the promotion, even when it is not a
+ * prewarmed branch, as main is until the first promotion
+ */
+func (c *PreWarmNeonDBClient) moveBranchesToTargetHead(targetBranchName string, previous ...string) error {
+	names := make([]string, 0, len(c.branches)+len(previous))
 	for _, branch := range c.branches {
-		if branch.Name != targetBranchName {
-			c.moveBranchToHead(branch.Name, targetBranchName)
+		names = append(names, branch.Name)
+	}
+	if c.keeping() {
+		for _, name := range previous {
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
 		}
 	}
+
+	for _, branchName := range names {
+		if branchName == targetBranchName {
+			continue
+		}
+		if c.keeping() && slices.Contains(previous, branchName) {
+			name := c.next("history_")
+			if err := c.moveBranchToHead(branchName, targetBranchName, "--preserve-under-name", name); err != nil {
+				return err
+			}
+			c.preserved(branchName, name)
+			c.push(name)
+			continue
+		}
+		if err := c.moveBranchToHead(branchName, targetBranchName); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (c *PreWarmNeonDBClient) renameBranch(oldBranchName string, newBranchName string) {
-	c.runNeonCmd(fmt.Sprintf("Branch %s not found", oldBranchName), "branch", "rename", oldBranchName, newBranchName)
+func (c *PreWarmNeonDBClient) renameBranch(oldBranchName string, newBranchName string) error {
+	_, err := c.runNeonCmd(fmt.Sprintf("Branch %s not found", oldBranchName), "branch", "rename", oldBranchName, newBranchName)
+	return err
 }
 
-func (c *PreWarmNeonDBClient) makeBranchDefault(branchName string) {
-	c.runNeonCmd("", "branch", "set-default", branchName)
+func (c *PreWarmNeonDBClient) makeBranchDefault(branchName string) error {
+	if _, err := c.runNeonCmd("", "branch", "set-default", branchName); err != nil {
+		return err
+	}
 	c.defaultBranchName = branchName
+	return nil
 }
 
-func (c *PreWarmNeonDBClient) moveBranchToHead(branchName string, targetBranchName string, arg ...string) {
+func (c *PreWarmNeonDBClient) moveBranchToHead(branchName string, targetBranchName string, arg ...string) error {
 	args := []string{"branch", "restore", branchName, targetBranchName}
 	args = append(args, arg...)
-	c.runNeonCmd("", args...)
+	_, err := c.runNeonCmd("", args...)
+	return err
 }
 
 func (c *PreWarmNeonDBClient) GetName() string {
@@ -52,83 +94,112 @@ func (c *PreWarmNeonDBClient) GetNumTransactionsInFlight() []int {
 	return []int{2, 4, 6, 7, 8}
 }
 
-func (c *PreWarmNeonDBClient) Scaffold(schema string, inFlight int) error {
-	err := c.ColdNeonDBClient.Scaffold(schema, inFlight)
+func (c *PreWarmNeonDBClient) Scaffold(ctx context.Context, schema string, inFlight int) error {
+	if inFlight > 10 {
+		return fmt.Errorf("prewarm-neondb can only handle 10 concurrent branches, so inFlight must be at most 10, got %d", inFlight)
+	}
+	err := c.ColdNeonDBClient.Scaffold(ctx, schema, inFlight)
 	if err != nil {
 		return err
 	}
-	if inFlight > 10 {
-		log.Fatalf("error scaffolding smartneondb. Can only handle 10 concurrent branches, so inFlight must be at most 10")
-	}
 
 	/*
 	 * 1. create (inFlight-1) extra branches
 	 * 2. turn main into the last branch with active compute
 	 * 3. have an archived branch (with no compute) as the parent to all branches
 	 */
+	forkStart := time.Now()
 	for i := 0; i < inFlight-1; i++ {
 		db := fmt.Sprintf("db_%v", i)
-		connStr := c.createBranch(db)
+		connStr, err := c.createBranch(db, "")
+		if err != nil {
+			return err
+		}
 		c.branches = append(c.branches, BranchInfo{Name: db, ConnStr: connStr})
 	}
 	lastdb := fmt.Sprintf("db_%v", inFlight)
-	c.moveBranchToHead("main", "db_0", "--preserve-under-name", "oldmain")
-	c.moveBranchToHead("main", "oldmain")
-	c.renameBranch("main", lastdb)
-	c.renameBranch("oldmain", "main")
-	c.makeBranchDefault("main")
-	c.branches = append(c.branches, BranchInfo{Name: lastdb, ConnStr: c.getConnectionString(lastdb)})
+	steps := []func() error{
+		func() error { return c.moveBranchToHead("main", "db_0", "--preserve-under-name", "oldmain") },
+		func() error { return c.moveBranchToHead("main", "oldmain") },
+		func() error { return c.renameBranch("main", lastdb) },
+		func() error { return c.renameBranch("oldmain", "main") },
+		func() error { return c.makeBranchDefault("main") },
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return fmt.Errorf("error scaffolding prewarm-neondb: %v", err)
+		}
+	}
+	connStr, err := c.getConnectionString(lastdb)
+	if err != nil {
+		return err
+	}
+	c.branches = append(c.branches, BranchInfo{Name: lastdb, ConnStr: connStr})
+	c.forkDuration = time.Since(forkStart)
 	return nil
 }
 
-func executeBranchInfo(statement Statement, branchInfo BranchInfo, wg *sync.WaitGroup, ch chan ExecutionResult) {
+func executeBranchInfo(ctx context.Context, index int, statement Statement, branchInfo BranchInfo, wg *sync.WaitGroup, ch chan ExecutionResult) {
 	defer wg.Done()
+	start := time.Now()
+	send := func(result ExecutionResult) {
+		result.Index = index
+		result.BranchName = branchInfo.Name
+		result.Statement = statement
+		result.Duration = time.Since(start)
+		EndCandidate(trace.SpanFromContext(ctx), result)
+		ch <- result
+	}
 
 	var rows pgx.Rows
 	var values []any
 
-	conn, err := pgx.Connect(context.Background(), branchInfo.ConnStr)
+	conn, err := pgx.Connect(ctx, branchInfo.ConnStr)
 	if err != nil {
-		ch <- ExecutionResult{Error: err}
+		send(ExecutionResult{Error: err})
 		return
 	}
-	defer conn.Close(context.Background())
+	defer conn.Close(ctx)
 
 	if statement.Command != "" {
 
-		_, err := conn.Exec(context.Background(), statement.Command)
+		_, err := conn.Exec(ctx, statement.Command)
 		if err != nil {
-			ch <- ExecutionResult{Error: err}
+			send(ExecutionResult{Error: err})
 			return
 		}
 	} else {
-		rows, err = conn.Query(context.Background(), statement.Query)
+		rows, err = conn.Query(ctx, statement.Query)
 		if err != nil {
-			ch <- ExecutionResult{Error: err}
+			send(ExecutionResult{Error: err})
 			return
 		}
 		if rows.Next() {
 			values, err = rows.Values()
 			if err != nil {
-				ch <- ExecutionResult{Error: err}
+				send(ExecutionResult{Error: err})
 				return
 			}
 		}
 	}
 
-	ch <- ExecutionResult{BranchName: branchInfo.Name, Statement: statement, Values: values}
+	send(ExecutionResult{Values: values})
 }
 
-func (c *PreWarmNeonDBClient) Execute(testCase TestCase, experiment *Experiment) error {
-	rand.Seed(uint64(time.Now().UnixNano()))
+func (c *PreWarmNeonDBClient) Execute(ctx context.Context, testCase TestCase, experiment *Experiment) error {
 	benchmark := Benchmark{
 		Experiment:       experiment,
 		Policy:           c.GetName(),
 		TestCase:         testCase.Name,
 		TransactionCount: len(testCase.Statements),
+		Forks:            c,
 	}
-	benchmark.Start()
+	benchmark.Start(ctx)
+	// branches are forked up front in Scaffold and are reused, so
+	// there is no teardown between test cases
+	benchmark.AddPhase(PhaseFork, c.forkDuration)
 
+	benchmark.Phase(PhaseExecute)
 	var results []ExecutionResult
 	ch := make(chan ExecutionResult)
 	var wg sync.WaitGroup
@@ -136,7 +207,8 @@ func (c *PreWarmNeonDBClient) Execute(testCase TestCase, experiment *Experiment)
 	for i, statement := range testCase.Statements {
 		wg.Add(1)
 		branchInfo := c.branches[i]
-		go executeBranchInfo(statement, branchInfo, &wg, ch)
+		candidateCtx, _ := benchmark.StartCandidate(i)
+		go executeBranchInfo(candidateCtx, i, statement, branchInfo, &wg, ch)
 	}
 
 	go func() {
@@ -145,38 +217,191 @@ func (c *PreWarmNeonDBClient) Execute(testCase TestCase, experiment *Experiment)
 	}()
 
 	for result := range ch {
+		benchmark.Candidate(result)
 		if result.Error == nil {
 			results = append(results, result)
-		} else {
-			log.Printf("error encountered while executing statement: %v", result.Error)
 		}
 	}
+	if len(results) == 0 {
+		return fmt.Errorf("every candidate failed")
+	}
 
 	// dummy "consensus" step here -- take a random one.
-	idx := rand.Intn(len(results))
+	benchmark.Phase(PhaseConsensus)
+	idx := rng.Intn(len(results))
+	benchmark.Winner(results[idx].Index)
 	winningBranchName := results[idx].BranchName
-	c.makeBranchDefault(winningBranchName)
-	c.moveBranchesToTargetHead(winningBranchName)
+
+	benchmark.Phase(PhasePromote)
+	if err := c.makeBranchDefault(winningBranchName); err != nil {
+		return err
+	}
+	if err := c.moveBranchesToTargetHead(winningBranchName); err != nil {
+		return err
+	}
 
 	benchmark.End()
 	benchmark.Log()
 	return nil
 }
 
-func (c *PreWarmNeonDBClient) Cleanup(sql string) error {
+/*
+ * Fork - connects to prewarmed branches rather than creating any. The
+ * default branch holds the main state, so it is never a fork, and at most
+ * inFlight branches (inFlight-1 once a fork has been promoted) are available
+ */
+func (c *PreWarmNeonDBClient) Fork(ctx context.Context, n int) ([]Fork, error) {
+	if len(c.conns) > 0 || len(c.forks) > 0 {
+		return nil, ErrForksOpen
+	}
+	var available []BranchInfo
+	for _, branch := range c.branches {
+		if branch.Name != c.defaultBranchName {
+			available = append(available, branch)
+		}
+	}
+	if n > len(available) {
+		return nil, fmt.Errorf("only %d prewarmed branches are available, scaffold with a larger inFlight", len(available))
+	}
+
+	forks := make([]Fork, n)
+	for i, branch := range available[:n] {
+		fork, err := connectFork(ctx, branch)
+		if err != nil {
+			c.Discard(ctx)
+			return nil, err
+		}
+		c.conns = append(c.conns, fork)
+		forks[i] = fork
+	}
+	return forks, nil
+}
+
+/*
+ * ForkFrom - creates a branch of parent's branch, or of the default branch,
+ * per fork. Prewarmed branches cannot be forked into more than once, so
+ * tree search creates branches as cold-neondb does
+ */
+func (c *PreWarmNeonDBClient) ForkFrom(ctx context.Context, parent Fork, n int) ([]Fork, error) {
+	parentName := c.defaultBranchName
+	if parent != nil {
+		if forkIndex(c.conns, parent) < 0 && forkIndex(c.forks, parent) < 0 {
+			return nil, fmt.Errorf("fork %s is not open", parent.Name())
+		}
+		parentName = parent.Name()
+	}
+	// the prewarmed branches are named db_<i>
+	return c.forkBranches(ctx, "tree", parentName, parentLog(parent), n)
+}
+
+// Release - closes the connections to forks, prewarmed or created
+func (c *PreWarmNeonDBClient) Release(ctx context.Context, forks ...Fork) error {
+	var errs []error
+	for _, fork := range forks {
+		if i := forkIndex(c.conns, fork); i >= 0 {
+			errs = append(errs, closeForks(c.conns[i:i+1]))
+			c.conns = slices.Delete(c.conns, i, i+1)
+		}
+	}
+	return errors.Join(append(errs, c.ColdNeonDBClient.Release(ctx, forks...))...)
+}
+
+// Promote - makes the winner the default branch and moves the other
+// branches to its head, as Execute does
+func (c *PreWarmNeonDBClient) Promote(ctx context.Context, winner int) error {
+	if err := checkWinner(winner, len(c.conns)); err != nil {
+		return err
+	}
+	winningBranchName := c.conns[winner].name
+	previous := c.defaultBranchName
+	err := closeForks(c.conns)
+	c.conns = nil
+	if defaultErr := c.makeBranchDefault(winningBranchName); defaultErr != nil {
+		return errors.Join(err, defaultErr)
+	}
+	return errors.Join(err, c.moveBranchesToTargetHead(winningBranchName, previous))
+}
+
+/*
+ * PromoteFork - promotes a prewarmed fork as Promote does. Created forks
+ * are not prewarmed, so the statements of their whole path are re-executed
+ * on the default branch instead, as cold-neondb does on main
+ */
+func (c *PreWarmNeonDBClient) PromoteFork(ctx context.Context, fork Fork) error {
+	if i := forkIndex(c.conns, fork); i >= 0 {
+		if err := c.ColdNeonDBClient.Discard(ctx); err != nil {
+			return err
+		}
+		return c.Promote(ctx, i)
+	}
+	i := forkIndex(c.forks, fork)
+	if i < 0 {
+		return fmt.Errorf("fork %s is not open", fork.Name())
+	}
+	connStr, err := c.getConnectionString(c.defaultBranchName)
+	if err != nil {
+		return err
+	}
+	state, err := c.branchState(ctx, c.defaultBranchName, connStr)
+	if err != nil {
+		return err
+	}
+	if err := promoteLog(ctx, connStr, c.forks[i].log); err != nil {
+		return err
+	}
+	c.keep(state)
+	return c.Discard(ctx)
+}
+
+// Revert - restores the default branch to the state of the default branch
+// n promotions ago, and moves every prewarmed branch to its head
+func (c *PreWarmNeonDBClient) Revert(ctx context.Context, n int) error {
+	if len(c.conns) > 0 || len(c.forks) > 0 || len(c.created) > 0 {
+		return ErrForksOpen
+	}
+	state, _, err := c.revert(n)
+	if err != nil {
+		return err
+	}
+	if err := c.restoreBranch(c.defaultBranchName, state); err != nil {
+		return err
+	}
+	return c.moveBranchesToTargetHead(c.defaultBranchName)
+}
+
+// Discard - deletes created branches and moves every prewarmed branch back
+// to the head of the default branch
+func (c *PreWarmNeonDBClient) Discard(ctx context.Context) error {
+	err := c.ColdNeonDBClient.Discard(ctx)
+	if len(c.conns) == 0 {
+		return err
+	}
+	err = errors.Join(err, closeForks(c.conns))
+	c.conns = nil
+	return errors.Join(err, c.moveBranchesToTargetHead(c.defaultBranchName))
+}
+
+func (c *PreWarmNeonDBClient) Cleanup(ctx context.Context, sql string) error {
+	if err := c.Discard(ctx); err != nil {
+		return err
+	}
 	currDefaultBranchName := c.defaultBranchName
+	var errs []error
 	for _, branchName := range c.branches {
 		if branchName.Name != currDefaultBranchName {
-			c.deleteBranch(branchName.Name)
+			errs = append(errs, c.deleteBranch(branchName.Name))
 		}
 	}
 
-	c.makeBranchDefault("main")
-	c.addCompute("main")
-
-	c.deleteBranch(currDefaultBranchName)
+	if err := c.makeBranchDefault("main"); err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+	errs = append(errs, c.addCompute("main"), c.deleteBranch(currDefaultBranchName))
 	c.branches = []BranchInfo{}
 
-	c.mainConnStr = c.getConnectionString("main")
-	return c.ColdNeonDBClient.Cleanup(sql)
+	var err error
+	if c.mainConnStr, err = c.getConnectionString("main"); err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+	return errors.Join(append(errs, c.ColdNeonDBClient.Cleanup(ctx, sql))...)
 }
@@ -0,0 +1,122 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// fakeNeon - a Neon project of branches, each with the state at its head,
+// standing in for the neon CLI
+type fakeNeon struct {
+	heads         map[string]string
+	defaultBranch string
+}
+
+func (f *fakeNeon) run(args ...string) (string, string, error) {
+	switch {
+	case len(args) == 3 && args[0] == "branch" && args[1] == "set-default":
+		if _, ok := f.heads[args[2]]; !ok {
+			return "", "", fmt.Errorf("branch %s not found", args[2])
+		}
+		f.defaultBranch = args[2]
+		return "", "", nil
+	case len(args) >= 4 && args[0] == "branch" && args[1] == "restore":
+		branch, source := args[2], args[3]
+		head, ok := f.heads[source]
+		if !ok {
+			return "", "", fmt.Errorf("branch %s not found", source)
+		}
+		if len(args) == 6 && args[4] == "--preserve-under-name" {
+			f.heads[args[5]] = f.heads[branch]
+		}
+		f.heads[branch] = head
+		return "", "", nil
+	}
+	return "", "", fmt.Errorf("unexpected neon command %v", args)
+}
+
+// newFakePrewarm - a prewarm-neondb client on a fake project with main and
+// n prewarmed branches at state s0, keeping depth states
+func newFakePrewarm(t *testing.T, n int, depth int) (*PreWarmNeonDBClient, *fakeNeon) {
+	neon := &fakeNeon{heads: map[string]string{"main": "s0"}, defaultBranch: "main"}
+	previous := neonCommand
+	neonCommand = neon.run
+	t.Cleanup(func() { neonCommand = previous })
+
+	c := &PreWarmNeonDBClient{defaultBranchName: "main"}
+	for i := range n {
+		name := fmt.Sprintf("db_%d", i)
+		neon.heads[name] = "s0"
+		c.branches = append(c.branches, BranchInfo{Name: name})
+	}
+	c.SetHistory(depth)
+	return c, neon
+}
+
+// promoteWrite - promotes branch as if a fork had written state to it
+func promoteWrite(t *testing.T, c *PreWarmNeonDBClient, neon *fakeNeon, branch string, state string) {
+	t.Helper()
+	neon.heads[branch] = state
+	c.conns = []*directFork{{name: branch}}
+	if err := c.Promote(context.Background(), 0); err != nil {
+		t.Fatalf("promoting %s: %v", branch, err)
+	}
+	if neon.defaultBranch != branch {
+		t.Fatalf("default branch is %s, want %s", neon.defaultBranch, branch)
+	}
+}
+
+func TestPreWarmPromoteKeepsMain(t *testing.T) {
+	c, neon := newFakePrewarm(t, 3, 2)
+	promoteWrite(t, c, neon, "db_0", "s1")
+	if got := c.History(); got != 1 {
+		t.Fatalf("History() = %d after one promotion, want 1", got)
+	}
+	for _, branch := range []string{"db_1", "db_2"} {
+		if got := neon.heads[branch]; got != "s1" {
+			t.Errorf("%s is at %s, want the winner's s1", branch, got)
+		}
+	}
+
+	if err := c.Revert(context.Background(), 1); err != nil {
+		t.Fatalf("Revert(1): %v", err)
+	}
+	for _, branch := range []string{"db_0", "db_1", "db_2"} {
+		if got := neon.heads[branch]; got != "s0" {
+			t.Errorf("%s is at %s after reverting, want s0", branch, got)
+		}
+	}
+}
+
+func TestPreWarmRevertSeveral(t *testing.T) {
+	c, neon := newFakePrewarm(t, 3, 2)
+	promoteWrite(t, c, neon, "db_0", "s1")
+	promoteWrite(t, c, neon, "db_1", "s2")
+	promoteWrite(t, c, neon, "db_2", "s3")
+	if got := c.History(); got != 2 {
+		t.Fatalf("History() = %d beyond depth 2", got)
+	}
+
+	if err := c.Revert(context.Background(), 2); err != nil {
+		t.Fatalf("Revert(2): %v", err)
+	}
+	if got := neon.heads["db_2"]; got != "s1" {
+		t.Errorf("default branch is at %s after reverting 2, want s1", got)
+	}
+	if err := c.Revert(context.Background(), 1); !errors.Is(err, ErrNoHistory) {
+		t.Errorf("Revert(1) with no states kept = %v, want ErrNoHistory", err)
+	}
+}
+
+func TestPreWarmPromoteWithoutHistory(t *testing.T) {
+	c, neon := newFakePrewarm(t, 2, 0)
+	promoteWrite(t, c, neon, "db_0", "s1")
+	if got := neon.heads["main"]; got != "s0" {
+		t.Errorf("main is at %s, want it left at s0 when no history is kept", got)
+	}
+	if err := c.Revert(context.Background(), 1); !errors.Is(err, ErrNoHistory) {
+		t.Errorf("Revert(1) = %v, want ErrNoHistory", err)
+	}
+}
@@ -0,0 +1,29 @@
+package policy
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// rng - the source of all randomness in winner selection, so that a run
+// can be reproduced from the seed recorded in its manifest
+var rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// rngMu - guards rng for Intn, whose callers may run concurrently
+var rngMu sync.Mutex
+
+// Seed - reseeds winner selection for every policy
+func Seed(seed int64) {
+	rngMu.Lock()
+	defer rngMu.Unlock()
+	rng = rand.New(rand.NewSource(seed))
+}
+
+// Intn - a random number in [0, n) from the seeded source, for winners
+// selected outside of a policy, e.g. by speculate.Random
+func Intn(n int) int {
+	rngMu.Lock()
+	defer rngMu.Unlock()
+	return rng.Intn(n)
+}
@@ -0,0 +1,153 @@
+package policy
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*
+ * Resources - what running one test case cost, the other side of the
+ * latency speculation buys. CPU time and peak RSS are of the whole ntran
+ * process (including embedded DuckDB), not of a Postgres or Neon server.
+ */
+type Resources struct {
+	// CPUTime - user and system CPU time of the process
+	CPUTime time.Duration
+	// PeakRSS - the peak resident set size of the process in bytes
+	PeakRSS int64
+	// AllocBytes - bytes allocated on the Go heap
+	AllocBytes int64
+	// Allocs - the number of Go heap allocations
+	Allocs int64
+	// ForkBytes - on-disk bytes the forks added at the end of the execute
+	// phase, when every fork exists and has been written to
+	ForkBytes int64
+	// BaseBytes - on-disk bytes of the base state the forks were made from
+	BaseBytes int64
+}
+
+// Amplification - the storage of the base state and its forks relative
+// to the base state alone, 0 when the base was not measured
+func (r Resources) Amplification() float64 {
+	if r.BaseBytes <= 0 {
+		return 0
+	}
+	return float64(r.BaseBytes+r.ForkBytes) / float64(r.BaseBytes)
+}
+
+func meanResources(resources []Resources) Resources {
+	var mean Resources
+	n := int64(len(resources))
+	if n == 0 {
+		return mean
+	}
+	for _, r := range resources {
+		mean.CPUTime += r.CPUTime
+		mean.PeakRSS += r.PeakRSS
+		mean.AllocBytes += r.AllocBytes
+		mean.Allocs += r.Allocs
+		mean.ForkBytes += r.ForkBytes
+		mean.BaseBytes += r.BaseBytes
+	}
+	mean.CPUTime /= time.Duration(n)
+	mean.PeakRSS /= n
+	mean.AllocBytes /= n
+	mean.Allocs /= n
+	mean.ForkBytes /= n
+	mean.BaseBytes /= n
+	return mean
+}
+
+// ForkSizer - implemented by policies whose forks take up storage that
+// can be measured: the size of the base state the forks were made from,
+// and the extra storage each fork adds on top of it keyed by fork
+// (branch) name
+type ForkSizer interface {
+	ForkSizes(ctx context.Context) (base int64, forks map[string]int64, err error)
+}
+
+// resourceSnapshot - the process counters at the start of a test case
+type resourceSnapshot struct {
+	cpuTime    time.Duration
+	allocBytes uint64
+	allocs     uint64
+}
+
+func takeResourceSnapshot() resourceSnapshot {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	return resourceSnapshot{
+		cpuTime:    cpuTime(),
+		allocBytes: memStats.TotalAlloc,
+		allocs:     memStats.Mallocs,
+	}
+}
+
+// since - the resources used since the snapshot, apart from ForkBytes
+func (s resourceSnapshot) since() Resources {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	return Resources{
+		CPUTime:    cpuTime() - s.cpuTime,
+		PeakRSS:    peakRSS(),
+		AllocBytes: int64(memStats.TotalAlloc - s.allocBytes),
+		Allocs:     int64(memStats.Mallocs - s.allocs),
+	}
+}
+
+func cpuTime() time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// resetPeakRSS - resets the peak RSS of the process so that it can be read
+// per test case, which Linux supports through /proc/self/clear_refs.
+// Elsewhere the peak is that of the whole process so far
+func resetPeakRSS() {
+	os.WriteFile("/proc/self/clear_refs", []byte("5"), 0)
+}
+
+// peakRSS - VmHWM from /proc/self/status, falling back to rusage
+func peakRSS() int64 {
+	if f, err := os.Open("/proc/self/status"); err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if value, ok := strings.CutPrefix(scanner.Text(), "VmHWM:"); ok {
+				kb, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimSpace(value), " kB"), 10, 64)
+				if err == nil {
+					return kb * 1024
+				}
+			}
+		}
+	}
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0
+	}
+	// kilobytes on Linux
+	return usage.Maxrss * 1024
+}
+
+// fileSizes - the size of each file that exists, along with its DuckDB
+// write-ahead log, keyed by name
+func fileSizes(paths map[string]string) map[string]int64 {
+	sizes := make(map[string]int64, len(paths))
+	for name, path := range paths {
+		for _, p := range []string{path, path + ".wal"} {
+			if info, err := os.Stat(p); err == nil {
+				sizes[name] += info.Size()
+			}
+		}
+	}
+	return sizes
+}
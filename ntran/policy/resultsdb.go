@@ -0,0 +1,232 @@
+package policy
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	_ "github.com/marcboeker/go-duckdb"
+
+	"ntran/stats"
+)
+
+/*
+ * ResultsDB - an embedded DuckDB database experiments append their runs,
+ * configurations, records, and per-candidate and per-depth records to, so
+ * that results across runs can be sliced with SQL. The schema is stable: columns are
+ * only ever added (see resultsMigrations), and every duration is an
+ * integer nanosecond column.
+ */
+type ResultsDB struct {
+	db *sql.DB
+}
+
+func resultsSchema() string {
+	var phaseColumns []string
+	for _, phase := range Phases {
+		phaseColumns = append(phaseColumns, fmt.Sprintf("\t%s_ns BIGINT,", phase))
+	}
+	return fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS runs (
+	run_id VARCHAR PRIMARY KEY,
+	policy VARCHAR,
+	seed BIGINT,
+	workload_hash VARCHAR,
+	schema_hash VARCHAR,
+	git_revision VARCHAR,
+	go_version VARCHAR,
+	start_time TIMESTAMP,
+	end_time TIMESTAMP,
+	manifest VARCHAR
+);
+
+CREATE TABLE IF NOT EXISTS configurations (
+	run_id VARCHAR,
+	policy VARCHAR,
+	test_case VARCHAR,
+	in_flight INTEGER,
+	n INTEGER,
+	mean_ns DOUBLE,
+	median_ns DOUBLE,
+	p95_ns DOUBLE,
+	p99_ns DOUBLE,
+	stddev_ns DOUBLE,
+	ci_low_ns DOUBLE,
+	ci_high_ns DOUBLE
+);
+
+CREATE TABLE IF NOT EXISTS records (
+	run_id VARCHAR,
+	policy VARCHAR,
+	test_case VARCHAR,
+	in_flight INTEGER,
+	repetition INTEGER,
+	duration_ns BIGINT,
+	total_ns BIGINT,
+%s
+	failures INTEGER
+);
+
+CREATE TABLE IF NOT EXISTS candidates (
+	run_id VARCHAR,
+	policy VARCHAR,
+	test_case VARCHAR,
+	in_flight INTEGER,
+	repetition INTEGER,
+	candidate INTEGER,
+	branch VARCHAR,
+	duration_ns BIGINT,
+	error VARCHAR,
+	winner BOOLEAN
+);
+
+CREATE TABLE IF NOT EXISTS depths (
+	run_id VARCHAR,
+	policy VARCHAR,
+	test_case VARCHAR,
+	in_flight INTEGER,
+	repetition INTEGER,
+	depth INTEGER,
+	forks INTEGER,
+	survivors INTEGER,
+	failures INTEGER,
+	duration_ns BIGINT,
+%s
+);
+`, strings.Join(phaseColumns, "\n"), strings.TrimSuffix(strings.Join(phaseColumns, "\n"), ","))
+}
+
+// resultsMigrations - columns added after a table was first created, which
+// databases written by earlier versions of ntran lack
+var resultsMigrations = []string{
+	"ALTER TABLE records ADD COLUMN IF NOT EXISTS cpu_time_ns BIGINT",
+	"ALTER TABLE records ADD COLUMN IF NOT EXISTS peak_rss_bytes BIGINT",
+	"ALTER TABLE records ADD COLUMN IF NOT EXISTS alloc_bytes BIGINT",
+	"ALTER TABLE records ADD COLUMN IF NOT EXISTS allocs BIGINT",
+	"ALTER TABLE records ADD COLUMN IF NOT EXISTS fork_bytes BIGINT",
+	"ALTER TABLE configurations ADD COLUMN IF NOT EXISTS mean_cpu_time_ns BIGINT",
+	"ALTER TABLE configurations ADD COLUMN IF NOT EXISTS mean_peak_rss_bytes BIGINT",
+	"ALTER TABLE configurations ADD COLUMN IF NOT EXISTS mean_alloc_bytes BIGINT",
+	"ALTER TABLE configurations ADD COLUMN IF NOT EXISTS mean_allocs BIGINT",
+	"ALTER TABLE configurations ADD COLUMN IF NOT EXISTS mean_fork_bytes BIGINT",
+	"ALTER TABLE records ADD COLUMN IF NOT EXISTS base_bytes BIGINT",
+	"ALTER TABLE configurations ADD COLUMN IF NOT EXISTS mean_base_bytes BIGINT",
+	"ALTER TABLE candidates ADD COLUMN IF NOT EXISTS bytes BIGINT",
+	"ALTER TABLE records ADD COLUMN IF NOT EXISTS depths INTEGER",
+	"ALTER TABLE records ADD COLUMN IF NOT EXISTS forks INTEGER",
+	"ALTER TABLE candidates ADD COLUMN IF NOT EXISTS depth INTEGER",
+	"ALTER TABLE candidates ADD COLUMN IF NOT EXISTS parent INTEGER",
+	"ALTER TABLE candidates ADD COLUMN IF NOT EXISTS sql VARCHAR",
+}
+
+func OpenResultsDB(path string) (*ResultsDB, error) {
+	db, err := sql.Open("duckdb", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open results database: %v", err)
+	}
+	if _, err := db.Exec(resultsSchema()); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create results schema: %v", err)
+	}
+	for _, migration := range resultsMigrations {
+		if _, err := db.Exec(migration); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to migrate results schema: %v", err)
+		}
+	}
+	return &ResultsDB{db: db}, nil
+}
+
+// WriteRun - inserts or updates the run described by manifest
+func (r *ResultsDB) WriteRun(manifest *Manifest) error {
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	var endTime any
+	if manifest.EndTime != nil {
+		endTime = *manifest.EndTime
+	}
+	_, err = r.db.Exec(`INSERT OR REPLACE INTO runs VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		manifest.RunID, manifest.Policy, manifest.Seed, manifest.WorkloadHash, manifest.SchemaHash,
+		manifest.GitRevision, manifest.GoVersion, manifest.StartTime, endTime, string(b))
+	return err
+}
+
+// WriteRecord - appends a record, its candidates and its depths
+func (r *ResultsDB) WriteRecord(runID string, record Record) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	args := []any{runID, record.Policy, record.TestCase, record.TransactionCount, record.Repetition,
+		record.Duration.Nanoseconds(), record.Total.Nanoseconds()}
+	for _, phase := range Phases {
+		args = append(args, record.Phases[phase].Nanoseconds())
+	}
+	args = append(args, record.Failures, record.Resources.CPUTime.Nanoseconds(), record.Resources.PeakRSS,
+		record.Resources.AllocBytes, record.Resources.Allocs, record.Resources.ForkBytes, record.Resources.BaseBytes,
+		len(record.Depths), record.Forks())
+	if _, err := tx.Exec(fmt.Sprintf("INSERT INTO records (%s) VALUES (%s)", recordColumns(), placeholders(len(args))), args...); err != nil {
+		return err
+	}
+
+	for _, c := range record.Candidates {
+		// candidates forked from the base state have no parent
+		var parent any
+		if c.Parent >= 0 {
+			parent = c.Parent
+		}
+		_, err := tx.Exec(`INSERT INTO candidates (run_id, policy, test_case, in_flight, repetition, candidate, branch, duration_ns, error, winner, bytes, depth, parent, sql)
+			VALUES (`+placeholders(14)+`)`,
+			runID, record.Policy, record.TestCase, record.TransactionCount, record.Repetition,
+			c.Index, c.Branch, c.Duration.Nanoseconds(), c.Error, c.Winner, c.Bytes, c.Depth, parent, c.SQL)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, d := range record.Depths {
+		args := []any{runID, record.Policy, record.TestCase, record.TransactionCount, record.Repetition,
+			d.Depth, d.Forks, d.Survivors, d.Failures, d.Duration.Nanoseconds()}
+		for _, phase := range Phases {
+			args = append(args, d.Phases[phase].Nanoseconds())
+		}
+		if _, err := tx.Exec(fmt.Sprintf("INSERT INTO depths VALUES (%s)", placeholders(len(args))), args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// WriteConfiguration - appends the summary statistics and mean resources
+// of a configuration
+func (r *ResultsDB) WriteConfiguration(runID string, policy string, testCase string, inFlight int, summary stats.Summary, resources Resources) error {
+	_, err := r.db.Exec(`INSERT INTO configurations (run_id, policy, test_case, in_flight, n, mean_ns, median_ns, p95_ns, p99_ns, stddev_ns, ci_low_ns, ci_high_ns,
+		mean_cpu_time_ns, mean_peak_rss_bytes, mean_alloc_bytes, mean_allocs, mean_fork_bytes, mean_base_bytes) VALUES (`+placeholders(18)+`)`,
+		runID, policy, testCase, inFlight, summary.N, summary.Mean, summary.Median,
+		summary.P95, summary.P99, summary.StdDev, summary.CILow, summary.CIHigh,
+		resources.CPUTime.Nanoseconds(), resources.PeakRSS, resources.AllocBytes, resources.Allocs, resources.ForkBytes, resources.BaseBytes)
+	return err
+}
+
+// recordColumns - the columns of the records table in insertion order
+func recordColumns() string {
+	columns := []string{"run_id", "policy", "test_case", "in_flight", "repetition", "duration_ns", "total_ns"}
+	for _, phase := range Phases {
+		columns = append(columns, phase+"_ns")
+	}
+	columns = append(columns, "failures", "cpu_time_ns", "peak_rss_bytes", "alloc_bytes", "allocs", "fork_bytes", "base_bytes", "depths", "forks")
+	return strings.Join(columns, ", ")
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func (r *ResultsDB) Close() error {
+	return r.db.Close()
+}
@@ -2,14 +2,16 @@ package policy
 
 import (
 	"context"
+	"database/sql/driver"
+	"errors"
 	"fmt"
-	"log"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
 	"github.com/joho/godotenv"
-	"golang.org/x/exp/rand"
 )
 
 /*
@@ -20,6 +22,15 @@ import (
  */
 type SerialClient struct {
 	mainConnStr string
+	// scaffoldSize - the size of the database once scaffolded, which
+	// candidates' writes grow
+	scaffoldSize int64
+	// conn, parentTxn and forks - the forks open for Fork, which take
+	// turns on savepoints of one parent transaction
+	conn      *pgx.Conn
+	parentTxn pgx.Tx
+	forks     []*rollbackFork
+	mu        sync.Mutex
 }
 
 func (c *SerialClient) GetName() string {
@@ -30,72 +41,107 @@ func (c *SerialClient) GetNumTransactionsInFlight() []int {
 	return []int{10, 25, 50, 100, 200, 500}
 }
 
-func (c *SerialClient) Scaffold(sql string, inFlight int) error {
+func (c *SerialClient) loadConnStr() error {
 	err := godotenv.Load()
 	if err != nil {
 		return fmt.Errorf("error loading .env file")
 	}
 	c.mainConnStr = os.Getenv("SERIAL_DATABASE_URL")
-	conn, err := pgx.Connect(context.Background(), c.mainConnStr)
+	return nil
+}
+
+func (c *SerialClient) EngineVersions() map[string]string {
+	if err := c.loadConnStr(); err != nil {
+		return map[string]string{"postgres": fmt.Sprintf("unknown: %v", err)}
+	}
+	return map[string]string{"postgres": postgresVersion(c.mainConnStr)}
+}
+
+func (c *SerialClient) Scaffold(ctx context.Context, sql string, inFlight int) error {
+	err := c.loadConnStr()
 	if err != nil {
 		return err
 	}
-	defer conn.Close(context.Background())
+	conn, err := pgx.Connect(ctx, c.mainConnStr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
 
-	_, err = conn.Exec(context.Background(), sql)
+	_, err = conn.Exec(ctx, sql)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	c.scaffoldSize, err = postgresDatabaseSize(ctx, c.mainConnStr, "")
+	return err
 }
 
-func (c *SerialClient) Execute(testCase TestCase, experiment *Experiment) error {
-	rand.Seed(uint64(time.Now().UnixNano()))
+// ForkSizes - savepoints share the database, so their storage is what the
+// rolled back candidates grew it by since it was scaffolded
+func (c *SerialClient) ForkSizes(ctx context.Context) (int64, map[string]int64, error) {
+	size, err := postgresDatabaseSize(ctx, c.mainConnStr, "")
+	if err != nil {
+		return 0, nil, err
+	}
+	return c.scaffoldSize, map[string]int64{"nested_txn": size - c.scaffoldSize}, nil
+}
 
+func (c *SerialClient) Execute(ctx context.Context, testCase TestCase, experiment *Experiment) error {
 	// Share DB connection across all TestCases
-	conn, err := pgx.Connect(context.Background(), c.mainConnStr)
+	conn, err := pgx.Connect(ctx, c.mainConnStr)
 	if err != nil {
 		return err
 	}
-	defer conn.Close(context.Background())
+	defer conn.Close(ctx)
 
 	benchmark := Benchmark{
 		Experiment:       experiment,
 		Policy:           c.GetName(),
 		TestCase:         testCase.Name,
 		TransactionCount: len(testCase.Statements),
+		Forks:            c,
 	}
-	benchmark.Start()
+	benchmark.Start(ctx)
+
+	// Savepoints are created and rolled back inline with each statement, so
+	// the only fork cost measured up front is the parent transaction
+	benchmark.Phase(PhaseFork)
 
 	// Start parent transaction
-	parentTxn, err := conn.BeginTx(context.Background(), pgx.TxOptions{})
+	parentTxn, err := conn.BeginTx(ctx, pgx.TxOptions{})
 	if err != nil {
-		log.Fatalf("Failed to begin parent transaction: %v\n", err)
+		fatal("failed to begin parent transaction", "error", err)
 	}
 
+	benchmark.Phase(PhaseExecute)
 	var states []ExecutionResult
-	for _, statement := range testCase.Statements {
+	for i, statement := range testCase.Statements {
 
 		// Start nested transaction, rollback to this savepoint once state collected
-		_, err := parentTxn.Exec(context.Background(), "SAVEPOINT nested_txn")
+		_, err := parentTxn.Exec(ctx, "SAVEPOINT nested_txn")
 		if err != nil {
-			log.Fatalf("Failed to create savepoint for nested transaction: %v\n", err)
+			fatal("failed to create savepoint for nested transaction", LogCandidate, i, "error", err)
 		}
+		openForks.WithLabelValues(forkSavepoint).Inc()
 
+		_, span := benchmark.StartCandidate(i)
+		candidateStart := time.Now()
+		result := ExecutionResult{Index: i, BranchName: "nested_txn", Statement: statement}
 		var rows pgx.Rows
 		if statement.Command != "" {
 
 			// Command from TestCase
-			_, err = parentTxn.Exec(context.Background(), statement.Command)
+			_, err = parentTxn.Exec(ctx, statement.Command)
 			if err != nil {
 				return err
 			}
-			states = append(states, ExecutionResult{Statement: statement, Values: []any{}})
+			result.Values = []any{}
+			states = append(states, result)
 
 		} else {
 			// Query only, no Command
-			rows, err = parentTxn.Query(context.Background(), statement.Query)
+			rows, err = parentTxn.Query(ctx, statement.Query)
 			if err != nil {
 				return err
 			}
@@ -106,34 +152,41 @@ func (c *SerialClient) Execute(testCase TestCase, experiment *Experiment) error
 				if err != nil {
 					return err
 				}
-				states = append(states, ExecutionResult{Statement: statement, Values: v})
+				result.Values = v
+				states = append(states, result)
 			}
 			rows.Close() // required so connection is not considered busy during rollback
 		}
+		result.Duration = time.Since(candidateStart)
+		benchmark.Candidate(result)
+		EndCandidate(span, result)
 
-		_, rollbackErr := parentTxn.Exec(context.Background(), "ROLLBACK TO SAVEPOINT nested_txn")
+		_, rollbackErr := parentTxn.Exec(ctx, "ROLLBACK TO SAVEPOINT nested_txn")
 		if rollbackErr != nil {
-			fmt.Println("failed")
-			log.Fatalf("Failed to rollback to savepoint for nested transaction: %v\n", rollbackErr)
+			fatal("failed to rollback to savepoint for nested transaction", LogCandidate, i, "error", rollbackErr)
 		}
+		openForks.WithLabelValues(forkSavepoint).Dec()
 	}
 
 	// For now, choose random state as correct state
-	idx := rand.Intn(len(states))
-	log.Printf("idx: %v; state: %v\n", idx, states[idx])
+	benchmark.Phase(PhaseConsensus)
+	idx := rng.Intn(len(states))
+	benchmark.Logger().Debug("winner state", LogCandidate, states[idx].Index, "values", states[idx].Values)
+	benchmark.Winner(states[idx].Index)
 
 	// Command from chosen Statement
+	benchmark.Phase(PhasePromote)
 	if states[idx].Statement.Command != "" {
-		_, err = parentTxn.Exec(context.Background(), testCase.Statements[idx].Command)
+		_, err = parentTxn.Exec(ctx, testCase.Statements[idx].Command)
 		if err != nil {
 			return err
 		}
 	}
 
 	// Commit parent transaction with applied changes from one chosen Statement
-	err = parentTxn.Commit(context.Background())
+	err = parentTxn.Commit(ctx)
 	if err != nil {
-		log.Fatalf("Failed to commit parent transaction: %v\n", err)
+		fatal("failed to commit parent transaction", "error", err)
 	}
 
 	benchmark.End()
@@ -142,14 +195,109 @@ func (c *SerialClient) Execute(testCase TestCase, experiment *Experiment) error
 	return nil
 }
 
-func (c *SerialClient) Cleanup(sql string) error {
-	conn, err := pgx.Connect(context.Background(), c.mainConnStr)
+// MainConnector - connects to the database the parent transaction of the
+// forks runs on, outside of it
+func (c *SerialClient) MainConnector() (driver.Connector, error) {
+	if c.mainConnStr == "" {
+		return nil, fmt.Errorf("the database has not been scaffolded")
+	}
+	config, err := pgx.ParseConfig(c.mainConnStr)
+	if err != nil {
+		return nil, err
+	}
+	return stdlib.GetConnector(*config), nil
+}
+
+// Fork - forks that each run under a savepoint of a parent transaction,
+// which is rolled back to after every statement
+func (c *SerialClient) Fork(ctx context.Context, n int) ([]Fork, error) {
+	if len(c.forks) > 0 {
+		return nil, ErrForksOpen
+	}
+	conn, err := pgx.Connect(ctx, c.mainConnStr)
+	if err != nil {
+		return nil, err
+	}
+	parentTxn, err := conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		conn.Close(ctx)
+		return nil, fmt.Errorf("failed to begin parent transaction: %v", err)
+	}
+	c.conn = conn
+	c.parentTxn = parentTxn
+
+	forks := make([]Fork, n)
+	for i := range n {
+		fork := &rollbackFork{name: fmt.Sprintf("nested_txn_%d", i), sandbox: c.sandbox}
+		c.forks = append(c.forks, fork)
+		forks[i] = fork
+	}
+	return forks, nil
+}
+
+// sandbox - runs fn under a savepoint that is rolled back to
+func (c *SerialClient) sandbox(ctx context.Context, fn func(q querier) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.parentTxn.Exec(ctx, "SAVEPOINT nested_txn"); err != nil {
+		return fmt.Errorf("failed to create savepoint for nested transaction: %v", err)
+	}
+	openForks.WithLabelValues(forkSavepoint).Inc()
+	defer openForks.WithLabelValues(forkSavepoint).Dec()
+
+	err := fn(pgxQuerier{c.parentTxn})
+	if _, rollbackErr := c.parentTxn.Exec(ctx, "ROLLBACK TO SAVEPOINT nested_txn"); rollbackErr != nil {
+		return errors.Join(err, fmt.Errorf("failed to rollback to savepoint for nested transaction: %v", rollbackErr))
+	}
+	return err
+}
+
+// Promote - re-executes the winner's statements in the parent transaction
+// and commits it, as Execute does with the chosen statement
+func (c *SerialClient) Promote(ctx context.Context, winner int) error {
+	if err := checkWinner(winner, len(c.forks)); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := replay(ctx, pgxQuerier{c.parentTxn}, c.forks[winner].log); err != nil {
+		return err
+	}
+	if err := c.parentTxn.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit parent transaction: %v", err)
+	}
+	return c.closeForks(ctx)
+}
+
+// Discard - rolls back the parent transaction
+func (c *SerialClient) Discard(ctx context.Context) error {
+	if len(c.forks) == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.parentTxn.Rollback(ctx); err != nil {
+		return errors.Join(fmt.Errorf("failed to rollback parent transaction: %v", err), c.closeForks(ctx))
+	}
+	return c.closeForks(ctx)
+}
+
+func (c *SerialClient) closeForks(ctx context.Context) error {
+	err := c.conn.Close(ctx)
+	c.conn = nil
+	c.parentTxn = nil
+	c.forks = nil
+	return err
+}
+
+func (c *SerialClient) Cleanup(ctx context.Context, sql string) error {
+	conn, err := pgx.Connect(ctx, c.mainConnStr)
 	if err != nil {
 		return err
 	}
-	defer conn.Close(context.Background())
+	defer conn.Close(ctx)
 
-	_, err = conn.Exec(context.Background(), sql)
+	_, err = conn.Exec(ctx, sql)
 	if err != nil {
 		return err
 	}
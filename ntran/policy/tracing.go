@@ -0,0 +1,94 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer - spans are no-ops until SetupTracing installs a provider
+var tracer = otel.Tracer("ntran/policy")
+
+// Span attributes shared by the policies and ntran itself
+const (
+	AttrPolicy    = attribute.Key("ntran.policy")
+	AttrTestCase  = attribute.Key("ntran.test_case")
+	AttrInFlight  = attribute.Key("ntran.in_flight")
+	AttrCandidate = attribute.Key("ntran.candidate")
+	AttrBranch    = attribute.Key("ntran.branch")
+	AttrWinner    = attribute.Key("ntran.winner")
+	AttrSteps     = attribute.Key("ntran.steps")
+)
+
+// SetupTracing - exports spans over OTLP/HTTP to otlpEndpoint (a URL, e.g.
+// http://localhost:4318) and/or as JSON to file, returning a function that
+// flushes and stops the exporters. Tracing stays disabled when both are empty.
+func SetupTracing(ctx context.Context, otlpEndpoint string, file string) (func(context.Context) error, error) {
+	var closers []func(context.Context) error
+	shutdown := func(ctx context.Context) error {
+		var errs []error
+		for i := len(closers) - 1; i >= 0; i-- {
+			errs = append(errs, closers[i](ctx))
+		}
+		return errors.Join(errs...)
+	}
+	if otlpEndpoint == "" && file == "" {
+		return shutdown, nil
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName("ntran")))
+	if err != nil {
+		return shutdown, fmt.Errorf("error creating trace resource: %v", err)
+	}
+	options := []sdktrace.TracerProviderOption{sdktrace.WithResource(res)}
+
+	if otlpEndpoint != "" {
+		exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(otlpEndpoint))
+		if err != nil {
+			return shutdown, fmt.Errorf("error creating OTLP exporter: %v", err)
+		}
+		options = append(options, sdktrace.WithBatcher(exporter))
+	}
+	if file != "" {
+		f, err := os.Create(file)
+		if err != nil {
+			return shutdown, fmt.Errorf("error creating trace file: %v", err)
+		}
+		closers = append(closers, func(context.Context) error { return f.Close() })
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			return shutdown, fmt.Errorf("error creating trace file exporter: %v", err)
+		}
+		options = append(options, sdktrace.WithBatcher(exporter))
+	}
+
+	provider := sdktrace.NewTracerProvider(options...)
+	closers = append(closers, provider.Shutdown)
+	otel.SetTracerProvider(provider)
+	return shutdown, nil
+}
+
+// StartSpan - starts a span of the ntran pipeline as a child of ctx
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// EndSpan - ends span, marking it as failed if err is non-nil
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,334 @@
+package policy
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/apache/arrow/go/v17/arrow"
+	"github.com/apache/arrow/go/v17/arrow/array"
+	"github.com/apache/arrow/go/v17/arrow/memory"
+	"github.com/apache/arrow/go/v17/parquet"
+	"github.com/apache/arrow/go/v17/parquet/compress"
+	"github.com/apache/arrow/go/v17/parquet/pqarrow"
+)
+
+// Supported result formats
+const (
+	FormatCSV     = "csv"
+	FormatJSONL   = "jsonl"
+	FormatParquet = "parquet"
+)
+
+var Formats = []string{FormatCSV, FormatJSONL, FormatParquet}
+
+// RecordWriter - writes experiment records to a results file
+type RecordWriter interface {
+	Write(record Record) error
+	Close() error
+}
+
+func NewRecordWriter(format string, path string) (RecordWriter, error) {
+	switch format {
+	case FormatCSV:
+		return newCSVRecordWriter(path)
+	case FormatJSONL:
+		return newJSONLRecordWriter(path)
+	case FormatParquet:
+		return newParquetRecordWriter(path)
+	}
+	return nil, fmt.Errorf("unsupported result format %s, must be one of %v", format, Formats)
+}
+
+// PhaseColumn - the csv header for a phase, e.g. "fork" -> "ForkDuration"
+func PhaseColumn(phase string) string {
+	return strings.ToUpper(phase[:1]) + phase[1:] + "Duration"
+}
+
+/*
+ * csvRecordWriter - the original results format. The first four columns
+ * are unchanged since the first experiments; durations are written both
+ * as Go duration strings and, in the trailing *Ns columns, as integer
+ * nanoseconds
+ */
+type csvRecordWriter struct {
+	file   *os.File
+	writer *csv.Writer
+}
+
+func newCSVRecordWriter(path string) (*csvRecordWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &csvRecordWriter{file: file, writer: csv.NewWriter(file)}
+
+	headers := []string{"Policy", "TestCase", "TransactionCount", "Duration", "Total"}
+	for _, phase := range Phases {
+		headers = append(headers, PhaseColumn(phase))
+	}
+	headers = append(headers, "Repetition", "DurationNs", "TotalNs")
+	for _, phase := range Phases {
+		headers = append(headers, PhaseColumn(phase)+"Ns")
+	}
+	headers = append(headers, "Failures", "CPUTimeNs", "PeakRSSBytes", "AllocBytes", "Allocs", "ForkBytes", "BaseBytes", "Depths", "Forks")
+	if err := w.writer.Write(headers); err != nil {
+		file.Close()
+		return nil, err
+	}
+	w.writer.Flush()
+	return w, nil
+}
+
+func (w *csvRecordWriter) Write(record Record) error {
+	row := []string{
+		record.Policy,
+		record.TestCase,
+		fmt.Sprintf("%d", record.TransactionCount),
+		record.Duration.String(),
+		record.Total.String(),
+	}
+	for _, phase := range Phases {
+		row = append(row, record.Phases[phase].String())
+	}
+	row = append(row,
+		fmt.Sprintf("%d", record.Repetition),
+		fmt.Sprintf("%d", record.Duration.Nanoseconds()),
+		fmt.Sprintf("%d", record.Total.Nanoseconds()),
+	)
+	for _, phase := range Phases {
+		row = append(row, fmt.Sprintf("%d", record.Phases[phase].Nanoseconds()))
+	}
+	row = append(row,
+		fmt.Sprintf("%d", record.Failures),
+		fmt.Sprintf("%d", record.Resources.CPUTime.Nanoseconds()),
+		fmt.Sprintf("%d", record.Resources.PeakRSS),
+		fmt.Sprintf("%d", record.Resources.AllocBytes),
+		fmt.Sprintf("%d", record.Resources.Allocs),
+		fmt.Sprintf("%d", record.Resources.ForkBytes),
+		fmt.Sprintf("%d", record.Resources.BaseBytes),
+		fmt.Sprintf("%d", len(record.Depths)),
+		fmt.Sprintf("%d", record.Forks()),
+	)
+	if err := w.writer.Write(row); err != nil {
+		return err
+	}
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+func (w *csvRecordWriter) Close() error {
+	w.writer.Flush()
+	return w.file.Close()
+}
+
+// JSONRecord - one line of a JSON Lines results file, all durations in nanoseconds
+type JSONRecord struct {
+	Policy           string           `json:"policy"`
+	TestCase         string           `json:"test_case"`
+	TransactionCount int              `json:"transaction_count"`
+	Repetition       int              `json:"repetition"`
+	DurationNs       int64            `json:"duration_ns"`
+	TotalNs          int64            `json:"total_ns"`
+	PhasesNs         map[string]int64 `json:"phases_ns"`
+	Failures         int              `json:"failures"`
+	CPUTimeNs        int64            `json:"cpu_time_ns"`
+	PeakRSSBytes     int64            `json:"peak_rss_bytes"`
+	AllocBytes       int64            `json:"alloc_bytes"`
+	Allocs           int64            `json:"allocs"`
+	ForkBytes        int64            `json:"fork_bytes"`
+	BaseBytes        int64            `json:"base_bytes"`
+	Candidates       []JSONCandidate  `json:"candidates,omitempty"`
+	Depths           []JSONDepth      `json:"depths,omitempty"`
+}
+
+// JSONDepth - one depth of a tree search
+type JSONDepth struct {
+	Depth      int              `json:"depth"`
+	Forks      int              `json:"forks"`
+	Survivors  int              `json:"survivors"`
+	Failures   int              `json:"failures"`
+	DurationNs int64            `json:"duration_ns"`
+	PhasesNs   map[string]int64 `json:"phases_ns"`
+}
+
+type JSONCandidate struct {
+	Index      int    `json:"index"`
+	Branch     string `json:"branch,omitempty"`
+	DurationNs int64  `json:"duration_ns"`
+	Error      string `json:"error,omitempty"`
+	Winner     bool   `json:"winner"`
+	Bytes      int64  `json:"bytes,omitempty"`
+	Depth      int    `json:"depth,omitempty"`
+	// Parent - the candidate the fork was copied from, omitted when it was
+	// copied from the base state
+	Parent *int   `json:"parent,omitempty"`
+	SQL    string `json:"sql,omitempty"`
+}
+
+func toJSONRecord(record Record) JSONRecord {
+	phases := make(map[string]int64, len(Phases))
+	for _, phase := range Phases {
+		phases[phase] = record.Phases[phase].Nanoseconds()
+	}
+	var candidates []JSONCandidate
+	for _, c := range record.Candidates {
+		candidate := JSONCandidate{Index: c.Index, Branch: c.Branch, DurationNs: c.Duration.Nanoseconds(), Error: c.Error, Winner: c.Winner, Bytes: c.Bytes, Depth: c.Depth, SQL: c.SQL}
+		if c.Parent >= 0 {
+			candidate.Parent = &c.Parent
+		}
+		candidates = append(candidates, candidate)
+	}
+	var depths []JSONDepth
+	for _, d := range record.Depths {
+		phasesNs := make(map[string]int64, len(d.Phases))
+		for phase, duration := range d.Phases {
+			phasesNs[phase] = duration.Nanoseconds()
+		}
+		depths = append(depths, JSONDepth{Depth: d.Depth, Forks: d.Forks, Survivors: d.Survivors, Failures: d.Failures, DurationNs: d.Duration.Nanoseconds(), PhasesNs: phasesNs})
+	}
+	return JSONRecord{
+		Policy:           record.Policy,
+		TestCase:         record.TestCase,
+		TransactionCount: record.TransactionCount,
+		Repetition:       record.Repetition,
+		DurationNs:       record.Duration.Nanoseconds(),
+		TotalNs:          record.Total.Nanoseconds(),
+		PhasesNs:         phases,
+		Failures:         record.Failures,
+		CPUTimeNs:        record.Resources.CPUTime.Nanoseconds(),
+		PeakRSSBytes:     record.Resources.PeakRSS,
+		AllocBytes:       record.Resources.AllocBytes,
+		Allocs:           record.Resources.Allocs,
+		ForkBytes:        record.Resources.ForkBytes,
+		BaseBytes:        record.Resources.BaseBytes,
+		Candidates:       candidates,
+		Depths:           depths,
+	}
+}
+
+type jsonlRecordWriter struct {
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func newJSONLRecordWriter(path string) (*jsonlRecordWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonlRecordWriter{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+func (w *jsonlRecordWriter) Write(record Record) error {
+	return w.encoder.Encode(toJSONRecord(record))
+}
+
+func (w *jsonlRecordWriter) Close() error {
+	return w.file.Close()
+}
+
+// parquetRowGroupRecords - the records buffered before they are written
+// out as a row group
+const parquetRowGroupRecords = 64
+
+/*
+ * parquetRecordWriter - buffers records and writes them out as a row group
+ * every parquetRowGroupRecords records and when the experiment ends, so a
+ * long run does not hold every record in memory. Durations are int64
+ * nanoseconds
+ */
+type parquetRecordWriter struct {
+	file    *os.File
+	writer  *pqarrow.FileWriter
+	builder *array.RecordBuilder
+}
+
+func parquetSchema() *arrow.Schema {
+	fields := []arrow.Field{
+		{Name: "policy", Type: arrow.BinaryTypes.String},
+		{Name: "test_case", Type: arrow.BinaryTypes.String},
+		{Name: "transaction_count", Type: arrow.PrimitiveTypes.Int64},
+		{Name: "repetition", Type: arrow.PrimitiveTypes.Int64},
+		{Name: "duration_ns", Type: arrow.PrimitiveTypes.Int64},
+		{Name: "total_ns", Type: arrow.PrimitiveTypes.Int64},
+	}
+	for _, phase := range Phases {
+		fields = append(fields, arrow.Field{Name: phase + "_ns", Type: arrow.PrimitiveTypes.Int64})
+	}
+	for _, name := range []string{"failures", "cpu_time_ns", "peak_rss_bytes", "alloc_bytes", "allocs", "fork_bytes", "base_bytes", "depths", "forks"} {
+		fields = append(fields, arrow.Field{Name: name, Type: arrow.PrimitiveTypes.Int64})
+	}
+	return arrow.NewSchema(fields, nil)
+}
+
+func newParquetRecordWriter(path string) (*parquetRecordWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	schema := parquetSchema()
+	props := parquet.NewWriterProperties(parquet.WithCompression(compress.Codecs.Snappy))
+	writer, err := pqarrow.NewFileWriter(schema, file, props, pqarrow.DefaultWriterProps())
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &parquetRecordWriter{
+		file:    file,
+		writer:  writer,
+		builder: array.NewRecordBuilder(memory.DefaultAllocator, schema),
+	}, nil
+}
+
+func (w *parquetRecordWriter) Write(record Record) error {
+	w.builder.Field(0).(*array.StringBuilder).Append(record.Policy)
+	w.builder.Field(1).(*array.StringBuilder).Append(record.TestCase)
+	w.builder.Field(2).(*array.Int64Builder).Append(int64(record.TransactionCount))
+	w.builder.Field(3).(*array.Int64Builder).Append(int64(record.Repetition))
+	w.builder.Field(4).(*array.Int64Builder).Append(record.Duration.Nanoseconds())
+	w.builder.Field(5).(*array.Int64Builder).Append(record.Total.Nanoseconds())
+	for i, phase := range Phases {
+		w.builder.Field(6 + i).(*array.Int64Builder).Append(record.Phases[phase].Nanoseconds())
+	}
+	tail := []int64{
+		int64(record.Failures),
+		record.Resources.CPUTime.Nanoseconds(),
+		record.Resources.PeakRSS,
+		record.Resources.AllocBytes,
+		record.Resources.Allocs,
+		record.Resources.ForkBytes,
+		record.Resources.BaseBytes,
+		int64(len(record.Depths)),
+		int64(record.Forks()),
+	}
+	for i, v := range tail {
+		w.builder.Field(6 + len(Phases) + i).(*array.Int64Builder).Append(v)
+	}
+	if w.builder.Field(0).Len() >= parquetRowGroupRecords {
+		return w.flush()
+	}
+	return nil
+}
+
+// flush - writes the buffered records out as a row group
+func (w *parquetRecordWriter) flush() error {
+	rec := w.builder.NewRecord()
+	defer rec.Release()
+	if rec.NumRows() == 0 {
+		return nil
+	}
+	return w.writer.Write(rec)
+}
+
+func (w *parquetRecordWriter) Close() error {
+	defer w.builder.Release()
+	if err := w.flush(); err != nil {
+		w.writer.Close()
+		return err
+	}
+	// also closes the underlying file
+	return w.writer.Close()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"ntran/analysis"
+	"ntran/policy"
+)
+
+// progressInterval - how often the live progress line is redrawn
+const progressInterval = 200 * time.Millisecond
+
+/*
+ * progress - shows which inFlight level, test case and repetition an
+ * experiment is on, how many of its candidates have finished, the elapsed
+ * time and an ETA. On a terminal it redraws a single line; otherwise it
+ * prints a line per finished test case. The ETA extrapolates from the
+ * share of candidates finished, counting -repeat repetitions of every
+ * configuration, so adaptive repetitions past that (and beam searches that
+ * end early) move it.
+ */
+type progress struct {
+	out io.Writer
+	tty bool
+
+	mu        sync.Mutex
+	start     time.Time
+	inFlights []int
+	level     int
+	inFlight  int
+	planned   func(inFlight int) int
+	testCase  string
+	repeat    string
+	done      int // candidates finished in earlier test cases
+	current   int // candidates finished in the current test case
+	expected  int // candidates planned for the current test case
+	failed    int
+	total     int // candidates planned
+	stop      chan struct{}
+	stopped   sync.WaitGroup
+}
+
+// newProgress - planned is the number of candidates a test case of inFlight
+// statements runs
+func newProgress(out *os.File, inFlights []int, testCases int, repetitions int, planned func(inFlight int) int) *progress {
+	p := &progress{out: out, tty: isTerminal(out), start: time.Now(), inFlights: inFlights, planned: planned, stop: make(chan struct{})}
+	for _, inFlight := range inFlights {
+		p.total += planned(inFlight) * testCases * repetitions
+	}
+	if p.tty {
+		p.stopped.Add(1)
+		go p.redraw()
+	}
+	return p
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// TestCase - a repetition of a test case is starting
+func (p *progress) TestCase(inFlight int, testCase string, repeat string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, f := range p.inFlights {
+		if f == inFlight {
+			p.level = i + 1
+		}
+	}
+	p.inFlight = inFlight
+	p.expected = p.planned(inFlight)
+	p.testCase = testCase
+	p.repeat = repeat
+	p.current = 0
+}
+
+// CandidateFinished - implements policy.Observer
+func (p *progress) CandidateFinished(result policy.ExecutionResult) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current++
+	if result.Error != nil {
+		p.failed++
+	}
+}
+
+// TestCaseFinished - a repetition of a test case has finished
+func (p *progress) TestCaseFinished() {
+	p.mu.Lock()
+	p.current = p.expected
+	line := p.line()
+	p.done += p.expected
+	p.current = 0
+	p.mu.Unlock()
+	if !p.tty {
+		fmt.Fprintln(p.out, line)
+	}
+}
+
+// line - the progress so far; the caller holds mu
+func (p *progress) line() string {
+	elapsed := time.Since(p.start)
+	done := p.done + p.current
+	total := max(p.total, done+p.expected-p.current)
+	eta := "-"
+	if done > 0 {
+		eta = analysis.FormatDuration((elapsed * time.Duration(total-done) / time.Duration(done)).Round(time.Second))
+	}
+	var failed string
+	if p.failed > 0 {
+		failed = fmt.Sprintf(" (%d failed)", p.failed)
+	}
+	return fmt.Sprintf("inFlight %d (%d/%d) | %s %s | candidates %d/%d, %d/%d overall%s | elapsed %s | ETA %s",
+		p.inFlight, p.level, len(p.inFlights), p.testCase, p.repeat, p.current, p.expected, done, total, failed,
+		analysis.FormatDuration(elapsed.Round(time.Second)), eta)
+}
+
+func (p *progress) redraw() {
+	defer p.stopped.Done()
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.mu.Lock()
+			line := p.line()
+			p.mu.Unlock()
+			// \r and clearing the line redraw it in place
+			fmt.Fprintf(p.out, "\r\033[K%s", line)
+		}
+	}
+}
+
+// Finish - stops redrawing and prints the final summary of every configuration
+func (p *progress) Finish(experiment *policy.Experiment, configs []analysis.Key) {
+	if p.tty {
+		close(p.stop)
+		p.stopped.Wait()
+		fmt.Fprint(p.out, "\r\033[K")
+	}
+
+	table := &analysis.Table{
+		Title:   fmt.Sprintf("Finished %s in %s", experiment.RunID, analysis.FormatDuration(time.Since(p.start).Round(time.Second))),
+		Headers: []string{"TestCase", "InFlight", "N", "Mean", "Median", "P95", "CILow", "CIHigh"},
+	}
+	for _, config := range configs {
+		s := experiment.Summary(config.TestCase, config.InFlight)
+		table.Append(config.TestCase, config.InFlight, s.N, time.Duration(s.Mean), time.Duration(s.Median),
+			time.Duration(s.P95), time.Duration(s.CILow), time.Duration(s.CIHigh))
+	}
+	fmt.Fprintln(p.out)
+	table.Render(p.out, analysis.FormatText)
+	if p.failed > 0 {
+		fmt.Fprintf(p.out, "%d candidate(s) failed, see %s\n", p.failed, filepath.Join(experiment.RunDir, policy.LogFile))
+	}
+}
@@ -0,0 +1,909 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"ntran/policy"
+	"ntran/speculate"
+)
+
+// textOID - every column is sent as text
+const textOID = 25
+
+// The commands the proxy adds to SQL
+var (
+	beginSpeculative    = regexp.MustCompile(`(?is)^BEGIN\s+SPECULATIVE\s+(\d+)$`)
+	onBranch            = regexp.MustCompile(`(?is)^ON\s+BRANCH\s+(\d+)\s+(.+)$`)
+	useBranch           = regexp.MustCompile(`(?is)^USE\s+BRANCH\s+(\d+)$`)
+	commitBranch        = regexp.MustCompile(`(?is)^COMMIT\s+BRANCH\s+(\w+)$`)
+	rollbackSpeculative = regexp.MustCompile(`(?is)^ROLLBACK\s+SPECULATIVE$`)
+	showBranches        = regexp.MustCompile(`(?is)^SHOW\s+BRANCHES$`)
+	revertCommits       = regexp.MustCompile(`(?is)^REVERT(?:\s+(\d+))?$`)
+)
+
+var (
+	// queryKeyword - statements starting with one of these return rows
+	queryKeyword = regexp.MustCompile(`(?is)^[(\s]*(SELECT|SHOW|VALUES|TABLE|EXPLAIN|WITH)\b`)
+	// modifyingKeyword - a WITH query that modifies data is executed
+	modifyingKeyword = regexp.MustCompile(`(?is)\b(INSERT|UPDATE|DELETE|MERGE)\b`)
+)
+
+func proxyCommand(args []string) error {
+	fs := flag.NewFlagSet("proxy", flag.ExitOnError)
+	addrArg := fs.String("addr", "localhost:5433", "the address to accept Postgres connections on")
+	passwordArg := fs.String("password", "", "the password clients must send, for any user (none when empty)")
+	policyArg := fs.String("policy", "postgres-template", "the policy to fork with [serial-snapshot, duckdb-parallel, duckdb-serial, cold-neondb, prewarm-neondb, postgres-template]")
+	schemaArg := fs.String("schema", "", "a SQL file to execute on the main database at startup (none when empty)")
+	cleanupArg := fs.String("cleanup", "", "a SQL file to execute on the main database at shutdown (none when empty)")
+	branchesArg := fs.Int("branches", 8, "the most branches a client may fork at once")
+	historyArg := fs.Int("history", 0, "the most earlier committed states kept for REVERT (0 to keep none)")
+	interactiveArg := fs.Bool("interactive", false, "offer COMMIT BRANCH interactive, which asks the operator at this terminal to pick the winner")
+	diffArg := fs.String("diff", "", "a SQL file of queries whose rows the interactive strategy compares between each branch and the main state")
+	logFormatArg := fs.String("log-format", policy.LogFormatText, fmt.Sprintf("the format of the log written to stderr %v", policy.LogFormats))
+	logLevelArg := fs.String("log-level", "info", "the minimum level of the log [debug, info, warn, error]")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: ntran proxy [flags]\n\n")
+		fmt.Fprintf(fs.Output(), "Speaks the Postgres wire protocol and routes statements to forks, or to the main\ndatabase when they name no branch:\n")
+		fmt.Fprintf(fs.Output(), "  BEGIN SPECULATIVE n     fork n branches\n")
+		fmt.Fprintf(fs.Output(), "  ON BRANCH i <sql>       run a statement on branch i\n")
+		fmt.Fprintf(fs.Output(), "  USE BRANCH i            run statements without ON BRANCH on branch i\n")
+		fmt.Fprintf(fs.Output(), "  SHOW BRANCHES           list the branches and whether they failed\n")
+		fmt.Fprintf(fs.Output(), "  COMMIT BRANCH i         commit branch i, or first, random, majority or interactive\n")
+		fmt.Fprintf(fs.Output(), "  ROLLBACK SPECULATIVE    discard every branch\n")
+		fmt.Fprintf(fs.Output(), "  REVERT [n]              undo the n (1) most recent commits, with -history\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if err := setupStderrLog(*logFormatArg, *logLevelArg); err != nil {
+		return err
+	}
+	var err error
+	options := speculate.Options{Policy: *policyArg, Branches: *branchesArg, History: *historyArg}
+	if options.Schema, err = readSQLFile(*schemaArg); err != nil {
+		return err
+	}
+	if options.Cleanup, err = readSQLFile(*cleanupArg); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	engine, err := speculate.Open(ctx, options)
+	if err != nil {
+		return err
+	}
+	defer engine.Close(context.Background())
+
+	listener, err := net.Listen("tcp", *addrArg)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	slog.Info("proxying", "addr", listener.Addr().String(), policy.LogPolicy, *policyArg)
+
+	p := &proxy{engine: engine, password: *passwordArg, sessions: make(map[*proxySession]bool)}
+	if *interactiveArg {
+		if p.interactive, err = newInteractive(engine, *diffArg); err != nil {
+			return err
+		}
+	}
+	var sessions sync.WaitGroup
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return err
+		}
+		sessions.Add(1)
+		go func() {
+			defer sessions.Done()
+			p.serve(conn)
+		}()
+	}
+	p.closeSessions()
+	sessions.Wait()
+	return nil
+}
+
+/*
+ * proxy - shares one engine between client sessions. The engine has one
+ * set of branches open at a time, which belongs to the session that forked
+ * it until that session commits, discards or disconnects
+ */
+type proxy struct {
+	engine   *speculate.Engine
+	password string
+	// interactive - the interactive strategy, nil unless the operator
+	// offered it
+	interactive *speculate.Interactive
+
+	mu       sync.Mutex
+	owner    *proxySession
+	nextID   int
+	sessions map[*proxySession]bool
+}
+
+type proxySession struct {
+	id      int
+	conn    net.Conn
+	backend *pgproto3.Backend
+	logger  *slog.Logger
+	// branch - the branch statements without ON BRANCH run on, -1 for the
+	// main database
+	branch int
+	// prepared - the statements of the extended protocol by name, "" for
+	// the unnamed statement
+	prepared map[string]*preparedStatement
+	// portals - the bound statements of the extended protocol by name
+	portals map[string]*portal
+}
+
+type preparedStatement struct {
+	sql string
+	// oids - the type of each parameter, 0 when the client left it unset
+	oids []uint32
+}
+
+// portal - a prepared statement bound to its arguments. Queries run when
+// the portal is described, so that their columns can be, and their rows
+// are sent when it is executed
+type portal struct {
+	sql    string
+	args   []any
+	result *result
+}
+
+// result - what a statement returns to the client
+type result struct {
+	// rows - the rows of a query, nil for other statements
+	rows *speculate.Rows
+	tag  string
+}
+
+func (p *proxy) closeSessions() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for s := range p.sessions {
+		s.conn.Close()
+	}
+}
+
+func (p *proxy) serve(conn net.Conn) {
+	defer conn.Close()
+	p.mu.Lock()
+	p.nextID++
+	s := &proxySession{
+		id:       p.nextID,
+		conn:     conn,
+		backend:  pgproto3.NewBackend(conn, conn),
+		branch:   -1,
+		prepared: make(map[string]*preparedStatement),
+		portals:  make(map[string]*portal),
+	}
+	s.logger = slog.With("session", s.id, "remote", conn.RemoteAddr().String())
+	p.sessions[s] = true
+	p.mu.Unlock()
+	defer p.endSession(s)
+
+	if err := p.startup(s); err != nil {
+		if !errors.Is(err, io.EOF) {
+			s.logger.Warn("error starting session", "error", err)
+		}
+		return
+	}
+	s.logger.Debug("session started")
+
+	for {
+		msg, err := s.backend.Receive()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				s.logger.Warn("error receiving", "error", err)
+			}
+			return
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.Query:
+			p.query(s, msg.String)
+		case *pgproto3.Terminate:
+			return
+		case *pgproto3.Sync:
+			p.ready(s)
+		case *pgproto3.Flush:
+			if err := s.backend.Flush(); err != nil {
+				return
+			}
+		case *pgproto3.Parse, *pgproto3.Bind, *pgproto3.Describe, *pgproto3.Execute, *pgproto3.Close:
+			if err := p.extended(s, msg); err != nil {
+				// the rest of the extended query is skipped until the
+				// client syncs, as a server does after any error
+				s.logger.Debug("extended query failed", "error", err)
+				s.backend.Send(pgErrorResponse(err))
+				if err := s.backend.Flush(); err != nil {
+					return
+				}
+				if err := skipUntilSync(s.backend); err != nil {
+					return
+				}
+				p.ready(s)
+			}
+		default:
+			s.backend.Send(&pgproto3.ErrorResponse{Severity: "FATAL", Code: "08P01", Message: fmt.Sprintf("unexpected message %T", msg)})
+			s.backend.Flush()
+			return
+		}
+	}
+}
+
+// endSession - discards the branches of a client that went away
+func (p *proxy) endSession(s *proxySession) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.sessions, s)
+	if p.owner != s {
+		return
+	}
+	p.owner = nil
+	if err := p.engine.Discard(context.Background()); err != nil {
+		s.logger.Error("error discarding branches", "error", err)
+		return
+	}
+	s.logger.Info("discarded the branches of a closed session")
+}
+
+func skipUntilSync(backend *pgproto3.Backend) error {
+	for {
+		msg, err := backend.Receive()
+		if err != nil {
+			return err
+		}
+		if _, ok := msg.(*pgproto3.Sync); ok {
+			return nil
+		}
+	}
+}
+
+// startup - negotiates the session: encryption is declined, and the
+// password is checked when one is required
+func (p *proxy) startup(s *proxySession) error {
+	for {
+		msg, err := s.backend.ReceiveStartupMessage()
+		if err != nil {
+			return err
+		}
+		switch msg.(type) {
+		case *pgproto3.SSLRequest, *pgproto3.GSSEncRequest:
+			if _, err := s.conn.Write([]byte("N")); err != nil {
+				return err
+			}
+		case *pgproto3.CancelRequest:
+			// statements are not cancellable, so the request is ignored
+			return io.EOF
+		case *pgproto3.StartupMessage:
+			return p.authenticate(s)
+		default:
+			return fmt.Errorf("unexpected startup message %T", msg)
+		}
+	}
+}
+
+func (p *proxy) authenticate(s *proxySession) error {
+	if p.password != "" {
+		s.backend.Send(&pgproto3.AuthenticationCleartextPassword{})
+		if err := s.backend.Flush(); err != nil {
+			return err
+		}
+		if err := s.backend.SetAuthType(pgproto3.AuthTypeCleartextPassword); err != nil {
+			return err
+		}
+		msg, err := s.backend.Receive()
+		if err != nil {
+			return err
+		}
+		password, ok := msg.(*pgproto3.PasswordMessage)
+		if !ok || password.Password != p.password {
+			s.backend.Send(&pgproto3.ErrorResponse{Severity: "FATAL", Code: "28P01", Message: "password authentication failed"})
+			s.backend.Flush()
+			return errors.New("password authentication failed")
+		}
+	}
+
+	s.backend.Send(&pgproto3.AuthenticationOk{})
+	for name, value := range map[string]string{
+		"server_version":              "16.0 (ntran proxy)",
+		"server_encoding":             "UTF8",
+		"client_encoding":             "UTF8",
+		"DateStyle":                   "ISO, MDY",
+		"integer_datetimes":           "on",
+		"standard_conforming_strings": "on",
+	} {
+		s.backend.Send(&pgproto3.ParameterStatus{Name: name, Value: value})
+	}
+	s.backend.Send(&pgproto3.BackendKeyData{ProcessID: uint32(s.id)})
+	p.ready(s)
+	return nil
+}
+
+// ready - tells the client the session is idle, or in a transaction while
+// it has branches open
+func (p *proxy) ready(s *proxySession) {
+	p.mu.Lock()
+	status := byte('I')
+	if p.owner == s {
+		status = 'T'
+	}
+	p.mu.Unlock()
+	s.backend.Send(&pgproto3.ReadyForQuery{TxStatus: status})
+	s.backend.Flush()
+}
+
+// query - runs each statement of a simple query, stopping at the first error
+func (p *proxy) query(s *proxySession, sql string) {
+	statements := splitStatements(sql)
+	if len(statements) == 0 {
+		s.backend.Send(&pgproto3.EmptyQueryResponse{})
+	}
+	for _, statement := range statements {
+		result, err := p.statement(context.Background(), s, statement, nil)
+		if err != nil {
+			s.logger.Debug("statement failed", "statement", statement, "error", err)
+			s.backend.Send(pgErrorResponse(err))
+			break
+		}
+		if result.rows != nil {
+			sendRowDescription(s.backend, result.rows.Columns)
+			sendDataRows(s.backend, result.rows.Values)
+		}
+		s.backend.Send(&pgproto3.CommandComplete{CommandTag: []byte(result.tag)})
+	}
+	p.ready(s)
+}
+
+// extended - handles a message of the extended query protocol, whose
+// statements are routed as a simple query's are
+func (p *proxy) extended(s *proxySession, msg pgproto3.FrontendMessage) error {
+	switch msg := msg.(type) {
+	case *pgproto3.Parse:
+		statements := splitStatements(msg.Query)
+		if len(statements) > 1 {
+			return &pgconn.PgError{Code: "42601", Message: "cannot insert multiple commands into a prepared statement"}
+		}
+		prepared := &preparedStatement{oids: slices.Clone(msg.ParameterOIDs)}
+		if len(statements) == 1 {
+			prepared.sql = statements[0]
+		}
+		for len(prepared.oids) < parameterCount(prepared.sql) {
+			prepared.oids = append(prepared.oids, 0)
+		}
+		s.prepared[msg.Name] = prepared
+		s.backend.Send(&pgproto3.ParseComplete{})
+
+	case *pgproto3.Bind:
+		prepared, ok := s.prepared[msg.PreparedStatement]
+		if !ok {
+			return &pgconn.PgError{Code: "26000", Message: fmt.Sprintf("prepared statement %q does not exist", msg.PreparedStatement)}
+		}
+		if len(msg.Parameters) != len(prepared.oids) {
+			return &pgconn.PgError{Code: "08P01", Message: fmt.Sprintf("bind message supplies %d parameters, but prepared statement %q requires %d", len(msg.Parameters), msg.PreparedStatement, len(prepared.oids))}
+		}
+		args := make([]any, len(msg.Parameters))
+		for i, value := range msg.Parameters {
+			var err error
+			if args[i], err = decodeParameter(prepared.oids[i], formatCode(msg.ParameterFormatCodes, i), value); err != nil {
+				return err
+			}
+		}
+		s.portals[msg.DestinationPortal] = &portal{sql: prepared.sql, args: args}
+		s.backend.Send(&pgproto3.BindComplete{})
+
+	case *pgproto3.Describe:
+		if msg.ObjectType == 'S' {
+			prepared, ok := s.prepared[msg.Name]
+			if !ok {
+				return &pgconn.PgError{Code: "26000", Message: fmt.Sprintf("prepared statement %q does not exist", msg.Name)}
+			}
+			// the columns of a query are not known until it runs, so they
+			// are only described for portals
+			s.backend.Send(&pgproto3.ParameterDescription{ParameterOIDs: prepared.oids})
+			s.backend.Send(&pgproto3.NoData{})
+			return nil
+		}
+		portal, ok := s.portals[msg.Name]
+		if !ok {
+			return &pgconn.PgError{Code: "34000", Message: fmt.Sprintf("portal %q does not exist", msg.Name)}
+		}
+		if portal.sql == "" || !returnsRows(portal.sql) {
+			s.backend.Send(&pgproto3.NoData{})
+			return nil
+		}
+		if portal.result == nil {
+			result, err := p.statement(context.Background(), s, portal.sql, portal.args)
+			if err != nil {
+				return err
+			}
+			portal.result = &result
+		}
+		if portal.result.rows == nil {
+			s.backend.Send(&pgproto3.NoData{})
+			return nil
+		}
+		sendRowDescription(s.backend, portal.result.rows.Columns)
+
+	case *pgproto3.Execute:
+		portal, ok := s.portals[msg.Portal]
+		if !ok {
+			return &pgconn.PgError{Code: "34000", Message: fmt.Sprintf("portal %q does not exist", msg.Portal)}
+		}
+		if portal.sql == "" {
+			s.backend.Send(&pgproto3.EmptyQueryResponse{})
+			return nil
+		}
+		if portal.result == nil {
+			result, err := p.statement(context.Background(), s, portal.sql, portal.args)
+			if err != nil {
+				return err
+			}
+			portal.result = &result
+		}
+		// every row is sent at once, whatever the row limit
+		if portal.result.rows != nil {
+			sendDataRows(s.backend, portal.result.rows.Values)
+		}
+		s.backend.Send(&pgproto3.CommandComplete{CommandTag: []byte(portal.result.tag)})
+		delete(s.portals, msg.Portal)
+
+	case *pgproto3.Close:
+		if msg.ObjectType == 'S' {
+			delete(s.prepared, msg.Name)
+		} else {
+			delete(s.portals, msg.Name)
+		}
+		s.backend.Send(&pgproto3.CloseComplete{})
+	}
+	return nil
+}
+
+// parameterCount - the highest $n parameter a statement refers to
+func parameterCount(sql string) int {
+	count := 0
+	for _, m := range parameterRef.FindAllStringSubmatch(sql, -1) {
+		n, _ := strconv.Atoi(m[1])
+		count = max(count, n)
+	}
+	return count
+}
+
+var parameterRef = regexp.MustCompile(`\$(\d+)`)
+
+// formatCode - the format of the ith parameter, given no codes (all text),
+// one code for every parameter or one per parameter
+func formatCode(codes []int16, i int) int16 {
+	switch len(codes) {
+	case 0:
+		return pgtype.TextFormatCode
+	case 1:
+		return codes[0]
+	}
+	return codes[i]
+}
+
+// decodeParameter - the value of a bound parameter, typed by its oid when
+// it has one. Text of an unset type is passed on as a string
+func decodeParameter(oid uint32, format int16, value []byte) (any, error) {
+	if value == nil {
+		return nil, nil
+	}
+	if format == pgtype.TextFormatCode {
+		text := string(value)
+		var v any
+		var err error
+		switch oid {
+		case pgtype.BoolOID:
+			v, err = strconv.ParseBool(text)
+		case pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID:
+			v, err = strconv.ParseInt(text, 10, 64)
+		case pgtype.Float4OID, pgtype.Float8OID:
+			v, err = strconv.ParseFloat(text, 64)
+		default:
+			return text, nil
+		}
+		if err != nil {
+			return nil, &pgconn.PgError{Code: "22P02", Message: fmt.Sprintf("invalid input %q for a parameter of type %d", text, oid)}
+		}
+		return v, nil
+	}
+
+	size := map[uint32]int{pgtype.BoolOID: 1, pgtype.Int2OID: 2, pgtype.Int4OID: 4, pgtype.Int8OID: 8, pgtype.Float4OID: 4, pgtype.Float8OID: 8}
+	if n, ok := size[oid]; ok && len(value) != n {
+		return nil, &pgconn.PgError{Code: "08P01", Message: fmt.Sprintf("a binary parameter of type %d has %d bytes", oid, len(value))}
+	}
+	switch oid {
+	case pgtype.BoolOID:
+		return value[0] != 0, nil
+	case pgtype.Int2OID:
+		return int64(int16(binary.BigEndian.Uint16(value))), nil
+	case pgtype.Int4OID:
+		return int64(int32(binary.BigEndian.Uint32(value))), nil
+	case pgtype.Int8OID:
+		return int64(binary.BigEndian.Uint64(value)), nil
+	case pgtype.Float4OID:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(value))), nil
+	case pgtype.Float8OID:
+		return math.Float64frombits(binary.BigEndian.Uint64(value)), nil
+	case pgtype.TextOID, pgtype.VarcharOID:
+		return string(value), nil
+	case pgtype.ByteaOID:
+		return bytes.Clone(value), nil
+	}
+	return nil, &pgconn.PgError{Code: "0A000", Message: fmt.Sprintf("binary parameters of type %d are not supported", oid), Hint: "send the parameter in text format"}
+}
+
+func pgErrorResponse(err error) *pgproto3.ErrorResponse {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return &pgproto3.ErrorResponse{Severity: "ERROR", Code: pgErr.Code, Message: pgErr.Message, Detail: pgErr.Detail, Hint: pgErr.Hint}
+	}
+	return &pgproto3.ErrorResponse{Severity: "ERROR", Code: "XX000", Message: policy.Redact(err.Error())}
+}
+
+/*
+ * statement - runs a statement with its arguments: a command of the proxy,
+ * or SQL on the session's branch, the branch it names with ON BRANCH or,
+ * when there is neither, the main database. The main database can be
+ * queried at any time but only written while no branches are open
+ */
+func (p *proxy) statement(ctx context.Context, s *proxySession, statement string, args []any) (result, error) {
+	if m := beginSpeculative.FindStringSubmatch(statement); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		return result{tag: "BEGIN"}, p.begin(ctx, s, n)
+	}
+	if m := commitBranch.FindStringSubmatch(statement); m != nil {
+		return result{tag: "COMMIT"}, p.commit(ctx, s, strings.ToLower(m[1]))
+	}
+	if rollbackSpeculative.MatchString(statement) {
+		return result{tag: "ROLLBACK"}, p.rollback(ctx, s)
+	}
+	if showBranches.MatchString(statement) {
+		rows := p.showBranches(s)
+		return result{rows: &rows, tag: fmt.Sprintf("SELECT %d", len(rows.Values))}, nil
+	}
+	if m := revertCommits.FindStringSubmatch(statement); m != nil {
+		n := 1
+		if m[1] != "" {
+			n, _ = strconv.Atoi(m[1])
+		}
+		return result{tag: "REVERT"}, p.revert(ctx, s, n)
+	}
+	if m := useBranch.FindStringSubmatch(statement); m != nil {
+		index, _ := strconv.Atoi(m[1])
+		if _, err := p.branch(s, index); err != nil {
+			return result{}, err
+		}
+		s.branch = index
+		return result{tag: "SET"}, nil
+	}
+
+	index := s.branch
+	if m := onBranch.FindStringSubmatch(statement); m != nil {
+		index, _ = strconv.Atoi(m[1])
+		statement = m[2]
+	}
+	if index < 0 {
+		return p.main(ctx, statement, args)
+	}
+	branch, err := p.branch(s, index)
+	if err != nil {
+		return result{}, err
+	}
+
+	if returnsRows(statement) {
+		rows, err := branch.Query(ctx, statement, args...)
+		if err != nil {
+			return result{}, err
+		}
+		return result{rows: &rows, tag: fmt.Sprintf("SELECT %d", len(rows.Values))}, nil
+	}
+	if err := branch.Exec(ctx, statement, args...); err != nil {
+		return result{}, err
+	}
+	executed := branch.Executed()
+	return result{tag: commandTag(statement, executed[len(executed)-1].RowsAffected)}, nil
+}
+
+// main - runs a statement that names no branch on the main database
+func (p *proxy) main(ctx context.Context, statement string, args []any) (result, error) {
+	if returnsRows(statement) {
+		rows, err := p.engine.QueryMain(ctx, statement, args...)
+		if err != nil {
+			return result{}, err
+		}
+		return result{rows: &rows, tag: fmt.Sprintf("SELECT %d", len(rows.Values))}, nil
+	}
+	affected, err := p.engine.ExecMain(ctx, statement, args...)
+	if errors.Is(err, policy.ErrForksOpen) {
+		return result{}, errors.New("the main database cannot be written while branches are open: COMMIT BRANCH i or ROLLBACK SPECULATIVE first, or run the statement ON BRANCH i")
+	}
+	if err != nil {
+		return result{}, err
+	}
+	return result{tag: commandTag(statement, affected)}, nil
+}
+
+// returnsRows - whether a statement, or the statement ON BRANCH runs, is
+// a query
+func returnsRows(statement string) bool {
+	if m := onBranch.FindStringSubmatch(statement); m != nil {
+		statement = m[2]
+	}
+	m := queryKeyword.FindStringSubmatch(statement)
+	return m != nil && !(strings.EqualFold(m[1], "WITH") && modifyingKeyword.MatchString(statement))
+}
+
+// commandTag - the tag of a statement that affected rows, e.g. INSERT 0 3,
+// or just its keyword when the rows are not known (-1) or do not apply
+func commandTag(statement string, affected int64) string {
+	keyword := strings.ToUpper(strings.Fields(statement)[0])
+	switch {
+	case affected < 0:
+		return keyword
+	case keyword == "INSERT":
+		return fmt.Sprintf("INSERT 0 %d", affected)
+	case keyword == "UPDATE" || keyword == "DELETE" || keyword == "MERGE":
+		return fmt.Sprintf("%s %d", keyword, affected)
+	}
+	return keyword
+}
+
+// branch - the open branch at index, if this session forked it
+func (p *proxy) branch(s *proxySession, index int) (*speculate.Branch, error) {
+	p.mu.Lock()
+	owned := p.owner == s
+	p.mu.Unlock()
+	if !owned {
+		return nil, errors.New("this session has no branches open, run BEGIN SPECULATIVE n first")
+	}
+	branches := p.engine.Branches()
+	if index < 0 || index >= len(branches) {
+		return nil, fmt.Errorf("branch %d does not exist, branches 0 to %d are open", index, len(branches)-1)
+	}
+	return branches[index], nil
+}
+
+func (p *proxy) begin(ctx context.Context, s *proxySession, n int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.owner == s {
+		return errors.New("this session already has branches open, COMMIT BRANCH i or ROLLBACK SPECULATIVE first")
+	}
+	if p.owner != nil {
+		return errors.New("another session has branches open, try again once it commits or rolls back")
+	}
+	if _, err := p.engine.Fork(ctx, n); err != nil {
+		return err
+	}
+	p.owner = s
+	s.branch = -1
+	s.logger.Info("forked branches", "branches", n)
+	return nil
+}
+
+// commit - commits branch i, or the branch a strategy named by target selects
+func (p *proxy) commit(ctx context.Context, s *proxySession, target string) error {
+	var winner *speculate.Branch
+	if index, err := strconv.Atoi(target); err == nil {
+		if winner, err = p.branch(s, index); err != nil {
+			return err
+		}
+		if err := winner.Err(); err != nil {
+			return fmt.Errorf("branch %d failed and cannot be committed: %v", index, err)
+		}
+	} else {
+		strategy, ok := speculate.Strategies[target]
+		if target == "interactive" && p.interactive != nil {
+			// the client's statements cannot be run again
+			strategy, ok = p.interactive.WithoutRerun(), true
+		}
+		if !ok {
+			return fmt.Errorf("COMMIT BRANCH takes a branch or one of %v, got %s", speculate.StrategyNames, target)
+		}
+		if _, err := p.branch(s, 0); err != nil {
+			return err
+		}
+		winner, err = p.engine.Select(ctx, strategy)
+		if errors.Is(err, speculate.ErrRejected) {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			p.owner = nil
+			s.branch = -1
+			s.logger.Info("the operator rejected every branch")
+			return errors.Join(fmt.Errorf("%v, so the branches were rolled back", err), p.engine.Discard(ctx))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.engine.Commit(ctx, winner); err != nil {
+		// a failed promotion discards the branches, while a winner that is
+		// not open leaves them to this session
+		if len(p.engine.Branches()) == 0 {
+			p.owner = nil
+			s.branch = -1
+		}
+		return err
+	}
+	p.owner = nil
+	s.branch = -1
+	s.logger.Info("committed branch", "winner", winner.Index)
+	return nil
+}
+
+// revert - undoes the n most recent commits, while no session has
+// branches open
+func (p *proxy) revert(ctx context.Context, s *proxySession, n int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.owner != nil {
+		return errors.New("branches are open, COMMIT BRANCH i or ROLLBACK SPECULATIVE first")
+	}
+	if n < 1 {
+		return fmt.Errorf("REVERT takes at least 1 commit, got %d", n)
+	}
+	if err := p.engine.Revert(ctx, n); err != nil {
+		return err
+	}
+	s.logger.Info("reverted commits", "steps", n)
+	return nil
+}
+
+func (p *proxy) rollback(ctx context.Context, s *proxySession) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.owner != s {
+		return errors.New("this session has no branches open")
+	}
+	p.owner = nil
+	s.branch = -1
+	if err := p.engine.Discard(ctx); err != nil {
+		return err
+	}
+	s.logger.Info("discarded branches")
+	return nil
+}
+
+// showBranches - the session's branches and whether they failed
+func (p *proxy) showBranches(s *proxySession) speculate.Rows {
+	p.mu.Lock()
+	owned := p.owner == s
+	p.mu.Unlock()
+	rows := speculate.Rows{Columns: []string{"branch", "name", "error"}}
+	if owned {
+		for _, branch := range p.engine.Branches() {
+			var failure any
+			if err := branch.Err(); err != nil {
+				failure = err.Error()
+			}
+			rows.Values = append(rows.Values, []any{branch.Index, branch.Name(), failure})
+		}
+	}
+	return rows
+}
+
+// sendRowDescription - columns, every one of them text
+func sendRowDescription(backend *pgproto3.Backend, columns []string) {
+	fields := make([]pgproto3.FieldDescription, len(columns))
+	for i, column := range columns {
+		fields[i] = pgproto3.FieldDescription{Name: []byte(column), DataTypeOID: textOID, DataTypeSize: -1, TypeModifier: -1}
+	}
+	backend.Send(&pgproto3.RowDescription{Fields: fields})
+}
+
+// sendDataRows - rows in text format
+func sendDataRows(backend *pgproto3.Backend, rows [][]any) {
+	for _, values := range rows {
+		row := make([][]byte, len(values))
+		for i, v := range values {
+			row[i] = textValue(v)
+		}
+		backend.Send(&pgproto3.DataRow{Values: row})
+	}
+}
+
+// textValue - v in Postgres' text format, nil for NULL
+func textValue(v any) []byte {
+	if valuer, ok := v.(driver.Valuer); ok {
+		value, err := valuer.Value()
+		if err == nil {
+			v = value
+		}
+	}
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return []byte(fmt.Sprintf("\\x%x", v))
+	case bool:
+		if v {
+			return []byte("t")
+		}
+		return []byte("f")
+	case time.Time:
+		return []byte(v.Format("2006-01-02 15:04:05.999999Z07:00"))
+	}
+	return []byte(fmt.Sprint(v))
+}
+
+// splitStatements - the statements of a simple query, split on semicolons
+// outside quotes, dollar quotes and comments
+func splitStatements(sql string) []string {
+	var statements []string
+	start := 0
+	add := func(end int) {
+		if statement := strings.TrimSpace(sql[start:end]); statement != "" {
+			statements = append(statements, statement)
+		}
+	}
+	for i := 0; i < len(sql); i++ {
+		switch {
+		case sql[i] == '\'' || sql[i] == '"':
+			quote := sql[i]
+			for i++; i < len(sql) && sql[i] != quote; i++ {
+			}
+		case strings.HasPrefix(sql[i:], "--"):
+			for ; i < len(sql) && sql[i] != '\n'; i++ {
+			}
+		case strings.HasPrefix(sql[i:], "/*"):
+			if end := strings.Index(sql[i+2:], "*/"); end >= 0 {
+				i += end + 3
+			} else {
+				i = len(sql)
+			}
+		case sql[i] == '$':
+			if tag := dollarTag.FindString(sql[i:]); tag != "" {
+				if end := strings.Index(sql[i+len(tag):], tag); end >= 0 {
+					i += len(tag) + end + len(tag) - 1
+				} else {
+					i = len(sql)
+				}
+			}
+		case sql[i] == ';':
+			add(i)
+			start = i + 1
+		}
+	}
+	add(len(sql))
+	return statements
+}
+
+// dollarTag - the opening of a dollar-quoted string, e.g. $$ or $body$
+var dollarTag = regexp.MustCompile(`^\$[A-Za-z_]*\$`)
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"ntran/speculate"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name string
+		sql  string
+		want []string
+	}{
+		{"one", "SELECT 1", []string{"SELECT 1"}},
+		{"several", "SELECT 1; SELECT 2;", []string{"SELECT 1", "SELECT 2"}},
+		{"empty", " ; ;\n", nil},
+		{"single quotes", "INSERT INTO t VALUES ('a;b'); SELECT 1", []string{"INSERT INTO t VALUES ('a;b')", "SELECT 1"}},
+		{"escaped quote", "SELECT 'it''s; here'; SELECT 2", []string{"SELECT 'it''s; here'", "SELECT 2"}},
+		{"double quotes", `SELECT "a;b" FROM t; SELECT 2`, []string{`SELECT "a;b" FROM t`, "SELECT 2"}},
+		{"dollar quotes", "SELECT $$a;b$$; SELECT 2", []string{"SELECT $$a;b$$", "SELECT 2"}},
+		{"dollar tags", "SELECT $body$a;$$;b$body$; SELECT 2", []string{"SELECT $body$a;$$;b$body$", "SELECT 2"}},
+		{"parameters", "SELECT $1; SELECT $2", []string{"SELECT $1", "SELECT $2"}},
+		{"line comment", "SELECT 1 -- a; b\n; SELECT 2", []string{"SELECT 1 -- a; b", "SELECT 2"}},
+		{"block comment", "SELECT /* a; b */ 1; SELECT 2", []string{"SELECT /* a; b */ 1", "SELECT 2"}},
+		{"unterminated comment", "SELECT 1 /* a; b", []string{"SELECT 1 /* a; b"}},
+		{"unterminated dollar quote", "SELECT $$a; b", []string{"SELECT $$a; b"}},
+		{"on branch", "ON BRANCH 1 INSERT INTO t VALUES (1); COMMIT BRANCH 1", []string{"ON BRANCH 1 INSERT INTO t VALUES (1)", "COMMIT BRANCH 1"}},
+	}
+	for _, tt := range tests {
+		if got := splitStatements(tt.sql); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: splitStatements(%q) = %q, want %q", tt.name, tt.sql, got, tt.want)
+		}
+	}
+}
+
+func TestReturnsRows(t *testing.T) {
+	tests := []struct {
+		statement string
+		want      bool
+	}{
+		{"SELECT 1", true},
+		{"select * from t", true},
+		{"(SELECT 1) UNION (SELECT 2)", true},
+		{"VALUES (1)", true},
+		{"TABLE t", true},
+		{"EXPLAIN SELECT 1", true},
+		{"SHOW search_path", true},
+		{"WITH x AS (SELECT 1) SELECT * FROM x", true},
+		{"WITH x AS (DELETE FROM t RETURNING *) SELECT * FROM x", false},
+		{"ON BRANCH 2 SELECT 1", true},
+		{"ON BRANCH 2 UPDATE t SET x = 1", false},
+		{"INSERT INTO t VALUES (1)", false},
+		{"CREATE TABLE selected (x INT)", false},
+	}
+	for _, tt := range tests {
+		if got := returnsRows(tt.statement); got != tt.want {
+			t.Errorf("returnsRows(%q) = %v, want %v", tt.statement, got, tt.want)
+		}
+	}
+}
+
+func TestCommandTag(t *testing.T) {
+	tests := []struct {
+		statement string
+		affected  int64
+		want      string
+	}{
+		{"INSERT INTO t VALUES (1), (2)", 2, "INSERT 0 2"},
+		{"insert into t values (1)", 1, "INSERT 0 1"},
+		{"UPDATE t SET x = 1", 3, "UPDATE 3"},
+		{"DELETE FROM t", 0, "DELETE 0"},
+		{"MERGE INTO t USING s ON true WHEN MATCHED THEN DELETE", 4, "MERGE 4"},
+		{"INSERT INTO t VALUES (1)", -1, "INSERT"},
+		{"CREATE TABLE t (x INT)", 0, "CREATE"},
+	}
+	for _, tt := range tests {
+		if got := commandTag(tt.statement, tt.affected); got != tt.want {
+			t.Errorf("commandTag(%q, %d) = %q, want %q", tt.statement, tt.affected, got, tt.want)
+		}
+	}
+}
+
+func TestCommands(t *testing.T) {
+	tests := []struct {
+		statement string
+		command   string
+		want      []string
+	}{
+		{"BEGIN SPECULATIVE 3", "begin", []string{"3"}},
+		{"begin  speculative\n12", "begin", []string{"12"}},
+		{"BEGIN", "begin", nil},
+		{"BEGIN SPECULATIVE n", "begin", nil},
+		{"COMMIT BRANCH 2", "commit", []string{"2"}},
+		{"commit branch majority", "commit", []string{"majority"}},
+		{"COMMIT", "commit", nil},
+		{"ON BRANCH 1 SELECT 1", "on", []string{"1", "SELECT 1"}},
+		{"on branch 0 INSERT INTO t\nVALUES (1)", "on", []string{"0", "INSERT INTO t\nVALUES (1)"}},
+		{"ON BRANCH SELECT 1", "on", nil},
+		{"USE BRANCH 4", "use", []string{"4"}},
+		{"REVERT", "revert", []string{""}},
+		{"revert 3", "revert", []string{"3"}},
+		{"REVERT ALL", "revert", nil},
+	}
+	commands := map[string]interface {
+		FindStringSubmatch(string) []string
+	}{"begin": beginSpeculative, "commit": commitBranch, "on": onBranch, "use": useBranch, "revert": revertCommits}
+	for _, tt := range tests {
+		m := commands[tt.command].FindStringSubmatch(tt.statement)
+		var got []string
+		if m != nil {
+			got = m[1:]
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s matches %q as %q, want %q", tt.command, tt.statement, got, tt.want)
+		}
+	}
+	for _, statement := range []string{"ROLLBACK SPECULATIVE", "rollback\tspeculative"} {
+		if !rollbackSpeculative.MatchString(statement) {
+			t.Errorf("rollbackSpeculative does not match %q", statement)
+		}
+	}
+	for _, statement := range []string{"SHOW BRANCHES", "show branches"} {
+		if !showBranches.MatchString(statement) {
+			t.Errorf("showBranches does not match %q", statement)
+		}
+	}
+}
+
+func TestParameterCount(t *testing.T) {
+	tests := map[string]int{
+		"SELECT 1":                  0,
+		"SELECT $1":                 1,
+		"SELECT $2, $1":             2,
+		"SELECT $1 + $1":            1,
+		"INSERT INTO t VALUES ($3)": 3,
+	}
+	for sql, want := range tests {
+		if got := parameterCount(sql); got != want {
+			t.Errorf("parameterCount(%q) = %d, want %d", sql, got, want)
+		}
+	}
+}
+
+func TestDecodeParameter(t *testing.T) {
+	be := func(n int, v uint64) []byte {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, v)
+		return b[8-n:]
+	}
+	tests := []struct {
+		name   string
+		oid    uint32
+		format int16
+		value  []byte
+		want   any
+		code   string
+	}{
+		{"null", pgtype.Int4OID, pgtype.BinaryFormatCode, nil, nil, ""},
+		{"text untyped", 0, pgtype.TextFormatCode, []byte("42"), "42", ""},
+		{"text bool", pgtype.BoolOID, pgtype.TextFormatCode, []byte("t"), true, ""},
+		{"text int", pgtype.Int4OID, pgtype.TextFormatCode, []byte("-7"), int64(-7), ""},
+		{"text float", pgtype.Float8OID, pgtype.TextFormatCode, []byte("1.5"), 1.5, ""},
+		{"text varchar", pgtype.VarcharOID, pgtype.TextFormatCode, []byte("a"), "a", ""},
+		{"text invalid int", pgtype.Int8OID, pgtype.TextFormatCode, []byte("x"), nil, "22P02"},
+		{"binary bool", pgtype.BoolOID, pgtype.BinaryFormatCode, []byte{1}, true, ""},
+		{"binary int2", pgtype.Int2OID, pgtype.BinaryFormatCode, be(2, 0xfffe), int64(-2), ""},
+		{"binary int4", pgtype.Int4OID, pgtype.BinaryFormatCode, be(4, 70000), int64(70000), ""},
+		{"binary int8", pgtype.Int8OID, pgtype.BinaryFormatCode, be(8, 1<<40), int64(1 << 40), ""},
+		{"binary float4", pgtype.Float4OID, pgtype.BinaryFormatCode, be(4, uint64(math.Float32bits(0.5))), 0.5, ""},
+		{"binary float8", pgtype.Float8OID, pgtype.BinaryFormatCode, be(8, math.Float64bits(-2.25)), -2.25, ""},
+		{"binary text", pgtype.TextOID, pgtype.BinaryFormatCode, []byte("abc"), "abc", ""},
+		{"binary bytea", pgtype.ByteaOID, pgtype.BinaryFormatCode, []byte{0, 1}, []byte{0, 1}, ""},
+		{"binary wrong size", pgtype.Int4OID, pgtype.BinaryFormatCode, []byte{0, 1}, nil, "08P01"},
+		{"binary unsupported", pgtype.DateOID, pgtype.BinaryFormatCode, []byte{0, 0, 0, 1}, nil, "0A000"},
+	}
+	for _, tt := range tests {
+		got, err := decodeParameter(tt.oid, tt.format, tt.value)
+		var pgErr *pgconn.PgError
+		switch {
+		case tt.code != "":
+			if !errors.As(err, &pgErr) || pgErr.Code != tt.code {
+				t.Errorf("%s: error %v, want code %s", tt.name, err, tt.code)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case !reflect.DeepEqual(got, tt.want):
+			t.Errorf("%s: %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFormatCode(t *testing.T) {
+	if got := formatCode(nil, 2); got != pgtype.TextFormatCode {
+		t.Errorf("formatCode with no codes = %d, want text", got)
+	}
+	if got := formatCode([]int16{pgtype.BinaryFormatCode}, 2); got != pgtype.BinaryFormatCode {
+		t.Errorf("formatCode with one code = %d, want it for every parameter", got)
+	}
+	if got := formatCode([]int16{pgtype.BinaryFormatCode, pgtype.TextFormatCode}, 1); got != pgtype.TextFormatCode {
+		t.Errorf("formatCode with a code per parameter = %d, want the parameter's", got)
+	}
+}
+
+// startProxy - a proxy over a duckdb-parallel engine, and a client of it
+func startProxy(t *testing.T, ctx context.Context) *pgx.Conn {
+	engine, err := speculate.Open(ctx, speculate.Options{
+		Policy:   "duckdb-parallel",
+		Schema:   "CREATE TABLE users (id INTEGER PRIMARY KEY, name VARCHAR); INSERT INTO users VALUES (1, 'ada');",
+		Branches: 4,
+		History:  2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &proxy{engine: engine, sessions: make(map[*proxySession]bool)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		p.closeSessions()
+		engine.Close(context.Background())
+	})
+
+	conn, err := pgx.Connect(ctx, "postgres://ntran@"+listener.Addr().String()+"/ntran?sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close(context.Background()) })
+	return conn
+}
+
+func TestProxyRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	conn := startProxy(t, ctx)
+
+	count := func(sql string) int {
+		t.Helper()
+		// every column is sent as text
+		var text string
+		if err := conn.QueryRow(ctx, sql).Scan(&text); err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+		n, err := strconv.Atoi(text)
+		if err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+		return n
+	}
+	exec := func(sql string, args ...any) pgconn.CommandTag {
+		t.Helper()
+		tag, err := conn.Exec(ctx, sql, args...)
+		if err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+		return tag
+	}
+
+	exec("BEGIN SPECULATIVE 2")
+	if tag := exec("ON BRANCH 0 INSERT INTO users VALUES (2, 'bob')"); tag.String() != "INSERT 0 1" {
+		t.Errorf("insert tag %q, want INSERT 0 1", tag)
+	}
+	exec("ON BRANCH 1 INSERT INTO users VALUES (2, 'bob'), (3, 'cy')")
+	exec("ON BRANCH 1 UPDATE users SET name = $1 WHERE id = 1", "ada lovelace")
+	if n := count("ON BRANCH 1 SELECT count(*) FROM users"); n != 3 {
+		t.Errorf("branch 1 has %d users, want 3", n)
+	}
+	if n := count("SELECT count(*) FROM users"); n != 1 {
+		t.Errorf("main has %d users while branches are open, want 1", n)
+	}
+	if _, err := conn.Exec(ctx, "INSERT INTO users VALUES (9, 'eve')"); err == nil {
+		t.Error("wrote the main database while branches are open")
+	}
+
+	exec("COMMIT BRANCH 1")
+	if n := count("SELECT count(*) FROM users"); n != 3 {
+		t.Errorf("main has %d users after committing branch 1, want 3", n)
+	}
+	var name string
+	if err := conn.QueryRow(ctx, "SELECT name FROM users WHERE id = 1").Scan(&name); err != nil || name != "ada lovelace" {
+		t.Errorf("user 1 is %q (%v) after committing, want ada lovelace", name, err)
+	}
+
+	exec("REVERT")
+	if n := count("SELECT count(*) FROM users"); n != 1 {
+		t.Errorf("main has %d users after reverting, want 1", n)
+	}
+	if _, err := conn.Exec(ctx, "REVERT"); err == nil {
+		t.Error("reverted a commit that was not kept")
+	}
+
+	// the session keeps no branches once it committed
+	if _, err := conn.Exec(ctx, "ON BRANCH 0 SELECT 1"); err == nil {
+		t.Error("ran a statement on a branch after committing")
+	}
+	exec("INSERT INTO users VALUES (4, 'dee')")
+	if n := count("SELECT count(*) FROM users"); n != 2 {
+		t.Errorf("main has %d users after writing it, want 2", n)
+	}
+}
+
+func TestProxySimpleProtocol(t *testing.T) {
+	ctx := context.Background()
+	conn := startProxy(t, ctx)
+
+	results, err := conn.PgConn().Exec(ctx, "BEGIN SPECULATIVE 2; ON BRANCH 0 DELETE FROM users; SHOW BRANCHES; ROLLBACK SPECULATIVE").ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tags []string
+	for _, result := range results {
+		tags = append(tags, result.CommandTag.String())
+	}
+	if want := []string{"BEGIN", "DELETE 1", "SELECT 2", "ROLLBACK"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("tags %q, want %q", tags, want)
+	}
+	if rows := results[2].Rows; len(rows) != 2 || string(rows[1][0]) != "1" {
+		t.Errorf("SHOW BRANCHES rows %q, want branches 0 and 1", rows)
+	}
+}
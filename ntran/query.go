@@ -0,0 +1,75 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	_ "github.com/marcboeker/go-duckdb"
+
+	"ntran/analysis"
+)
+
+func queryCommand(args []string) error {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	dbArg := fs.String("db", "./results.duckdb", "the DuckDB results database to query")
+	formatArg := fs.String("format", analysis.FormatText, fmt.Sprintf("the output format %v", analysis.Formats))
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: ntran query [flags] \"<sql>\"\n\n")
+		fmt.Fprintf(fs.Output(), "Queries a results database written with -results-db. Tables: runs, configurations,\nrecords, candidates and depths.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if _, err := os.Stat(*dbArg); err != nil {
+		return fmt.Errorf("results database %s: %v", *dbArg, err)
+	}
+	db, err := sql.Open("duckdb", *dbArg+"?access_mode=READ_ONLY")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	table := &analysis.Table{Headers: columns}
+	for rows.Next() {
+		values := make([]any, len(columns))
+		scanVals := make([]any, len(columns))
+		for i := range values {
+			scanVals[i] = &values[i]
+		}
+		if err := rows.Scan(scanVals...); err != nil {
+			return err
+		}
+		for i, v := range values {
+			switch v := v.(type) {
+			case []byte:
+				values[i] = string(v)
+			case time.Time:
+				values[i] = v.Format(time.RFC3339)
+			case float32:
+				values[i] = float64(v)
+			}
+		}
+		table.Append(values...)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return table.Render(os.Stdout, *formatArg)
+}
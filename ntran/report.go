@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"ntran/analysis"
+)
+
+func reportCommand(args []string) error {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	outArg := fs.String("o", "report.html", "the html file to write the report to")
+	metricArg := fs.String("metric", analysis.MetricTotal, fmt.Sprintf("the duration to chart %v", analysis.Metrics()))
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: ntran report [flags] [results files or run directories...]\n\n")
+		fmt.Fprintf(fs.Output(), "Renders a self-contained html report with inline charts. Defaults to ./runs and ./results.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	records, err := analysis.Load(resultPaths(fs.Args())...)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("no results found")
+	}
+
+	f, err := os.Create(*outArg)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := analysis.WriteReport(f, records, *metricArg); err != nil {
+		return err
+	}
+	fmt.Printf("wrote report of %d records to '%s'\n", len(records), *outArg)
+	return nil
+}
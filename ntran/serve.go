@@ -0,0 +1,886 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"ntran/policy"
+	"ntran/speculate"
+)
+
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+// Speculation statuses
+const (
+	statusCommitted = "committed"
+	statusHeld      = "held"
+	statusDiscarded = "discarded"
+	statusRejected  = "rejected"
+)
+
+// maxBodyBytes - the largest request body the server reads
+const maxBodyBytes = 1 << 20
+
+func serveCommand(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addrArg := fs.String("addr", ":8080", "the address to serve the HTTP API on")
+	policyArg := fs.String("policy", "postgres-template", "the policy to fork with [serial-snapshot, duckdb-parallel, duckdb-serial, cold-neondb, prewarm-neondb, postgres-template]")
+	schemaArg := fs.String("schema", "", "a SQL file to execute on the main database at startup (none when empty)")
+	cleanupArg := fs.String("cleanup", "", "a SQL file to execute on the main database at shutdown (none when empty)")
+	branchesArg := fs.Int("branches", 8, "the most candidates a request may submit")
+	ttlArg := fs.Duration("ttl", 5*time.Minute, "how long a session may be idle, or a speculation held, before its branches are discarded (0 to never expire)")
+	historyArg := fs.Int("history", 0, "the most earlier main states kept for POST /v1/revert (0 to keep none)")
+	interactiveArg := fs.Bool("interactive", false, "offer the interactive strategy, which asks the operator at this terminal to pick each winner")
+	diffArg := fs.String("diff", "", "a SQL file of queries whose rows the interactive strategy compares between each branch and the main state")
+	logFormatArg := fs.String("log-format", policy.LogFormatText, fmt.Sprintf("the format of the log written to stderr %v", policy.LogFormats))
+	logLevelArg := fs.String("log-level", "info", "the minimum level of the log [debug, info, warn, error]")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: ntran serve [flags]\n\n")
+		fmt.Fprintf(fs.Output(), "Serves an HTTP/JSON API that forks the database, runs candidate transactions\nand commits the winner. The OpenAPI spec is served at /openapi.yaml.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if err := setupStderrLog(*logFormatArg, *logLevelArg); err != nil {
+		return err
+	}
+
+	var err error
+	options := speculate.Options{Policy: *policyArg, Branches: *branchesArg, History: *historyArg}
+	if options.Schema, err = readSQLFile(*schemaArg); err != nil {
+		return err
+	}
+	if options.Cleanup, err = readSQLFile(*cleanupArg); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	engine, err := speculate.Open(ctx, options)
+	if err != nil {
+		return err
+	}
+	defer engine.Close(context.Background())
+
+	s := &server{engine: engine, ttl: *ttlArg}
+	if *interactiveArg {
+		if s.interactive, err = newInteractive(engine, *diffArg); err != nil {
+			return err
+		}
+	}
+	httpServer := &http.Server{Addr: *addrArg, Handler: s.handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		httpServer.Shutdown(context.Background())
+	}()
+	slog.Info("serving", "addr", *addrArg, policy.LogPolicy, *policyArg)
+	if err := httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// readSQLFile - the contents of path, or nothing when path is empty
+func readSQLFile(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	b, err := os.ReadFile(path)
+	return string(b), err
+}
+
+/*
+ * server - serves speculations and sessions on one engine. The engine has
+ * one set of branches open at a time, so speculations run one at a time,
+ * and none can start while one is running or held open or a session is
+ * open. mu guards the server's state but is not held while a speculation
+ * runs, so other requests are answered meanwhile
+ */
+type server struct {
+	engine *speculate.Engine
+	// ttl - how long a session may be idle or a speculation held, 0 for ever
+	ttl time.Duration
+	// interactive - the interactive strategy, nil unless the operator
+	// offered it
+	interactive *speculate.Interactive
+
+	mu sync.Mutex
+	// running - the speculation whose candidates are running or being
+	// selected from
+	running *speculationResponse
+	held    *speculationResponse
+	// heldTimer - discards the held speculation once it expires
+	heldTimer *time.Timer
+	// session - the last session opened, kept once closed so its outcome
+	// can still be read
+	session *speculate.Session
+}
+
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/speculations", s.createSpeculation)
+	mux.HandleFunc("GET /v1/speculations/{id}", s.getSpeculation)
+	mux.HandleFunc("POST /v1/speculations/{id}/commit", s.commitSpeculation)
+	mux.HandleFunc("DELETE /v1/speculations/{id}", s.discardSpeculation)
+	mux.HandleFunc("POST /v1/sessions", s.createSession)
+	mux.HandleFunc("GET /v1/sessions/{id}", s.getSession)
+	mux.HandleFunc("POST /v1/sessions/{id}/branches/{branch}/statements", s.runSessionStatement)
+	mux.HandleFunc("POST /v1/sessions/{id}/commit", s.commitSession)
+	mux.HandleFunc("DELETE /v1/sessions/{id}", s.discardSession)
+	mux.HandleFunc("GET /v1/history", s.getHistory)
+	mux.HandleFunc("POST /v1/revert", s.revert)
+	mux.HandleFunc("GET /openapi.yaml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(openAPISpec)
+	})
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok", "policy": s.engine.Policy()})
+	})
+	return http.MaxBytesHandler(mux, maxBodyBytes)
+}
+
+type statementRequest struct {
+	SQL   string `json:"sql"`
+	Args  []any  `json:"args,omitempty"`
+	Query bool   `json:"query,omitempty"`
+}
+
+type candidateRequest struct {
+	Statements []statementRequest `json:"statements"`
+}
+
+type speculationRequest struct {
+	Candidates []candidateRequest `json:"candidates"`
+	Strategy   string             `json:"strategy"`
+	Hold       bool               `json:"hold"`
+}
+
+type rowsResponse struct {
+	Columns []string `json:"columns"`
+	Rows    [][]any  `json:"rows"`
+}
+
+type candidateResponse struct {
+	Index      int            `json:"index"`
+	Branch     string         `json:"branch"`
+	Results    []rowsResponse `json:"results"`
+	Error      string         `json:"error,omitempty"`
+	DurationNs int64          `json:"duration_ns"`
+}
+
+type speculationResponse struct {
+	ID         string              `json:"id"`
+	Policy     string              `json:"policy"`
+	Strategy   string              `json:"strategy"`
+	Candidates []candidateResponse `json:"candidates"`
+	// Winner - the selected candidate, nil when every candidate failed
+	Winner *int   `json:"winner"`
+	Status string `json:"status"`
+	// ExpiresAt - when a held speculation is discarded unless it is
+	// committed or discarded first, nil otherwise
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	branches []*speculate.Branch
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: policy.Redact(err.Error())})
+}
+
+// bodyStatus - the status of an error reading a request body
+func bodyStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// forkStatus - the status of an error forking branches: the request's
+// fault when it asked for too many, a conflict when branches are already
+// open and the server's otherwise
+func forkStatus(err error) int {
+	switch {
+	case errors.Is(err, speculate.ErrBranchCount):
+		return http.StatusBadRequest
+	case errors.Is(err, policy.ErrForksOpen):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// decodeRequest - the request body, with JSON numbers in statement
+// arguments decoded as integers where they are whole
+func decodeRequest(r *http.Request) (speculationRequest, error) {
+	var request speculationRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		return request, fmt.Errorf("invalid request body: %w", err)
+	}
+	if len(request.Candidates) == 0 {
+		return request, errors.New("at least one candidate is required")
+	}
+	if request.Strategy == "" {
+		request.Strategy = "random"
+	}
+	for _, candidate := range request.Candidates {
+		for _, statement := range candidate.Statements {
+			for i, arg := range statement.Args {
+				statement.Args[i] = jsonArg(arg)
+			}
+		}
+	}
+	return request, nil
+}
+
+func jsonArg(arg any) any {
+	number, ok := arg.(json.Number)
+	if !ok {
+		return arg
+	}
+	if i, err := number.Int64(); err == nil {
+		return i
+	}
+	f, _ := number.Float64()
+	return f
+}
+
+func newSpeculationID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (s *server) createSpeculation(w http.ResponseWriter, r *http.Request) {
+	request, err := decodeRequest(r)
+	if err != nil {
+		writeError(w, bodyStatus(err), err)
+		return
+	}
+	strategy, err := s.strategy(request.Strategy, true)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	response := &speculationResponse{ID: newSpeculationID(), Policy: s.engine.Policy(), Strategy: request.Strategy}
+	s.mu.Lock()
+	if err := s.checkIdle(); err != nil {
+		s.mu.Unlock()
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	s.running = response
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.running = nil
+		s.mu.Unlock()
+	}()
+
+	candidates := make([][]speculate.Statement, len(request.Candidates))
+	for i, candidate := range request.Candidates {
+		for _, statement := range candidate.Statements {
+			candidates[i] = append(candidates[i], speculate.Statement{SQL: statement.SQL, Args: statement.Args, Query: statement.Query})
+		}
+	}
+	// forks must be committed or discarded even if the client goes away
+	ctx := context.WithoutCancel(r.Context())
+	logger := slog.With("speculation", response.ID, policy.LogPolicy, response.Policy)
+	var winner *speculate.Branch
+	for {
+		var results []speculate.Result
+		if results, err = s.engine.Run(ctx, candidates); err != nil {
+			writeError(w, forkStatus(err), err)
+			return
+		}
+		response.setCandidates(results)
+		winner, err = s.engine.Select(ctx, strategy)
+		if !errors.Is(err, speculate.ErrRerun) {
+			break
+		}
+		// the operator wants to see the candidates again
+		if err := s.engine.Discard(ctx); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		logger.Info("running the candidates again", "candidates", len(candidates))
+	}
+	if errors.Is(err, speculate.ErrAllFailed) || errors.Is(err, speculate.ErrRejected) {
+		response.Status = statusDiscarded
+		if errors.Is(err, speculate.ErrRejected) {
+			response.Status = statusRejected
+		}
+		if err := s.engine.Discard(ctx); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		logger.Warn("no candidate was selected", "candidates", len(candidates), "reason", err)
+		writeJSON(w, http.StatusOK, response)
+		return
+	}
+	if err != nil {
+		s.engine.Discard(ctx)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	response.Winner = &winner.Index
+
+	if request.Hold {
+		s.mu.Lock()
+		s.hold(response)
+		s.mu.Unlock()
+		logger.Info("speculation held", "candidates", len(candidates), "winner", winner.Index, "ttl", s.ttl)
+		writeJSON(w, http.StatusOK, response)
+		return
+	}
+	if err := s.engine.Commit(ctx, winner); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	response.Status = statusCommitted
+	logger.Info("speculation committed", "candidates", len(candidates), "winner", winner.Index)
+	writeJSON(w, http.StatusOK, response)
+}
+
+// setCandidates - the candidates' results, replacing those of an earlier
+// run of the same candidates
+func (response *speculationResponse) setCandidates(results []speculate.Result) {
+	response.Candidates, response.branches = nil, nil
+	for i, result := range results {
+		candidate := candidateResponse{Index: i, Branch: result.Branch.Name(), Results: []rowsResponse{}, DurationNs: result.Duration.Nanoseconds()}
+		for _, rows := range result.Rows {
+			candidate.Results = append(candidate.Results, rowsResponse{Columns: rows.Columns, Rows: rows.Values})
+		}
+		if result.Err != nil {
+			candidate.Error = policy.Redact(result.Err.Error())
+		}
+		response.Candidates = append(response.Candidates, candidate)
+		response.branches = append(response.branches, result.Branch)
+	}
+}
+
+/*
+ * newInteractive - the interactive strategy, asking the operator on stdin
+ * and stdout, and offering to run the candidates again. The queries of the SQL file at diff are compared with the
+ * main state when the policy can query it, or with the first branch
+ */
+func newInteractive(engine *speculate.Engine, diff string) (*speculate.Interactive, error) {
+	queries, err := readSQLFile(diff)
+	if err != nil {
+		return nil, err
+	}
+	interactive := &speculate.Interactive{In: os.Stdin, Out: os.Stdout, Diff: splitStatements(queries), Rerun: true}
+	if _, err := engine.Connector(); err == nil {
+		interactive.Baseline = func(ctx context.Context, query string) (speculate.Rows, error) {
+			return engine.QueryMain(ctx, query)
+		}
+	}
+	return interactive, nil
+}
+
+// strategy - the strategy named name. The interactive strategy offers to
+// run the candidates again when rerun is set
+func (s *server) strategy(name string, rerun bool) (speculate.Strategy, error) {
+	if name == "interactive" && s.interactive != nil {
+		if rerun {
+			return s.interactive, nil
+		}
+		return s.interactive.WithoutRerun(), nil
+	}
+	strategy, ok := speculate.Strategies[name]
+	if !ok {
+		names := speculate.StrategyNames
+		if s.interactive != nil {
+			names = append(slices.Clone(names), "interactive")
+		}
+		return nil, fmt.Errorf("unknown strategy %s, must be one of %v", name, names)
+	}
+	return strategy, nil
+}
+
+// checkIdle - an error while a speculation is running or held or a
+// session is open; the caller holds mu
+func (s *server) checkIdle() error {
+	if s.running != nil {
+		return fmt.Errorf("speculation %s is running, try again once it finishes", s.running.ID)
+	}
+	if s.held != nil {
+		return fmt.Errorf("speculation %s is held open, commit or discard it first", s.held.ID)
+	}
+	if s.session != nil && s.session.State() == speculate.SessionOpen {
+		return fmt.Errorf("session %s is open, commit or discard it first", s.session.ID)
+	}
+	return nil
+}
+
+// hold - keeps a speculation's branches open to be committed or discarded
+// later, discarding them once held for ttl; the caller holds mu
+func (s *server) hold(response *speculationResponse) {
+	response.Status = statusHeld
+	s.held = response
+	if s.ttl <= 0 {
+		return
+	}
+	expires := time.Now().Add(s.ttl)
+	response.ExpiresAt = &expires
+	s.heldTimer = time.AfterFunc(s.ttl, func() { s.expire(response) })
+}
+
+// release - the held speculation, no longer held; the caller holds mu
+func (s *server) release() *speculationResponse {
+	held := s.held
+	s.held = nil
+	held.ExpiresAt = nil
+	if s.heldTimer != nil {
+		s.heldTimer.Stop()
+		s.heldTimer = nil
+	}
+	return held
+}
+
+// expire - discards a speculation held for longer than ttl, unless it was
+// committed or discarded meanwhile
+func (s *server) expire(held *speculationResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.held != held {
+		return
+	}
+	s.release()
+	held.Status = statusDiscarded
+	logger := slog.With("speculation", held.ID, policy.LogPolicy, held.Policy)
+	if err := s.engine.Discard(context.Background()); err != nil {
+		logger.Error("error discarding an expired speculation", "error", err)
+		return
+	}
+	logger.Warn("discarded a speculation held for longer than the ttl", "ttl", s.ttl)
+}
+
+// heldSpeculation - the held speculation with the path's id; the caller holds mu
+func (s *server) heldSpeculation(w http.ResponseWriter, r *http.Request) *speculationResponse {
+	id := r.PathValue("id")
+	if s.held == nil || s.held.ID != id {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no speculation %s is held open", id))
+		return nil
+	}
+	return s.held
+}
+
+func (s *server) getSpeculation(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if held := s.heldSpeculation(w, r); held != nil {
+		writeJSON(w, http.StatusOK, held)
+	}
+}
+
+type commitRequest struct {
+	// Winner - the candidate to commit instead of the selected one
+	Winner *int `json:"winner"`
+}
+
+func (s *server) commitSpeculation(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	held := s.heldSpeculation(w, r)
+	if held == nil {
+		return
+	}
+
+	// the body is optional, without one the selected winner is committed
+	var request commitRequest
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, bodyStatus(err), err)
+		return
+	}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &request); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %v", err))
+			return
+		}
+	}
+	winner := *held.Winner
+	if request.Winner != nil {
+		winner = *request.Winner
+	}
+	if winner < 0 || winner >= len(held.branches) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("winner %d out of range, there are %d candidates", winner, len(held.branches)))
+		return
+	}
+	if held.branches[winner].Err() != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("candidate %d failed and cannot be committed", winner))
+		return
+	}
+
+	s.release()
+	if err := s.engine.Commit(context.WithoutCancel(r.Context()), held.branches[winner]); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	held.Winner = &winner
+	held.Status = statusCommitted
+	slog.Info("speculation committed", "speculation", held.ID, policy.LogPolicy, held.Policy, "winner", winner)
+	writeJSON(w, http.StatusOK, held)
+}
+
+func (s *server) discardSpeculation(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	held := s.heldSpeculation(w, r)
+	if held == nil {
+		return
+	}
+
+	s.release()
+	if err := s.engine.Discard(context.WithoutCancel(r.Context())); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	held.Status = statusDiscarded
+	slog.Info("speculation discarded", "speculation", held.ID, policy.LogPolicy, held.Policy)
+	writeJSON(w, http.StatusOK, held)
+}
+
+type sessionRequest struct {
+	Branches int `json:"branches"`
+	// TTLSeconds - how long the session may be idle, the server's -ttl when
+	// not given
+	TTLSeconds *float64 `json:"ttl_seconds"`
+}
+
+type sessionBranchResponse struct {
+	Index      int    `json:"index"`
+	Branch     string `json:"branch"`
+	Statements int    `json:"statements"`
+	Error      string `json:"error,omitempty"`
+}
+
+type sessionResponse struct {
+	ID       string                  `json:"id"`
+	Policy   string                  `json:"policy"`
+	Status   string                  `json:"status"`
+	Branches []sessionBranchResponse `json:"branches"`
+	// ExpiresAt - when the session expires unless it is used, nil once it
+	// is closed or when it never expires
+	ExpiresAt *time.Time `json:"expires_at"`
+	// Winner - the committed branch, nil until one is committed
+	Winner *int `json:"winner"`
+}
+
+type statementResponse struct {
+	Branch int           `json:"branch"`
+	Result *rowsResponse `json:"result,omitempty"`
+	Error  string        `json:"error,omitempty"`
+}
+
+type sessionCommitRequest struct {
+	// Branch - the branch to commit, otherwise the one Strategy selects
+	Branch   *int   `json:"branch"`
+	Strategy string `json:"strategy"`
+}
+
+func newSessionResponse(policyName string, session *speculate.Session) sessionResponse {
+	response := sessionResponse{ID: session.ID, Policy: policyName, Status: session.State(), Branches: []sessionBranchResponse{}}
+	for _, branch := range session.Branches() {
+		b := sessionBranchResponse{Index: branch.Index, Branch: branch.Name(), Statements: branch.Statements()}
+		if err := branch.Err(); err != nil {
+			b.Error = policy.Redact(err.Error())
+		}
+		response.Branches = append(response.Branches, b)
+	}
+	if expires := session.Expires(); !expires.IsZero() {
+		response.ExpiresAt = &expires
+	}
+	if winner := session.Winner(); winner >= 0 {
+		response.Winner = &winner
+	}
+	return response
+}
+
+// decodeBody - decodes an optional JSON body into v
+func decodeBody(r *http.Request, v any) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("invalid request body: %w", err)
+	}
+	return nil
+}
+
+// sessionStatus - the status of an error using a session that is no longer open
+func sessionStatus(err error) int {
+	switch {
+	case errors.Is(err, speculate.ErrExpired):
+		return http.StatusGone
+	case errors.Is(err, speculate.ErrSessionClosed), errors.Is(err, speculate.ErrClosed):
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// closeStatus - the status of an error committing or discarding session:
+// the request's fault while the session stays open or was already closed,
+// the server's once this request closed it
+func closeStatus(session *speculate.Session, err error) int {
+	if session.State() == speculate.SessionOpen || errors.Is(err, speculate.ErrExpired) || errors.Is(err, speculate.ErrSessionClosed) {
+		return sessionStatus(err)
+	}
+	return http.StatusInternalServerError
+}
+
+func (s *server) createSession(w http.ResponseWriter, r *http.Request) {
+	var request sessionRequest
+	if err := decodeBody(r, &request); err != nil {
+		writeError(w, bodyStatus(err), err)
+		return
+	}
+	ttl := s.ttl
+	if request.TTLSeconds != nil {
+		ttl = time.Duration(*request.TTLSeconds * float64(time.Second))
+	}
+	if ttl < 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("ttl_seconds must not be negative, got %v", *request.TTLSeconds))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkIdle(); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	session, err := s.engine.OpenSession(context.WithoutCancel(r.Context()), request.Branches, ttl)
+	if err != nil {
+		writeError(w, forkStatus(err), err)
+		return
+	}
+	s.session = session
+	slog.Info("session opened", "session", session.ID, policy.LogPolicy, s.engine.Policy(), "branches", request.Branches, "ttl", ttl)
+	writeJSON(w, http.StatusOK, newSessionResponse(s.engine.Policy(), session))
+}
+
+// pathSession - the session with the path's id
+func (s *server) pathSession(w http.ResponseWriter, r *http.Request) *speculate.Session {
+	id := r.PathValue("id")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.session == nil || s.session.ID != id {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no session %s", id))
+		return nil
+	}
+	return s.session
+}
+
+func (s *server) getSession(w http.ResponseWriter, r *http.Request) {
+	if session := s.pathSession(w, r); session != nil {
+		writeJSON(w, http.StatusOK, newSessionResponse(s.engine.Policy(), session))
+	}
+}
+
+// runSessionStatement - runs one statement on a branch. Statements on
+// different branches run concurrently; a statement that fails is reported
+// in the response and rules its branch out of commits
+func (s *server) runSessionStatement(w http.ResponseWriter, r *http.Request) {
+	session := s.pathSession(w, r)
+	if session == nil {
+		return
+	}
+	branch, err := strconv.Atoi(r.PathValue("branch"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid branch %q", r.PathValue("branch")))
+		return
+	}
+	var request statementRequest
+	if err := decodeBody(r, &request); err != nil {
+		writeError(w, bodyStatus(err), err)
+		return
+	}
+	if request.SQL == "" {
+		writeError(w, http.StatusBadRequest, errors.New("sql is required"))
+		return
+	}
+	for i, arg := range request.Args {
+		request.Args[i] = jsonArg(arg)
+	}
+	if branch < 0 || branch >= len(session.Branches()) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("branch %d out of range, the session has %d branches", branch, len(session.Branches())))
+		return
+	}
+
+	response := statementResponse{Branch: branch}
+	ctx := context.WithoutCancel(r.Context())
+	if request.Query {
+		var rows speculate.Rows
+		rows, err = session.Query(ctx, branch, request.SQL, request.Args...)
+		if err == nil {
+			response.Result = &rowsResponse{Columns: rows.Columns, Rows: rows.Values}
+		}
+	} else {
+		err = session.Exec(ctx, branch, request.SQL, request.Args...)
+	}
+	if errors.Is(err, speculate.ErrExpired) || errors.Is(err, speculate.ErrSessionClosed) || errors.Is(err, speculate.ErrClosed) {
+		writeError(w, sessionStatus(err), err)
+		return
+	}
+	if err != nil {
+		response.Error = policy.Redact(err.Error())
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *server) commitSession(w http.ResponseWriter, r *http.Request) {
+	session := s.pathSession(w, r)
+	if session == nil {
+		return
+	}
+	var request sessionCommitRequest
+	if err := decodeBody(r, &request); err != nil {
+		writeError(w, bodyStatus(err), err)
+		return
+	}
+	ctx := context.WithoutCancel(r.Context())
+
+	var winner int
+	if request.Branch != nil {
+		winner = *request.Branch
+	} else {
+		if request.Strategy == "" {
+			request.Strategy = "random"
+		}
+		strategy, err := s.strategy(request.Strategy, false)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		winner, err = session.Select(ctx, strategy)
+		if errors.Is(err, speculate.ErrRejected) {
+			if err := session.Discard(ctx); err != nil {
+				writeError(w, closeStatus(session, err), err)
+				return
+			}
+			slog.Info("session rejected", "session", session.ID, policy.LogPolicy, s.engine.Policy())
+			writeJSON(w, http.StatusOK, newSessionResponse(s.engine.Policy(), session))
+			return
+		}
+		if err != nil {
+			writeError(w, sessionStatus(err), err)
+			return
+		}
+	}
+	if err := session.Commit(ctx, winner); err != nil {
+		writeError(w, closeStatus(session, err), err)
+		return
+	}
+	slog.Info("session committed", "session", session.ID, policy.LogPolicy, s.engine.Policy(), "winner", winner)
+	writeJSON(w, http.StatusOK, newSessionResponse(s.engine.Policy(), session))
+}
+
+func (s *server) discardSession(w http.ResponseWriter, r *http.Request) {
+	session := s.pathSession(w, r)
+	if session == nil {
+		return
+	}
+	if err := session.Discard(context.WithoutCancel(r.Context())); err != nil {
+		writeError(w, closeStatus(session, err), err)
+		return
+	}
+	slog.Info("session discarded", "session", session.ID, policy.LogPolicy, s.engine.Policy())
+	writeJSON(w, http.StatusOK, newSessionResponse(s.engine.Policy(), session))
+}
+
+type historyResponse struct {
+	Policy string `json:"policy"`
+	// States - the number of earlier main states kept, the most steps a
+	// revert can go back
+	States int `json:"states"`
+}
+
+type revertRequest struct {
+	// Steps - the number of commits to undo, 1 when not given
+	Steps *int `json:"steps"`
+}
+
+func (s *server) getHistory(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, historyResponse{Policy: s.engine.Policy(), States: s.engine.History()})
+}
+
+// revert - undoes the most recent commits, restoring the main state from
+// before them. Like a speculation, it waits for other requests on the engine
+func (s *server) revert(w http.ResponseWriter, r *http.Request) {
+	var request revertRequest
+	if err := decodeBody(r, &request); err != nil {
+		writeError(w, bodyStatus(err), err)
+		return
+	}
+	steps := 1
+	if request.Steps != nil {
+		steps = *request.Steps
+	}
+	if steps < 1 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("steps must be at least 1, got %d", steps))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkIdle(); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	err := s.engine.Revert(context.WithoutCancel(r.Context()), steps)
+	switch {
+	case errors.Is(err, policy.ErrNoHistory):
+		writeError(w, http.StatusBadRequest, err)
+		return
+	case errors.Is(err, policy.ErrForksOpen):
+		writeError(w, http.StatusConflict, err)
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	slog.Info("reverted", policy.LogPolicy, s.engine.Policy(), "steps", steps)
+	writeJSON(w, http.StatusOK, historyResponse{Policy: s.engine.Policy(), States: s.engine.History()})
+}
@@ -0,0 +1,261 @@
+package speculate
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrRejected - the operator rejected every branch
+	ErrRejected = errors.New("the operator rejected every branch")
+	// ErrRerun - the operator asked for the candidates to be run again
+	ErrRerun = errors.New("the operator asked to run the candidates again")
+)
+
+// maxShownRows - the most rows of a query result or diff shown per branch
+const maxShownRows = 20
+
+/*
+ * Interactive - leaves the choice of winner to an operator at a terminal,
+ * to audit agents before trusting automatic selection. Every branch is
+ * shown with its statements, their rows or the rows they affected, and how
+ * the rows of the Diff queries differ from the main state. The operator
+ * then picks the winner, rejects every branch (ErrRejected) or, when Rerun
+ * is set, asks for the candidates to be run again (ErrRerun). One prompt is
+ * shown at a time, so an Interactive can be shared
+ */
+type Interactive struct {
+	// In - the operator's input, usually os.Stdin
+	In io.Reader
+	// Out - where branches and prompts are shown, usually os.Stdout
+	Out io.Writer
+	// Diff - queries run on every branch whose rows are compared with the
+	// main state's, e.g. SELECT * FROM users ORDER BY id
+	Diff []string
+	// Baseline - runs a Diff query on the main state, e.g. Engine.QueryMain.
+	// Branches are compared with the first branch that did not fail when
+	// it is nil or fails
+	Baseline func(ctx context.Context, query string) (Rows, error)
+	// Rerun - offer to run the candidates again, for callers that can
+	Rerun bool
+
+	mu    sync.Mutex
+	once  sync.Once
+	lines chan string
+}
+
+// readLines - reads In a line at a time for the life of the process, so a
+// prompt given up on when its context is done does not lose later input
+func (s *Interactive) readLines() {
+	s.lines = make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(s.In)
+		for scanner.Scan() {
+			s.lines <- scanner.Text()
+		}
+		close(s.lines)
+	}()
+}
+
+func (s *Interactive) Select(ctx context.Context, branches []*Branch) (*Branch, error) {
+	return s.prompt(ctx, branches, s.Rerun)
+}
+
+// WithoutRerun - the strategy without the choice to run the candidates
+// again, for branches that were not run from candidates, e.g. a session's
+func (s *Interactive) WithoutRerun() Strategy {
+	return StrategyFunc(func(ctx context.Context, branches []*Branch) (*Branch, error) {
+		return s.prompt(ctx, branches, false)
+	})
+}
+
+// prompt - shows the branches and asks the operator until they choose
+func (s *Interactive) prompt(ctx context.Context, branches []*Branch, rerun bool) (*Branch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.once.Do(s.readLines)
+
+	ok, err := succeeded(branches)
+	if err != nil {
+		return nil, err
+	}
+	s.show(ctx, branches, ok[0])
+
+	choices := fmt.Sprintf("pick a branch [%d-%d], \"none\" to reject every branch", branches[0].Index, branches[len(branches)-1].Index)
+	if rerun {
+		choices += ", or \"rerun\" to run the candidates again"
+	}
+	for {
+		fmt.Fprintf(s.Out, "%s: ", choices)
+		var line string
+		select {
+		case <-ctx.Done():
+			fmt.Fprintln(s.Out)
+			return nil, ctx.Err()
+		case l, open := <-s.lines:
+			if !open {
+				fmt.Fprintln(s.Out)
+				return nil, fmt.Errorf("%w: the operator's input is closed", ErrRejected)
+			}
+			line = strings.ToLower(strings.TrimSpace(l))
+		}
+
+		switch {
+		case line == "none":
+			return nil, ErrRejected
+		case line == "rerun" && rerun:
+			return nil, ErrRerun
+		}
+		index, err := strconv.Atoi(line)
+		if err != nil {
+			fmt.Fprintf(s.Out, "%q is not a choice\n", line)
+			continue
+		}
+		i := slices.IndexFunc(branches, func(branch *Branch) bool { return branch.Index == index })
+		switch {
+		case i < 0:
+			fmt.Fprintf(s.Out, "branch %d is not one of the candidates\n", index)
+		case branches[i].Err() != nil:
+			fmt.Fprintf(s.Out, "branch %d failed and cannot be committed\n", index)
+		default:
+			return branches[i], nil
+		}
+	}
+}
+
+// show - writes every branch's statements and diffs, the diffs against
+// reference's rows when there is no baseline
+func (s *Interactive) show(ctx context.Context, branches []*Branch, reference *Branch) {
+	baselines := make([]Rows, len(s.Diff))
+	against := make([]string, len(s.Diff))
+	for i, query := range s.Diff {
+		against[i] = "main"
+		if s.Baseline != nil {
+			rows, err := s.Baseline(ctx, query)
+			if err == nil {
+				baselines[i] = rows
+				continue
+			}
+			fmt.Fprintf(s.Out, "cannot query the main state for %q: %v\n", query, err)
+		}
+		rows, err := reference.Peek(ctx, query)
+		if err != nil {
+			fmt.Fprintf(s.Out, "cannot query branch %d for %q: %v\n", reference.Index, query, err)
+		}
+		baselines[i], against[i] = rows, fmt.Sprintf("branch %d", reference.Index)
+	}
+
+	fmt.Fprintf(s.Out, "\n%d candidates finished\n", len(branches))
+	for _, branch := range branches {
+		fmt.Fprintf(s.Out, "\n--- branch %d (%s) ---\n", branch.Index, branch.Name())
+		for i, executed := range branch.Executed() {
+			fmt.Fprintf(s.Out, "%3d> %s", i+1, executed.SQL)
+			if len(executed.Args) > 0 {
+				fmt.Fprintf(s.Out, "  %v", executed.Args)
+			}
+			fmt.Fprintln(s.Out)
+			switch {
+			case executed.Err != nil:
+				fmt.Fprintf(s.Out, "     error: %v\n", executed.Err)
+			case executed.Query:
+				writeTable(s.Out, executed.Rows)
+			case executed.RowsAffected >= 0:
+				fmt.Fprintf(s.Out, "     %d rows affected\n", executed.RowsAffected)
+			}
+		}
+		if branch.Err() != nil {
+			fmt.Fprintln(s.Out, "failed, so it cannot be committed")
+			continue
+		}
+		for i, query := range s.Diff {
+			rows, err := branch.Peek(ctx, query)
+			if err != nil {
+				fmt.Fprintf(s.Out, "diff %s: %v\n", query, err)
+				continue
+			}
+			fmt.Fprintf(s.Out, "diff %s (against %s)\n", query, against[i])
+			writeDiff(s.Out, baselines[i], rows)
+		}
+	}
+	fmt.Fprintln(s.Out)
+}
+
+// writeTable - the columns and rows of a query result
+func writeTable(w io.Writer, rows Rows) {
+	fmt.Fprintf(w, "     %s\n", strings.Join(rows.Columns, " | "))
+	for i, values := range rows.Values {
+		if i == maxShownRows {
+			fmt.Fprintf(w, "     ... %d more rows\n", len(rows.Values)-i)
+			break
+		}
+		fmt.Fprintf(w, "     %s\n", formatRow(values))
+	}
+	fmt.Fprintf(w, "     (%d rows)\n", len(rows.Values))
+}
+
+// writeDiff - the rows only in before (-) and only in after (+), compared
+// as multisets so that the order of rows does not matter
+func writeDiff(w io.Writer, before Rows, after Rows) {
+	counts := make(map[string]int)
+	for _, values := range before.Values {
+		counts[formatRow(values)]++
+	}
+	var added []string
+	for _, values := range after.Values {
+		row := formatRow(values)
+		if counts[row] > 0 {
+			counts[row]--
+			continue
+		}
+		added = append(added, row)
+	}
+	var removed []string
+	for _, values := range before.Values {
+		row := formatRow(values)
+		if counts[row] > 0 {
+			counts[row]--
+			removed = append(removed, row)
+		}
+	}
+
+	if len(removed) == 0 && len(added) == 0 {
+		fmt.Fprintln(w, "     no changes")
+		return
+	}
+	shown := 0
+	for _, lines := range []struct {
+		sign string
+		rows []string
+	}{{"-", removed}, {"+", added}} {
+		for _, row := range lines.rows {
+			if shown == maxShownRows {
+				fmt.Fprintf(w, "     ... %d more changed rows\n", len(removed)+len(added)-shown)
+				return
+			}
+			fmt.Fprintf(w, "   %s %s\n", lines.sign, row)
+			shown++
+		}
+	}
+}
+
+func formatRow(values []any) string {
+	cells := make([]string, len(values))
+	for i, value := range values {
+		switch v := value.(type) {
+		case nil:
+			cells[i] = "NULL"
+		case []byte:
+			cells[i] = string(v)
+		default:
+			cells[i] = fmt.Sprint(v)
+		}
+	}
+	return strings.Join(cells, " | ")
+}
@@ -0,0 +1,67 @@
+package speculate
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Statement - one statement of a candidate transaction
+type Statement struct {
+	SQL  string
+	Args []any
+	// Query - the statement returns rows. Other statements are executed,
+	// which is what a commit re-executes on policies that replay the winner
+	Query bool
+}
+
+// Result - how a candidate transaction went on its branch
+type Result struct {
+	Branch *Branch
+	// Rows - the rows of each query of the transaction, in order
+	Rows []Rows
+	// Err - the error that stopped the transaction, if any
+	Err      error
+	Duration time.Duration
+}
+
+// Run - forks a branch per candidate transaction and executes each
+// transaction on its branch in parallel, stopping a branch at its first error
+func (e *Engine) Run(ctx context.Context, candidates [][]Statement) ([]Result, error) {
+	branches, err := e.Fork(ctx, len(candidates))
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]Result, len(candidates))
+	var wg sync.WaitGroup
+	for i, statements := range candidates {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = branches[i].run(ctx, statements)
+		}()
+	}
+	wg.Wait()
+	return results, nil
+}
+
+func (b *Branch) run(ctx context.Context, statements []Statement) Result {
+	result := Result{Branch: b}
+	start := time.Now()
+	for _, statement := range statements {
+		if statement.Query {
+			rows, err := b.Query(ctx, statement.SQL, statement.Args...)
+			if err != nil {
+				result.Err = err
+				break
+			}
+			result.Rows = append(result.Rows, rows)
+		} else if err := b.Exec(ctx, statement.SQL, statement.Args...); err != nil {
+			result.Err = err
+			break
+		}
+	}
+	result.Duration = time.Since(start)
+	return result
+}
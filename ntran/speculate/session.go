@@ -0,0 +1,259 @@
+package speculate
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrExpired - the session was idle for longer than its TTL, so its
+	// branches were discarded
+	ErrExpired = errors.New("session expired")
+	// ErrSessionClosed - the session has been committed or discarded
+	ErrSessionClosed = errors.New("session is closed")
+)
+
+// Session states
+const (
+	SessionOpen      = "open"
+	SessionCommitted = "committed"
+	SessionDiscarded = "discarded"
+	SessionExpired   = "expired"
+)
+
+/*
+ * Session - branches that stay open across statements sent over seconds or
+ * minutes, as an agent interleaves SQL with thinking and tool calls. A
+ * session expires once it has been idle (no statement running or sent) for
+ * its TTL, discarding its branches, so an abandoned session does not hold
+ * the engine's branches forever. A session is safe for concurrent use
+ */
+type Session struct {
+	// ID - a random identifier of the session
+	ID string
+	// TTL - how long the session may be idle, zero to never expire
+	TTL time.Duration
+
+	engine   *Engine
+	branches []*Branch
+
+	mu      sync.Mutex
+	state   string
+	active  int
+	expires time.Time
+	timer   *time.Timer
+	winner  int
+}
+
+// OpenSession - forks n branches that stay open until the session is
+// committed, discarded, or idle for ttl
+func (e *Engine) OpenSession(ctx context.Context, n int, ttl time.Duration) (*Session, error) {
+	if ttl < 0 {
+		return nil, fmt.Errorf("ttl must not be negative, got %v", ttl)
+	}
+	branches, err := e.Fork(ctx, n)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	s := &Session{ID: hex.EncodeToString(id), TTL: ttl, engine: e, branches: branches, state: SessionOpen, winner: -1}
+	if ttl > 0 {
+		s.expires = time.Now().Add(ttl)
+		s.timer = time.AfterFunc(ttl, s.expire)
+	}
+	return s, nil
+}
+
+// expire - discards the branches unless the session was used since the
+// timer was set, or is in use
+func (s *Session) expire() {
+	s.mu.Lock()
+	if s.state != SessionOpen {
+		s.mu.Unlock()
+		return
+	}
+	if s.active > 0 {
+		s.timer.Reset(s.TTL)
+		s.mu.Unlock()
+		return
+	}
+	if remaining := time.Until(s.expires); remaining > 0 {
+		s.timer.Reset(remaining)
+		s.mu.Unlock()
+		return
+	}
+	s.state = SessionExpired
+	s.expires = time.Time{}
+	s.mu.Unlock()
+	if err := s.engine.discardOpen(context.Background(), s.branches); err != nil {
+		slog.Error("error discarding the branches of an expired session", "session", s.ID, "error", err)
+		return
+	}
+	slog.Warn("session expired, discarded its branches", "session", s.ID, "ttl", s.TTL)
+}
+
+// begin - the i-th branch, counting a statement as running on it; the
+// caller calls end once it finishes
+func (s *Session) begin(i int) (*Branch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	if i < 0 || i >= len(s.branches) {
+		return nil, fmt.Errorf("branch %d out of range, the session has %d branches", i, len(s.branches))
+	}
+	s.active++
+	return s.branches[i], nil
+}
+
+// end - restarts the session's idle time once a statement finishes
+func (s *Session) end() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active--
+	if s.timer != nil {
+		s.expires = time.Now().Add(s.TTL)
+	}
+}
+
+// checkOpen - an error unless the session is open; the caller holds mu
+func (s *Session) checkOpen() error {
+	switch s.state {
+	case SessionOpen:
+		return nil
+	case SessionExpired:
+		return fmt.Errorf("%w after being idle for %v", ErrExpired, s.TTL)
+	default:
+		return fmt.Errorf("%w, it was %s", ErrSessionClosed, s.state)
+	}
+}
+
+// Exec - executes a statement on the i-th branch
+func (s *Session) Exec(ctx context.Context, i int, sql string, args ...any) error {
+	branch, err := s.begin(i)
+	if err != nil {
+		return err
+	}
+	defer s.end()
+	return branch.Exec(ctx, sql, args...)
+}
+
+// Query - executes a query on the i-th branch, returning every row
+func (s *Session) Query(ctx context.Context, i int, sql string, args ...any) (Rows, error) {
+	branch, err := s.begin(i)
+	if err != nil {
+		return Rows{}, err
+	}
+	defer s.end()
+	return branch.Query(ctx, sql, args...)
+}
+
+// Peek - executes a query on the i-th branch without recording it, see
+// Branch.Peek
+func (s *Session) Peek(ctx context.Context, i int, sql string, args ...any) (Rows, error) {
+	branch, err := s.begin(i)
+	if err != nil {
+		return Rows{}, err
+	}
+	defer s.end()
+	return branch.Peek(ctx, sql, args...)
+}
+
+// Branches - the session's branches, in order
+func (s *Session) Branches() []*Branch {
+	return append([]*Branch(nil), s.branches...)
+}
+
+// State - whether the session is open, committed, discarded or expired
+func (s *Session) State() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// Expires - when the session expires unless it is used, the zero time for
+// sessions without a TTL
+func (s *Session) Expires() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.expires
+}
+
+// Winner - the index of the committed branch, -1 until one is committed
+func (s *Session) Winner() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.winner
+}
+
+// Select - the index of the branch strategy chooses. The session is in use
+// while strategy chooses, so it does not expire while an operator does
+func (s *Session) Select(ctx context.Context, strategy Strategy) (int, error) {
+	if _, err := s.begin(0); err != nil {
+		return -1, err
+	}
+	winner, err := strategy.Select(ctx, s.Branches())
+	s.end()
+	if err != nil {
+		return -1, err
+	}
+	return winner.Index, nil
+}
+
+// close - marks the session closed with state; the engine waits for
+// statements still running as it closes the branches
+func (s *Session) close(state string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	s.state = state
+	if s.timer != nil {
+		s.timer.Stop()
+		s.expires = time.Time{}
+	}
+	return nil
+}
+
+// Commit - makes the i-th branch's state the new main state and closes
+// every branch. A session whose promotion fails is discarded, with no
+// winner
+func (s *Session) Commit(ctx context.Context, i int) error {
+	if i < 0 || i >= len(s.branches) {
+		return fmt.Errorf("branch %d out of range, the session has %d branches", i, len(s.branches))
+	}
+	if err := s.branches[i].Err(); err != nil {
+		return fmt.Errorf("branch %d failed and cannot be committed: %v", i, err)
+	}
+	if err := s.close(SessionCommitted); err != nil {
+		return err
+	}
+	if err := s.engine.Commit(ctx, s.branches[i]); err != nil {
+		s.mu.Lock()
+		s.state = SessionDiscarded
+		s.mu.Unlock()
+		return errors.Join(err, s.engine.discardOpen(ctx, s.branches))
+	}
+	s.mu.Lock()
+	s.winner = i
+	s.mu.Unlock()
+	return nil
+}
+
+// Discard - closes every branch, leaving the main state as it was
+func (s *Session) Discard(ctx context.Context) error {
+	if err := s.close(SessionDiscarded); err != nil {
+		return err
+	}
+	return s.engine.discardOpen(ctx, s.branches)
+}
@@ -0,0 +1,471 @@
+/*
+ * Package speculate runs speculative transactions from Go: it forks the main
+ * database into branches, runs candidate statements on each, selects a
+ * winner and commits it. Forking, promoting and discarding are done by the
+ * same policies ntran benchmarks, so an engine behaves as its benchmark does.
+ *
+ *	engine, err := speculate.Open(ctx, speculate.Options{Policy: "postgres-template", Branches: 4})
+ *	branches, err := engine.Fork(ctx, 3)
+ *	for i, branch := range branches {
+ *		branch.Exec(ctx, "UPDATE users SET balance = balance + $1 WHERE id = 1", i)
+ *		branch.Query(ctx, "SELECT balance FROM users WHERE id = 1")
+ *	}
+ *	winner, err := engine.Select(ctx, speculate.Majority)
+ *	err = engine.Commit(ctx, winner)
+ *
+ * With Options.History, an engine keeps the main states its commits
+ * replaced, and Revert rolls back commits found to be wrong later.
+ */
+package speculate
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"ntran/policy"
+)
+
+var (
+	// ErrClosed - the branch has been committed or discarded
+	ErrClosed = errors.New("branch is closed")
+	// ErrNoBranches - no branches are open
+	ErrNoBranches = errors.New("no branches are open")
+	// ErrBranchCount - more branches were asked for than the engine allows,
+	// or none
+	ErrBranchCount = errors.New("invalid number of branches")
+)
+
+// Rows - the result of a query on a branch
+type Rows = policy.Rows
+
+// Options - how an engine forks
+type Options struct {
+	// Policy - the name of the policy that forks, e.g. postgres-template.
+	// Each policy reads its connection string from .env as in a benchmark
+	Policy string
+	// Schema - SQL executed on the main database when the engine is opened,
+	// empty to fork the state the database already holds
+	Schema string
+	// Cleanup - SQL executed on the main database when the engine is
+	// closed, empty to leave it as it is
+	Cleanup string
+	// Branches - the most branches forked at once, which prewarm-neondb
+	// creates up front
+	Branches int
+	// History - the most earlier main states kept for Revert, 0 to keep
+	// none. Every policy but serial-snapshot can keep them
+	History int
+}
+
+/*
+ * Engine - forks one main database. One set of branches is open at a time:
+ * Fork opens them, and Commit or Discard closes them. An engine is safe for
+ * concurrent use, and so are its branches
+ */
+type Engine struct {
+	options Options
+	client  policy.Policy
+	forker  policy.Forker
+
+	mu       sync.Mutex
+	branches []*Branch
+}
+
+// Open - creates the policy's client and scaffolds the main database
+func Open(ctx context.Context, options Options) (*Engine, error) {
+	client, err := policy.CreateClient(options.Policy)
+	if err != nil {
+		return nil, err
+	}
+	forker, ok := client.(policy.Forker)
+	if !ok {
+		return nil, fmt.Errorf("policy %s cannot fork a statement at a time", options.Policy)
+	}
+	if options.Branches < 1 {
+		return nil, fmt.Errorf("branches must be at least 1, got %d", options.Branches)
+	}
+	if options.History < 0 {
+		return nil, fmt.Errorf("history must not be negative, got %d", options.History)
+	}
+	if options.History > 0 {
+		reverter, ok := client.(policy.Reverter)
+		if !ok {
+			return nil, fmt.Errorf("policy %s cannot keep earlier main states", options.Policy)
+		}
+		reverter.SetHistory(options.History)
+	}
+
+	ctx, span := policy.StartSpan(ctx, "Scaffold", policy.AttrPolicy.String(options.Policy))
+	err = client.Scaffold(ctx, options.Schema, options.Branches)
+	policy.EndSpan(span, err)
+	if err != nil {
+		return nil, fmt.Errorf("error scaffolding %s: %v", options.Policy, err)
+	}
+	return &Engine{options: options, client: client, forker: forker}, nil
+}
+
+// Policy - the name of the policy the engine forks with
+func (e *Engine) Policy() string {
+	return e.client.GetName()
+}
+
+// Connector - connects to the main database directly, for statements
+// outside of any branch, when the policy allows it
+func (e *Engine) Connector() (driver.Connector, error) {
+	main, ok := e.client.(policy.MainConnector)
+	if !ok {
+		return nil, fmt.Errorf("policy %s cannot connect to its main database directly", e.Policy())
+	}
+	return main.MainConnector()
+}
+
+// QueryMain - executes a query on the main database through Connector,
+// returning every row, e.g. to compare branches with the main state
+func (e *Engine) QueryMain(ctx context.Context, query string, args ...any) (Rows, error) {
+	connector, err := e.Connector()
+	if err != nil {
+		return Rows{}, err
+	}
+	conn, err := connector.Connect(ctx)
+	if err != nil {
+		return Rows{}, err
+	}
+	defer conn.Close()
+	queryer, ok := conn.(driver.QueryerContext)
+	if !ok {
+		return Rows{}, fmt.Errorf("policy %s cannot query its main database directly", e.Policy())
+	}
+	rows, err := queryer.QueryContext(ctx, query, namedValues(args))
+	if err != nil {
+		return Rows{}, err
+	}
+	defer rows.Close()
+
+	result := Rows{Columns: rows.Columns()}
+	for {
+		dest := make([]driver.Value, len(result.Columns))
+		if err := rows.Next(dest); err == io.EOF {
+			return result, nil
+		} else if err != nil {
+			return Rows{}, err
+		}
+		values := make([]any, len(dest))
+		for i, value := range dest {
+			// drivers may reuse byte slices between rows
+			if b, ok := value.([]byte); ok {
+				value = bytes.Clone(b)
+			}
+			values[i] = value
+		}
+		result.Values = append(result.Values, values)
+	}
+}
+
+/*
+ * ExecMain - executes a statement on the main database through Connector,
+ * returning the rows it affected (-1 when the driver cannot tell). Writes
+ * are what the next Fork copies, so ExecMain fails with ErrForksOpen while
+ * branches are open
+ */
+func (e *Engine) ExecMain(ctx context.Context, sql string, args ...any) (int64, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.branches) > 0 {
+		return 0, policy.ErrForksOpen
+	}
+	connector, err := e.Connector()
+	if err != nil {
+		return 0, err
+	}
+	conn, err := connector.Connect(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	execer, ok := conn.(driver.ExecerContext)
+	if !ok {
+		return 0, fmt.Errorf("policy %s cannot execute on its main database directly", e.Policy())
+	}
+	result, err := execer.ExecContext(ctx, sql, namedValues(args))
+	if err != nil {
+		return 0, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return -1, nil
+	}
+	return affected, nil
+}
+
+// namedValues - args as the positional arguments of a driver
+func namedValues(args []any) []driver.NamedValue {
+	values := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		values[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	return values
+}
+
+// Fork - opens n branches, each a copy of the main state
+func (e *Engine) Fork(ctx context.Context, n int) ([]*Branch, error) {
+	if n < 1 || n > e.options.Branches {
+		return nil, fmt.Errorf("%w: can fork between 1 and %d branches, got %d", ErrBranchCount, e.options.Branches, n)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.branches) > 0 {
+		return nil, policy.ErrForksOpen
+	}
+
+	ctx, span := policy.StartSpan(ctx, policy.PhaseFork, policy.AttrPolicy.String(e.Policy()), policy.AttrInFlight.Int(n))
+	forks, err := e.forker.Fork(ctx, n)
+	policy.EndSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	for i, fork := range forks {
+		e.branches = append(e.branches, &Branch{Index: i, fork: fork})
+	}
+	return append([]*Branch(nil), e.branches...), nil
+}
+
+// Branches - the open branches
+func (e *Engine) Branches() []*Branch {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*Branch(nil), e.branches...)
+}
+
+// Select - the branch strategy chooses from the open branches
+func (e *Engine) Select(ctx context.Context, strategy Strategy) (*Branch, error) {
+	branches := e.Branches()
+	if len(branches) == 0 {
+		return nil, ErrNoBranches
+	}
+
+	ctx, span := policy.StartSpan(ctx, policy.PhaseConsensus, policy.AttrPolicy.String(e.Policy()))
+	winner, err := strategy.Select(ctx, branches)
+	if winner != nil {
+		span.SetAttributes(policy.AttrWinner.Int(winner.Index))
+	}
+	policy.EndSpan(span, err)
+	return winner, err
+}
+
+// Commit - makes winner's state the new main state and closes every branch.
+// The branches are discarded if the winner cannot be promoted
+func (e *Engine) Commit(ctx context.Context, winner *Branch) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.branches) == 0 {
+		return ErrNoBranches
+	}
+	if winner == nil || winner.Index < 0 || winner.Index >= len(e.branches) || e.branches[winner.Index] != winner {
+		return errors.New("winner is not one of the open branches")
+	}
+	e.closeBranches()
+
+	ctx, span := policy.StartSpan(ctx, policy.PhasePromote, policy.AttrPolicy.String(e.Policy()), policy.AttrWinner.Int(winner.Index))
+	err := e.forker.Promote(ctx, winner.Index)
+	policy.EndSpan(span, err)
+	if err != nil {
+		return errors.Join(fmt.Errorf("error promoting branch %s: %v", winner.Name(), err), e.forker.Discard(ctx))
+	}
+	return nil
+}
+
+// Discard - closes every branch, leaving the main state as it was
+func (e *Engine) Discard(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.discard(ctx)
+}
+
+// discardOpen - discards branches if they are still the open branches,
+// rather than closed and replaced by a later Fork
+func (e *Engine) discardOpen(ctx context.Context, branches []*Branch) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.branches) == 0 || len(branches) == 0 || e.branches[0] != branches[0] {
+		return nil
+	}
+	return e.discard(ctx)
+}
+
+// discard - the caller holds mu
+func (e *Engine) discard(ctx context.Context) error {
+	if len(e.branches) == 0 {
+		return nil
+	}
+	e.closeBranches()
+
+	ctx, span := policy.StartSpan(ctx, policy.PhaseTeardown, policy.AttrPolicy.String(e.Policy()))
+	err := e.forker.Discard(ctx)
+	policy.EndSpan(span, err)
+	return err
+}
+
+// closeBranches - waits for statements running on the branches to finish
+// and stops new ones; the caller holds mu
+func (e *Engine) closeBranches() {
+	for _, branch := range e.branches {
+		branch.mu.Lock()
+		branch.closed = true
+		branch.mu.Unlock()
+	}
+	e.branches = nil
+}
+
+// History - the number of earlier main states kept, which Revert can go
+// back to
+func (e *Engine) History() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if reverter, ok := e.client.(policy.Reverter); ok && e.options.History > 0 {
+		return reverter.History()
+	}
+	return 0
+}
+
+// Revert - restores the main state from n commits ago, undoing the n most
+// recent commits. Branches must not be open, and statements on the main
+// database through Connector must have finished
+func (e *Engine) Revert(ctx context.Context, n int) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	reverter, ok := e.client.(policy.Reverter)
+	if !ok || e.options.History == 0 {
+		return fmt.Errorf("%w: the engine keeps no history, open it with a History", policy.ErrNoHistory)
+	}
+	if len(e.branches) > 0 {
+		return policy.ErrForksOpen
+	}
+
+	ctx, span := policy.StartSpan(ctx, "Revert", policy.AttrPolicy.String(e.Policy()), policy.AttrSteps.Int(n))
+	err := reverter.Revert(ctx, n)
+	policy.EndSpan(span, err)
+	return err
+}
+
+// Close - discards any open branches and cleans up the main database
+func (e *Engine) Close(ctx context.Context) error {
+	err := e.Discard(ctx)
+	return errors.Join(err, e.client.Cleanup(ctx, e.options.Cleanup))
+}
+
+// Branch - one copy of the main state, open until the engine commits or
+// discards it
+type Branch struct {
+	// Index - the branch's position among the branches Fork returned
+	Index int
+	fork  policy.Fork
+
+	mu       sync.Mutex
+	closed   bool
+	err      error
+	rows     Rows
+	executed []Executed
+}
+
+// Executed - a statement that ran on a branch
+type Executed struct {
+	Statement
+	// RowsAffected - the rows a statement that is not a query changed, -1
+	// when the policy cannot tell
+	RowsAffected int64
+	// Rows - the rows of a query
+	Rows Rows
+	// Err - the error the statement returned, if any
+	Err error
+}
+
+// Name - the name of the branch's fork, e.g. its Neon branch or database
+func (b *Branch) Name() string {
+	return b.fork.Name()
+}
+
+// Exec - executes a statement on the branch
+func (b *Branch) Exec(ctx context.Context, sql string, args ...any) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	executed := Executed{Statement: Statement{SQL: sql, Args: args}, RowsAffected: -1}
+	executed.Err = b.fork.Exec(ctx, sql, args...)
+	if counter, ok := b.fork.(policy.RowCounter); ok && executed.Err == nil {
+		executed.RowsAffected = counter.RowsAffected()
+	}
+	b.executed = append(b.executed, executed)
+	return b.failed(executed.Err)
+}
+
+// Query - executes a query on the branch, returning every row
+func (b *Branch) Query(ctx context.Context, sql string, args ...any) (Rows, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return Rows{}, ErrClosed
+	}
+	rows, err := b.fork.Query(ctx, sql, args...)
+	b.executed = append(b.executed, Executed{Statement: Statement{SQL: sql, Args: args, Query: true}, RowsAffected: -1, Rows: rows, Err: err})
+	if err != nil {
+		return Rows{}, b.failed(err)
+	}
+	b.rows = rows
+	return rows, nil
+}
+
+// Peek - executes a query on the branch without recording it as one of
+// its statements, e.g. to inspect or compare its state. A failed Peek does
+// not rule the branch out, and the rows are not what strategies compare
+func (b *Branch) Peek(ctx context.Context, sql string, args ...any) (Rows, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return Rows{}, ErrClosed
+	}
+	return b.fork.Query(ctx, sql, args...)
+}
+
+// failed - records the first error of the branch; the caller holds mu
+func (b *Branch) failed(err error) error {
+	if err != nil && b.err == nil {
+		b.err = err
+	}
+	return err
+}
+
+// Err - the first error a statement on the branch returned, which rules
+// the branch out of selection
+func (b *Branch) Err() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
+
+// Result - the rows of the last query on the branch
+func (b *Branch) Result() Rows {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rows
+}
+
+// Statements - the number of statements executed on the branch
+func (b *Branch) Statements() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.executed)
+}
+
+// Executed - the statements executed on the branch, in order
+func (b *Branch) Executed() []Executed {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]Executed(nil), b.executed...)
+}
@@ -0,0 +1,97 @@
+package speculate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"ntran/policy"
+)
+
+// ErrAllFailed - every branch failed, so there is nothing to select
+var ErrAllFailed = errors.New("every branch failed")
+
+// Strategy - chooses the branch to commit from the open branches
+type Strategy interface {
+	Select(ctx context.Context, branches []*Branch) (*Branch, error)
+}
+
+// StrategyFunc - a function used as a Strategy
+type StrategyFunc func(ctx context.Context, branches []*Branch) (*Branch, error)
+
+func (f StrategyFunc) Select(ctx context.Context, branches []*Branch) (*Branch, error) {
+	return f(ctx, branches)
+}
+
+var (
+	// First - the first branch that has not failed
+	First Strategy = StrategyFunc(first)
+	// Random - a random branch that has not failed, drawn from the source
+	// policy.Seed seeds, as the policies choose winners in benchmarks
+	Random Strategy = StrategyFunc(random)
+	// Majority - the first branch whose last query result the most
+	// branches that have not failed agree on, the first of them when
+	// results tie
+	Majority Strategy = StrategyFunc(majority)
+)
+
+// Strategies - the built-in strategies by name
+var Strategies = map[string]Strategy{
+	"first":    First,
+	"random":   Random,
+	"majority": Majority,
+}
+
+// StrategyNames - the names of the built-in strategies
+var StrategyNames = []string{"first", "random", "majority"}
+
+// succeeded - the branches that have not failed
+func succeeded(branches []*Branch) ([]*Branch, error) {
+	var ok []*Branch
+	for _, branch := range branches {
+		if branch.Err() == nil {
+			ok = append(ok, branch)
+		}
+	}
+	if len(ok) == 0 {
+		return nil, ErrAllFailed
+	}
+	return ok, nil
+}
+
+func first(ctx context.Context, branches []*Branch) (*Branch, error) {
+	ok, err := succeeded(branches)
+	if err != nil {
+		return nil, err
+	}
+	return ok[0], nil
+}
+
+func random(ctx context.Context, branches []*Branch) (*Branch, error) {
+	ok, err := succeeded(branches)
+	if err != nil {
+		return nil, err
+	}
+	return ok[policy.Intn(len(ok))], nil
+}
+
+func majority(ctx context.Context, branches []*Branch) (*Branch, error) {
+	ok, err := succeeded(branches)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]string, len(ok))
+	votes := make(map[string]int)
+	most := 0
+	for i, branch := range ok {
+		results[i] = fmt.Sprint(branch.Result().Values)
+		votes[results[i]]++
+		most = max(most, votes[results[i]])
+	}
+	for i, result := range results {
+		if votes[result] == most {
+			return ok[i], nil
+		}
+	}
+	return nil, ErrAllFailed
+}
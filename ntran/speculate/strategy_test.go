@@ -0,0 +1,82 @@
+package speculate
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"ntran/policy"
+)
+
+// branches - a branch per result, failed where the result is "fail"
+func branches(results ...string) []*Branch {
+	out := make([]*Branch, len(results))
+	for i, result := range results {
+		out[i] = &Branch{Index: i, rows: Rows{Columns: []string{"v"}, Values: [][]any{{result}}}}
+		if result == "fail" {
+			out[i].err = errors.New("failed")
+		}
+	}
+	return out
+}
+
+func TestStrategies(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy Strategy
+		results  []string
+		want     int
+	}{
+		{"first", First, []string{"a", "b"}, 0},
+		{"first skips failed", First, []string{"fail", "fail", "b", "a"}, 2},
+		{"majority", Majority, []string{"a", "b", "b"}, 1},
+		{"majority of the branches that did not fail", Majority, []string{"fail", "fail", "b", "a", "b"}, 2},
+		{"majority tie picks the first branch", Majority, []string{"a", "b", "b", "a"}, 0},
+		{"majority tie of singletons", Majority, []string{"c", "b", "a"}, 0},
+		{"majority tie after a failure", Majority, []string{"fail", "b", "a", "a", "b"}, 1},
+		{"random with one left", Random, []string{"fail", "a", "fail"}, 1},
+	}
+	for _, tt := range tests {
+		winner, err := tt.strategy.Select(context.Background(), branches(tt.results...))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if winner.Index != tt.want {
+			t.Errorf("%s: selected branch %d of %v, want %d", tt.name, winner.Index, tt.results, tt.want)
+		}
+	}
+}
+
+func TestStrategiesAllFailed(t *testing.T) {
+	for name, strategy := range Strategies {
+		if _, err := strategy.Select(context.Background(), branches("fail", "fail")); !errors.Is(err, ErrAllFailed) {
+			t.Errorf("%s: %v, want ErrAllFailed", name, err)
+		}
+	}
+}
+
+func TestRandomIsSeeded(t *testing.T) {
+	candidates := branches("a", "fail", "b", "c", "d", "e", "f", "g")
+	draw := func() []int {
+		policy.Seed(42)
+		var picks []int
+		for range 20 {
+			winner, err := Random.Select(context.Background(), candidates)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if winner.Err() != nil {
+				t.Fatalf("selected failed branch %d", winner.Index)
+			}
+			picks = append(picks, winner.Index)
+		}
+		return picks
+	}
+	first, second := draw(), draw()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("the same seed drew %v and then %v", first, second)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+/*
+ * Package sqldriver registers the database/sql driver "ntran", which wraps
+ * the driver of a policy's main database (pgx for serial-snapshot, DuckDB
+ * for duckdb-parallel and duckdb-serial). Statements on the *sql.DB run on
+ * the main database as they would without ntran, and BeginSpeculative forks
+ * it into branches whose results can be compared before one is committed.
+ *
+ *	db, err := sql.Open("ntran", "policy=duckdb-parallel&schema=../schemas/schema.sql&branches=4")
+ *	db.ExecContext(ctx, "INSERT INTO users VALUES (1, 'ann', 100)")
+ *	spec, err := sqldriver.BeginSpeculative(ctx, db, 2)
+ *	spec.ExecContext(ctx, 0, "UPDATE users SET balance = balance + 1 WHERE id = 1")
+ *	spec.ExecContext(ctx, 1, "UPDATE users SET balance = balance + 2 WHERE id = 1")
+ *	results, err := spec.Compare(ctx, "SELECT balance FROM users WHERE id = 1")
+ *	err = spec.Commit(ctx, 1)
+ */
+package sqldriver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+
+	"ntran/speculate"
+)
+
+// DriverName - the name the driver is registered under
+const DriverName = "ntran"
+
+func init() {
+	sql.Register(DriverName, &Driver{})
+}
+
+/*
+ * Driver - opens ntran databases. The data source name is a URL query:
+ *
+ *	policy   - the policy that forks, e.g. serial-snapshot (required)
+ *	schema   - a SQL file executed on the main database when it is opened
+ *	cleanup  - a SQL file executed on the main database when it is closed
+ *	branches - the most branches forked at once (default 8)
+ *	history  - the most earlier main states kept for Revert (default 0)
+ */
+type Driver struct{}
+
+// Open - not supported, as every connection of a database shares the
+// policy's engine; sql.Open uses OpenConnector instead
+func (d *Driver) Open(dsn string) (driver.Conn, error) {
+	return nil, errors.New("ntran: connections can only be opened through sql.Open or sql.OpenDB")
+}
+
+// OpenConnector - parses the data source name; the engine is opened, and
+// the main database scaffolded, on the first connection
+func (d *Driver) OpenConnector(dsn string) (driver.Connector, error) {
+	options, err := parseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &connector{driver: d, options: options}, nil
+}
+
+// parseDSN - the engine options of a data source name
+func parseDSN(dsn string) (speculate.Options, error) {
+	query, err := url.ParseQuery(dsn)
+	if err != nil {
+		return speculate.Options{}, fmt.Errorf("ntran: invalid data source name: %v", err)
+	}
+	options := speculate.Options{Policy: query.Get("policy"), Branches: 8}
+	if options.Policy == "" {
+		return speculate.Options{}, errors.New("ntran: the data source name has no policy")
+	}
+	if branches := query.Get("branches"); branches != "" {
+		options.Branches, err = strconv.Atoi(branches)
+		if err != nil {
+			return speculate.Options{}, fmt.Errorf("ntran: invalid branches %q: %v", branches, err)
+		}
+	}
+	if history := query.Get("history"); history != "" {
+		options.History, err = strconv.Atoi(history)
+		if err != nil {
+			return speculate.Options{}, fmt.Errorf("ntran: invalid history %q: %v", history, err)
+		}
+	}
+	if options.Schema, err = readSQLFile(query.Get("schema")); err != nil {
+		return speculate.Options{}, err
+	}
+	if options.Cleanup, err = readSQLFile(query.Get("cleanup")); err != nil {
+		return speculate.Options{}, err
+	}
+	return options, nil
+}
+
+// readSQLFile - the contents of a SQL file, empty when there is no file
+func readSQLFile(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("ntran: error reading %s: %v", path, err)
+	}
+	return string(contents), nil
+}
+
+// connector - connects to the main database of one engine, which is closed
+// with the *sql.DB
+type connector struct {
+	driver  *Driver
+	options speculate.Options
+
+	mu     sync.Mutex
+	engine *speculate.Engine
+	main   driver.Connector
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	main, err := c.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	underlying, err := main.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{Conn: underlying, connector: c}, nil
+}
+
+// open - opens the engine unless it is open already, returning the
+// connector of its main database
+func (c *connector) open(ctx context.Context) (driver.Connector, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.engine != nil {
+		return c.main, nil
+	}
+	engine, err := speculate.Open(ctx, c.options)
+	if err != nil {
+		return nil, err
+	}
+	main, err := engine.Connector()
+	if err != nil {
+		return nil, errors.Join(err, engine.Close(ctx))
+	}
+	c.engine = engine
+	c.main = main
+	return main, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return c.driver
+}
+
+// Close - discards any open branches and cleans up the main database,
+// called by (*sql.DB).Close
+func (c *connector) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.engine == nil {
+		return nil
+	}
+	err := c.engine.Close(context.Background())
+	c.engine = nil
+	c.main = nil
+	return err
+}
+
+/*
+ * conn - a connection of the underlying driver to the main database. The
+ * optional interfaces database/sql looks for are forwarded to it, falling
+ * back as database/sql would when it does not implement them
+ */
+type conn struct {
+	driver.Conn
+	connector *connector
+}
+
+func (c *conn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if prepare, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return prepare.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if begin, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return begin.BeginTx(ctx, opts)
+	}
+	if opts != (driver.TxOptions{}) {
+		return nil, errors.New("ntran: the underlying driver does not support transaction options")
+	}
+	return c.Conn.Begin()
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if exec, ok := c.Conn.(driver.ExecerContext); ok {
+		return exec.ExecContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if q, ok := c.Conn.(driver.QueryerContext); ok {
+		return q.QueryContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *conn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *conn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *conn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+func (c *conn) CheckNamedValue(value *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return driver.ErrSkip
+}
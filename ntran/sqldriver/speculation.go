@@ -0,0 +1,172 @@
+package sqldriver
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"ntran/speculate"
+)
+
+// ErrNotNtran - the database was not opened with the ntran driver
+var ErrNotNtran = errors.New("ntran: the database was not opened with the ntran driver")
+
+// Engine - the engine that forks db, which must have been opened with the
+// ntran driver
+func Engine(ctx context.Context, db *sql.DB) (*speculate.Engine, error) {
+	c, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	var engine *speculate.Engine
+	err = c.Raw(func(driverConn any) error {
+		nc, ok := driverConn.(*conn)
+		if !ok {
+			return ErrNotNtran
+		}
+		nc.connector.mu.Lock()
+		defer nc.connector.mu.Unlock()
+		engine = nc.connector.engine
+		return nil
+	})
+	if err == nil && engine == nil {
+		err = speculate.ErrClosed
+	}
+	return engine, err
+}
+
+// BeginSpeculative - forks db's main database into n branches, each a
+// transaction of its own. One speculation is open at a time per database,
+// until it is committed or rolled back
+func BeginSpeculative(ctx context.Context, db *sql.DB, n int) (*Speculation, error) {
+	engine, err := Engine(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	branches, err := engine.Fork(ctx, n)
+	if err != nil {
+		return nil, err
+	}
+	return &Speculation{engine: engine, branches: branches}, nil
+}
+
+// Revert - undoes the n most recent commits to db's main database, which
+// must have been opened with a history. No speculation may be open, and
+// transactions on db must have finished
+func Revert(ctx context.Context, db *sql.DB, n int) error {
+	engine, err := Engine(ctx, db)
+	if err != nil {
+		return err
+	}
+	return engine.Revert(ctx, n)
+}
+
+/*
+ * Speculation - n forked transactions over the same main state. Statements
+ * run on one branch without affecting the main database or the others, and
+ * arguments are passed to the policy's driver as they are, so placeholders
+ * are those of the main database ($1 for Postgres, ? for DuckDB)
+ */
+type Speculation struct {
+	engine   *speculate.Engine
+	branches []*speculate.Branch
+}
+
+// Len - the number of branches
+func (s *Speculation) Len() int {
+	return len(s.branches)
+}
+
+// Branch - the i-th branch, for strategies and running statements directly
+func (s *Speculation) Branch(i int) (*speculate.Branch, error) {
+	if i < 0 || i >= len(s.branches) {
+		return nil, fmt.Errorf("ntran: branch %d out of range, %d branches are open", i, len(s.branches))
+	}
+	return s.branches[i], nil
+}
+
+// ExecContext - executes a statement on the i-th branch
+func (s *Speculation) ExecContext(ctx context.Context, i int, query string, args ...any) error {
+	branch, err := s.Branch(i)
+	if err != nil {
+		return err
+	}
+	return branch.Exec(ctx, query, args...)
+}
+
+// QueryContext - executes a query on the i-th branch, returning every row
+func (s *Speculation) QueryContext(ctx context.Context, i int, query string, args ...any) (speculate.Rows, error) {
+	branch, err := s.Branch(i)
+	if err != nil {
+		return speculate.Rows{}, err
+	}
+	return branch.Query(ctx, query, args...)
+}
+
+/*
+ * Compare - executes a query on every branch in parallel, returning each
+ * branch's rows (or error) in order. The query is peeked (Branch.Peek):
+ * it is not recorded, an error does not rule its branch out, and the
+ * majority strategy still compares the rows of each branch's last
+ * QueryContext
+ */
+func (s *Speculation) Compare(ctx context.Context, query string, args ...any) []speculate.Result {
+	results := make([]speculate.Result, len(s.branches))
+	var wg sync.WaitGroup
+	for i, branch := range s.branches {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			rows, err := branch.Peek(ctx, query, args...)
+			results[i] = speculate.Result{Branch: branch, Err: err, Duration: time.Since(start)}
+			if err == nil {
+				results[i].Rows = []speculate.Rows{rows}
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// Select - the index of the branch strategy chooses
+func (s *Speculation) Select(ctx context.Context, strategy speculate.Strategy) (int, error) {
+	if !s.open() {
+		return -1, speculate.ErrClosed
+	}
+	winner, err := s.engine.Select(ctx, strategy)
+	if err != nil {
+		return -1, err
+	}
+	return winner.Index, nil
+}
+
+// Commit - makes the i-th branch's state the main database's and closes
+// every branch
+func (s *Speculation) Commit(ctx context.Context, i int) error {
+	branch, err := s.Branch(i)
+	if err != nil {
+		return err
+	}
+	return s.engine.Commit(ctx, branch)
+}
+
+// Rollback - closes every branch, leaving the main database as it was
+func (s *Speculation) Rollback(ctx context.Context) error {
+	if !s.open() {
+		return speculate.ErrClosed
+	}
+	return s.engine.Discard(ctx)
+}
+
+// open - whether the branches are still the engine's open branches, rather
+// than committed or rolled back and maybe replaced by a later speculation
+func (s *Speculation) open() bool {
+	branches := s.engine.Branches()
+	return len(branches) > 0 && branches[0] == s.branches[0]
+}
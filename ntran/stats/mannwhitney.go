@@ -0,0 +1,126 @@
+package stats
+
+import (
+	"math"
+	"sort"
+)
+
+/*
+ * MannWhitneyU - the two-sided Mann-Whitney U test of whether samples a and
+ * b come from the same distribution. Returns U for a and the p-value; the
+ * p-value is exact for small samples without ties and uses the normal
+ * approximation (with tie and continuity corrections) otherwise. p is NaN
+ * when either sample is empty.
+ */
+func MannWhitneyU(a []float64, b []float64) (u float64, p float64) {
+	n1, n2 := len(a), len(b)
+	if n1 == 0 || n2 == 0 {
+		return 0, math.NaN()
+	}
+
+	type value struct {
+		v     float64
+		fromA bool
+	}
+	values := make([]value, 0, n1+n2)
+	for _, v := range a {
+		values = append(values, value{v, true})
+	}
+	for _, v := range b {
+		values = append(values, value{v, false})
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].v < values[j].v })
+
+	// average ranks over ties
+	var rankSumA, tieCorrection float64
+	ties := false
+	for i := 0; i < len(values); {
+		j := i
+		for j < len(values) && values[j].v == values[i].v {
+			j++
+		}
+		rank := float64(i+j+1) / 2
+		for k := i; k < j; k++ {
+			if values[k].fromA {
+				rankSumA += rank
+			}
+		}
+		if t := float64(j - i); t > 1 {
+			ties = true
+			tieCorrection += t*t*t - t
+		}
+		i = j
+	}
+
+	u = rankSumA - float64(n1*(n1+1))/2
+	uMin := math.Min(u, float64(n1*n2)-u)
+
+	if !ties && n1 <= 20 && n2 <= 20 {
+		return u, math.Min(1, 2*exactCDF(n1, n2, int(uMin)))
+	}
+
+	n := float64(n1 + n2)
+	mean := float64(n1*n2) / 2
+	variance := float64(n1*n2) / 12 * ((n + 1) - tieCorrection/(n*(n-1)))
+	if variance <= 0 {
+		return u, 1
+	}
+	z := (math.Abs(u-mean) - 0.5) / math.Sqrt(variance)
+	if z < 0 {
+		z = 0
+	}
+	return u, math.Min(1, math.Erfc(z/math.Sqrt2))
+}
+
+// exactCDF - P(U <= u) for samples of sizes n1 and n2 without ties,
+// counting the rank arrangements that give each U
+func exactCDF(n1 int, n2 int, u int) float64 {
+	// counts[m][n][k] - arrangements of m and n values with U = k,
+	// built up with f(m, n, k) = f(m-1, n, k-n) + f(m, n-1, k)
+	maxU := n1 * n2
+	prev := make([][]float64, n2+1)
+	for n := range prev {
+		prev[n] = make([]float64, maxU+1)
+		prev[n][0] = 1
+	}
+	for m := 1; m <= n1; m++ {
+		curr := make([][]float64, n2+1)
+		curr[0] = make([]float64, maxU+1)
+		curr[0][0] = 1
+		for n := 1; n <= n2; n++ {
+			curr[n] = make([]float64, maxU+1)
+			for k := 0; k <= m*n; k++ {
+				if k-n >= 0 {
+					curr[n][k] += prev[n][k-n]
+				}
+				curr[n][k] += curr[n-1][k]
+			}
+		}
+		prev = curr
+	}
+
+	var total, below float64
+	for k, count := range prev[n2] {
+		total += count
+		if k <= u {
+			below += count
+		}
+	}
+	return below / total
+}
+
+// MinMannWhitneyP - the smallest two-sided p-value MannWhitneyU can give
+// for samples of sizes n1 and n2, when they do not overlap at all. A test
+// at a significance level below it can never reject
+func MinMannWhitneyP(n1 int, n2 int) float64 {
+	if n1 == 0 || n2 == 0 {
+		return math.NaN()
+	}
+	if n1 <= 20 && n2 <= 20 {
+		return math.Min(1, 2*exactCDF(n1, n2, 0))
+	}
+	n := float64(n1 + n2)
+	mean := float64(n1*n2) / 2
+	z := (mean - 0.5) / math.Sqrt(float64(n1*n2)/12*(n+1))
+	return math.Min(1, math.Erfc(z/math.Sqrt2))
+}
@@ -0,0 +1,95 @@
+package stats
+
+import (
+	"math"
+	"testing"
+)
+
+// span - the integers from lo to hi in steps of step
+func span(lo int, hi int, step int) []float64 {
+	var values []float64
+	for v := lo; v <= hi; v += step {
+		values = append(values, float64(v))
+	}
+	return values
+}
+
+func TestMannWhitneyU(t *testing.T) {
+	tests := []struct {
+		name  string
+		a, b  []float64
+		wantU float64
+		wantP float64
+	}{
+		// exact: 2 of the 20 arrangements of 3 and 3 are as extreme
+		{"exact separated 3v3", []float64{1, 2, 3}, []float64{4, 5, 6}, 0, 0.1},
+		{"exact separated reversed", []float64{4, 5, 6}, []float64{1, 2, 3}, 9, 0.1},
+		// exact: 2 of the 252 arrangements of 5 and 5
+		{"exact separated 5v5", span(1, 5, 1), span(6, 10, 1), 0, 2.0 / 252},
+		// exact: P(U <= 3) is 7 of the 20 arrangements
+		{"exact interleaved", []float64{1, 3, 5}, []float64{2, 4, 6}, 3, 0.7},
+		{"exact balanced", []float64{1, 4, 5, 8}, []float64{2, 3, 6, 7}, 8, 1},
+		// ties use the normal approximation with tie and continuity corrections
+		{"ties", []float64{1, 1, 2}, []float64{2, 3, 3}, 0.5, 0.110149},
+		{"all tied", []float64{5, 5, 5}, []float64{5, 5}, 3, 1},
+		// more than 20 a side uses the normal approximation
+		{"normal separated", span(1, 25, 1), span(26, 50, 1), 0, 1.415656e-9},
+		{"normal interleaved", span(1, 41, 2), span(2, 42, 2), 210, 0.801383},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, p := MannWhitneyU(tt.a, tt.b)
+			if u != tt.wantU {
+				t.Errorf("U = %v, want %v", u, tt.wantU)
+			}
+			if math.Abs(p-tt.wantP)/tt.wantP > 1e-5 {
+				t.Errorf("p = %.8g, want %.8g", p, tt.wantP)
+			}
+		})
+	}
+}
+
+func TestMannWhitneyUEmpty(t *testing.T) {
+	if _, p := MannWhitneyU(nil, []float64{1}); !math.IsNaN(p) {
+		t.Errorf("p = %v with an empty sample, want NaN", p)
+	}
+}
+
+func TestExactCDF(t *testing.T) {
+	// the distribution of U for 3 and 3 counts 1 1 2 3 3 3 3 2 1 1
+	counts := []float64{1, 1, 2, 3, 3, 3, 3, 2, 1, 1}
+	var below float64
+	for u, count := range counts {
+		below += count
+		if got := exactCDF(3, 3, u); math.Abs(got-below/20) > 1e-12 {
+			t.Errorf("exactCDF(3, 3, %d) = %v, want %v", u, got, below/20)
+		}
+	}
+}
+
+func TestMinMannWhitneyP(t *testing.T) {
+	tests := []struct {
+		n1, n2 int
+		want   float64
+	}{
+		{1, 1, 1},
+		{2, 2, 1.0 / 3},
+		{3, 3, 0.1},
+		{4, 4, 2.0 / 70},
+		{3, 5, 2.0 / 56},
+		{25, 25, 1.415656e-9},
+	}
+	for _, tt := range tests {
+		if got := MinMannWhitneyP(tt.n1, tt.n2); math.Abs(got-tt.want)/tt.want > 1e-5 {
+			t.Errorf("MinMannWhitneyP(%d, %d) = %.8g, want %.8g", tt.n1, tt.n2, got, tt.want)
+		}
+		// the most extreme samples reach it
+		a, b := span(1, tt.n1, 1), span(tt.n1+1, tt.n1+tt.n2, 1)
+		if _, p := MannWhitneyU(a, b); math.Abs(p-MinMannWhitneyP(tt.n1, tt.n2)) > 1e-12 {
+			t.Errorf("MannWhitneyU of separated %d and %d = %v, want MinMannWhitneyP", tt.n1, tt.n2, p)
+		}
+	}
+	if got := MinMannWhitneyP(0, 4); !math.IsNaN(got) {
+		t.Errorf("MinMannWhitneyP(0, 4) = %v, want NaN", got)
+	}
+}
@@ -0,0 +1,133 @@
+// Summary statistics over repeated benchmark samples
+package stats
+
+import (
+	"math"
+	"sort"
+)
+
+type Summary struct {
+	N      int
+	Mean   float64
+	Median float64
+	P95    float64
+	P99    float64
+	StdDev float64
+	// 95% confidence interval of the mean
+	CILow  float64
+	CIHigh float64
+}
+
+// Summarize - computes the summary statistics of samples. The
+// confidence interval uses Student's t distribution, so it is
+// meaningful for the small numbers of repetitions we run.
+func Summarize(samples []float64) Summary {
+	n := len(samples)
+	if n == 0 {
+		return Summary{}
+	}
+
+	sorted := make([]float64, n)
+	copy(sorted, samples)
+	sort.Float64s(sorted)
+
+	var sum float64
+	for _, v := range sorted {
+		sum += v
+	}
+	mean := sum / float64(n)
+
+	var stddev float64
+	if n > 1 {
+		var sq float64
+		for _, v := range sorted {
+			sq += (v - mean) * (v - mean)
+		}
+		stddev = math.Sqrt(sq / float64(n-1))
+	}
+
+	margin := 0.0
+	if n > 1 {
+		margin = tCritical95(n-1) * stddev / math.Sqrt(float64(n))
+	}
+
+	return Summary{
+		N:      n,
+		Mean:   mean,
+		Median: Percentile(sorted, 50),
+		P95:    Percentile(sorted, 95),
+		P99:    Percentile(sorted, 99),
+		StdDev: stddev,
+		CILow:  mean - margin,
+		CIHigh: mean + margin,
+	}
+}
+
+// RelativeCIWidth - the width of the confidence interval as a fraction
+// of the mean; +Inf when there are not enough samples to tell
+func (s Summary) RelativeCIWidth() float64 {
+	if s.N < 2 || s.Mean == 0 {
+		return math.Inf(1)
+	}
+	return (s.CIHigh - s.CILow) / math.Abs(s.Mean)
+}
+
+// Percentile - the p-th percentile (0-100) of sorted samples, linearly
+// interpolating between the closest ranks
+func Percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	if len(sorted) == 1 {
+		return sorted[0]
+	}
+	rank := p / 100 * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+	frac := rank - float64(lo)
+	return sorted[lo] + (sorted[hi]-sorted[lo])*frac
+}
+
+// two-sided 95% critical values of Student's t distribution, indexed by
+// degrees of freedom - 1
+var tTable95 = []float64{
+	12.706, 4.303, 3.182, 2.776, 2.571, 2.447, 2.365, 2.306, 2.262, 2.228,
+	2.201, 2.179, 2.160, 2.145, 2.131, 2.120, 2.110, 2.101, 2.093, 2.086,
+	2.080, 2.074, 2.069, 2.064, 2.060, 2.056, 2.052, 2.048, 2.045, 2.042,
+}
+
+// two-sided 95% critical values beyond tTable95, with the normal
+// distribution's as df goes to infinity (0)
+var tTable95Large = []struct {
+	df int
+	t  float64
+}{
+	{30, 2.042}, {40, 2.021}, {50, 2.009}, {60, 2.000}, {80, 1.990}, {100, 1.984}, {120, 1.980}, {0, 1.960},
+}
+
+// tCritical95 - the two-sided 95% critical value for df degrees of
+// freedom, interpolated linearly in 1/df beyond tTable95, which is within
+// 0.001 of the exact value
+func tCritical95(df int) float64 {
+	if df <= 0 {
+		return math.Inf(1)
+	}
+	if df <= len(tTable95) {
+		return tTable95[df-1]
+	}
+	inverse := func(df int) float64 {
+		if df == 0 {
+			return 0
+		}
+		return 1 / float64(df)
+	}
+	for i := 1; i < len(tTable95Large); i++ {
+		lo, hi := tTable95Large[i-1], tTable95Large[i]
+		if hi.df != 0 && df > hi.df {
+			continue
+		}
+		frac := (inverse(lo.df) - inverse(df)) / (inverse(lo.df) - inverse(hi.df))
+		return lo.t + (hi.t-lo.t)*frac
+	}
+	return 1.960
+}
@@ -0,0 +1,131 @@
+package stats
+
+import (
+	"math"
+	"testing"
+)
+
+func TestTCritical95(t *testing.T) {
+	// exact values from the t distribution's quantile function
+	tests := []struct {
+		df   int
+		want float64
+	}{
+		{1, 12.706},
+		{2, 4.303},
+		{10, 2.228},
+		{30, 2.042},
+		{31, 2.0395},
+		{35, 2.0301},
+		{40, 2.0211},
+		{45, 2.0141},
+		{70, 1.9944},
+		{90, 1.9867},
+		{120, 1.9799},
+		{150, 1.9759},
+		{200, 1.9719},
+		{1000, 1.9623},
+		{1000000, 1.9600},
+	}
+	for _, tt := range tests {
+		if got := tCritical95(tt.df); math.Abs(got-tt.want) > 0.001 {
+			t.Errorf("tCritical95(%d) = %.4f, want %.4f", tt.df, got, tt.want)
+		}
+	}
+	if got := tCritical95(0); !math.IsInf(got, 1) {
+		t.Errorf("tCritical95(0) = %v, want +Inf", got)
+	}
+}
+
+func TestTCritical95Decreases(t *testing.T) {
+	for df := 2; df <= 500; df++ {
+		if tCritical95(df) > tCritical95(df-1) {
+			t.Fatalf("tCritical95(%d) = %.4f is above tCritical95(%d) = %.4f", df, tCritical95(df), df-1, tCritical95(df-1))
+		}
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	sequence := func(n int) []float64 {
+		samples := make([]float64, n)
+		for i := range samples {
+			samples[i] = float64(i)
+		}
+		return samples
+	}
+	tests := []struct {
+		name    string
+		samples []float64
+		want    Summary
+	}{
+		{"empty", nil, Summary{}},
+		{"one", []float64{7}, Summary{N: 1, Mean: 7, Median: 7, P95: 7, P99: 7, CILow: 7, CIHigh: 7}},
+		{"two", []float64{3, 1}, Summary{N: 2, Mean: 2, Median: 2, P95: 2.9, P99: 2.98, StdDev: math.Sqrt2, CILow: 2 - 12.706, CIHigh: 2 + 12.706}},
+		{"five", []float64{5, 1, 4, 2, 3}, Summary{N: 5, Mean: 3, Median: 3, P95: 4.8, P99: 4.96, StdDev: math.Sqrt(2.5), CILow: 3 - 1.96293, CIHigh: 3 + 1.96293}},
+		// 40 degrees of freedom, beyond the table of small ones
+		{"forty-one", sequence(41), Summary{N: 41, Mean: 20, Median: 20, P95: 38, P99: 39.6, StdDev: math.Sqrt(143.5), CILow: 20 - 3.78094, CIHigh: 20 + 3.78094}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Summarize(tt.samples)
+			if got.N != tt.want.N {
+				t.Fatalf("N = %d, want %d", got.N, tt.want.N)
+			}
+			for _, field := range []struct {
+				name      string
+				got, want float64
+			}{
+				{"Mean", got.Mean, tt.want.Mean},
+				{"Median", got.Median, tt.want.Median},
+				{"P95", got.P95, tt.want.P95},
+				{"P99", got.P99, tt.want.P99},
+				{"StdDev", got.StdDev, tt.want.StdDev},
+				{"CILow", got.CILow, tt.want.CILow},
+				{"CIHigh", got.CIHigh, tt.want.CIHigh},
+			} {
+				if math.Abs(field.got-field.want) > 1e-4 {
+					t.Errorf("%s = %.5f, want %.5f", field.name, field.got, field.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRelativeCIWidth(t *testing.T) {
+	tests := []struct {
+		name    string
+		summary Summary
+		want    float64
+	}{
+		{"one sample", Summary{N: 1, Mean: 10, CILow: 10, CIHigh: 10}, math.Inf(1)},
+		{"zero mean", Summary{N: 5, Mean: 0, CILow: -1, CIHigh: 1}, math.Inf(1)},
+		{"positive", Summary{N: 5, Mean: 10, CILow: 9, CIHigh: 11}, 0.2},
+		{"negative", Summary{N: 5, Mean: -10, CILow: -11, CIHigh: -9}, 0.2},
+	}
+	for _, tt := range tests {
+		if got := tt.summary.RelativeCIWidth(); got != tt.want && math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: RelativeCIWidth() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []float64{1, 2, 3, 4}
+	tests := []struct {
+		sorted []float64
+		p      float64
+		want   float64
+	}{
+		{nil, 50, 0},
+		{[]float64{5}, 99, 5},
+		{sorted, 0, 1},
+		{sorted, 100, 4},
+		{sorted, 50, 2.5},
+		{sorted, 95, 3.85},
+	}
+	for _, tt := range tests {
+		if got := Percentile(tt.sorted, tt.p); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("Percentile(%v, %v) = %v, want %v", tt.sorted, tt.p, got, tt.want)
+		}
+	}
+}